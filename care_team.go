@@ -1,6 +1,13 @@
 package ie
 
-import "time"
+import (
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// CareTeamReferenceType is the type of references to care teams (e.g., as notification recipients)
+const CareTeamReferenceType = "CareTeam"
 
 // CareTeam a collection of care providers providing care to a set of patients
 type CareTeam struct {
@@ -10,6 +17,17 @@ type CareTeam struct {
 	CreatedAt time.Time `bson:"created_at,omitempty" json:"created_at,omitempty"`
 }
 
+// Reference returns a reference to the care team, which can be used as the recipient of a notification
+func (c *CareTeam) Reference() models.Reference {
+	return models.Reference{
+		Reference:    CareTeamReferenceType + "/" + c.ID,
+		Type:         CareTeamReferenceType,
+		ReferencedID: c.ID,
+		External:     new(bool),
+		Display:      c.Name,
+	}
+}
+
 // CareTeamService describes the interface for storing a CareTeam
 type CareTeamService interface {
 	CareTeam(id string) (*CareTeam, error)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/intervention-engine/ie/huddles"
+)
+
+// huddlesim simulates nightly huddle scheduling for a synthetic population so that huddle configs can be tuned
+// offline.  See docs/huddle_simulation.md for the population file format.
+func main() {
+	configPath := flag.String("config", "", "path to the huddle configuration file (required)")
+	populationPath := flag.String("population", "", "path to the synthetic population file (required)")
+	startStr := flag.String("start", time.Now().Format("2006-01-02"), "first day of the simulation (YYYY-MM-DD)")
+	weeks := flag.Int("weeks", 12, "number of weeks to simulate")
+	seed := flag.Int64("seed", 1, "seed used to randomly decide which patients are reviewed")
+	useMongo := flag.Bool("mongo", false, "simulate in a scratch Mongo database instead of in memory")
+	dbName := flag.String("db", "huddlesim", "name of the scratch database to simulate in with -mongo (it is dropped first!)")
+	asJSON := flag.Bool("json", false, "output the results as JSON instead of a table")
+	verbose := flag.Bool("v", false, "log the scheduler output for every simulated night")
+	flag.Parse()
+
+	if *configPath == "" || *populationPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *useMongo && *dbName == "fhir" {
+		log.Fatalln("Refusing to simulate in the fhir database; use a scratch database instead")
+	}
+
+	config := new(huddles.HuddleConfig)
+	loadJSON(*configPath, config)
+	population := new(huddles.SimulatedPopulation)
+	loadJSON(*populationPath, population)
+	start, err := time.ParseInLocation("2006-01-02", *startStr, time.Local)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	sim := &huddles.Simulation{
+		Config:     config,
+		Population: population,
+		Start:      start,
+		Weeks:      *weeks,
+		Seed:       *seed,
+	}
+
+	if *useMongo {
+		mongoURL := os.Getenv("MONGO_URL")
+		if mongoURL == "" {
+			mongoURL = "mongodb://localhost:27017"
+		}
+		session, err := mgo.Dial(mongoURL)
+		if err != nil {
+			log.Fatalf("dialing mongo failed at url: %s\n", mongoURL)
+		}
+		defer session.Close()
+		db := session.DB(*dbName)
+		if err := db.DropDatabase(); err != nil {
+			log.Fatalln(err)
+		}
+		sim.Store = &huddles.MongoHuddleStore{DB: db}
+	}
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	report, err := sim.Run()
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(report); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	printReport(report)
+}
+
+func loadJSON(path string, v interface{}) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Fatalf("Error parsing %s: %v\n", path, err)
+	}
+}
+
+func printReport(report *huddles.SimulationReport) {
+	fmt.Printf("%s (starting %s)\n\n", report.Name, report.Start.Format("Mon Jan 2, 2006"))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Week\tStart\tHuddles\tScheduled\tMin Size\tMax Size\tAvg Size\tDiscussed\tRolled Over\tOverdue\tAdherence\t")
+	for _, wk := range report.Weeks {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%.1f\t%d\t%d\t%d\t%.0f%%\t\n", wk.Week, wk.Start.Format("01/02"),
+			wk.Huddles, wk.Scheduled, wk.MinHuddleSize, wk.MaxHuddleSize, wk.AverageHuddleSize, wk.Discussed,
+			wk.RolledOver, wk.Overdue, wk.FrequencyAdherence*100)
+	}
+	w.Flush()
+}
@@ -12,7 +12,10 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie/delivery"
+	"github.com/intervention-engine/ie/groups"
 	"github.com/intervention-engine/ie/huddles"
+	"github.com/intervention-engine/ie/notifications"
 	"github.com/robfig/cron"
 )
 
@@ -36,13 +39,30 @@ type args struct {
 	Icd9URL    *string
 	Icd10URL   *string
 	HuddlePath huddlePath
+	// GroupSnapshotCron is the cron spec for refreshing materialized group snapshots
+	GroupSnapshotCron *string
+	// GroupSnapshotRefresh enables refreshing materialized group snapshots whenever resources change
+	GroupSnapshotRefresh *bool
+	// NamedQueries is the path to a named query configuration file
+	NamedQueries *string
+	// RemoteGroupServers is a comma-separated list of FHIR servers that groupId may reference
+	RemoteGroupServers *string
+	// NotificationDefinitions is the path to a notification definition configuration file
+	NotificationDefinitions *string
+	// NotificationDelivery is the path to a notification delivery configuration file
+	NotificationDelivery *string
 }
 
 type vars struct {
-	MongoURL       string
-	RiskServiceURL string
-	LogFilePath    string
-	HuddlePath     huddlePath
+	MongoURL                string
+	RiskServiceURL          string
+	LogFilePath             string
+	HuddlePath              huddlePath
+	GroupSnapshotCron       string
+	NamedQueries            string
+	RemoteGroupServers      string
+	NotificationDefinitions string
+	NotificationDelivery    string
 }
 
 var huddleFlag huddlePath
@@ -59,6 +79,12 @@ func getArgs() args {
 	a.SubFlag = flag.Bool("subscriptions", false, "enables limited support for resource subscriptions (default: false)")
 	a.ReqLog = flag.Bool("reqlog", false, "Enables request logging -- do NOT use in production")
 	a.LogFile = flag.String("logdir", "", "Path to a directory for ie and gin logs to be written to.")
+	a.GroupSnapshotCron = flag.String("groupSnapshotCron", "", "cron spec for refreshing materialized group snapshots (e.g., \"0 0 * * * *\")")
+	a.GroupSnapshotRefresh = flag.Bool("groupSnapshotRefresh", false, "refresh materialized group snapshots whenever resources change (default: false)")
+	a.RemoteGroupServers = flag.String("remoteGroupServers", "", "comma-separated base URLs of FHIR servers hosting groups that can be referenced by URL (default: none)")
+	a.NotificationDefinitions = flag.String("notificationDefinitions", "", "path to a notification definition configuration file (default: built-in encounter notifications)")
+	a.NotificationDelivery = flag.String("notificationDelivery", "", "path to a notification delivery (email, webhook, SMS, and digest) configuration file (default: no delivery)")
+	a.NamedQueries = flag.String("namedQueries", "", "path to a named query configuration file (e.g., config/named_queries.json)")
 	flag.Parse()
 	a.HuddlePath = huddleFlag
 	return a
@@ -84,6 +110,12 @@ func getVars() vars {
 		v.HuddlePath = []string(strings.Split(paths, ","))
 	}
 
+	v.GroupSnapshotCron = os.Getenv("GROUP_SNAPSHOT_CRON")
+	v.NamedQueries = os.Getenv("NAMED_QUERIES")
+	v.RemoteGroupServers = os.Getenv("REMOTE_GROUP_SERVERS")
+	v.NotificationDefinitions = os.Getenv("NOTIFICATION_DEFINITIONS")
+	v.NotificationDelivery = os.Getenv("NOTIFICATION_DELIVERY")
+
 	return v
 }
 
@@ -162,6 +194,102 @@ func configureHuddles(huddleConfigs []string) (*huddles.HuddleSchedulerControlle
 	return huddleController, c
 }
 
+func configureGroupSnapshots(s *server.FHIRServer, cronSpec string, refreshOnChange bool) *cron.Cron {
+	c := cron.New()
+	m := groups.NewGroupMaterializer(nil)
+	refreshIt := func() {
+		if err := m.RefreshAll(); err != nil {
+			log.Printf("ERROR: Could not refresh group snapshots: %v", err)
+		}
+	}
+
+	if refreshOnChange {
+		for _, resource := range []string{"Patient", "Condition", "Encounter", "MedicationStatement", "Procedure", "Observation", "RiskAssessment", "Group", "Batch"} {
+			s.AddMiddleware(resource, m.Middleware())
+		}
+		m.Start(10 * time.Second)
+	}
+
+	// Wait 1 minute before doing initial runs or setting up cron jobs.  This allows the server to get
+	// started (since it needs to initiate the db connection, etc).
+	if cronSpec != "" || refreshOnChange {
+		time.AfterFunc(1*time.Minute, func() {
+			log.Println("Initial refresh of group snapshots")
+			refreshIt()
+
+			if cronSpec != "" {
+				if err := c.AddFunc(cronSpec, refreshIt); err != nil {
+					log.Fatalln(err)
+				}
+				log.Printf("Group snapshots scheduled with cron spec: %s\n", cronSpec)
+			}
+		})
+	}
+	return c
+}
+
+func configureNamedQueries(path string) {
+	if path == "" {
+		return
+	}
+	if err := groups.DefaultNamedQueryRegistry.LoadConfig(path); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Loaded named queries from %s\n", path)
+}
+
+func configureRemoteGroups(servers string) {
+	if servers == "" {
+		return
+	}
+	resolver := groups.NewHTTPRemoteGroupResolver(strings.Split(servers, ","))
+	groups.DefaultRemoteGroupResolver = resolver
+	log.Printf("Remote groups can be referenced from: %s\n", strings.Join(resolver.BaseURLs, ", "))
+}
+
+func configureNotificationDefinitions(s *server.FHIRServer, path string) {
+	if path == "" {
+		return
+	}
+	loader := &notifications.NotificationDefinitionLoader{Path: path, Registry: notifications.DefaultNotificationDefinitionRegistry}
+	if err := loader.Load(); err != nil {
+		log.Fatalln(err)
+	}
+	s.Engine.POST("/ReloadNotificationDefinitions", loader.ReloadHandler)
+}
+
+// configureNotificationDelivery sets up the delivery of notifications and the scheduling of care team digests,
+// returning a function that stops delivering them
+func configureNotificationDelivery(path string) func() {
+	if path == "" {
+		return func() {}
+	}
+	dispatcher, digester, err := delivery.LoadConfig(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	delivery.DefaultDispatcher = dispatcher
+	log.Printf("Delivering notifications to %d preferences from %s\n", len(dispatcher.Preferences), path)
+	if digester == nil {
+		return dispatcher.Stop
+	}
+
+	c := cron.New()
+	if err := c.AddFunc(digester.CronSpec, func() {
+		if err := digester.Run(); err != nil {
+			log.Printf("ERROR: Could not create notification digests: %v", err)
+		}
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	c.Start()
+	log.Printf("Notification digests scheduled with cron spec: %s\n", digester.CronSpec)
+	return func() {
+		c.Stop()
+		dispatcher.Stop()
+	}
+}
+
 func resolveHuddleConfig(argPath []string, varPath []string) []string {
 	var p []string
 	if len(varPath) != 0 {
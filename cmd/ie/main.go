@@ -60,12 +60,46 @@ func main() {
 	hc, cronJob := configureHuddles(huddleConfig)
 
 	s.Engine.GET("/ScheduleHuddles", hc.ScheduleHandler)
+	s.Engine.GET("/HuddleMetrics", hc.MetricsHandler)
 
 	if len(huddleConfig) > 0 {
 		cronJob.Start()
 		defer cronJob.Stop()
 	}
 
+	snapshotCron := *args.GroupSnapshotCron
+	if snapshotCron == "" {
+		snapshotCron = vars.GroupSnapshotCron
+	}
+	snapshotCronJob := configureGroupSnapshots(s, snapshotCron, *args.GroupSnapshotRefresh)
+	snapshotCronJob.Start()
+	defer snapshotCronJob.Stop()
+
+	namedQueries := *args.NamedQueries
+	if namedQueries == "" {
+		namedQueries = vars.NamedQueries
+	}
+	configureNamedQueries(namedQueries)
+
+	remoteGroupServers := *args.RemoteGroupServers
+	if remoteGroupServers == "" {
+		remoteGroupServers = vars.RemoteGroupServers
+	}
+	configureRemoteGroups(remoteGroupServers)
+
+	notificationDefinitions := *args.NotificationDefinitions
+	if notificationDefinitions == "" {
+		notificationDefinitions = vars.NotificationDefinitions
+	}
+	configureNotificationDefinitions(s, notificationDefinitions)
+
+	notificationDelivery := *args.NotificationDelivery
+	if notificationDelivery == "" {
+		notificationDelivery = vars.NotificationDelivery
+	}
+	stopDelivery := configureNotificationDelivery(notificationDelivery)
+	defer stopDelivery()
+
 	closer := web.RegisterRoutes(s, selfURL, vars.RiskServiceURL, *args.SubFlag)
 	defer closer()
 
@@ -1,16 +1,33 @@
 package controllers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/mongo"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// NotificationCountHandler counts each patient's notifications.  Care team digests aren't about a patient, so they
+// aren't counted.  By default only open notifications are counted, but the notifications can be filtered by:
+//   - status: comma-separated notification states (e.g., acknowledged,snoozed), "open", or "all"
+//   - reason: comma-separated reason codes, optionally prefixed by their system (e.g., system|code)
+//   - since and until: the dates (or times) the notifications were requested between
 func NotificationCountHandler(c *gin.Context) {
-	pipe := server.Database.C("communicationrequests").Pipe([]bson.M{{"$group": bson.M{"_id": "$subject.referenceid", "count": bson.M{"$sum": 1}}}})
+	match, err := notificationCountQuery(c, time.Now())
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	pipe := server.Database.C("communicationrequests").Pipe([]bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": "$subject.referenceid", "count": bson.M{"$sum": 1}}}})
 	var results []NotificationCountResult
 	if err := pipe.All(&results); err != nil {
 		log.Printf("Error getting notification count: %#v", err)
@@ -24,3 +41,64 @@ type NotificationCountResult struct {
 	Patient string  `bson:"_id" json:"patient"`
 	Count   float64 `bson:"count" json:"count"`
 }
+
+// notificationCountQuery builds the query matching the notifications to count from the request's filters
+func notificationCountQuery(c *gin.Context, now time.Time) (bson.M, error) {
+	digest := bson.M{"system": ie.NotificationDigestCategory.System, "code": ie.NotificationDigestCategory.Code}
+	and := []bson.M{{"category.coding": bson.M{"$not": bson.M{"$elemMatch": digest}}}}
+
+	status := c.DefaultQuery("status", "open")
+	if status != "all" {
+		var or []bson.M
+		var statuses []string
+		for _, s := range strings.Split(status, ",") {
+			switch {
+			case s == "open":
+				or = append(or, mongo.OpenNotificationQuery(now))
+			case ie.NotificationStatuses[s] != "":
+				statuses = append(statuses, ie.NotificationStatuses[s])
+			default:
+				return nil, fmt.Errorf("Unknown notification status: %s", s)
+			}
+		}
+		if len(statuses) > 0 {
+			or = append(or, bson.M{"status": bson.M{"$in": statuses}})
+		}
+		and = append(and, bson.M{"$or": or})
+	}
+
+	if reason := c.Query("reason"); reason != "" {
+		var or []bson.M
+		for _, r := range strings.Split(reason, ",") {
+			coding := bson.M{"code": r}
+			if i := strings.LastIndex(r, "|"); i >= 0 {
+				coding = bson.M{"system": r[:i], "code": r[i+1:]}
+			}
+			or = append(or, bson.M{"reason.coding": bson.M{"$elemMatch": coding}})
+		}
+		and = append(and, bson.M{"$or": or})
+	}
+
+	requestedOn := bson.M{}
+	for param, op := range map[string]string{"since": "$gte", "until": "$lte"} {
+		if value := c.Query(param); value != "" {
+			t, err := parseNotificationDate(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s date: %s", param, value)
+			}
+			requestedOn[op] = t
+		}
+	}
+	if len(requestedOn) > 0 {
+		and = append(and, bson.M{"requestedOn.time": requestedOn})
+	}
+
+	return bson.M{"$and": and}, nil
+}
+
+func parseNotificationDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
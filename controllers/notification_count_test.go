@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/models"
@@ -12,6 +13,7 @@ import (
 	"github.com/intervention-engine/ie/testutil"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // In order for 'go test' to run this suite, we need to create
@@ -90,6 +92,87 @@ func (n *NotificationCountSuite) TestNotificationCount() {
 	assert.Equal(1, m["c"])
 }
 
+func (n *NotificationCountSuite) TestNotificationCountOnlyCountsOpenNotifications() {
+	n.insertNotifications()
+	n.Assert().Equal(map[string]int{"a": 2, "b": 1, "c": 1}, n.getCounts("/NotificationCount"))
+}
+
+func (n *NotificationCountSuite) TestNotificationCountFilters() {
+	assert := n.Assert()
+
+	n.insertNotifications()
+
+	assert.Equal(map[string]int{"a": 1, "b": 2, "c": 1}, n.getCounts("/NotificationCount?status=all&reason=admission"))
+	assert.Equal(map[string]int{"b": 2}, n.getCounts("/NotificationCount?status=completed,dismissed"))
+	assert.Equal(map[string]int{"c": 2}, n.getCounts("/NotificationCount?status=snoozed"))
+	assert.Equal(map[string]int{"a": 1}, n.getCounts("/NotificationCount?reason=http://interventionengine.org/notification-reasons|critical-lab"))
+	assert.Equal(map[string]int{"a": 1, "b": 1}, n.getCounts("/NotificationCount?since=2016-06-01"))
+	assert.Equal(map[string]int{"a": 1, "c": 1}, n.getCounts("/NotificationCount?until=2016-06-01T00:00:00Z"))
+}
+
+func (n *NotificationCountSuite) TestNotificationCountInvalidFilter() {
+	handler := NotificationCountHandler
+	ctx, w, _ := gin.CreateTestContext()
+	ctx.Request, _ = http.NewRequest("GET", "/NotificationCount?status=forgotten", nil)
+	handler(ctx)
+	n.Assert().Equal(http.StatusBadRequest, w.Code)
+}
+
+// insertNotifications stores notifications in different states: patient a has two open notifications, b has one open
+// and two closed, and c has one that is snoozed for another day and one whose snooze ended an hour ago
+func (n *NotificationCountSuite) insertNotifications() {
+	require := n.Require()
+	now := time.Now()
+	fixtures := []struct {
+		patient, status, reason string
+		requested               time.Time
+		snoozedUntil            *time.Time
+	}{
+		{"a", "requested", "admission", time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"a", "accepted", "critical-lab", time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"b", "requested", "admission", time.Date(2016, time.August, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"b", "completed", "admission", time.Date(2016, time.February, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"b", "rejected", "high-risk", time.Date(2016, time.February, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"c", "suspended", "admission", time.Date(2016, time.February, 1, 0, 0, 0, 0, time.UTC), timePtr(now.AddDate(0, 0, 1))},
+		{"c", "suspended", "high-risk", time.Date(2016, time.February, 1, 0, 0, 0, 0, time.UTC), timePtr(now.Add(-time.Hour))},
+	}
+	for i, f := range fixtures {
+		notification, err := UnmarshallCommunicationRequest("../fixtures/communication-request.json")
+		require.NoError(err)
+		notification.Id = bson.NewObjectId().Hex()
+		notification.Subject.Reference = "http://test-ie/Patient/" + f.patient
+		notification.Subject.ReferencedID = f.patient
+		notification.Status = f.status
+		notification.Reason = []models.CodeableConcept{{Coding: []models.Coding{{System: "http://interventionengine.org/notification-reasons", Code: f.reason}}}}
+		notification.RequestedOn = &models.FHIRDateTime{Time: f.requested, Precision: models.Timestamp}
+		if f.snoozedUntil != nil {
+			notification.ScheduledDateTime = &models.FHIRDateTime{Time: *f.snoozedUntil, Precision: models.Timestamp}
+		}
+		require.NoError(n.NotificationCollection.Insert(*notification), "fixture %d", i)
+	}
+}
+
+func (n *NotificationCountSuite) getCounts(url string) map[string]int {
+	require := n.Require()
+	handler := NotificationCountHandler
+	ctx, w, _ := gin.CreateTestContext()
+	ctx.Request, _ = http.NewRequest("GET", url, nil)
+	handler(ctx)
+	require.Equal(http.StatusOK, w.Code)
+
+	var counts []NotificationCountResult
+	require.NoError(json.NewDecoder(w.Body).Decode(&counts))
+	m := make(map[string]int)
+	for _, count := range counts {
+		m[count.Patient] = int(count.Count)
+	}
+	return m
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
 func UnmarshallCommunicationRequest(file string) (*models.CommunicationRequest, error) {
 	data, err := os.Open(file)
 	if err != nil {
@@ -0,0 +1,89 @@
+package delivery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// The names of the built-in delivery channels
+const (
+	EmailChannelName   = "email"
+	WebhookChannelName = "webhook"
+	SMSChannelName     = "sms"
+)
+
+// Channel delivers notifications (CommunicationRequests) to an address, such as an email address, a webhook URL, or a
+// phone number.  Channels must be safe for concurrent use.
+type Channel interface {
+	Name() string
+	Deliver(notification *models.CommunicationRequest, address string) error
+}
+
+// Summary returns a short subject and a plain text description of the notification.  Only references to the patient
+// and the resource that triggered the notification are included, so protected health information isn't sent through
+// channels like email and SMS.  The description of a digest is its summary of the notifications it covers.
+func Summary(notification *models.CommunicationRequest) (subject, text string) {
+	if IsDigest(notification) {
+		var lines []string
+		for _, p := range notification.Payload {
+			if p.ContentString != "" {
+				lines = append(lines, p.ContentString)
+			}
+		}
+		subject = "Intervention Engine: " + DigestCategory.Display
+		if len(notification.Recipient) > 0 && notification.Recipient[0].Display != "" {
+			subject += " for " + notification.Recipient[0].Display
+		}
+		return subject, strings.Join(lines, "\n")
+	}
+
+	reason := reasonText(notification)
+	subject = "Intervention Engine: " + reason
+
+	lines := []string{reason}
+	if notification.Subject != nil {
+		lines[0] += " for " + notification.Subject.Reference
+	}
+	for _, p := range notification.Payload {
+		if p.ContentReference != nil {
+			lines = append(lines, p.ContentReference.Reference)
+		}
+	}
+	return subject, strings.Join(lines, "\n")
+}
+
+// postJSON posts the JSON body to the URL, returning an error if the request fails or isn't successful
+func postJSON(client *http.Client, url, contentType string, body interface{}, header http.Header) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Config is the JSON configuration of the delivery channels, the users' and teams' preferences, and the schedule of
+// care team digests.  Channels that aren't configured aren't available, and digests are only created if they are
+// configured.
+type Config struct {
+	SMTP *struct {
+		Addr     string `json:"addr"`
+		From     string `json:"from"`
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+	} `json:"smtp,omitempty"`
+	Webhook *struct {
+		Timeout string `json:"timeout,omitempty"`
+	} `json:"webhook,omitempty"`
+	SMS *struct {
+		GatewayURL string `json:"gatewayURL"`
+		From       string `json:"from,omitempty"`
+		APIKey     string `json:"apiKey,omitempty"`
+	} `json:"sms,omitempty"`
+	MaxAttempts int          `json:"maxAttempts,omitempty"`
+	Backoff     string       `json:"backoff,omitempty"`
+	Preferences []Preference `json:"preferences"`
+	Digest      *struct {
+		Cron      string   `json:"cron"`
+		CareTeams []string `json:"careTeams,omitempty"`
+	} `json:"digest,omitempty"`
+}
+
+// Default retry settings, used when they aren't configured
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = 30 * time.Second
+)
+
+// LoadConfig creates a dispatcher and, if digests are configured, a digester from the JSON configuration file
+func LoadConfig(path string) (*Dispatcher, *Digester, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig creates a dispatcher and, if digests are configured, a digester from the JSON configuration
+func ParseConfig(data []byte) (*Dispatcher, *Digester, error) {
+	config := new(Config)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, nil, err
+	}
+	d, err := newDispatcher(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if config.Digest == nil {
+		return d, nil, nil
+	}
+	if _, err := cron.Parse(config.Digest.Cron); err != nil {
+		return nil, nil, fmt.Errorf("Invalid digest cron spec: %s", config.Digest.Cron)
+	}
+	return d, &Digester{CronSpec: config.Digest.Cron, CareTeams: config.Digest.CareTeams, Dispatcher: d}, nil
+}
+
+func newDispatcher(config *Config) (*Dispatcher, error) {
+	var channels []Channel
+	if config.SMTP != nil {
+		if config.SMTP.Addr == "" || config.SMTP.From == "" {
+			return nil, errors.New("The SMTP channel requires an addr and a from address")
+		}
+		channels = append(channels, &SMTPChannel{Addr: config.SMTP.Addr, From: config.SMTP.From, Username: config.SMTP.Username, Password: config.SMTP.Password})
+	}
+	if config.Webhook != nil {
+		timeout := 30 * time.Second
+		if config.Webhook.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(config.Webhook.Timeout); err != nil {
+				return nil, fmt.Errorf("Invalid webhook timeout: %s", config.Webhook.Timeout)
+			}
+		}
+		channels = append(channels, &WebhookChannel{Client: &http.Client{Timeout: timeout}})
+	}
+	if config.SMS != nil {
+		if config.SMS.GatewayURL == "" {
+			return nil, errors.New("The SMS channel requires a gatewayURL")
+		}
+		channels = append(channels, &SMSChannel{GatewayURL: config.SMS.GatewayURL, From: config.SMS.From, APIKey: config.SMS.APIKey})
+	}
+
+	maxAttempts := config.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	backoff := DefaultBackoff
+	if config.Backoff != "" {
+		var err error
+		if backoff, err = time.ParseDuration(config.Backoff); err != nil || backoff < 0 {
+			return nil, fmt.Errorf("Invalid backoff: %s", config.Backoff)
+		}
+	}
+
+	d := NewDispatcher(channels, config.Preferences, maxAttempts, backoff)
+	for _, pref := range config.Preferences {
+		if pref.Recipient == "" || pref.Address == "" {
+			return nil, fmt.Errorf("Delivery preferences require a recipient and an address: %#v", pref)
+		}
+		if _, ok := d.Channels[pref.Channel]; !ok {
+			return nil, fmt.Errorf("Delivery preference for %s uses an unconfigured channel: %s", pref.Recipient, pref.Channel)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,225 @@
+package delivery
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/mongo"
+	"github.com/robfig/cron"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DigestCategory is the category of digest notifications, which summarize a care team's unacknowledged notifications
+var DigestCategory = ie.NotificationDigestCategory
+
+// MaxDigestReferences is the most notifications a digest's payload references.  The digest's summary still counts all
+// of the notifications by reason.
+const MaxDigestReferences = 100
+
+// DefaultDigestWindow is how far back a care team's first digest looks when the time between digests can't be found
+// from the Digester's CronSpec
+const DefaultDigestWindow = 24 * time.Hour
+
+// IsDigest indicates if the notification is a digest of other notifications
+func IsDigest(notification *models.CommunicationRequest) bool {
+	return notification.Category != nil && notification.Category.MatchesCode(DigestCategory.System, DigestCategory.Code)
+}
+
+// Digester periodically summarizes each care team's unacknowledged notifications into a single digest notification.
+// Each digest covers the notifications requested since the team's last digest (or, for the team's first digest, since
+// the time between digests ago), and is stored with the other notifications (so there is a record of what was sent)
+// before it is dispatched to the preferences for digests.
+type Digester struct {
+	// CronSpec is the cron spec for creating digests (e.g., "0 0 7 * * *" for every day at 7 AM)
+	CronSpec string
+	// CareTeams are the IDs of the care teams to create digests for.  If it is empty, digests are created for all care
+	// teams.
+	CareTeams  []string
+	Dispatcher *Dispatcher
+	// DB is the database holding the care teams and notifications.  If it isn't set, server.Database is used.
+	DB *mgo.Database
+}
+
+// Run creates and dispatches the digests of the care teams that have unacknowledged notifications since their last
+// digest
+func (d *Digester) Run() error {
+	teams, err := d.careTeams()
+	if err != nil {
+		return err
+	}
+	for i := range teams {
+		digest, err := d.Digest(&teams[i], time.Now())
+		if err != nil {
+			log.Printf("Error creating notification digest for care team %s: %v", teams[i].ID, err)
+			continue
+		}
+		if digest != nil && d.Dispatcher != nil {
+			d.Dispatcher.Dispatch(digest)
+		}
+	}
+	return nil
+}
+
+// Digest creates and stores the digest of the care team's unacknowledged notifications since its last digest.  If
+// there aren't any, no digest is created and nil is returned.
+func (d *Digester) Digest(team *ie.CareTeam, now time.Time) (*models.CommunicationRequest, error) {
+	c := d.db().C("communicationrequests")
+	recipient := bson.M{"$elemMatch": bson.M{"type": ie.CareTeamReferenceType, "referenceid": team.ID}}
+	digestCategory := bson.M{"$elemMatch": bson.M{"system": DigestCategory.System, "code": DigestCategory.Code}}
+
+	since := now.Add(-d.firstWindow(now))
+	var last []models.CommunicationRequest
+	err := c.Find(bson.M{"recipient": recipient, "category.coding": digestCategory}).Sort("-requestedOn.time").Limit(1).All(&last)
+	if err != nil {
+		return nil, err
+	}
+	if len(last) > 0 && last[0].RequestedOn != nil {
+		since = last[0].RequestedOn.Time
+	}
+
+	var nn []models.CommunicationRequest
+	query := bson.M{
+		"recipient":        recipient,
+		"status":           ie.NotificationStatuses[ie.NotificationRequested],
+		"category.coding":  bson.M{"$not": digestCategory},
+		"requestedOn.time": bson.M{"$gt": since, "$lte": now},
+	}
+	fields := bson.M{"reason": 1, "requestedOn": 1}
+	if err := c.Find(query).Select(fields).Sort("requestedOn.time").All(&nn); err != nil {
+		return nil, err
+	}
+	if len(nn) == 0 {
+		return nil, nil
+	}
+
+	digest := NewDigest(team, nn, since, now)
+	if err := c.Insert(digest); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// firstWindow returns how far back a care team's first digest looks: the time between the CronSpec's next two runs, or
+// DefaultDigestWindow if the CronSpec isn't set or valid
+func (d *Digester) firstWindow(now time.Time) time.Duration {
+	schedule, err := cron.Parse(d.CronSpec)
+	if err != nil {
+		return DefaultDigestWindow
+	}
+	next := schedule.Next(now)
+	if window := schedule.Next(next).Sub(next); !next.IsZero() && window > 0 {
+		return window
+	}
+	return DefaultDigestWindow
+}
+
+func (d *Digester) careTeams() ([]ie.CareTeam, error) {
+	service := &mongo.CareTeamService{C: d.db().C("care_teams")}
+	if len(d.CareTeams) == 0 {
+		return service.CareTeams()
+	}
+	var teams []ie.CareTeam
+	for _, id := range d.CareTeams {
+		team, err := service.CareTeam(id)
+		if err != nil {
+			log.Printf("Error finding care team %s for notification digest: %v", id, err)
+			continue
+		}
+		teams = append(teams, *team)
+	}
+	return teams, nil
+}
+
+func (d *Digester) db() *mgo.Database {
+	if d.DB != nil {
+		return d.DB
+	}
+	return server.Database
+}
+
+// NewDigest returns a digest notification for the care team, summarizing the notifications requested since the
+// given time.  The summary counts the notifications by reason (e.g., admissions, readmissions, and ER visits), and the
+// digest's payload references the first MaxDigestReferences of the notifications.
+func NewDigest(team *ie.CareTeam, notifications []models.CommunicationRequest, since, now time.Time) *models.CommunicationRequest {
+	counts := make(map[string]int)
+	for i := range notifications {
+		counts[reasonText(&notifications[i])]++
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Sort(byReasonCount{reasons, counts})
+
+	period := "since " + since.Format(time.RFC3339)
+	if since.IsZero() {
+		period = "as of " + now.Format(time.RFC3339)
+	}
+	lines := []string{fmt.Sprintf("%d unacknowledged notifications for %s %s", len(notifications), team.Name, period)}
+	for _, reason := range reasons {
+		lines = append(lines, fmt.Sprintf("%s: %d", reason, counts[reason]))
+	}
+
+	digest := &models.CommunicationRequest{
+		Status:      ie.NotificationStatuses[ie.NotificationRequested],
+		Category:    &models.CodeableConcept{Coding: []models.Coding{DigestCategory}, Text: DigestCategory.Display},
+		Recipient:   []models.Reference{team.Reference()},
+		Payload:     []models.CommunicationRequestPayloadComponent{{ContentString: strings.Join(lines, "\n")}},
+		RequestedOn: &models.FHIRDateTime{Time: now, Precision: models.Timestamp},
+	}
+	digest.Id = bson.NewObjectId().Hex()
+	for i, n := range notifications {
+		if i == MaxDigestReferences {
+			break
+		}
+		ref := &models.Reference{Reference: "CommunicationRequest/" + n.Id, Type: "CommunicationRequest", ReferencedID: n.Id, External: new(bool)}
+		digest.Payload = append(digest.Payload, models.CommunicationRequestPayloadComponent{ContentReference: ref})
+	}
+	return digest
+}
+
+// byReasonCount sorts reasons by their counts (most common first), and then by name
+type byReasonCount struct {
+	reasons []string
+	counts  map[string]int
+}
+
+func (r byReasonCount) Len() int {
+	return len(r.reasons)
+}
+
+func (r byReasonCount) Swap(i, j int) {
+	r.reasons[i], r.reasons[j] = r.reasons[j], r.reasons[i]
+}
+
+func (r byReasonCount) Less(i, j int) bool {
+	if r.counts[r.reasons[i]] != r.counts[r.reasons[j]] {
+		return r.counts[r.reasons[i]] > r.counts[r.reasons[j]]
+	}
+	return r.reasons[i] < r.reasons[j]
+}
+
+// reasonText returns the text of the notification's reason (or its first coding's display or code)
+func reasonText(notification *models.CommunicationRequest) string {
+	if len(notification.Reason) == 0 {
+		return "Notification"
+	}
+	reason := notification.Reason[0]
+	if reason.Text != "" {
+		return reason.Text
+	}
+	if len(reason.Coding) > 0 {
+		if reason.Coding[0].Display != "" {
+			return reason.Coding[0].Display
+		}
+		return reason.Coding[0].Code
+	}
+	return "Notification"
+}
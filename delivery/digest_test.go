@@ -0,0 +1,179 @@
+package delivery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestDigestSuite(t *testing.T) {
+	suite.Run(t, new(DigestSuite))
+}
+
+type DigestSuite struct {
+	suite.Suite
+}
+
+var autoDocs = &ie.CareTeam{ID: "58c314acb367c1ff54d19e9e", Name: "The AutoDocs", Leader: "Optometrist Prime"}
+
+func (d *DigestSuite) TestNewDigest() {
+	require := d.Require()
+	assert := d.Assert()
+
+	since := time.Date(2017, time.March, 14, 7, 0, 0, 0, time.UTC)
+	now := since.Add(24 * time.Hour)
+	nn := []models.CommunicationRequest{
+		digestTestNotification("58c314acb367c1ff54d1a001", "4525004", "Emergency department patient visit", since.Add(time.Hour)),
+		digestTestNotification("58c314acb367c1ff54d1a002", "32485007", "Hospital admission (procedure)", since.Add(2*time.Hour)),
+		digestTestNotification("58c314acb367c1ff54d1a003", "4525004", "Emergency department patient visit", since.Add(3*time.Hour)),
+	}
+	digest := NewDigest(autoDocs, nn, since, now)
+
+	assert.True(IsDigest(digest))
+	assert.NotEmpty(digest.Id)
+	assert.Equal("requested", digest.Status)
+	assert.Nil(digest.Subject)
+	assert.Empty(digest.Reason)
+	require.Len(digest.Recipient, 1)
+	assert.Equal("CareTeam/58c314acb367c1ff54d19e9e", digest.Recipient[0].Reference)
+	assert.Equal(now, digest.RequestedOn.Time)
+
+	require.Len(digest.Payload, 4)
+	assert.Equal("3 unacknowledged notifications for The AutoDocs since 2017-03-14T07:00:00Z\n"+
+		"Emergency department patient visit: 2\n"+
+		"Hospital admission (procedure): 1", digest.Payload[0].ContentString)
+	for i, n := range nn {
+		require.NotNil(digest.Payload[i+1].ContentReference)
+		assert.Equal("CommunicationRequest/"+n.Id, digest.Payload[i+1].ContentReference.Reference)
+	}
+
+	subject, text := Summary(digest)
+	assert.Equal("Intervention Engine: Notification digest for The AutoDocs", subject)
+	assert.Equal(digest.Payload[0].ContentString, text)
+
+	first := NewDigest(autoDocs, nn[:1], time.Time{}, now)
+	assert.Equal("1 unacknowledged notifications for The AutoDocs as of 2017-03-15T07:00:00Z\n"+
+		"Emergency department patient visit: 1", first.Payload[0].ContentString)
+	assert.NotEqual(digest.Id, first.Id)
+	assert.False(IsDigest(&nn[0]))
+}
+
+func (d *DigestSuite) TestNewDigestLimitsReferences() {
+	require := d.Require()
+	assert := d.Assert()
+
+	since := time.Date(2017, time.March, 14, 7, 0, 0, 0, time.UTC)
+	var nn []models.CommunicationRequest
+	for i := 0; i < MaxDigestReferences+5; i++ {
+		nn = append(nn, digestTestNotification(bson.NewObjectId().Hex(), "4525004", "Emergency department patient visit", since.Add(time.Minute)))
+	}
+	digest := NewDigest(autoDocs, nn, since, since.Add(24*time.Hour))
+	require.Len(digest.Payload, MaxDigestReferences+1)
+	assert.Equal("CommunicationRequest/"+nn[0].Id, digest.Payload[1].ContentReference.Reference)
+	assert.Equal(fmt.Sprintf("%d unacknowledged notifications for The AutoDocs since 2017-03-14T07:00:00Z\n"+
+		"Emergency department patient visit: %d", len(nn), len(nn)), digest.Payload[0].ContentString)
+}
+
+func (d *DigestSuite) TestFirstDigestWindow() {
+	assert := d.Assert()
+
+	now := time.Date(2017, time.March, 14, 12, 0, 0, 0, time.Local)
+	assert.Equal(24*time.Hour, (&Digester{CronSpec: "0 0 7 * * *"}).firstWindow(now))
+	assert.Equal(7*24*time.Hour, (&Digester{CronSpec: "0 0 7 * * MON"}).firstWindow(now))
+	assert.Equal(DefaultDigestWindow, (&Digester{}).firstWindow(now))
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestDigesterSuite(t *testing.T) {
+	suite.Run(t, new(DigesterSuite))
+}
+
+type DigesterSuite struct {
+	testutil.MongoSuite
+	NotificationCollection *mgo.Collection
+}
+
+func (d *DigesterSuite) SetupTest() {
+	d.NotificationCollection = d.DB().C("communicationrequests")
+}
+
+func (d *DigesterSuite) TearDownTest() {
+	d.TearDownDB()
+}
+
+func (d *DigesterSuite) TearDownSuite() {
+	d.TearDownDBServer()
+}
+
+func (d *DigesterSuite) TestDigestSinceLastDigest() {
+	require := d.Require()
+	assert := d.Assert()
+
+	start := time.Date(2017, time.March, 14, 7, 0, 0, 0, time.UTC)
+	acknowledged := digestTestNotification("58c314acb367c1ff54d1a002", "4525004", "Emergency department patient visit", start.Add(2*time.Hour))
+	acknowledged.Status = "accepted"
+	otherTeam := digestTestNotification("58c314acb367c1ff54d1a003", "4525004", "Emergency department patient visit", start.Add(3*time.Hour))
+	otherTeam.Recipient = []models.Reference{(&ie.CareTeam{ID: "58c314acb367c1ff54d19e9f", Name: "The RoboDocs"}).Reference()}
+	// The first digest only covers the last day (the default window), so older notifications aren't included
+	old := digestTestNotification("58c314acb367c1ff54d1a005", "4525004", "Emergency department patient visit", start.Add(-time.Hour))
+	for _, n := range []models.CommunicationRequest{
+		digestTestNotification("58c314acb367c1ff54d1a001", "4525004", "Emergency department patient visit", start.Add(time.Hour)),
+		acknowledged,
+		otherTeam,
+		old,
+	} {
+		require.NoError(d.NotificationCollection.Insert(n))
+	}
+
+	digester := &Digester{DB: d.DB()}
+	now := start.Add(24 * time.Hour)
+	digest, err := digester.Digest(autoDocs, now)
+	require.NoError(err)
+	require.NotNil(digest)
+	require.Len(digest.Payload, 2)
+	assert.Equal("CommunicationRequest/58c314acb367c1ff54d1a001", digest.Payload[1].ContentReference.Reference)
+	assert.Contains(digest.Payload[0].ContentString, "since 2017-03-14T07:00:00Z")
+
+	stored := new(models.CommunicationRequest)
+	require.NoError(d.NotificationCollection.FindId(digest.Id).One(stored))
+	assert.True(IsDigest(stored))
+
+	// Nothing new since the last digest, so there isn't another one
+	digest, err = digester.Digest(autoDocs, now.Add(24*time.Hour))
+	require.NoError(err)
+	assert.Nil(digest)
+
+	require.NoError(d.NotificationCollection.Insert(digestTestNotification("58c314acb367c1ff54d1a004", "32485007", "Hospital admission (procedure)", now.Add(time.Hour))))
+	digest, err = digester.Digest(autoDocs, now.Add(24*time.Hour))
+	require.NoError(err)
+	require.NotNil(digest)
+	require.Len(digest.Payload, 2)
+	assert.Equal("CommunicationRequest/58c314acb367c1ff54d1a004", digest.Payload[1].ContentReference.Reference)
+	assert.Contains(digest.Payload[0].ContentString, "since 2017-03-15T07:00:00Z")
+
+	count, err := d.NotificationCollection.Find(nil).Count()
+	require.NoError(err)
+	assert.Equal(7, count)
+}
+
+func digestTestNotification(id, code, display string, requestedOn time.Time) models.CommunicationRequest {
+	cr := models.CommunicationRequest{
+		Status:      "requested",
+		Subject:     &models.Reference{Reference: "Patient/5540f2041cd4623133000001", Type: "Patient", ReferencedID: "5540f2041cd4623133000001"},
+		Reason:      []models.CodeableConcept{{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: code, Display: display}}}},
+		Recipient:   []models.Reference{autoDocs.Reference()},
+		RequestedOn: &models.FHIRDateTime{Time: requestedOn, Precision: models.Timestamp},
+	}
+	cr.Id = id
+	return cr
+}
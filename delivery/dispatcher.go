@@ -0,0 +1,216 @@
+package delivery
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DeliveryExtensionURL is the extension recording the status of a notification's delivery through a channel.  Its
+// annotation's author is the channel and address (e.g., email:team@example.org), its time is the time of the last
+// attempt, and its text is the status (e.g., "delivered after 2 attempts").
+const DeliveryExtensionURL = "http://interventionengine.org/fhir/extension/communicationrequest/delivery"
+
+// The statuses of a delivery
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryRetrying  = "retrying"
+	DeliveryFailed    = "failed"
+)
+
+// Preference is a user's or team's preference to receive notifications through a channel, at an address.  The
+// Recipient matches the notification's recipient references (e.g., CareTeam/123) or, for recipients without a
+// reference (e.g., care team leaders), their display names.  Preferences for digests receive a care team's digests
+// (see Digester) instead of each of its notifications as they are created.
+type Preference struct {
+	Recipient string `json:"recipient"`
+	Channel   string `json:"channel"`
+	Address   string `json:"address"`
+	Digest    bool   `json:"digest,omitempty"`
+}
+
+// DeliveryStatus is the status of a notification's delivery through a channel, to an address
+type DeliveryStatus struct {
+	Channel  string
+	Address  string
+	Status   string
+	Attempts int
+	Time     time.Time
+	Error    error
+}
+
+// Extension returns the extension recording the status on a CommunicationRequest
+func (s DeliveryStatus) Extension() models.Extension {
+	text := fmt.Sprintf("%s after %d attempt", s.Status, s.Attempts)
+	if s.Attempts != 1 {
+		text += "s"
+	}
+	if s.Error != nil {
+		text += ": " + s.Error.Error()
+	}
+	return models.Extension{
+		Url: DeliveryExtensionURL,
+		ValueAnnotation: &models.Annotation{
+			AuthorString: s.Channel + ":" + s.Address,
+			Time:         &models.FHIRDateTime{Time: s.Time, Precision: models.Timestamp},
+			Text:         text,
+		},
+	}
+}
+
+// StatusRecorder records the status of a notification's delivery
+type StatusRecorder interface {
+	RecordStatus(notificationID string, status DeliveryStatus) error
+}
+
+// Dispatcher delivers notifications to their recipients through the channels the recipients prefer.  Failed
+// deliveries are retried (up to MaxAttempts times), waiting Backoff before the first retry and doubling the wait
+// before each retry after that.  The status of each delivery is recorded on the notification.
+type Dispatcher struct {
+	Channels    map[string]Channel
+	Preferences []Preference
+	MaxAttempts int
+	Backoff     time.Duration
+	// Recorder records delivery statuses.  If it isn't set, they are recorded as extensions on the notifications in the
+	// communicationrequests collection of DB (or of server.Database if DB isn't set).
+	Recorder StatusRecorder
+	DB       *mgo.Database
+
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	stopped bool
+	stop    chan struct{}
+}
+
+// NewDispatcher returns a Dispatcher delivering notifications through the channels according to the preferences
+func NewDispatcher(channels []Channel, preferences []Preference, maxAttempts int, backoff time.Duration) *Dispatcher {
+	d := &Dispatcher{
+		Channels:    make(map[string]Channel),
+		Preferences: preferences,
+		MaxAttempts: maxAttempts,
+		Backoff:     backoff,
+		stop:        make(chan struct{}),
+	}
+	for _, ch := range channels {
+		d.Channels[ch.Name()] = ch
+	}
+	return d
+}
+
+// DefaultDispatcher delivers the notifications created by the notification middleware.  If it is nil, notifications
+// aren't delivered (and wait for care teams to see them in the UI).
+var DefaultDispatcher *Dispatcher
+
+// Dispatch delivers the notification, in the background, to each of its recipients through their preferred channels.
+// Digests are only delivered to the preferences for digests, and other notifications only to the other preferences.
+func (d *Dispatcher) Dispatch(notification *models.CommunicationRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return
+	}
+	n := *notification
+	digest := IsDigest(notification)
+	for _, recipient := range notification.Recipient {
+		for _, pref := range d.Preferences {
+			if pref.Digest != digest || pref.Recipient == "" || (pref.Recipient != recipient.Reference && pref.Recipient != recipient.Display) {
+				continue
+			}
+			ch, ok := d.Channels[pref.Channel]
+			if !ok {
+				log.Printf("Unknown delivery channel %s for notification recipient %s", pref.Channel, pref.Recipient)
+				continue
+			}
+			d.wg.Add(1)
+			go d.deliver(&n, ch, pref.Address)
+		}
+	}
+}
+
+// Stop stops retrying deliveries and waits for the deliveries in progress to finish.  Notifications dispatched after
+// the dispatcher is stopped aren't delivered.
+func (d *Dispatcher) Stop() {
+	d.mutex.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.stop)
+	}
+	d.mutex.Unlock()
+	d.Wait()
+}
+
+// Wait waits for the deliveries in progress, including their retries, to finish
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) deliver(notification *models.CommunicationRequest, ch Channel, address string) {
+	defer d.wg.Done()
+	maxAttempts := d.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := d.Backoff
+	for attempt := 1; ; attempt++ {
+		err := ch.Deliver(notification, address)
+		status := DeliveryStatus{Channel: ch.Name(), Address: address, Attempts: attempt, Time: time.Now(), Error: err}
+		switch {
+		case err == nil:
+			status.Status = DeliveryDelivered
+		case attempt < maxAttempts:
+			status.Status = DeliveryRetrying
+		default:
+			status.Status = DeliveryFailed
+		}
+		d.record(notification, status)
+		if status.Status != DeliveryRetrying {
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-d.stop:
+			log.Printf("Delivery of notification %s via %s to %s stopped after %d attempts", notification.Id, ch.Name(), address, attempt)
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) record(notification *models.CommunicationRequest, status DeliveryStatus) {
+	if status.Error != nil {
+		log.Printf("Error delivering notification %s via %s to %s (attempt %d): %v", notification.Id, status.Channel, status.Address, status.Attempts, status.Error)
+	}
+	recorder := d.Recorder
+	if recorder == nil {
+		db := d.DB
+		if db == nil {
+			db = server.Database
+		}
+		recorder = &MongoStatusRecorder{C: db.C("communicationrequests")}
+	}
+	if err := recorder.RecordStatus(notification.Id, status); err != nil {
+		log.Printf("Error recording delivery status of notification %s: %v", notification.Id, err)
+	}
+}
+
+// MongoStatusRecorder records delivery statuses as extensions on the notifications in the collection, replacing the
+// previous status of the delivery through the same channel, to the same address
+type MongoStatusRecorder struct {
+	C *mgo.Collection
+}
+
+func (r *MongoStatusRecorder) RecordStatus(notificationID string, status DeliveryStatus) error {
+	ext := status.Extension()
+	previous := bson.M{"$pull": bson.M{"extension": bson.M{"url": DeliveryExtensionURL, "valueAnnotation.authorString": ext.ValueAnnotation.AuthorString}}}
+	if err := r.C.UpdateId(notificationID, previous); err != nil {
+		return err
+	}
+	return r.C.UpdateId(notificationID, bson.M{"$push": bson.M{"extension": ext}})
+}
@@ -0,0 +1,265 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestDispatcherSuite(t *testing.T) {
+	suite.Run(t, new(DispatcherSuite))
+}
+
+type DispatcherSuite struct {
+	suite.Suite
+	SMTP     *testutil.FakeSMTPServer
+	HTTP     *testutil.FakeHTTPSink
+	Recorder *memoryRecorder
+}
+
+func (d *DispatcherSuite) SetupTest() {
+	var err error
+	d.SMTP, err = testutil.NewFakeSMTPServer()
+	d.Require().NoError(err)
+	d.HTTP = testutil.NewFakeHTTPSink()
+	d.Recorder = new(memoryRecorder)
+}
+
+func (d *DispatcherSuite) TearDownTest() {
+	d.SMTP.Close()
+	d.HTTP.Close()
+}
+
+func (d *DispatcherSuite) newDispatcher(preferences []Preference, maxAttempts int) *Dispatcher {
+	dispatcher := NewDispatcher([]Channel{
+		&SMTPChannel{Addr: d.SMTP.Addr, From: "notifications@example.org"},
+		&WebhookChannel{},
+		&SMSChannel{GatewayURL: d.HTTP.URL + "/sms", From: "+15555550100", APIKey: "secret"},
+	}, preferences, maxAttempts, time.Millisecond)
+	dispatcher.Recorder = d.Recorder
+	return dispatcher
+}
+
+func (d *DispatcherSuite) TestDeliverToPreferredChannels() {
+	require := d.Require()
+	assert := d.Assert()
+
+	dispatcher := d.newDispatcher([]Preference{
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9e", Channel: EmailChannelName, Address: "autodocs@example.org"},
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9e", Channel: WebhookChannelName, Address: d.HTTP.URL + "/hooks/autodocs"},
+		{Recipient: "Optometrist Prime", Channel: SMSChannelName, Address: "+15555550123"},
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9f", Channel: EmailChannelName, Address: "robodocs@example.org"},
+	}, 3)
+	dispatcher.Dispatch(testNotification())
+	dispatcher.Wait()
+
+	messages := d.SMTP.Messages()
+	require.Len(messages, 1)
+	assert.Equal([]string{"autodocs@example.org"}, messages[0].To)
+	assert.Contains(messages[0].Data, "Subject: Intervention Engine: Emergency department patient visit")
+	assert.Contains(messages[0].Data, "Patient/5540f2041cd4623133000001")
+	assert.Contains(messages[0].Data, "http://intervention-engine.org/Encounter/123")
+
+	requests := d.HTTP.Requests()
+	require.Len(requests, 2)
+	byPath := make(map[string]testutil.FakeHTTPRequest)
+	for _, r := range requests {
+		byPath[r.Path] = r
+	}
+	hook := byPath["/hooks/autodocs"]
+	assert.Equal("application/json+fhir", hook.Header.Get("Content-Type"))
+	cr := new(models.CommunicationRequest)
+	require.NoError(json.Unmarshal([]byte(hook.Body), cr))
+	assert.Equal("58c314acb367c1ff54d1a001", cr.Id)
+
+	sms := byPath["/sms"]
+	assert.Equal("Bearer secret", sms.Header.Get("Authorization"))
+	msg := new(SMSMessage)
+	require.NoError(json.Unmarshal([]byte(sms.Body), msg))
+	assert.Equal("+15555550123", msg.To)
+	assert.Equal("+15555550100", msg.From)
+	assert.True(strings.HasPrefix(msg.Message, "Intervention Engine: Emergency department patient visit"))
+
+	statuses := d.Recorder.Statuses("58c314acb367c1ff54d1a001")
+	require.Len(statuses, 3)
+	for _, s := range statuses {
+		assert.Equal(DeliveryDelivered, s.Status)
+		assert.Equal(1, s.Attempts)
+	}
+}
+
+func (d *DispatcherSuite) TestRetryWithBackoff() {
+	require := d.Require()
+	assert := d.Assert()
+
+	d.HTTP.SetStatus(http.StatusServiceUnavailable)
+	dispatcher := d.newDispatcher([]Preference{
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9e", Channel: WebhookChannelName, Address: d.HTTP.URL + "/hooks/autodocs"},
+	}, 3)
+	dispatcher.Dispatch(testNotification())
+	dispatcher.Wait()
+
+	assert.Len(d.HTTP.Requests(), 3)
+	statuses := d.Recorder.Statuses("58c314acb367c1ff54d1a001")
+	require.Len(statuses, 3)
+	assert.Equal(DeliveryRetrying, statuses[0].Status)
+	assert.Equal(DeliveryRetrying, statuses[1].Status)
+	assert.Equal(DeliveryFailed, statuses[2].Status)
+	assert.Equal(3, statuses[2].Attempts)
+	assert.Error(statuses[2].Error)
+
+	ext := statuses[2].Extension()
+	assert.Equal(DeliveryExtensionURL, ext.Url)
+	assert.Equal("webhook:"+d.HTTP.URL+"/hooks/autodocs", ext.ValueAnnotation.AuthorString)
+	assert.True(strings.HasPrefix(ext.ValueAnnotation.Text, "failed after 3 attempts: "))
+}
+
+func (d *DispatcherSuite) TestRetryUntilDelivered() {
+	assert := d.Assert()
+
+	failing := &flakyChannel{failures: 1}
+	dispatcher := NewDispatcher([]Channel{failing}, []Preference{{Recipient: "Optometrist Prime", Channel: "flaky", Address: "x"}}, 3, time.Millisecond)
+	dispatcher.Recorder = d.Recorder
+	dispatcher.Dispatch(testNotification())
+	dispatcher.Wait()
+
+	statuses := d.Recorder.Statuses("58c314acb367c1ff54d1a001")
+	d.Require().Len(statuses, 2)
+	assert.Equal(DeliveryRetrying, statuses[0].Status)
+	assert.Equal(DeliveryDelivered, statuses[1].Status)
+	assert.Equal("delivered after 2 attempts", statuses[1].Extension().ValueAnnotation.Text)
+}
+
+func (d *DispatcherSuite) TestDeliverDigestsToDigestPreferences() {
+	require := d.Require()
+	assert := d.Assert()
+
+	dispatcher := d.newDispatcher([]Preference{
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9e", Channel: WebhookChannelName, Address: d.HTTP.URL + "/hooks/realtime"},
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9e", Channel: WebhookChannelName, Address: d.HTTP.URL + "/hooks/digest", Digest: true},
+	}, 3)
+	dispatcher.Dispatch(testNotification())
+	dispatcher.Wait()
+	requests := d.HTTP.Requests()
+	require.Len(requests, 1)
+	assert.Equal("/hooks/realtime", requests[0].Path)
+
+	team := &ie.CareTeam{ID: "58c314acb367c1ff54d19e9e", Name: "The AutoDocs"}
+	dispatcher.Dispatch(NewDigest(team, []models.CommunicationRequest{*testNotification()}, time.Time{}, time.Now()))
+	dispatcher.Wait()
+	requests = d.HTTP.Requests()
+	require.Len(requests, 2)
+	assert.Equal("/hooks/digest", requests[1].Path)
+}
+
+func (d *DispatcherSuite) TestStoppedDispatcherDoesNotDeliver() {
+	dispatcher := d.newDispatcher([]Preference{
+		{Recipient: "CareTeam/58c314acb367c1ff54d19e9e", Channel: WebhookChannelName, Address: d.HTTP.URL + "/hooks/autodocs"},
+	}, 3)
+	dispatcher.Stop()
+	dispatcher.Dispatch(testNotification())
+	d.Empty(d.HTTP.Requests())
+}
+
+func (d *DispatcherSuite) TestParseConfig() {
+	require := d.Require()
+	assert := d.Assert()
+
+	dispatcher, digester, err := LoadConfig("../config/notification_delivery.json")
+	require.NoError(err)
+	assert.Len(dispatcher.Channels, 3)
+	assert.Len(dispatcher.Preferences, 4)
+	assert.Equal(5, dispatcher.MaxAttempts)
+	assert.Equal(30*time.Second, dispatcher.Backoff)
+	require.NotNil(digester)
+	assert.Equal("0 0 7 * * *", digester.CronSpec)
+	assert.Empty(digester.CareTeams)
+	assert.Equal(dispatcher, digester.Dispatcher)
+
+	dispatcher, digester, err = ParseConfig([]byte(`{"webhook": {}, "preferences": []}`))
+	require.NoError(err)
+	assert.Equal(DefaultMaxAttempts, dispatcher.MaxAttempts)
+	assert.Equal(DefaultBackoff, dispatcher.Backoff)
+	assert.Nil(digester)
+
+	for _, config := range []string{
+		`{"smtp": {"addr": "localhost:25"}}`,
+		`{"sms": {}}`,
+		`{"webhook": {"timeout": "soon"}}`,
+		`{"webhook": {}, "backoff": "soon"}`,
+		`{"webhook": {}, "preferences": [{"recipient": "CareTeam/1", "channel": "email", "address": "team@example.org"}]}`,
+		`{"webhook": {}, "preferences": [{"recipient": "CareTeam/1", "channel": "webhook"}]}`,
+		`{"webhook": {}, "digest": {}}`,
+		`{"webhook": {}, "digest": {"cron": "daily"}}`,
+	} {
+		_, _, err := ParseConfig([]byte(config))
+		assert.Error(err, config)
+	}
+}
+
+func testNotification() *models.CommunicationRequest {
+	cr := &models.CommunicationRequest{}
+	cr.Id = "58c314acb367c1ff54d1a001"
+	cr.Status = "requested"
+	cr.Subject = &models.Reference{Reference: "Patient/5540f2041cd4623133000001", Type: "Patient", ReferencedID: "5540f2041cd4623133000001"}
+	cr.Reason = []models.CodeableConcept{{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "4525004", Display: "Emergency department patient visit"}}}}
+	cr.Payload = []models.CommunicationRequestPayloadComponent{{ContentReference: &models.Reference{Reference: "http://intervention-engine.org/Encounter/123", Type: "Encounter", ReferencedID: "123"}}}
+	cr.Recipient = []models.Reference{
+		{Reference: "CareTeam/58c314acb367c1ff54d19e9e", Type: "CareTeam", ReferencedID: "58c314acb367c1ff54d19e9e", Display: "The AutoDocs"},
+		{Display: "Optometrist Prime"},
+	}
+	return cr
+}
+
+// memoryRecorder records delivery statuses in memory, in the order they were recorded
+type memoryRecorder struct {
+	mutex    sync.Mutex
+	statuses map[string][]DeliveryStatus
+}
+
+func (r *memoryRecorder) RecordStatus(notificationID string, status DeliveryStatus) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.statuses == nil {
+		r.statuses = make(map[string][]DeliveryStatus)
+	}
+	r.statuses[notificationID] = append(r.statuses[notificationID], status)
+	return nil
+}
+
+func (r *memoryRecorder) Statuses(notificationID string) []DeliveryStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.statuses[notificationID]
+}
+
+// flakyChannel fails the first failures deliveries
+type flakyChannel struct {
+	mutex    sync.Mutex
+	failures int
+}
+
+func (ch *flakyChannel) Name() string {
+	return "flaky"
+}
+
+func (ch *flakyChannel) Deliver(notification *models.CommunicationRequest, address string) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.failures > 0 {
+		ch.failures--
+		return errors.New("temporarily unavailable")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package delivery
+
+import (
+	"net/http"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// SMSChannel texts notifications to the phone number given as the address through an HTTP SMS gateway.  The gateway
+// is sent a JSON message with the to and from numbers and the text of the message, authorized by the APIKey (as a
+// bearer token) if it is set.
+type SMSChannel struct {
+	GatewayURL string
+	From       string
+	APIKey     string
+	Client     *http.Client
+}
+
+// SMSMessage is the message posted to the SMS gateway
+type SMSMessage struct {
+	To      string `json:"to"`
+	From    string `json:"from,omitempty"`
+	Message string `json:"message"`
+}
+
+func (ch *SMSChannel) Name() string {
+	return SMSChannelName
+}
+
+func (ch *SMSChannel) Deliver(notification *models.CommunicationRequest, address string) error {
+	subject, text := Summary(notification)
+	header := http.Header{}
+	if ch.APIKey != "" {
+		header.Set("Authorization", "Bearer "+ch.APIKey)
+	}
+	msg := SMSMessage{To: address, From: ch.From, Message: subject + "\n" + text}
+	return postJSON(ch.Client, ch.GatewayURL, "application/json", msg, header)
+}
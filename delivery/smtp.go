@@ -0,0 +1,45 @@
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// SMTPChannel emails notifications through an SMTP server.  If a Username is set, the channel authenticates with
+// PLAIN authentication (which requires TLS, unless the server is on localhost).
+type SMTPChannel struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (ch *SMTPChannel) Name() string {
+	return EmailChannelName
+}
+
+func (ch *SMTPChannel) Deliver(notification *models.CommunicationRequest, address string) error {
+	var auth smtp.Auth
+	if ch.Username != "" {
+		host, _, err := net.SplitHostPort(ch.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", ch.Username, ch.Password, host)
+	}
+
+	subject, text := Summary(notification)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", ch.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", address)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", text)
+	return smtp.SendMail(ch.Addr, auth, ch.From, []string{address}, msg.Bytes())
+}
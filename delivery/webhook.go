@@ -0,0 +1,22 @@
+package delivery
+
+import (
+	"net/http"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// WebhookChannel posts notifications, as FHIR JSON CommunicationRequests, to the webhook URL given as the address
+type WebhookChannel struct {
+	Client *http.Client
+	// Header is added to every request (e.g., for an Authorization header)
+	Header http.Header
+}
+
+func (ch *WebhookChannel) Name() string {
+	return WebhookChannelName
+}
+
+func (ch *WebhookChannel) Deliver(notification *models.CommunicationRequest, address string) error {
+	return postJSON(ch.Client, address, "application/json+fhir", notification, ch.Header)
+}
@@ -0,0 +1,452 @@
+package groups
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AgeBands are the lower bounds (in years) of the age bands used for age breakdowns.  Each band runs up to (but not
+// including) the next band's lower bound, and the last band is open-ended.
+var AgeBands = []int{0, 18, 35, 50, 65, 75, 85}
+
+// DefaultRiskBands are the lower bounds of the risk bands used for risk breakdowns when none are requested
+var DefaultRiskBands = []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+// DefaultTopConditions is the number of condition codes reported when the number isn't requested
+const DefaultTopConditions = 10
+
+// BreakdownOptions indicate which breakdowns to compute for a group's patients
+type BreakdownOptions struct {
+	Gender          bool
+	Age             bool
+	Risk            bool
+	Conditions      bool
+	RiskMethod      fhir.Coding
+	RiskBands       []float64
+	TopConditions   int
+	ConditionSystem string
+}
+
+// Any indicates if any breakdowns are requested
+func (o *BreakdownOptions) Any() bool {
+	return o.Gender || o.Age || o.Risk || o.Conditions
+}
+
+// ParseBreakdownOptions parses the breakdown options from query parameters:
+//   - breakdown: comma-separated list of breakdowns (gender, age, risk, and/or conditions)
+//   - riskMethod: the system|code of the risk assessment method (required for the risk breakdown)
+//   - riskBands: comma-separated, ascending lower bounds of the risk bands (defaults to 0 through 10)
+//   - top: the number of condition codes to report (defaults to 10)
+//   - conditionSystem: only report condition codes from this code system
+func ParseBreakdownOptions(values url.Values) (*BreakdownOptions, error) {
+	o := &BreakdownOptions{RiskBands: DefaultRiskBands, TopConditions: DefaultTopConditions}
+	for _, param := range values["breakdown"] {
+		for _, b := range strings.Split(param, ",") {
+			switch strings.TrimSpace(b) {
+			case "gender":
+				o.Gender = true
+			case "age":
+				o.Age = true
+			case "risk":
+				o.Risk = true
+			case "conditions":
+				o.Conditions = true
+			case "":
+			default:
+				return nil, fmt.Errorf("Unknown breakdown: %s", b)
+			}
+		}
+	}
+
+	if method := values.Get("riskMethod"); method != "" {
+		parts := strings.SplitN(method, "|", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("riskMethod must be a system|code: %s", method)
+		}
+		o.RiskMethod = fhir.Coding{System: parts[0], Code: parts[1]}
+	} else if o.Risk {
+		return nil, errors.New("The risk breakdown requires a riskMethod")
+	}
+
+	if bands := values.Get("riskBands"); bands != "" {
+		o.RiskBands = nil
+		for _, b := range strings.Split(bands, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid risk band: %s", b)
+			}
+			if len(o.RiskBands) > 0 && f <= o.RiskBands[len(o.RiskBands)-1] {
+				return nil, errors.New("Risk bands must be in ascending order")
+			}
+			o.RiskBands = append(o.RiskBands, f)
+		}
+	}
+
+	if top := values.Get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid top: %s", top)
+		}
+		o.TopConditions = n
+	}
+	o.ConditionSystem = values.Get("conditionSystem")
+
+	return o, nil
+}
+
+// Breakdowns contains the requested breakdowns of a group's patients.  Breakdowns that weren't requested are nil.
+type Breakdowns struct {
+	Gender     []BreakdownCount `json:"gender,omitempty"`
+	Age        []BreakdownCount `json:"age,omitempty"`
+	Risk       []BreakdownCount `json:"risk,omitempty"`
+	Conditions []ConditionCount `json:"conditions,omitempty"`
+}
+
+// BreakdownCount is the number of patients with the labeled value
+type BreakdownCount struct {
+	Label string `json:"label" bson:"_id"`
+	Count int    `json:"count" bson:"count"`
+}
+
+// ConditionCount is the number of patients with a confirmed condition coded with the code
+type ConditionCount struct {
+	System   string `json:"system"`
+	Code     string `json:"code"`
+	Display  string `json:"display,omitempty"`
+	Patients int    `json:"patients"`
+}
+
+// computeBreakdowns computes the requested breakdowns for the patients in the set.  Each batch of patients is broken
+// down using Mongo aggregation, so that only the counts (not the patients' records) are returned from the database,
+// and the batches' counts are then summed.
+func computeBreakdowns(set *mgo.Collection, o *BreakdownOptions, db *mgo.Database) (*Breakdowns, error) {
+	now := time.Now()
+	gender := make(map[string]int)
+	age := make(map[string]int)
+	risk := make(map[string]int)
+	conditions := make(map[fhir.Coding]*ConditionCount)
+	err := eachBatch(set, func(pids []string) error {
+		if o.Gender {
+			counts, err := genderBreakdown(pids, db)
+			if err != nil {
+				return err
+			}
+			sumBreakdown(gender, counts)
+		}
+		if o.Age {
+			counts, err := ageBreakdown(pids, now, db)
+			if err != nil {
+				return err
+			}
+			sumBreakdown(age, counts)
+		}
+		if o.Risk {
+			counts, err := riskBreakdown(pids, o.RiskMethod, o.RiskBands, db)
+			if err != nil {
+				return err
+			}
+			sumBreakdown(risk, counts)
+		}
+		if o.Conditions {
+			counts, err := conditionBreakdown(pids, o.ConditionSystem, db)
+			if err != nil {
+				return err
+			}
+			// Each patient is only in one batch, so their counts can simply be summed
+			for i := range counts {
+				key := fhir.Coding{System: counts[i].System, Code: counts[i].Code}
+				if total, ok := conditions[key]; ok {
+					total.Patients += counts[i].Patients
+				} else {
+					conditions[key] = &counts[i]
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(Breakdowns)
+	if o.Gender {
+		b.Gender = totalBreakdown(gender, nil)
+	}
+	if o.Age {
+		b.Age = totalBreakdown(age, append(ageBandLabels(), "unknown"))
+	}
+	if o.Risk {
+		b.Risk = totalBreakdown(risk, append(riskBandLabels(o.RiskBands), "none"))
+	}
+	if o.Conditions {
+		b.Conditions = topConditions(conditions, o.TopConditions)
+	}
+	return b, nil
+}
+
+func sumBreakdown(totals map[string]int, counts []BreakdownCount) {
+	for _, c := range counts {
+		totals[c.Label] += c.Count
+	}
+}
+
+// totalBreakdown converts the totals to counts, ordered by their labels (or alphabetically if there are no labels)
+func totalBreakdown(totals map[string]int, labels []string) []BreakdownCount {
+	var counts []BreakdownCount
+	for label, count := range totals {
+		counts = append(counts, BreakdownCount{Label: label, Count: count})
+	}
+	sort.Sort(byBreakdownLabel(counts))
+	return orderBreakdown(counts, labels)
+}
+
+// topConditions returns the condition codes with the most patients (breaking ties by code), limited to the top number
+func topConditions(totals map[fhir.Coding]*ConditionCount, top int) []ConditionCount {
+	var counts []ConditionCount
+	for _, c := range totals {
+		counts = append(counts, *c)
+	}
+	sort.Sort(byConditionPatients(counts))
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+	return counts
+}
+
+func genderBreakdown(pids []string, db *mgo.Database) ([]BreakdownCount, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"_id": bson.M{"$in": pids}}},
+		{"$group": bson.M{
+			"_id":   bson.M{"$ifNull": []interface{}{"$gender", "unknown"}},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	var results []BreakdownCount
+	err := db.C("patients").Pipe(pipeline).All(&results)
+	return results, err
+}
+
+func ageBreakdown(pids []string, now time.Time, db *mgo.Database) ([]BreakdownCount, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"_id": bson.M{"$in": pids}}},
+		{"$group": bson.M{
+			"_id":   ageBandExpression(now),
+			"count": bson.M{"$sum": 1},
+		}},
+	}
+	var results []BreakdownCount
+	if err := db.C("patients").Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+	return orderBreakdown(results, append(ageBandLabels(), "unknown")), nil
+}
+
+// ageBandExpression returns the aggregation expression that labels a patient with their age band.  Each band is
+// checked from oldest to youngest by comparing the birthdate to the latest birthdate in the band.
+func ageBandExpression(now time.Time) interface{} {
+	labels := ageBandLabels()
+	var expr interface{} = labels[0]
+	for i := 1; i < len(AgeBands); i++ {
+		latestBirthDate := now.AddDate(-1*AgeBands[i], 0, 0)
+		expr = bson.M{"$cond": []interface{}{
+			bson.M{"$lte": []interface{}{"$birthDate.time", latestBirthDate}},
+			labels[i],
+			expr,
+		}}
+	}
+	// Missing birthdates compare as less than any date, so check for them first
+	return bson.M{"$cond": []interface{}{
+		bson.M{"$eq": []interface{}{bson.M{"$ifNull": []interface{}{"$birthDate.time", nil}}, nil}},
+		"unknown",
+		expr,
+	}}
+}
+
+func ageBandLabels() []string {
+	labels := make([]string, len(AgeBands))
+	for i := range AgeBands {
+		if i == len(AgeBands)-1 {
+			labels[i] = fmt.Sprintf("%d+", AgeBands[i])
+		} else {
+			labels[i] = fmt.Sprintf("%d-%d", AgeBands[i], AgeBands[i+1]-1)
+		}
+	}
+	return labels
+}
+
+func riskBreakdown(pids []string, method fhir.Coding, bands []float64, db *mgo.Database) ([]BreakdownCount, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			"subject.referenceid": bson.M{"$in": pids},
+			"method.coding": bson.M{
+				"$elemMatch": bson.M{"system": method.System, "code": method.Code},
+			},
+			"meta.tag": bson.M{
+				"$elemMatch": bson.M{"system": "http://interventionengine.org/tags/", "code": "MOST_RECENT"},
+			},
+		}},
+		{"$project": bson.M{
+			"score": bson.M{"$arrayElemAt": []interface{}{"$prediction.probabilityDecimal", 0}},
+		}},
+		{"$group": bson.M{
+			"_id":   riskBandExpression(bands),
+			"count": bson.M{"$sum": 1},
+		}},
+	}
+	var results []BreakdownCount
+	if err := db.C("riskassessments").Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+
+	// Patients without a risk assessment aren't in the results, so count them separately
+	assessed := 0
+	for _, r := range results {
+		assessed += r.Count
+	}
+	if unassessed := len(pids) - assessed; unassessed > 0 {
+		results = append(results, BreakdownCount{Label: "none", Count: unassessed})
+	}
+	return orderBreakdown(results, append(riskBandLabels(bands), "none")), nil
+}
+
+// riskBandExpression returns the aggregation expression that labels a score with its risk band, checking each band
+// from highest to lowest.  Scores below the lowest band are labeled with "<" and the lowest band.
+func riskBandExpression(bands []float64) interface{} {
+	labels := riskBandLabels(bands)
+	var expr interface{} = labels[0]
+	for i := range bands {
+		expr = bson.M{"$cond": []interface{}{
+			bson.M{"$gte": []interface{}{"$score", bands[i]}},
+			labels[i+1],
+			expr,
+		}}
+	}
+	return expr
+}
+
+// riskBandLabels labels the scores below the lowest band, and then each band
+func riskBandLabels(bands []float64) []string {
+	labels := make([]string, len(bands)+1)
+	labels[0] = fmt.Sprintf("<%g", bands[0])
+	for i := range bands {
+		if i == len(bands)-1 {
+			labels[i+1] = fmt.Sprintf("%g+", bands[i])
+		} else {
+			labels[i+1] = fmt.Sprintf("%g-%g", bands[i], bands[i+1])
+		}
+	}
+	return labels
+}
+
+func conditionBreakdown(pids []string, system string, db *mgo.Database) ([]ConditionCount, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			"verificationStatus":  "confirmed",
+			"patient.referenceid": bson.M{"$in": pids},
+		}},
+		{"$unwind": "$code.coding"},
+	}
+	if system != "" {
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"code.coding.system": system}})
+	}
+	pipeline = append(pipeline,
+		// Count each patient once per code, no matter how many conditions they have with it
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"system":  "$code.coding.system",
+				"code":    "$code.coding.code",
+				"patient": "$patient.referenceid",
+			},
+			"display": bson.M{"$first": bson.M{"$ifNull": []interface{}{"$code.coding.display", "$code.text"}}},
+		}},
+		bson.M{"$group": bson.M{
+			"_id":      bson.M{"system": "$_id.system", "code": "$_id.code"},
+			"display":  bson.M{"$first": "$display"},
+			"patients": bson.M{"$sum": 1},
+		}},
+	)
+
+	var results []struct {
+		ID struct {
+			System string `bson:"system"`
+			Code   string `bson:"code"`
+		} `bson:"_id"`
+		Display  string `bson:"display"`
+		Patients int    `bson:"patients"`
+	}
+	if err := db.C("conditions").Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+	counts := make([]ConditionCount, len(results))
+	for i, r := range results {
+		counts[i] = ConditionCount{System: r.ID.System, Code: r.ID.Code, Display: r.Display, Patients: r.Patients}
+	}
+	return counts, nil
+}
+
+// orderBreakdown orders the counts in the same order as their labels
+func orderBreakdown(counts []BreakdownCount, labels []string) []BreakdownCount {
+	order := make(map[string]int, len(labels))
+	for i, l := range labels {
+		order[l] = i
+	}
+	sort.Stable(byLabelOrder{counts: counts, order: order})
+	return counts
+}
+
+type byBreakdownLabel []BreakdownCount
+
+func (b byBreakdownLabel) Len() int {
+	return len(b)
+}
+func (b byBreakdownLabel) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+func (b byBreakdownLabel) Less(i, j int) bool {
+	return b[i].Label < b[j].Label
+}
+
+// byLabelOrder sorts counts by the position of their labels in the order
+type byLabelOrder struct {
+	counts []BreakdownCount
+	order  map[string]int
+}
+
+func (b byLabelOrder) Len() int {
+	return len(b.counts)
+}
+func (b byLabelOrder) Swap(i, j int) {
+	b.counts[i], b.counts[j] = b.counts[j], b.counts[i]
+}
+func (b byLabelOrder) Less(i, j int) bool {
+	return b.order[b.counts[i].Label] < b.order[b.counts[j].Label]
+}
+
+// byConditionPatients sorts condition counts by their number of patients (most first), then by system and code
+type byConditionPatients []ConditionCount
+
+func (c byConditionPatients) Len() int {
+	return len(c)
+}
+func (c byConditionPatients) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+func (c byConditionPatients) Less(i, j int) bool {
+	if c[i].Patients != c[j].Patients {
+		return c[i].Patients > c[j].Patients
+	}
+	if c[i].System != c[j].System {
+		return c[i].System < c[j].System
+	}
+	return c[i].Code < c[j].Code
+}
@@ -0,0 +1,104 @@
+package groups
+
+import (
+	"net/url"
+	"testing"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestBreakdownSuite(t *testing.T) {
+	suite.Run(t, new(BreakdownSuite))
+}
+
+type BreakdownSuite struct {
+	suite.Suite
+}
+
+func (suite *BreakdownSuite) TestParseDefaultBreakdownOptions() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	o, err := ParseBreakdownOptions(url.Values{})
+	require.NoError(err)
+	assert.False(o.Any())
+	assert.Equal(DefaultRiskBands, o.RiskBands)
+	assert.Equal(DefaultTopConditions, o.TopConditions)
+}
+
+func (suite *BreakdownSuite) TestParseBreakdownOptions() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	values, _ := url.ParseQuery("breakdown=gender,age&breakdown=risk&breakdown=conditions" +
+		"&riskMethod=http://interventionengine.org/risk-assessments|Simple&riskBands=0,4,7&top=5" +
+		"&conditionSystem=http://hl7.org/fhir/sid/icd-9")
+	o, err := ParseBreakdownOptions(values)
+	require.NoError(err)
+	assert.True(o.Any())
+	assert.True(o.Gender)
+	assert.True(o.Age)
+	assert.True(o.Risk)
+	assert.True(o.Conditions)
+	assert.Equal(fhir.Coding{System: "http://interventionengine.org/risk-assessments", Code: "Simple"}, o.RiskMethod)
+	assert.Equal([]float64{0, 4, 7}, o.RiskBands)
+	assert.Equal(5, o.TopConditions)
+	assert.Equal("http://hl7.org/fhir/sid/icd-9", o.ConditionSystem)
+}
+
+func (suite *BreakdownSuite) TestParseInvalidBreakdownOptions() {
+	assert := suite.Assert()
+
+	for _, query := range []string{
+		"breakdown=zodiac",
+		"breakdown=risk",
+		"breakdown=risk&riskMethod=Simple",
+		"riskBands=0,7,4",
+		"riskBands=0,low",
+		"top=0",
+		"top=ten",
+	} {
+		values, _ := url.ParseQuery(query)
+		_, err := ParseBreakdownOptions(values)
+		assert.Error(err, query)
+	}
+}
+
+func (suite *BreakdownSuite) TestBandLabels() {
+	assert := suite.Assert()
+
+	assert.Equal([]string{"0-17", "18-34", "35-49", "50-64", "65-74", "75-84", "85+"}, ageBandLabels())
+	assert.Equal([]string{"<0", "0-4", "4-7.5", "7.5+"}, riskBandLabels([]float64{0, 4, 7.5}))
+}
+
+func (suite *BreakdownSuite) TestOrderBreakdown() {
+	counts := []BreakdownCount{{"unknown", 2}, {"85+", 1}, {"18-34", 5}}
+	suite.Assert().Equal([]BreakdownCount{{"18-34", 5}, {"85+", 1}, {"unknown", 2}},
+		orderBreakdown(counts, append(ageBandLabels(), "unknown")))
+}
+
+func (suite *BreakdownSuite) TestTotalBreakdown() {
+	assert := suite.Assert()
+
+	totals := make(map[string]int)
+	sumBreakdown(totals, []BreakdownCount{{"male", 2}, {"female", 1}})
+	sumBreakdown(totals, []BreakdownCount{{"female", 3}, {"unknown", 1}})
+	assert.Equal([]BreakdownCount{{"female", 4}, {"male", 2}, {"unknown", 1}}, totalBreakdown(totals, nil))
+}
+
+func (suite *BreakdownSuite) TestTopConditions() {
+	assert := suite.Assert()
+
+	totals := map[fhir.Coding]*ConditionCount{
+		{System: "icd-9", Code: "250.00"}: {System: "icd-9", Code: "250.00", Patients: 3},
+		{System: "icd-9", Code: "401.9"}:  {System: "icd-9", Code: "401.9", Patients: 5},
+		{System: "icd-9", Code: "296.21"}: {System: "icd-9", Code: "296.21", Patients: 3},
+	}
+	assert.Equal([]ConditionCount{
+		{System: "icd-9", Code: "401.9", Patients: 5},
+		{System: "icd-9", Code: "250.00", Patients: 3},
+	}, topConditions(totals, 2))
+}
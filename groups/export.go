@@ -0,0 +1,283 @@
+package groups
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The export output formats
+const (
+	ExportFormatBundle = "application/fhir+json"
+	ExportFormatNDJSON = "application/fhir+ndjson"
+)
+
+// DefaultExportTypes are the resource types exported when the _type parameter isn't passed
+var DefaultExportTypes = []string{"Patient", "Condition", "Encounter", "RiskAssessment"}
+
+// exportPatientFields are the fields each exportable resource type uses to refer to its patient
+var exportPatientFields = map[string]string{
+	"Patient":        "_id",
+	"Condition":      "patient.referenceid",
+	"Encounter":      "patient.referenceid",
+	"RiskAssessment": "subject.referenceid",
+}
+
+// ExportOptions indicate which resource types to export for a group's patients, and in which format
+type ExportOptions struct {
+	Types  []string
+	Format string
+}
+
+// ParseExportOptions parses the export options from Bulk Data-style query parameters:
+//   - _type: comma-separated list of resource types (Patient, Condition, Encounter, and/or RiskAssessment)
+//   - _outputFormat: bundle (or application/fhir+json) for a single collection Bundle, the default, or ndjson (or
+//     application/fhir+ndjson) for NDJSON files
+func ParseExportOptions(values url.Values) (*ExportOptions, error) {
+	o := &ExportOptions{Types: DefaultExportTypes, Format: ExportFormatBundle}
+	if types := values.Get("_type"); types != "" {
+		o.Types = nil
+		seen := make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			t = strings.TrimSpace(t)
+			if _, ok := exportPatientFields[t]; !ok {
+				return nil, fmt.Errorf("Unsupported export type: %s", t)
+			}
+			if !seen[t] {
+				seen[t] = true
+				o.Types = append(o.Types, t)
+			}
+		}
+	}
+
+	switch format := values.Get("_outputFormat"); format {
+	case "", "bundle", "json", ExportFormatBundle:
+	case "ndjson", "application/ndjson", ExportFormatNDJSON:
+		o.Format = ExportFormatNDJSON
+	default:
+		return nil, fmt.Errorf("Unsupported export format: %s", format)
+	}
+	return o, nil
+}
+
+// GroupExportHandler exports the resources of the group's patients, resolving the group's membership from its
+// characteristics unless it is an actual group.  The export options are described in ParseExportOptions.  Bundles
+// are streamed as a single collection Bundle.  NDJSON is streamed as a single NDJSON file when one type is exported,
+// or otherwise as a zip file containing one NDJSON file per type (e.g., Patient.ndjson).
+//
+// Since the export is streamed, errors after it begins can't be reported in the response status, so they are logged
+// and the response is cut short.
+func GroupExportHandler(c *gin.Context) {
+	options, err := ParseExportOptions(c.Request.URL.Query())
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	group := new(fhir.Group)
+	if err := server.Database.C("groups").FindId(c.Param("id")).One(group); err != nil {
+		if err == mgo.ErrNotFound {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// TODO: Get the searcher that is actually used in the FHIR server (requires registration refactoring)
+	r := newPatientSetResolver(search.NewMongoSearcher(server.Database))
+	defer r.Close()
+	set, err := r.groupSet(group)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var w exportWriter
+	switch {
+	case options.Format == ExportFormatBundle:
+		c.Header("Content-Type", ExportFormatBundle+"; charset=utf-8")
+		w = &bundleExportWriter{w: c.Writer, baseURL: requestBaseURL(c.Request)}
+	case len(options.Types) == 1:
+		c.Header("Content-Type", ExportFormatNDJSON)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.ndjson", options.Types[0]))
+		w = &ndjsonExportWriter{w: c.Writer}
+	default:
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=group-%s-export.zip", group.Id))
+		w = &zipExportWriter{zip: zip.NewWriter(c.Writer)}
+	}
+	c.Status(http.StatusOK)
+
+	if err := exportResources(set, options.Types, w, server.Database, c.Writer.Flush); err != nil {
+		log.Printf("Error exporting group %s: %v", group.Id, err)
+		return
+	}
+	if err := w.Close(); err != nil {
+		log.Printf("Error finishing export of group %s: %v", group.Id, err)
+	}
+}
+
+// exportResources writes the resources of each type that belong to the patients in the set, a batch of patients at
+// a time, flushing after each batch
+func exportResources(set *mgo.Collection, types []string, w exportWriter, db *mgo.Database, flush func()) error {
+	for _, resourceType := range types {
+		if err := w.Begin(resourceType); err != nil {
+			return err
+		}
+		collection := db.C(fhir.PluralizeLowerResourceName(resourceType))
+		field := exportPatientFields[resourceType]
+		err := eachBatch(set, func(pids []string) error {
+			iter := collection.Find(bson.M{field: bson.M{"$in": pids}}).Iter()
+			resource := fhir.NewStructForResourceName(resourceType)
+			for iter.Next(resource) {
+				if err := w.Write(resourceType, resource); err != nil {
+					iter.Close()
+					return err
+				}
+				// Unmarshaling into the same struct could leave fields from the previous resource
+				resource = fhir.NewStructForResourceName(resourceType)
+			}
+			if err := iter.Close(); err != nil {
+				return err
+			}
+			flush()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportWriter writes exported resources.  Begin is called before writing each type's resources, and Close is called
+// once all of the resources have been written.
+type exportWriter interface {
+	Begin(resourceType string) error
+	Write(resourceType string, resource interface{}) error
+	Close() error
+}
+
+// bundleExportWriter writes the resources as the entries of a collection Bundle
+type bundleExportWriter struct {
+	w       io.Writer
+	baseURL string
+	started bool
+	entries int
+}
+
+func (b *bundleExportWriter) Begin(resourceType string) error {
+	return b.start()
+}
+
+func (b *bundleExportWriter) start() error {
+	if b.started {
+		return nil
+	}
+	b.started = true
+	_, err := io.WriteString(b.w, `{"resourceType":"Bundle","type":"collection","entry":[`)
+	return err
+}
+
+func (b *bundleExportWriter) Write(resourceType string, resource interface{}) error {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	var ref struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	entry := struct {
+		FullURL  string          `json:"fullUrl"`
+		Resource json.RawMessage `json:"resource"`
+	}{b.baseURL + "/" + resourceType + "/" + ref.ID, data}
+	if data, err = json.Marshal(entry); err != nil {
+		return err
+	}
+	if b.entries > 0 {
+		if _, err := io.WriteString(b.w, ","); err != nil {
+			return err
+		}
+	}
+	b.entries++
+	_, err = b.w.Write(data)
+	return err
+}
+
+func (b *bundleExportWriter) Close() error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(b.w, "]}")
+	return err
+}
+
+// ndjsonExportWriter writes the resources as a single NDJSON file
+type ndjsonExportWriter struct {
+	w io.Writer
+}
+
+func (n *ndjsonExportWriter) Begin(resourceType string) error {
+	return nil
+}
+
+func (n *ndjsonExportWriter) Write(resourceType string, resource interface{}) error {
+	return writeNDJSON(n.w, resource)
+}
+
+func (n *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+// zipExportWriter writes each type's resources as an NDJSON file in a zip file
+type zipExportWriter struct {
+	zip  *zip.Writer
+	file io.Writer
+}
+
+func (z *zipExportWriter) Begin(resourceType string) (err error) {
+	z.file, err = z.zip.Create(resourceType + ".ndjson")
+	return err
+}
+
+func (z *zipExportWriter) Write(resourceType string, resource interface{}) error {
+	return writeNDJSON(z.file, resource)
+}
+
+func (z *zipExportWriter) Close() error {
+	return z.zip.Close()
+}
+
+func writeNDJSON(w io.Writer, resource interface{}) error {
+	// json.Marshal doesn't indent, so each resource is on its own line
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func requestBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
@@ -0,0 +1,197 @@
+package groups
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestExportOptionsSuite(t *testing.T) {
+	suite.Run(t, new(ExportOptionsSuite))
+}
+
+type ExportOptionsSuite struct {
+	suite.Suite
+}
+
+func (suite *ExportOptionsSuite) TestParseDefaultExportOptions() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	o, err := ParseExportOptions(url.Values{})
+	require.NoError(err)
+	assert.Equal(DefaultExportTypes, o.Types)
+	assert.Equal(ExportFormatBundle, o.Format)
+}
+
+func (suite *ExportOptionsSuite) TestParseExportOptions() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	values, _ := url.ParseQuery("_type=Condition,Patient,Condition&_outputFormat=application/fhir%2Bndjson")
+	o, err := ParseExportOptions(values)
+	require.NoError(err)
+	assert.Equal([]string{"Condition", "Patient"}, o.Types)
+	assert.Equal(ExportFormatNDJSON, o.Format)
+
+	for _, query := range []string{"_type=Observation", "_outputFormat=csv"} {
+		values, _ := url.ParseQuery(query)
+		_, err := ParseExportOptions(values)
+		assert.Error(err, query)
+	}
+}
+
+func (suite *ExportOptionsSuite) TestBundleExportWriter() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	var buf bytes.Buffer
+	w := &bundleExportWriter{w: &buf, baseURL: "http://ie-server"}
+	require.NoError(w.Begin("Patient"))
+	require.NoError(w.Write("Patient", &fhir.Patient{DomainResource: fhir.DomainResource{Resource: fhir.Resource{Id: "1"}}}))
+	require.NoError(w.Write("Patient", &fhir.Patient{DomainResource: fhir.DomainResource{Resource: fhir.Resource{Id: "2"}}}))
+	require.NoError(w.Close())
+
+	bundle := new(fhir.Bundle)
+	require.NoError(json.Unmarshal(buf.Bytes(), bundle))
+	assert.Equal("collection", bundle.Type)
+	require.Len(bundle.Entry, 2)
+	assert.Equal("http://ie-server/Patient/2", bundle.Entry[1].FullUrl)
+	assert.Equal("2", bundle.Entry[1].Resource.(*fhir.Patient).Id)
+
+	// An empty export is still a valid bundle
+	buf.Reset()
+	require.NoError((&bundleExportWriter{w: &buf}).Close())
+	require.NoError(json.Unmarshal(buf.Bytes(), bundle))
+	assert.Empty(bundle.Entry)
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestExportSuite(t *testing.T) {
+	suite.Run(t, new(ExportSuite))
+}
+
+type ExportSuite struct {
+	testutil.MongoSuite
+	Group *fhir.Group
+}
+
+func (suite *ExportSuite) SetupTest() {
+	require := suite.Require()
+
+	// Setup the database
+	server.Database = suite.DB()
+
+	// Store the group of males with major depression
+	suite.Group = new(fhir.Group)
+	suite.InsertFixture("groups", "../fixtures/sample-group.json", suite.Group)
+
+	// Store the bundle of data: two males, one of whom has major depression
+	bundleFile, err := os.Open("../fixtures/sample-group-data-bundle.json")
+	require.NoError(err)
+	defer bundleFile.Close()
+	ctx, rw, _ := gin.CreateTestContext()
+	ctx.Request, err = http.NewRequest("POST", "http://ie-server/", bundleFile)
+	require.NoError(err)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	server.NewBatchController(server.NewMongoDataAccessLayer(suite.DB())).Post(ctx)
+	require.Equal(200, rw.Code)
+}
+
+func (suite *ExportSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *ExportSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *ExportSuite) TestExportBundle() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	rw := suite.export("")
+	require.Equal(http.StatusOK, rw.Code)
+	bundle := new(fhir.Bundle)
+	require.NoError(json.NewDecoder(rw.Body).Decode(bundle))
+
+	// The matching patient, their encounter, and both of their conditions (confirmed or not)
+	counts := make(map[string]int)
+	for _, entry := range bundle.Entry {
+		counts[strings.SplitN(strings.TrimPrefix(entry.FullUrl, "http://ie-server/"), "/", 2)[0]]++
+	}
+	assert.Equal(map[string]int{"Patient": 1, "Encounter": 1, "Condition": 2}, counts)
+}
+
+func (suite *ExportSuite) TestExportNDJSON() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	rw := suite.export("?_type=Patient&_outputFormat=ndjson")
+	require.Equal(http.StatusOK, rw.Code)
+	assert.Equal(ExportFormatNDJSON, rw.Header().Get("Content-Type"))
+	lines := 0
+	scanner := bufio.NewScanner(rw.Body)
+	for scanner.Scan() {
+		patient := new(fhir.Patient)
+		require.NoError(json.Unmarshal(scanner.Bytes(), patient))
+		assert.Equal("male", patient.Gender)
+		lines++
+	}
+	assert.Equal(1, lines)
+}
+
+func (suite *ExportSuite) TestExportNDJSONZip() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	rw := suite.export("?_type=Patient,Condition&_outputFormat=ndjson")
+	require.Equal(http.StatusOK, rw.Code)
+	body := rw.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(err)
+	require.Len(zr.File, 2)
+	assert.Equal("Patient.ndjson", zr.File[0].Name)
+	assert.Equal("Condition.ndjson", zr.File[1].Name)
+
+	f, err := zr.File[1].Open()
+	require.NoError(err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(err)
+	assert.Len(strings.Split(strings.TrimSpace(string(data)), "\n"), 2)
+}
+
+func (suite *ExportSuite) TestExportUnknownGroup() {
+	suite.Assert().Equal(http.StatusNotFound, suite.exportGroup("123", "").Code)
+}
+
+func (suite *ExportSuite) export(query string) *httptest.ResponseRecorder {
+	return suite.exportGroup(suite.Group.Id, query)
+}
+
+func (suite *ExportSuite) exportGroup(id, query string) *httptest.ResponseRecorder {
+	e := gin.New()
+	e.GET("/Group/:id/$export", GroupExportHandler)
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://ie-server/Group/"+id+"/$export"+query, nil)
+	suite.Require().NoError(err)
+	e.ServeHTTP(rw, req)
+	return rw
+}
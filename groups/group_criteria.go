@@ -0,0 +1,192 @@
+package groups
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AnyOfExtensionURL is the URL of the characteristic extension that puts a characteristic in an OR group.  Its
+// valueString names the group: characteristics with the same name are ORed together, and the result is ANDed with the
+// group's other characteristics.
+const AnyOfExtensionURL = "http://interventionengine.org/fhir/extension/group/characteristic/anyOf"
+
+// GroupExtensionURL is the URL of the characteristic extension that nests another group's criteria.  Its
+// valueReference refers to a group contained in the group (e.g., "#diabetics") or a stored group (e.g.,
+// "Group/5813ba9e1b9a2b5b5e5f4e6a").  The characteristic matches the patients that match the nested group's
+// characteristics, so it may also be excluded or put in an OR group.
+const GroupExtensionURL = "http://interventionengine.org/fhir/extension/group/characteristic/group"
+
+// maxNestingDepth limits how deeply groups can be nested, which also catches groups that refer to each other
+const maxNestingDepth = 10
+
+// LoadGroupCharacteristicInfo converts the group's characteristics to CharacteristicInfo, supporting exclusions,
+// OR groups, and nested groups.  Nested groups are found in the group's contained resources or, if db isn't nil, in
+// the groups collection.
+func LoadGroupCharacteristicInfo(group *fhir.Group, db *mgo.Database) (*CharacteristicInfo, error) {
+	l := &groupLoader{root: group, db: db}
+	return l.load(group.Characteristic)
+}
+
+type groupLoader struct {
+	root  *fhir.Group
+	db    *mgo.Database
+	depth int
+}
+
+func (l *groupLoader) load(characteristics []fhir.GroupCharacteristicComponent) (*CharacteristicInfo, error) {
+	c := newCharacteristicInfo()
+	anyOfIndexes := make(map[string]int)
+	for _, characteristic := range characteristics {
+		ref := findExtension(characteristic.Extension, GroupExtensionURL)
+		anyOf := findExtension(characteristic.Extension, AnyOfExtensionURL)
+		exclude := characteristic.Exclude != nil && *characteristic.Exclude
+		window, err := loadTimeWindow(characteristic)
+		if err != nil {
+			return nil, err
+		}
+
+		// Plain characteristics are simply ANDed together
+		if ref == nil && anyOf == nil && !exclude && window == nil {
+			if err := c.addCharacteristic(characteristic); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var term *CharacteristicInfo
+		if ref != nil {
+			if window != nil {
+				return nil, fmt.Errorf("Nested group %s can't have a time window", ref.ValueReference.Reference)
+			}
+			nested, err := l.loadNested(ref.ValueReference)
+			if err != nil {
+				return nil, err
+			}
+			term = nested
+		} else {
+			// Windowed characteristics get their own info so the window only applies to them
+			term = newCharacteristicInfo()
+			term.Window = window
+			if err := term.addCharacteristic(characteristic); err != nil {
+				return nil, err
+			}
+			if err := term.checkWindow(); err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case anyOf == nil && exclude:
+			c.NoneOf = append(c.NoneOf, term)
+		case anyOf == nil:
+			c.AllOf = append(c.AllOf, term)
+		default:
+			if exclude {
+				excluded := newCharacteristicInfo()
+				excluded.NoneOf = []*CharacteristicInfo{term}
+				term = excluded
+			}
+			i, ok := anyOfIndexes[anyOf.ValueString]
+			if !ok {
+				i = len(c.AnyOf)
+				anyOfIndexes[anyOf.ValueString] = i
+				c.AnyOf = append(c.AnyOf, nil)
+			}
+			c.AnyOf[i] = append(c.AnyOf[i], term)
+		}
+	}
+	return c, nil
+}
+
+func (l *groupLoader) loadNested(ref *fhir.Reference) (*CharacteristicInfo, error) {
+	if ref == nil || ref.Reference == "" {
+		return nil, errors.New("Nested group characteristic requires a valueReference")
+	}
+	if l.depth >= maxNestingDepth {
+		return nil, fmt.Errorf("Groups are nested too deeply (or refer to each other) at %s", ref.Reference)
+	}
+
+	group, err := l.findGroup(ref)
+	if err != nil {
+		return nil, err
+	}
+	if group.Actual != nil && *group.Actual {
+		return nil, fmt.Errorf("Nested group %s must be a definitional (not actual) group", ref.Reference)
+	}
+
+	l.depth++
+	defer func() { l.depth-- }()
+	return l.load(group.Characteristic)
+}
+
+func (l *groupLoader) findGroup(ref *fhir.Reference) (*fhir.Group, error) {
+	if strings.HasPrefix(ref.Reference, "#") {
+		if l.root != nil {
+			if group, err := containedGroup(l.root, strings.TrimPrefix(ref.Reference, "#")); group != nil || err != nil {
+				return group, err
+			}
+		}
+		return nil, fmt.Errorf("Contained group not found: %s", ref.Reference)
+	}
+
+	id := ref.ReferencedID
+	if id == "" {
+		id = strings.TrimPrefix(ref.Reference, "Group/")
+	}
+	if l.db == nil {
+		return nil, fmt.Errorf("Cannot load nested group %s without a database", ref.Reference)
+	}
+	group := new(fhir.Group)
+	if err := l.db.C("groups").FindId(id).One(group); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, fmt.Errorf("Nested group not found: %s", ref.Reference)
+		}
+		return nil, err
+	}
+	return group, nil
+}
+
+// containedGroup finds the contained group with the ID.  Groups unmarshaled from JSON contain *fhir.Group resources,
+// but groups loaded from Mongo contain bson.M documents, so those are converted.
+func containedGroup(group *fhir.Group, id string) (*fhir.Group, error) {
+	for _, contained := range group.Contained {
+		switch r := contained.(type) {
+		case *fhir.Group:
+			if r.Id == id {
+				return r, nil
+			}
+		case fhir.Group:
+			if r.Id == id {
+				return &r, nil
+			}
+		case bson.M:
+			if r["resourceType"] != "Group" || r["_id"] != id {
+				continue
+			}
+			data, err := bson.Marshal(r)
+			if err != nil {
+				return nil, err
+			}
+			g := new(fhir.Group)
+			if err := bson.Unmarshal(data, g); err != nil {
+				return nil, err
+			}
+			return g, nil
+		}
+	}
+	return nil, nil
+}
+
+func findExtension(extensions []fhir.Extension, url string) *fhir.Extension {
+	for i := range extensions {
+		if extensions[i].Url == url {
+			return &extensions[i]
+		}
+	}
+	return nil
+}
@@ -4,8 +4,8 @@ import (
 	"errors"
 	"fmt"
 
-	fhir "github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -15,8 +15,7 @@ func init() {
 	search.GlobalRegistry().RegisterParameterParser(GroupParamInfo.Type, GroupParamParser)
 	search.GlobalMongoRegistry().RegisterBSONBuilder(GroupParamInfo.Type, GroupBSONBuilder)
 
-	// Register the _query parameter
-	search.GlobalRegistry().RegisterParameterInfo(QueryParamInfo)
+	// Register the _query parameter (the parameter info is registered along with each resource's named queries)
 	search.GlobalRegistry().RegisterParameterParser(QueryParamInfo.Type, QueryParamParser)
 	search.GlobalMongoRegistry().RegisterBSONBuilder(QueryParamInfo.Type, QueryBSONBuilder)
 }
@@ -29,7 +28,8 @@ type GroupParam struct {
 
 // GroupParamInfo represents the "groupId" parameter on patients.  This allows patients to be searched
 // by their membership to a group.  Their membership may be explicit (they are explicitly named as a
-// member of a group) or implicit (they match characteristics criteria of a group).
+// member of a group) or implicit (they match characteristics criteria of a group).  The value may be
+// a group id, a "Group/<id>" reference, or the absolute URL of a group on another FHIR server.
 var GroupParamInfo = search.SearchParamInfo{
 	Resource: "Patient",
 	Name:     "groupId",
@@ -43,7 +43,13 @@ var GroupParamParser = func(info search.SearchParamInfo, data search.SearchParam
 	}, nil
 }
 
-// GroupBSONBuilder builds the Mongo BSON object corresponding to the query for group membership.
+// maxGroupParamIDs is the most patients GroupBSONBuilder lists in a query, which keeps the query well below Mongo's
+// 16MB document limit
+const maxGroupParamIDs = 10 * resolutionBatchSize
+
+// GroupBSONBuilder builds the Mongo BSON object corresponding to the query for group membership.  Members that have to
+// be resolved (or read from the group's snapshot) are listed in the query, so they are limited to maxGroupParamIDs
+// patients.  Patient searches by groupId are usually handled by GroupSearchHandler instead, which has no such limit.
 var GroupBSONBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) (object bson.M, err error) {
 	// IDs are tokens, so treat the custom group param as a token param
 	gp, ok := param.(*GroupParam)
@@ -51,90 +57,122 @@ var GroupBSONBuilder = func(param search.SearchParam, searcher *search.MongoSear
 		return nil, errors.New("Expected a GroupParam")
 	}
 
-	// First get the group
-	var groupID string
-	if bson.IsObjectIdHex(gp.Code) {
-		groupID = bson.ObjectIdHex(gp.Code).Hex()
-	} else {
-		return nil, fmt.Errorf("Invalid BSON ID: %s", gp.Code)
+	r := newPatientSetResolver(searcher)
+	defer r.Close()
+	query, members, err := groupMembership(gp.Code, r)
+	if err != nil || query != nil {
+		return query, err
 	}
-	var group fhir.Group
-	if err := searcher.GetDB().C("groups").Find(bson.M{"_id": groupID}).One(&group); err != nil {
-		return nil, err
+
+	ids, err := setIDs(members, maxGroupParamIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Group %s can't be searched: %v", gp.Code, err)
+	}
+	return bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+	}, nil
+}
+
+// groupMembership finds the members of the group, which may be an id, a reference, or the URL of a group on another
+// FHIR server.  If the members can be matched by a patient query, the query is returned.  Otherwise, the members are
+// returned as a set, which is either resolved from the group's characteristics (and dropped when the resolver is
+// closed) or the group's fresh snapshot.
+func groupMembership(code string, r *patientSetResolver) (query bson.M, members *mgo.Collection, err error) {
+	// First get the group, which may be local or hosted by another FHIR server
+	ref, err := ParseGroupReference(code)
+	if err != nil {
+		return nil, nil, err
+	}
+	group, err := FindGroup(ref, r.db)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// If it's an "actual" group, then just look at the list of members (this is the case for huddles)
 	if group.Actual != nil && *group.Actual {
 		// Return a BSON object (for patient) indicating the ID can be any of those in the group
-		var ids []string
-		for _, m := range group.Member {
-			if m.Entity != nil && m.Entity.Type == "Patient" && m.Entity.ReferencedID != "" {
-				ids = append(ids, m.Entity.ReferencedID)
-			}
-		}
 		return bson.M{
 			"_id": bson.M{
-				"$in": ids,
+				"$in": groupMemberPatientIDs(group),
 			},
-		}, nil
+		}, nil, nil
+	}
+
+	// If the group's membership is materialized and the snapshot is fresh, use the snapshot.  Only local groups
+	// have snapshots.
+	if !ref.IsRemote() && IsMaterialized(group) {
+		snapshot, err := NewGroupMaterializer(r.db).FreshSnapshot(group.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if snapshot != nil {
+			return nil, SnapshotMembers(r.db, group.Id), nil
+		}
 	}
 
 	// It's not an "actual" group, so use the group characteristics instead
-	info, err := LoadCharacteristicInfo(group.Characteristic)
+	info, err := LoadGroupCharacteristicInfo(group, r.db)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// If the info is only patient characteristics, then this is a simple, normal patient search
-	if !info.HasConditionCharacteristics && !info.HasEncounterCharacteristics {
-		q := search.Query{Resource: "Patient", Query: info.PatientQueryValues.Encode()}
-		return searcher.CreateQueryObject(q), nil
-	}
-
-	// Otherwise, this cannot be expressed as a patient search without first resolving the patient IDs
-	ids, err := resolveGroup(info, searcher)
-	if err != nil {
-		return nil, err
+	if info.IsPatientSearch() {
+		return r.queryObject("Patient", info.PatientQueryValues), nil, nil
 	}
 
-	return bson.M{
-		"_id": bson.M{
-			"$in": ids,
-		},
-	}, nil
+	// Otherwise, this cannot be expressed as a patient search without first resolving the patients
+	members, err = r.resolve(info)
+	return nil, members, err
 }
 
-// QueryParam represents the _query parameter.  This exists only to provide backwards compatibility for the
-// frontend, which sends "_query=group".  Without this, the FHIR server would reject the _query parameter as
-// unsupported.  Since this is a string, we simply embed a StringParam. After fhir search is
-// fully refactored, we may be able to get rid of GroupParam and just return a StringParam from the parser.
+// QueryParam represents the _query parameter, which runs a named query registered in the
+// DefaultNamedQueryRegistry.  The String is the whole parameter value, while the Name and Args are parsed from it
+// (e.g., "recent-ed-visit;days=14" is the "recent-ed-visit" query with a days argument of 14).
 type QueryParam struct {
 	search.StringParam
+	Name string
+	Args map[string]string
 }
 
-// QueryParamInfo represents the info for the Patient._query parameter.
+// QueryParamInfo represents the info for the _query parameter.  It is registered for each resource that has named
+// queries.
 var QueryParamInfo = search.SearchParamInfo{
 	Resource: "Patient",
 	Name:     "_query",
-	Type:     "ie.noop",
+	Type:     "ie.query",
 }
 
 // QueryParamParser parses the parameter and returns a QueryParam
 var QueryParamParser = func(info search.SearchParamInfo, data search.SearchParamData) (search.SearchParam, error) {
+	sp := search.ParseStringParam(data.Value, info)
+	name, args, err := parseNamedQuery(sp.String)
+	if err != nil {
+		return nil, err
+	}
 	return &QueryParam{
-		StringParam: *search.ParseStringParam(data.Value, info),
+		StringParam: *sp,
+		Name:        name,
+		Args:        args,
 	}, nil
 }
 
-// QueryBSONBuilder returns an empty BSON object unless it detects an invalid query type
+// QueryBSONBuilder builds the BSON for the named query, returning an error if the query isn't registered for the
+// resource or its arguments are invalid
 var QueryBSONBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) (object bson.M, err error) {
-	// IDs are tokens, so treat the custom group param as a token param
 	qp, ok := param.(*QueryParam)
 	if !ok {
 		return nil, errors.New("Expected a QueryParam")
 	}
-	if qp.String != "group" {
-		return nil, fmt.Errorf("Unknown _query type: %s", qp.String)
+	q, ok := DefaultNamedQueryRegistry.Lookup(qp.Resource, qp.Name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown _query type: %s", qp.Name)
+	}
+	args, err := namedQueryArgs(q, qp.Args)
+	if err != nil {
+		return nil, err
 	}
-	return bson.M{}, nil
+	return q.BSON(args, searcher)
 }
@@ -83,6 +83,29 @@ func (suite *GroupParamSuite) TestGroupBSONBuilder() {
 	assert.Equal(expected, obtained)
 }
 
+func (suite *GroupParamSuite) TestGroupBSONBuilderWithStringID() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// An imported actual group with a non-ObjectId id
+	group := &fhir.Group{
+		DomainResource: fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Group", Id: "imported-cohort"}},
+		Actual:         boolPtr(true),
+		Member: []fhir.GroupMemberComponent{
+			{Entity: &fhir.Reference{Reference: "Patient/1", ReferencedID: "1", Type: "Patient"}},
+		},
+	}
+	require.NoError(suite.DB().C("groups").Insert(group))
+
+	for _, value := range []string{"imported-cohort", "Group/imported-cohort"} {
+		param, err := GroupParamParser(GroupParamInfo, search.SearchParamData{Value: value})
+		require.NoError(err)
+		obtained, err := GroupBSONBuilder(param, search.NewMongoSearcher(server.Database))
+		require.NoError(err)
+		assert.Equal(bson.M{"_id": bson.M{"$in": []string{"1"}}}, obtained)
+	}
+}
+
 func (suite *GroupParamSuite) TestQueryParamParser() {
 	require := suite.Require()
 	assert := suite.Assert()
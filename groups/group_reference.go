@@ -0,0 +1,171 @@
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+)
+
+// fhirIDPattern matches valid FHIR resource ids
+var fhirIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// GroupReference is a parsed reference to a group.  Local groups are stored in the groups collection and are
+// referenced by id (e.g., "123" or "Group/123").  Remote groups are hosted by another FHIR server and are referenced
+// by absolute URL (e.g., "https://fhir.example.com/Group/123").
+type GroupReference struct {
+	ID  string
+	URL string
+}
+
+// IsRemote indicates if the group is hosted by another FHIR server
+func (r GroupReference) IsRemote() bool {
+	return r.URL != ""
+}
+
+// ParseGroupReference parses a group id, relative Group reference, or absolute Group URL
+func ParseGroupReference(value string) (GroupReference, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		parts := strings.Split(strings.TrimRight(value, "/"), "/")
+		if len(parts) < 5 || parts[len(parts)-2] != "Group" || !fhirIDPattern.MatchString(parts[len(parts)-1]) {
+			return GroupReference{}, fmt.Errorf("Invalid Group URL: %s", value)
+		}
+		return GroupReference{ID: parts[len(parts)-1], URL: value}, nil
+	}
+
+	id := strings.TrimPrefix(value, "Group/")
+	if !fhirIDPattern.MatchString(id) {
+		return GroupReference{}, fmt.Errorf("Invalid Group id: %s", value)
+	}
+	return GroupReference{ID: id}, nil
+}
+
+// RemoteGroupResolver fetches groups hosted by other FHIR servers
+type RemoteGroupResolver interface {
+	ResolveGroup(url string) (*fhir.Group, error)
+}
+
+// DefaultRemoteGroupResolver resolves remote group references.  If it is nil, remote group references are rejected.
+var DefaultRemoteGroupResolver RemoteGroupResolver
+
+// FindGroup finds the referenced group, loading local groups from the database and remote groups using the
+// DefaultRemoteGroupResolver.  If a local group doesn't exist, mgo.ErrNotFound is returned.
+func FindGroup(ref GroupReference, db *mgo.Database) (*fhir.Group, error) {
+	if ref.IsRemote() {
+		if DefaultRemoteGroupResolver == nil {
+			return nil, fmt.Errorf("Remote Group references are not supported: %s", ref.URL)
+		}
+		return DefaultRemoteGroupResolver.ResolveGroup(ref.URL)
+	}
+
+	group := new(fhir.Group)
+	if err := db.C("groups").FindId(ref.ID).One(group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// HTTPRemoteGroupResolver fetches remote groups over HTTP from a list of trusted FHIR servers
+type HTTPRemoteGroupResolver struct {
+	Client   *http.Client
+	BaseURLs []string
+}
+
+// NewHTTPRemoteGroupResolver creates a resolver that only fetches groups from the FHIR servers at the base URLs
+func NewHTTPRemoteGroupResolver(baseURLs []string) *HTTPRemoteGroupResolver {
+	r := &HTTPRemoteGroupResolver{Client: &http.Client{Timeout: 30 * time.Second}}
+	for _, base := range baseURLs {
+		if base = strings.TrimRight(strings.TrimSpace(base), "/"); base != "" {
+			r.BaseURLs = append(r.BaseURLs, base)
+		}
+	}
+	return r
+}
+
+// ResolveGroup fetches the group, returning an error if it isn't hosted by one of the trusted FHIR servers
+func (r *HTTPRemoteGroupResolver) ResolveGroup(url string) (*fhir.Group, error) {
+	url, ok := r.trustedURL(url)
+	if !ok {
+		return nil, fmt.Errorf("Remote Group is not hosted by a trusted FHIR server: %s", url)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/fhir+json, application/json")
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching remote Group %s failed: %s", url, resp.Status)
+	}
+
+	group := new(fhir.Group)
+	if err := json.NewDecoder(resp.Body).Decode(group); err != nil {
+		return nil, err
+	}
+	if group.ResourceType != "" && group.ResourceType != "Group" {
+		return nil, fmt.Errorf("Remote reference %s is a %s, not a Group", url, group.ResourceType)
+	}
+	return group, nil
+}
+
+// trustedURL returns the URL with its path cleaned (so it can't use ".." to leave a base URL's path), and whether it
+// has the same scheme and host as one of the trusted base URLs and is under its path
+func (r *HTTPRemoteGroupResolver) trustedURL(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User != nil {
+		return rawURL, false
+	}
+	u.Path = path.Clean("/" + u.Path)
+	u.RawPath = ""
+	for _, rawBase := range r.BaseURLs {
+		base, err := url.Parse(rawBase)
+		if err != nil {
+			continue
+		}
+		basePath := strings.TrimRight(path.Clean("/"+base.Path), "/")
+		if strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host) &&
+			strings.HasPrefix(u.Path, basePath+"/") {
+			return u.String(), true
+		}
+	}
+	return rawURL, false
+}
+
+// groupMemberPatientIDs returns the ids of the patients that are members of an actual group.  Members of remote
+// groups aren't processed by this server, so their ids are taken from their references, matching the local patients
+// imported with the same ids.
+func groupMemberPatientIDs(group *fhir.Group) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, m := range group.Member {
+		if m.Entity == nil {
+			continue
+		}
+		id := m.Entity.ReferencedID
+		if id == "" || m.Entity.Type != "Patient" {
+			id = ""
+			parts := strings.Split(m.Entity.Reference, "/")
+			if len(parts) >= 2 && parts[len(parts)-2] == "Patient" {
+				id = parts[len(parts)-1]
+			}
+		}
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,122 @@
+package groups
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestGroupReferenceSuite(t *testing.T) {
+	suite.Run(t, new(GroupReferenceSuite))
+}
+
+type GroupReferenceSuite struct {
+	suite.Suite
+}
+
+func (suite *GroupReferenceSuite) TestParseGroupReference() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	for _, value := range []string{"5813ba9e1b9a2b5b5e5f4e6a", "ext-cohort.1", "Group/ext-cohort.1"} {
+		ref, err := ParseGroupReference(value)
+		require.NoError(err, value)
+		assert.False(ref.IsRemote(), value)
+	}
+	ref, _ := ParseGroupReference("Group/ext-cohort.1")
+	assert.Equal("ext-cohort.1", ref.ID)
+
+	ref, err := ParseGroupReference("https://fhir.example.com/baseDstu2/Group/cohort-1")
+	require.NoError(err)
+	assert.True(ref.IsRemote())
+	assert.Equal("cohort-1", ref.ID)
+	assert.Equal("https://fhir.example.com/baseDstu2/Group/cohort-1", ref.URL)
+
+	for _, value := range []string{"", "Patient/1", "bad id", "https://fhir.example.com/Patient/1", "ftp://fhir.example.com/Group/1"} {
+		_, err := ParseGroupReference(value)
+		assert.Error(err, value)
+	}
+}
+
+func (suite *GroupReferenceSuite) TestFindRemoteGroupWithoutResolver() {
+	_, err := FindGroup(GroupReference{ID: "1", URL: "https://fhir.example.com/Group/1"}, nil)
+	suite.Assert().Error(err)
+}
+
+func (suite *GroupReferenceSuite) TestHTTPRemoteGroupResolver() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fhir/Group/cohort-1":
+			w.Write([]byte(`{"resourceType": "Group", "id": "cohort-1", "name": "Remote Cohort", "actual": true}`))
+		case "/fhir/Group/patient":
+			w.Write([]byte(`{"resourceType": "Patient", "id": "patient"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	r := NewHTTPRemoteGroupResolver([]string{" " + ts.URL + "/fhir/ ", ""})
+	assert.Equal([]string{ts.URL + "/fhir"}, r.BaseURLs)
+
+	group, err := r.ResolveGroup(ts.URL + "/fhir/Group/cohort-1")
+	require.NoError(err)
+	assert.Equal("Remote Cohort", group.Name)
+
+	_, err = r.ResolveGroup(ts.URL + "/fhir/Group/missing")
+	assert.Error(err)
+	_, err = r.ResolveGroup(ts.URL + "/fhir/Group/patient")
+	assert.Error(err)
+
+	// Groups are only fetched from trusted servers
+	_, err = r.ResolveGroup(ts.URL + "/fhirx/Group/cohort-1")
+	assert.Error(err)
+}
+
+func (suite *GroupReferenceSuite) TestTrustedURL() {
+	assert := suite.Assert()
+
+	r := NewHTTPRemoteGroupResolver([]string{"https://trusted/fhir"})
+	trusted, ok := r.trustedURL("https://trusted/fhir/Group/1")
+	assert.True(ok)
+	assert.Equal("https://trusted/fhir/Group/1", trusted)
+	trusted, ok = r.trustedURL("https://TRUSTED/fhir/./Group/1")
+	assert.True(ok)
+	assert.Equal("https://TRUSTED/fhir/Group/1", trusted)
+
+	for _, value := range []string{
+		"https://trusted/fhir/../admin/Group/1",
+		"https://trusted/fhir/%2e%2e/admin/Group/1",
+		"https://trusted/fhirx/Group/1",
+		"https://trusted/fhir",
+		"http://trusted/fhir/Group/1",
+		"https://trusted.evil/fhir/Group/1",
+		"https://trusted:8443/fhir/Group/1",
+		"https://trusted@evil/fhir/Group/1",
+		"https://user@trusted/fhir/Group/1",
+	} {
+		_, ok := r.trustedURL(value)
+		assert.False(ok, value)
+	}
+}
+
+func (suite *GroupReferenceSuite) TestGroupMemberPatientIDs() {
+	group := &fhir.Group{
+		Member: []fhir.GroupMemberComponent{
+			{Entity: &fhir.Reference{Reference: "Patient/1", ReferencedID: "1", Type: "Patient"}},
+			{Entity: &fhir.Reference{Reference: "https://fhir.example.com/Patient/2"}},
+			{Entity: &fhir.Reference{Reference: "Patient/1"}},
+			{Entity: &fhir.Reference{Reference: "Practitioner/3", ReferencedID: "3", Type: "Practitioner"}},
+			{},
+		},
+	}
+	suite.Assert().Equal([]string{"1", "2"}, groupMemberPatientIDs(group))
+}
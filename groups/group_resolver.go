@@ -1,189 +1,543 @@
 package groups
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
 	fhir "github.com/intervention-engine/fhir/models"
-	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-func resolveGroup(cInfo *CharacteristicInfo, searcher *search.MongoSearcher) (pids []string, err error) {
-	cMap := make(map[string]bool)
-	eMap := make(map[string]bool)
+// resolve finds the set of patients matching the info.  The patients must match all of the info's own
+// characteristics, all of its AllOf criteria, at least one criteria in each of its AnyOf groups, and none of its
+// NoneOf criteria.
+func (r *patientSetResolver) resolve(cInfo *CharacteristicInfo) (*mgo.Collection, error) {
+	sets, err := r.characteristicSets(cInfo)
+	if err != nil {
+		return nil, err
+	}
 
-	type patientContainer struct {
-		ID string `bson:"referenceid"`
+	for _, nested := range cInfo.AllOf {
+		set, err := r.resolve(nested)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
 	}
 
-	// We only need to query for conditions if the group contains a condition criteria
-	// NOTE: We can't prefilter unconfirmed conditions (FHIR doesn't have a search parameter for
-	// verificationStatus) and our API doesn't let us insert non-FHIR criteria, so we must
-	// post-process the results to filter them out.
-	if cInfo.HasConditionCharacteristics {
-		var cResults []struct {
-			Patient patientContainer `bson:"patient"`
-			Status  string           `bson:"verificationStatus"`
+	for _, anyOf := range cInfo.AnyOf {
+		members := make([]*mgo.Collection, len(anyOf))
+		for i, nested := range anyOf {
+			if members[i], err = r.resolve(nested); err != nil {
+				return nil, err
+			}
+		}
+		union, err := r.union(members)
+		if err != nil {
+			return nil, err
 		}
-		cSearchQuery := search.Query{Resource: "Condition", Query: cInfo.ConditionQueryValues.Encode()}
-		cQ := searcher.CreateQueryWithoutOptions(cSearchQuery)
+		sets = append(sets, union)
+	}
 
-		if err := cQ.Select(bson.M{"patient.referenceid": 1, "verificationStatus": 1}).All(&cResults); err != nil {
+	// If there's nothing to narrow down the patients (e.g., the group only has exclusions), start with everyone
+	if len(sets) == 0 {
+		all, err := r.patientSearchSet(url.Values{})
+		if err != nil {
 			return nil, err
 		}
-		for i := range cResults {
-			if cResults[i].Status == "confirmed" {
-				cMap[cResults[i].Patient.ID] = true
+		sets = append(sets, all)
+	}
+
+	result, err := r.intersect(sets)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cInfo.NoneOf) > 0 {
+		excluded := make([]*mgo.Collection, len(cInfo.NoneOf))
+		for i, nested := range cInfo.NoneOf {
+			if excluded[i], err = r.resolve(nested); err != nil {
+				return nil, err
 			}
 		}
+		if result, err = r.subtract(result, excluded); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// characteristicSets resolves each kind of characteristic in the info (not including nested criteria) to a set of
+// matching patients
+func (r *patientSetResolver) characteristicSets(cInfo *CharacteristicInfo) ([]*mgo.Collection, error) {
+	var sets []*mgo.Collection
+	add := func(set *mgo.Collection, err error) error {
+		if err == nil {
+			sets = append(sets, set)
+		}
+		return err
+	}
+
+	if cInfo.HasPatientCharacteristics {
+		if err := add(r.patientSearchSet(cInfo.PatientQueryValues)); err != nil {
+			return nil, err
+		}
+	}
+
+	// NOTE: FHIR doesn't have a search parameter for verificationStatus, so unconfirmed conditions are filtered out
+	// by adding non-FHIR criteria to the query.
+	if cInfo.HasConditionCharacteristics {
+		query := r.queryObject("Condition", cInfo.windowedQueryValues(cInfo.ConditionQueryValues, "onset"))
+		query["verificationStatus"] = "confirmed"
+		if err := add(r.recordSet("Condition", query, "patient", cInfo.minOccurrences())); err != nil {
+			return nil, err
+		}
 	}
 
-	// We only need to query for encounters if the group contains an encounter criteria
 	if cInfo.HasEncounterCharacteristics {
-		var eResults []struct {
-			Patient patientContainer `bson:"patient"`
+		query := r.queryObject("Encounter", cInfo.windowedQueryValues(cInfo.EncounterQueryValues, "date"))
+		if err := add(r.recordSet("Encounter", query, "patient", cInfo.minOccurrences())); err != nil {
+			return nil, err
 		}
-		eSearchQuery := search.Query{Resource: "Encounter", Query: cInfo.EncounterQueryValues.Encode()}
-		eQ := searcher.CreateQueryWithoutOptions(eSearchQuery)
-		if err := eQ.Select(bson.M{"patient.referenceid": 1}).All(&eResults); err != nil {
+	}
+
+	// Each medication and procedure characteristic is resolved separately, since repeated code parameters would all
+	// have to match a single record
+	for _, values := range cInfo.MedicationQueryValues {
+		query := r.queryObject("MedicationStatement", cInfo.windowedQueryValues(values, "effectivedate"))
+		if err := add(r.recordSet("MedicationStatement", query, "patient", cInfo.minOccurrences())); err != nil {
 			return nil, err
 		}
-		for i := range eResults {
-			eMap[eResults[i].Patient.ID] = true
+	}
+
+	// NOTE: FHIR doesn't have a search parameter for a procedure's status, so only completed procedures are matched by
+	// adding non-FHIR criteria to the query.
+	for _, values := range cInfo.ProcedureQueryValues {
+		query := r.queryObject("Procedure", cInfo.windowedQueryValues(values, "date"))
+		query["status"] = "completed"
+		if err := add(r.recordSet("Procedure", query, "subject", cInfo.minOccurrences())); err != nil {
+			return nil, err
 		}
 	}
 
-	// Now figure out the patient list, which can come in one of four ways:
-	// (1) Group has condition AND encounter characteristics (+ optional demographics) --> patients who have matching conditions AND encounters
-	// (2) Group has only condition characteristics (+ optional demographics) --> patients who have matching conditions
-	// (3) Group has only encounter characteristics (+ optional demographics) --> patients who have matching encounters
-	// (4) Group has only demographics --> patients who match demographics
-	if cInfo.HasConditionCharacteristics && cInfo.HasEncounterCharacteristics {
-		// Only count patients with matching conditions and encounters
-		for pid := range cMap {
-			if _, ok := eMap[pid]; ok {
-				pids = append(pids, pid)
-			}
+	for i := range cInfo.ObservationCharacteristics {
+		if err := add(r.observationSet(&cInfo.ObservationCharacteristics[i], cInfo)); err != nil {
+			return nil, err
 		}
-	} else if cInfo.HasConditionCharacteristics {
-		// Only count patients with matching conditions
-		pids = make([]string, 0, len(cMap))
-		for pid := range cMap {
-			pids = append(pids, pid)
-		}
-	} else if cInfo.HasEncounterCharacteristics {
-		// Only count patients with matching encounters
-		pids = make([]string, 0, len(eMap))
-		for pid := range eMap {
-			pids = append(pids, pid)
-		}
-	} else {
-		// Only count patients with matching demographics
-		var resultIDs []struct {
-			ID string `bson:"_id"`
-		}
-		q := searcher.CreateQueryWithoutOptions(search.Query{Resource: "Patient", Query: cInfo.PatientQueryValues.Encode()})
-		if err := q.Select(bson.M{"_id": 1}).All(&resultIDs); err != nil {
+	}
+
+	for i := range cInfo.RiskAssessmentCharacteristics {
+		if err := add(r.riskAssessmentSet(&cInfo.RiskAssessmentCharacteristics[i], cInfo)); err != nil {
 			return nil, err
 		}
-		pids = make([]string, len(resultIDs))
-		for i := range resultIDs {
-			pids[i] = resultIDs[i].ID
+	}
+
+	return sets, nil
+}
+
+// windowedQueryValues returns a copy of the query values limited to the info's time window using the date parameter
+func (c *CharacteristicInfo) windowedQueryValues(values url.Values, dateParam string) url.Values {
+	windowed := make(url.Values)
+	for k, v := range values {
+		windowed[k] = append([]string(nil), v...)
+	}
+	if c.Window != nil {
+		for _, v := range c.Window.dateQueryValues() {
+			windowed.Add(dateParam, v)
 		}
 	}
+	return windowed
+}
 
-	return pids, nil
+// minOccurrences returns the number of matching records a patient needs, according to the info's time window
+func (c *CharacteristicInfo) minOccurrences() int {
+	if c.Window != nil && c.Window.MinOccurrences > 1 {
+		return c.Window.MinOccurrences
+	}
+	return 1
 }
 
-func resolveGroupCounts(cInfo *CharacteristicInfo, searcher *search.MongoSearcher) (patients, conditions, encounters int, err error) {
-	pids, err := resolveGroup(cInfo, searcher)
-	if err != nil {
-		return 0, 0, 0, err
+// observationSet finds the patients whose most recent final observation with the characteristic's code has a value
+// within the characteristic's threshold
+func (r *patientSetResolver) observationSet(oc *ThresholdCharacteristic, cInfo *CharacteristicInfo) (*mgo.Collection, error) {
+	values := make(url.Values)
+	values.Add("code", codeableConceptQueryValues(oc.Code))
+	values.Add("status", "final,amended")
+	values = cInfo.windowedQueryValues(values, "date")
+
+	// Only the most recent observation counts, so find it for each patient before checking the threshold
+	pipeline := []bson.M{
+		{"$match": r.queryObject("Observation", values)},
+		{"$sort": bson.M{"effectiveDateTime.time": -1}},
+		{"$group": bson.M{
+			"_id":   "$subject.referenceid",
+			"value": bson.M{"$first": "$valueQuantity.value"},
+		}},
+	}
+	if vq := oc.valueQuery(); vq != nil {
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"value": vq}})
 	}
-	patients = len(pids)
+	pipeline = append(pipeline, bson.M{"$project": bson.M{"_id": 1}})
+	return r.aggregate("observations", pipeline)
+}
+
+// riskAssessmentSet finds the patients whose most recent risk assessment using the characteristic's method has a
+// score within the characteristic's threshold
+func (r *patientSetResolver) riskAssessmentSet(rc *ThresholdCharacteristic, cInfo *CharacteristicInfo) (*mgo.Collection, error) {
+	// NOTE: prediction.probabilityDecimal is not a search parameter, so the scores are matched in the pipeline
+	values := make(url.Values)
+	values.Add("method", codeableConceptQueryValues(rc.Code))
+	values.Add("_tag", "http://interventionengine.org/tags/|MOST_RECENT")
+	values = cInfo.windowedQueryValues(values, "date")
 
-	cQuery := bson.M{
-		"verificationStatus": "confirmed",
-		"patient.referenceid": bson.M{
-			"$in": pids,
-		},
+	pipeline := []bson.M{
+		{"$match": r.queryObject("RiskAssessment", values)},
+		{"$project": bson.M{
+			"subject": 1,
+			"score":   bson.M{"$arrayElemAt": []interface{}{"$prediction.probabilityDecimal", 0}},
+		}},
+		{"$match": bson.M{"score": rc.scoreQuery()}},
+		{"$group": bson.M{"_id": "$subject.referenceid"}},
 	}
-	conditions, err = searcher.GetDB().C("conditions").Find(cQuery).Count()
+	return r.aggregate("riskassessments", pipeline)
+}
+
+// resolveGroupCounts counts the confirmed conditions and the encounters of the patients in the set
+func resolveGroupCounts(set *mgo.Collection, db *mgo.Database) (conditions, encounters int, err error) {
+	err = eachBatch(set, func(pids []string) error {
+		cQuery := bson.M{
+			"verificationStatus": "confirmed",
+			"patient.referenceid": bson.M{
+				"$in": pids,
+			},
+		}
+		n, err := db.C("conditions").Find(cQuery).Count()
+		if err != nil {
+			return err
+		}
+		conditions += n
+
+		eQuery := bson.M{
+			"patient.referenceid": bson.M{
+				"$in": pids,
+			},
+		}
+		n, err = db.C("encounters").Find(eQuery).Count()
+		if err != nil {
+			return err
+		}
+		encounters += n
+		return nil
+	})
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, err
 	}
+	return conditions, encounters, nil
+}
 
-	eQuery := bson.M{
-		"patient.referenceid": bson.M{
-			"$in": pids,
-		},
+// CharacteristicInfo contains the FHIR search query values corresponding to a group's characteristics.  Observation
+// and risk assessment characteristics can't be expressed as search query values (only the most recent value counts),
+// so they are kept as ThresholdCharacteristics instead.  Each medication and procedure characteristic has its own
+// query values, since they must be matched by separate records.
+//
+// Characteristics that can't simply be ANDed together are kept as nested criteria: patients must also match all of
+// the AllOf criteria, at least one of the criteria in each AnyOf group, and none of the NoneOf criteria.  If the info
+// has a Window, its clinical characteristics only match records within the window.
+type CharacteristicInfo struct {
+	PatientQueryValues            url.Values
+	HasPatientCharacteristics     bool
+	ConditionQueryValues          url.Values
+	HasConditionCharacteristics   bool
+	EncounterQueryValues          url.Values
+	HasEncounterCharacteristics   bool
+	MedicationQueryValues         []url.Values
+	HasMedicationCharacteristics  bool
+	ProcedureQueryValues          []url.Values
+	HasProcedureCharacteristics   bool
+	ObservationCharacteristics    []ThresholdCharacteristic
+	RiskAssessmentCharacteristics []ThresholdCharacteristic
+	AllOf                         []*CharacteristicInfo
+	AnyOf                         [][]*CharacteristicInfo
+	NoneOf                        []*CharacteristicInfo
+	Window                        *TimeWindow
+}
+
+// HasClinicalCharacteristics indicates if the info has any characteristics other than demographics (not including
+// nested criteria)
+func (c *CharacteristicInfo) HasClinicalCharacteristics() bool {
+	return c.HasConditionCharacteristics || c.HasEncounterCharacteristics || c.HasMedicationCharacteristics ||
+		c.HasProcedureCharacteristics || len(c.ObservationCharacteristics) > 0 || len(c.RiskAssessmentCharacteristics) > 0
+}
+
+// IsPatientSearch indicates if the info can be expressed as a simple patient search, i.e., it only has demographics
+func (c *CharacteristicInfo) IsPatientSearch() bool {
+	return !c.HasClinicalCharacteristics() && len(c.AllOf) == 0 && len(c.AnyOf) == 0 && len(c.NoneOf) == 0
+}
+
+// ResourceTypes returns the types of resources searched for the info's characteristics (including nested criteria),
+// sorted.  Only changes to those resources can affect which patients match the info.
+func (c *CharacteristicInfo) ResourceTypes() []string {
+	found := make(map[string]bool)
+	c.addResourceTypes(found)
+	types := make([]string, 0, len(found))
+	for t := range found {
+		types = append(types, t)
 	}
-	encounters, err = searcher.GetDB().C("encounters").Find(eQuery).Count()
-	if err != nil {
-		return 0, 0, 0, err
+	sort.Strings(types)
+	return types
+}
+
+func (c *CharacteristicInfo) addResourceTypes(found map[string]bool) {
+	// Criteria with nothing to narrow down the patients start with every patient (see resolve)
+	if c.HasPatientCharacteristics || (!c.HasClinicalCharacteristics() && len(c.AllOf) == 0 && len(c.AnyOf) == 0) {
+		found["Patient"] = true
+	}
+	if c.HasConditionCharacteristics {
+		found["Condition"] = true
+	}
+	if c.HasEncounterCharacteristics {
+		found["Encounter"] = true
+	}
+	if c.HasMedicationCharacteristics {
+		found["MedicationStatement"] = true
+	}
+	if c.HasProcedureCharacteristics {
+		found["Procedure"] = true
+	}
+	if len(c.ObservationCharacteristics) > 0 {
+		found["Observation"] = true
+	}
+	if len(c.RiskAssessmentCharacteristics) > 0 {
+		found["RiskAssessment"] = true
+	}
+	for _, nested := range c.AllOf {
+		nested.addResourceTypes(found)
+	}
+	for _, anyOf := range c.AnyOf {
+		for _, nested := range anyOf {
+			nested.addResourceTypes(found)
+		}
+	}
+	for _, nested := range c.NoneOf {
+		nested.addResourceTypes(found)
 	}
+}
 
-	return patients, conditions, encounters, nil
+// ThresholdCharacteristic matches patients whose most recent value for Code falls within the threshold.  Low and High
+// are inclusive unless LowExclusive or HighExclusive are set.  If both Low and High are nil, any value matches.
+type ThresholdCharacteristic struct {
+	Code          *fhir.CodeableConcept
+	Low           *float64
+	LowExclusive  bool
+	High          *float64
+	HighExclusive bool
 }
 
-type CharacteristicInfo struct {
-	PatientQueryValues          url.Values
-	HasPatientCharacteristics   bool
-	ConditionQueryValues        url.Values
-	HasConditionCharacteristics bool
-	EncounterQueryValues        url.Values
-	HasEncounterCharacteristics bool
+// HasThreshold indicates if the characteristic has a low or high value
+func (t *ThresholdCharacteristic) HasThreshold() bool {
+	return t.Low != nil || t.High != nil
+}
+
+// Matches indicates if the value falls within the threshold
+func (t *ThresholdCharacteristic) Matches(value float64) bool {
+	if t.Low != nil && (value < *t.Low || (t.LowExclusive && value == *t.Low)) {
+		return false
+	}
+	if t.High != nil && (value > *t.High || (t.HighExclusive && value == *t.High)) {
+		return false
+	}
+	return true
+}
+
+// valueQuery returns the Mongo query matching values within the threshold, or nil if any value matches
+func (t *ThresholdCharacteristic) valueQuery() bson.M {
+	if !t.HasThreshold() {
+		return nil
+	}
+	return t.scoreQuery()
+}
+
+// scoreQuery returns the Mongo query matching numbers within the threshold.  Without a threshold, it matches any
+// number.
+func (t *ThresholdCharacteristic) scoreQuery() bson.M {
+	q := bson.M{"$type": "number"}
+	if t.Low != nil {
+		if t.LowExclusive {
+			q["$gt"] = *t.Low
+		} else {
+			q["$gte"] = *t.Low
+		}
+	}
+	if t.High != nil {
+		if t.HighExclusive {
+			q["$lt"] = *t.High
+		} else {
+			q["$lte"] = *t.High
+		}
+	}
+	return q
 }
 
+// newThresholdCharacteristic creates a ThresholdCharacteristic from the characteristic's valueRange or valueQuantity.
+// A valueQuantity's comparator (<, <=, >=, or >) determines which side of the threshold it is on; without a comparator
+// only that exact value matches.
+func newThresholdCharacteristic(code *fhir.CodeableConcept, characteristic fhir.GroupCharacteristicComponent) (ThresholdCharacteristic, error) {
+	t := ThresholdCharacteristic{Code: code}
+	switch {
+	case characteristic.ValueRange != nil:
+		if characteristic.ValueRange.Low != nil {
+			t.Low = characteristic.ValueRange.Low.Value
+		}
+		if characteristic.ValueRange.High != nil {
+			t.High = characteristic.ValueRange.High.Value
+		}
+	case characteristic.ValueQuantity != nil && characteristic.ValueQuantity.Value != nil:
+		value := characteristic.ValueQuantity.Value
+		switch characteristic.ValueQuantity.Comparator {
+		case "<":
+			t.High, t.HighExclusive = value, true
+		case "<=":
+			t.High = value
+		case ">=":
+			t.Low = value
+		case ">":
+			t.Low, t.LowExclusive = value, true
+		case "":
+			t.Low, t.High = value, value
+		default:
+			return t, fmt.Errorf("Unknown comparator: %s", characteristic.ValueQuantity.Comparator)
+		}
+	default:
+		return t, fmt.Errorf("Characteristic %v requires a valueRange or valueQuantity", characteristic.Code)
+	}
+	return t, nil
+}
+
+// LoadCharacteristicInfo converts the group's characteristics to CharacteristicInfo.  Characteristics are ANDed
+// together unless they are excluded or in an OR group (see LoadGroupCharacteristicInfo).  Characteristics that refer
+// to other groups are not supported; use LoadGroupCharacteristicInfo instead.
 func LoadCharacteristicInfo(characteristics []fhir.GroupCharacteristicComponent) (*CharacteristicInfo, error) {
+	return (&groupLoader{}).load(characteristics)
+}
+
+func newCharacteristicInfo() *CharacteristicInfo {
 	c := new(CharacteristicInfo)
 	c.PatientQueryValues = make(url.Values)
 	c.ConditionQueryValues = make(url.Values)
 	c.EncounterQueryValues = make(url.Values)
+	return c
+}
 
-	for _, characteristic := range characteristics {
-		switch {
-		// Age
-		case characteristic.Code.MatchesCode("http://loinc.org", "21612-7"):
-			lowBD := time.Now().AddDate(-1*int(*characteristic.ValueRange.High.Value)-1, 0, 0)
-			lowBDExp := "gt" + lowBD.Format("2006-01-02")
-			highBD := time.Now().AddDate(-1*int(*characteristic.ValueRange.Low.Value), 0, 0)
-			highBDExp := "lte" + highBD.Format("2006-01-02")
-			c.PatientQueryValues.Add("birthdate", lowBDExp)
-			c.PatientQueryValues.Add("birthdate", highBDExp)
-			c.HasPatientCharacteristics = true
-			c.ConditionQueryValues.Add("patient.birthdate", lowBDExp)
-			c.ConditionQueryValues.Add("patient.birthdate", highBDExp)
-			c.EncounterQueryValues.Add("patient.birthdate", lowBDExp)
-			c.EncounterQueryValues.Add("patient.birthdate", highBDExp)
-
-		// Gender
-		case characteristic.Code.MatchesCode("http://loinc.org", "21840-4"):
-			gender := characteristic.ValueCodeableConcept.Coding[0].Code
-			c.PatientQueryValues.Add("gender", gender)
-			c.HasPatientCharacteristics = true
-			c.ConditionQueryValues.Add("patient.gender", gender)
-			c.EncounterQueryValues.Add("patient.gender", gender)
-
-		// Condition
-		case characteristic.Code.MatchesCode("http://loinc.org", "11450-4"):
-			c.ConditionQueryValues.Add("code", codeableConceptQueryValues(characteristic.ValueCodeableConcept))
-			c.HasConditionCharacteristics = true
-
-		// Encounter
-		case characteristic.Code.MatchesCode("http://loinc.org", "46240-8"):
-			c.EncounterQueryValues.Add("type", codeableConceptQueryValues(characteristic.ValueCodeableConcept))
-			c.HasEncounterCharacteristics = true
-
-		// Unknown
-		default:
-			return nil, fmt.Errorf("Unknown characteristic: %v", characteristic.Code)
+// addCharacteristic adds the characteristic, ANDing it with the info's other characteristics.  Supported
+// characteristics are:
+//   - Age (LOINC 21612-7) with a valueRange
+//   - Gender (LOINC 21840-4) with a valueCodeableConcept
+//   - Condition (LOINC 11450-4) with a valueCodeableConcept of condition codes
+//   - Encounter (LOINC 46240-8) with a valueCodeableConcept of encounter types
+//   - Medication (LOINC 10160-0) with a valueCodeableConcept of medication codes, matching active medications
+//   - Procedure (LOINC 47519-4) with a valueCodeableConcept of procedure codes, matching completed procedures
+//   - Observation (LOINC 30954-2) with a valueCodeableConcept of observation codes, matching any observation
+//   - Risk assessments (code from the http://interventionengine.org/risk-assessments system) with a valueRange or
+//     valueQuantity, matching the most recent score
+//   - Any other code with a valueRange or valueQuantity, matching the most recent observation with that code
+func (c *CharacteristicInfo) addCharacteristic(characteristic fhir.GroupCharacteristicComponent) error {
+	if characteristic.Code == nil {
+		return errors.New("Characteristic is missing a code")
+	}
+	switch {
+	// Age
+	case characteristic.Code.MatchesCode("http://loinc.org", "21612-7"):
+		lowBD := time.Now().AddDate(-1*int(*characteristic.ValueRange.High.Value)-1, 0, 0)
+		lowBDExp := "gt" + lowBD.Format("2006-01-02")
+		highBD := time.Now().AddDate(-1*int(*characteristic.ValueRange.Low.Value), 0, 0)
+		highBDExp := "lte" + highBD.Format("2006-01-02")
+		c.addPatientQueryValue("birthdate", lowBDExp)
+		c.addPatientQueryValue("birthdate", highBDExp)
+
+	// Gender
+	case characteristic.Code.MatchesCode("http://loinc.org", "21840-4"):
+		gender := characteristic.ValueCodeableConcept.Coding[0].Code
+		c.addPatientQueryValue("gender", gender)
+
+	// Condition
+	case characteristic.Code.MatchesCode("http://loinc.org", "11450-4"):
+		c.ConditionQueryValues.Add("code", codeableConceptQueryValues(characteristic.ValueCodeableConcept))
+		c.HasConditionCharacteristics = true
+
+	// Encounter
+	case characteristic.Code.MatchesCode("http://loinc.org", "46240-8"):
+		c.EncounterQueryValues.Add("type", codeableConceptQueryValues(characteristic.ValueCodeableConcept))
+		c.HasEncounterCharacteristics = true
+
+	// Medication
+	case characteristic.Code.MatchesCode("http://loinc.org", "10160-0"):
+		if characteristic.ValueCodeableConcept == nil {
+			return fmt.Errorf("Characteristic %v requires a valueCodeableConcept", characteristic.Code)
+		}
+		values := url.Values{"status": {"active"}, "code": {codeableConceptQueryValues(characteristic.ValueCodeableConcept)}}
+		c.MedicationQueryValues = append(c.MedicationQueryValues, values)
+		c.HasMedicationCharacteristics = true
+
+	// Procedure
+	case characteristic.Code.MatchesCode("http://loinc.org", "47519-4"):
+		if characteristic.ValueCodeableConcept == nil {
+			return fmt.Errorf("Characteristic %v requires a valueCodeableConcept", characteristic.Code)
+		}
+		values := url.Values{"code": {codeableConceptQueryValues(characteristic.ValueCodeableConcept)}}
+		c.ProcedureQueryValues = append(c.ProcedureQueryValues, values)
+		c.HasProcedureCharacteristics = true
+
+	// Observation (any value)
+	case characteristic.Code.MatchesCode("http://loinc.org", "30954-2"):
+		if characteristic.ValueCodeableConcept == nil {
+			return fmt.Errorf("Characteristic %v requires a valueCodeableConcept", characteristic.Code)
+		}
+		c.ObservationCharacteristics = append(c.ObservationCharacteristics, ThresholdCharacteristic{Code: characteristic.ValueCodeableConcept})
+
+	// Risk assessment score
+	case hasCodingFromSystem(characteristic.Code, "http://interventionengine.org/risk-assessments"):
+		t, err := newThresholdCharacteristic(characteristic.Code, characteristic)
+		if err != nil {
+			return err
+		}
+		c.RiskAssessmentCharacteristics = append(c.RiskAssessmentCharacteristics, t)
+
+	// Observation value
+	case characteristic.ValueRange != nil || characteristic.ValueQuantity != nil:
+		t, err := newThresholdCharacteristic(characteristic.Code, characteristic)
+		if err != nil {
+			return err
+		}
+		c.ObservationCharacteristics = append(c.ObservationCharacteristics, t)
+
+	// Unknown
+	default:
+		return fmt.Errorf("Unknown characteristic: %v", characteristic.Code)
+	}
+	return nil
+}
+
+// addPatientQueryValue adds the patient query value.  Patient characteristics aren't chained into the other
+// resources' queries, since chained searches load every matching patient ID into the query; the patients are
+// intersected with the other characteristics' patients instead.
+func (c *CharacteristicInfo) addPatientQueryValue(key, value string) {
+	c.PatientQueryValues.Add(key, value)
+	c.HasPatientCharacteristics = true
+}
+
+func hasCodingFromSystem(cc *fhir.CodeableConcept, system string) bool {
+	for i := range cc.Coding {
+		if cc.Coding[i].System == system {
+			return true
 		}
 	}
-	return c, nil
+	return false
 }
 
 func codeableConceptQueryValues(cc *fhir.CodeableConcept) string {
@@ -0,0 +1,184 @@
+package groups
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+// The group resolution benchmarks require mongod and generate a synthetic dataset, so they can take a while to set
+// up.  Run them with, e.g.:
+//
+//	go test ./groups -run XXX -bench GroupResolution -benchPatients 500000
+var benchPatients = flag.Int("benchPatients", 100000, "number of synthetic patients used by the group resolution benchmarks")
+
+var benchConditionCodes = []string{"250.00", "401.9", "296.21", "427.31", "428.0", "585.9", "496", "714.0"}
+
+func BenchmarkGroupResolutionCondition(b *testing.B) {
+	benchmarkGroupResolution(b,
+		characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "250.00")))
+}
+
+func BenchmarkGroupResolutionGenderAndCondition(b *testing.B) {
+	benchmarkGroupResolution(b,
+		characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "female")),
+		characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "401.9")))
+}
+
+func BenchmarkGroupResolutionAnyOfWithExclusion(b *testing.B) {
+	diabetes := characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "250.00"))
+	diabetes.Extension = []fhir.Extension{{Url: AnyOfExtensionURL, ValueString: "chronic"}}
+	hypertension := characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "401.9"))
+	hypertension.Extension = []fhir.Extension{{Url: AnyOfExtensionURL, ValueString: "chronic"}}
+	depression := characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "296.21"))
+	depression.Exclude = boolPtr(true)
+	benchmarkGroupResolution(b, diabetes, hypertension, depression)
+}
+
+func BenchmarkGroupResolutionRiskScore(b *testing.B) {
+	risk := characteristic("http://interventionengine.org/risk-assessments", "Simple", nil)
+	risk.ValueRange = &fhir.Range{Low: &fhir.Quantity{Value: float64Ptr(5)}}
+	benchmarkGroupResolution(b, risk)
+}
+
+func BenchmarkGroupResolutionBreakdowns(b *testing.B) {
+	db, cleanup := benchmarkDB(b)
+	defer cleanup()
+
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "male")),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	options := &BreakdownOptions{Gender: true, Age: true, Conditions: true, TopConditions: DefaultTopConditions}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newPatientSetResolver(search.NewMongoSearcher(db))
+		set, err := r.resolve(info)
+		if err == nil {
+			_, _, err = resolveGroupCounts(set, db)
+		}
+		if err == nil {
+			_, err = computeBreakdowns(set, options, db)
+		}
+		r.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkGroupResolution(b *testing.B, characteristics ...fhir.GroupCharacteristicComponent) {
+	db, cleanup := benchmarkDB(b)
+	defer cleanup()
+
+	info, err := LoadCharacteristicInfo(characteristics)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newPatientSetResolver(search.NewMongoSearcher(db))
+		set, err := r.resolve(info)
+		if err == nil {
+			_, err = set.Count()
+		}
+		r.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkDB starts a test Mongo server and loads it with the synthetic dataset
+func benchmarkDB(b *testing.B) (*mgo.Database, func()) {
+	path, err := ioutil.TempDir("", "mongobenchdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := &dbtest.DBServer{}
+	server.SetPath(path)
+	session := server.Session()
+	cleanup := func() {
+		session.Close()
+		server.Wipe()
+		server.Stop()
+		os.RemoveAll(path)
+	}
+
+	db := session.DB("ie-bench")
+	if err := loadSyntheticPatients(db, *benchPatients); err != nil {
+		cleanup()
+		b.Fatal(err)
+	}
+	return db, cleanup
+}
+
+// loadSyntheticPatients inserts the patients, each with a few confirmed conditions, a couple of encounters, and a risk
+// assessment.  The data is deterministic so that benchmark runs are comparable.
+func loadSyntheticPatients(db *mgo.Database, n int) error {
+	const chunk = 1000
+	now := time.Now()
+	genders := []string{"male", "female"}
+	for start := 0; start < n; start += chunk {
+		var patients, conditions, encounters, risks []interface{}
+		for i := start; i < start+chunk && i < n; i++ {
+			id := bson.NewObjectId().Hex()
+			ref := &fhir.Reference{Reference: "Patient/" + id, ReferencedID: id, Type: "Patient", External: new(bool)}
+			patients = append(patients, &fhir.Patient{
+				DomainResource: fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Patient", Id: id}},
+				Gender:         genders[i%len(genders)],
+				BirthDate:      &fhir.FHIRDateTime{Time: now.AddDate(-(i % 95), 0, 0), Precision: fhir.Date},
+			})
+			for j := 0; j < i%4; j++ {
+				code := benchConditionCodes[(i+j)%len(benchConditionCodes)]
+				conditions = append(conditions, &fhir.Condition{
+					DomainResource:     fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Condition", Id: bson.NewObjectId().Hex()}},
+					Patient:            ref,
+					Code:               codeValue("http://hl7.org/fhir/sid/icd-9", code),
+					VerificationStatus: "confirmed",
+				})
+			}
+			for j := 0; j < 2; j++ {
+				encounters = append(encounters, &fhir.Encounter{
+					DomainResource: fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Encounter", Id: bson.NewObjectId().Hex()}},
+					Patient:        ref,
+					Type:           []fhir.CodeableConcept{*codeValue("http://snomed.info/sct", "185349003")},
+				})
+			}
+			risks = append(risks, &fhir.RiskAssessment{
+				DomainResource: fhir.DomainResource{Resource: fhir.Resource{
+					ResourceType: "RiskAssessment",
+					Id:           bson.NewObjectId().Hex(),
+					Meta:         &fhir.Meta{Tag: []fhir.Coding{{System: "http://interventionengine.org/tags/", Code: "MOST_RECENT"}}},
+				}},
+				Subject:    ref,
+				Method:     codeValue("http://interventionengine.org/risk-assessments", "Simple"),
+				Prediction: []fhir.RiskAssessmentPredictionComponent{{ProbabilityDecimal: float64Ptr(float64(i % 11))}},
+			})
+		}
+		for collection, docs := range map[string][]interface{}{
+			"patients": patients, "conditions": conditions, "encounters": encounters, "riskassessments": risks,
+		} {
+			if len(docs) == 0 {
+				continue
+			}
+			if err := db.C(collection).Insert(docs...); err != nil {
+				return fmt.Errorf("Error loading synthetic %s: %v", collection, err)
+			}
+		}
+	}
+	return nil
+}
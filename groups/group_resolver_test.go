@@ -0,0 +1,305 @@
+package groups
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestCharacteristicInfoSuite(t *testing.T) {
+	suite.Run(t, new(CharacteristicInfoSuite))
+}
+
+type CharacteristicInfoSuite struct {
+	suite.Suite
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadMedicationAndProcedureCharacteristics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "female")),
+		characteristic("http://loinc.org", "10160-0", codeValue("http://www.nlm.nih.gov/research/umls/rxnorm/", "855332")),
+		characteristic("http://loinc.org", "47519-4", codeValue("http://snomed.info/sct", "232717009")),
+	})
+	require.NoError(err)
+	assert.True(info.HasClinicalCharacteristics())
+	assert.True(info.HasMedicationCharacteristics)
+	require.Len(info.MedicationQueryValues, 1)
+	assert.Equal("active", info.MedicationQueryValues[0].Get("status"))
+	assert.Equal("http://www.nlm.nih.gov/research/umls/rxnorm/|855332", info.MedicationQueryValues[0].Get("code"))
+	assert.True(info.HasProcedureCharacteristics)
+	require.Len(info.ProcedureQueryValues, 1)
+	assert.Equal("http://snomed.info/sct|232717009", info.ProcedureQueryValues[0].Get("code"))
+
+	// Procedure has no status search parameter, so completed procedures are filtered by the resolver
+	assert.Empty(info.ProcedureQueryValues[0]["status"])
+
+	// Patient characteristics are resolved separately rather than chained into the other resources' queries
+	assert.Equal("female", info.PatientQueryValues.Get("gender"))
+	assert.Empty(info.MedicationQueryValues[0]["patient.gender"])
+	assert.Empty(info.ProcedureQueryValues[0]["patient.gender"])
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadMultipleMedicationAndProcedureCharacteristics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		characteristic("http://loinc.org", "10160-0", codeValue("http://www.nlm.nih.gov/research/umls/rxnorm/", "855332")),
+		characteristic("http://loinc.org", "10160-0", codeValue("http://www.nlm.nih.gov/research/umls/rxnorm/", "253182")),
+		characteristic("http://loinc.org", "47519-4", codeValue("http://snomed.info/sct", "232717009")),
+		characteristic("http://loinc.org", "47519-4", codeValue("http://snomed.info/sct", "80146002")),
+	})
+	require.NoError(err)
+
+	// Each characteristic is matched by its own records, rather than requiring one record to have every code
+	require.Len(info.MedicationQueryValues, 2)
+	assert.Equal([]string{"http://www.nlm.nih.gov/research/umls/rxnorm/|855332"}, info.MedicationQueryValues[0]["code"])
+	assert.Equal([]string{"http://www.nlm.nih.gov/research/umls/rxnorm/|253182"}, info.MedicationQueryValues[1]["code"])
+	require.Len(info.ProcedureQueryValues, 2)
+	assert.Equal([]string{"http://snomed.info/sct|232717009"}, info.ProcedureQueryValues[0]["code"])
+	assert.Equal([]string{"http://snomed.info/sct|80146002"}, info.ProcedureQueryValues[1]["code"])
+
+	// Every query value must be a FHIR search parameter, or creating the query panics
+	searcher := search.NewMongoSearcher(nil)
+	for _, values := range info.MedicationQueryValues {
+		assert.NotPanics(func() {
+			searcher.CreateQueryObject(search.Query{Resource: "MedicationStatement", Query: values.Encode()})
+		})
+	}
+	for _, values := range info.ProcedureQueryValues {
+		assert.NotPanics(func() { searcher.CreateQueryObject(search.Query{Resource: "Procedure", Query: values.Encode()}) })
+	}
+	assert.Panics(func() { searcher.CreateQueryObject(search.Query{Resource: "Procedure", Query: "status=completed"}) })
+
+	// Characteristics without a value are invalid rather than panicking
+	for _, code := range []string{"10160-0", "47519-4"} {
+		_, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{characteristic("http://loinc.org", code, nil)})
+		assert.Error(err, code)
+	}
+}
+
+func (suite *CharacteristicInfoSuite) TestResourceTypes() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	hba1c := characteristic("http://loinc.org", "4548-4", nil)
+	hba1c.ValueQuantity = &fhir.Quantity{Value: float64Ptr(9), Comparator: ">"}
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		hba1c,
+		characteristic("http://loinc.org", "11450-4", codeValue("http://snomed.info/sct", "44054006")),
+	})
+	require.NoError(err)
+	assert.Equal([]string{"Condition", "Observation"}, info.ResourceTypes())
+
+	info.NoneOf = append(info.NoneOf, &CharacteristicInfo{HasProcedureCharacteristics: true})
+	info.AnyOf = append(info.AnyOf, []*CharacteristicInfo{{HasMedicationCharacteristics: true}, {HasPatientCharacteristics: true}})
+	assert.Equal([]string{"Condition", "MedicationStatement", "Observation", "Patient", "Procedure"}, info.ResourceTypes())
+
+	// Criteria that only exclude patients start with every patient
+	excluding := &CharacteristicInfo{NoneOf: []*CharacteristicInfo{{HasEncounterCharacteristics: true}}}
+	assert.Equal([]string{"Encounter", "Patient"}, excluding.ResourceTypes())
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadObservationAndRiskAssessmentCharacteristics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	hba1c := characteristic("http://loinc.org", "4548-4", nil)
+	hba1c.ValueQuantity = &fhir.Quantity{Value: float64Ptr(9), Comparator: ">"}
+	stroke := characteristic("http://interventionengine.org/risk-assessments", "Stroke", nil)
+	stroke.ValueRange = &fhir.Range{Low: &fhir.Quantity{Value: float64Ptr(4)}}
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		hba1c,
+		stroke,
+		characteristic("http://loinc.org", "30954-2", codeValue("http://loinc.org", "75492-9")),
+	})
+	require.NoError(err)
+	assert.True(info.HasClinicalCharacteristics())
+
+	require.Len(info.ObservationCharacteristics, 2)
+	assert.True(info.ObservationCharacteristics[0].Code.MatchesCode("http://loinc.org", "4548-4"))
+	assert.False(info.ObservationCharacteristics[0].Matches(9))
+	assert.True(info.ObservationCharacteristics[0].Matches(9.1))
+	assert.True(info.ObservationCharacteristics[1].Code.MatchesCode("http://loinc.org", "75492-9"))
+	assert.False(info.ObservationCharacteristics[1].HasThreshold())
+
+	require.Len(info.RiskAssessmentCharacteristics, 1)
+	assert.True(info.RiskAssessmentCharacteristics[0].Code.MatchesCode("http://interventionengine.org/risk-assessments", "Stroke"))
+	assert.False(info.RiskAssessmentCharacteristics[0].Matches(3.9))
+	assert.True(info.RiskAssessmentCharacteristics[0].Matches(4))
+	assert.True(info.RiskAssessmentCharacteristics[0].Matches(20))
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadCharacteristicInfoErrors() {
+	assert := suite.Assert()
+
+	_, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		characteristic("http://foo", "bar", codeValue("http://foo", "baz")),
+	})
+	assert.Error(err)
+
+	bad := characteristic("http://loinc.org", "4548-4", nil)
+	bad.ValueQuantity = &fhir.Quantity{Value: float64Ptr(9), Comparator: "~"}
+	_, err = LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{bad})
+	assert.Error(err)
+}
+
+func (suite *CharacteristicInfoSuite) TestThresholdCharacteristicMatches() {
+	assert := suite.Assert()
+
+	t := ThresholdCharacteristic{Low: float64Ptr(2), High: float64Ptr(4), HighExclusive: true}
+	assert.False(t.Matches(1.9))
+	assert.True(t.Matches(2))
+	assert.True(t.Matches(3.9))
+	assert.False(t.Matches(4))
+
+	t = ThresholdCharacteristic{}
+	assert.True(t.Matches(-100))
+	assert.True(t.Matches(100))
+}
+
+func (suite *CharacteristicInfoSuite) TestThresholdCharacteristicQueries() {
+	assert := suite.Assert()
+
+	t := ThresholdCharacteristic{Low: float64Ptr(2), High: float64Ptr(4), HighExclusive: true}
+	expected := bson.M{"$type": "number", "$gte": float64(2), "$lt": float64(4)}
+	assert.Equal(expected, t.valueQuery())
+	assert.Equal(expected, t.scoreQuery())
+
+	t = ThresholdCharacteristic{Low: float64Ptr(2), LowExclusive: true}
+	assert.Equal(bson.M{"$type": "number", "$gt": float64(2)}, t.valueQuery())
+
+	// Without a threshold, any value (even a missing one) matches, but scores must still be numbers
+	t = ThresholdCharacteristic{}
+	assert.Nil(t.valueQuery())
+	assert.Equal(bson.M{"$type": "number"}, t.scoreQuery())
+}
+
+func (suite *CharacteristicInfoSuite) TestWithout() {
+	assert := suite.Assert()
+
+	assert.Equal([]string{"a", "c"}, without([]string{"a", "b", "c"}, []string{"b", "d"}))
+	assert.Equal([]string{"a"}, without([]string{"a"}, nil))
+	assert.Empty(without([]string{"a"}, []string{"a"}))
+}
+
+func characteristic(system, code string, value *fhir.CodeableConcept) fhir.GroupCharacteristicComponent {
+	return fhir.GroupCharacteristicComponent{
+		Code:                 &fhir.CodeableConcept{Coding: []fhir.Coding{{System: system, Code: code}}},
+		ValueCodeableConcept: value,
+		Exclude:              new(bool),
+	}
+}
+
+func codeValue(system, code string) *fhir.CodeableConcept {
+	return &fhir.CodeableConcept{Coding: []fhir.Coding{{System: system, Code: code}}}
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadExcludedAndAnyOfCharacteristics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	insulin := characteristic("http://loinc.org", "10160-0", codeValue("http://www.nlm.nih.gov/research/umls/rxnorm/", "253182"))
+	insulin.Exclude = boolPtr(true)
+	age := characteristic("http://loinc.org", "21612-7", nil)
+	age.ValueRange = &fhir.Range{Low: &fhir.Quantity{Value: float64Ptr(65)}, High: &fhir.Quantity{Value: float64Ptr(200)}}
+	age.Extension = []fhir.Extension{{Url: AnyOfExtensionURL, ValueString: "frail"}}
+	chf := characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "428.0"))
+	chf.Extension = []fhir.Extension{{Url: AnyOfExtensionURL, ValueString: "frail"}}
+	male := characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "male"))
+	male.Exclude = boolPtr(true)
+	male.Extension = []fhir.Extension{{Url: AnyOfExtensionURL, ValueString: "frail"}}
+
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "250.00")),
+		insulin, age, chf, male,
+	})
+	require.NoError(err)
+	assert.False(info.IsPatientSearch())
+
+	// Diabetic...
+	assert.True(info.HasConditionCharacteristics)
+	assert.Equal("http://hl7.org/fhir/sid/icd-9|250.00", info.ConditionQueryValues.Get("code"))
+	assert.False(info.HasMedicationCharacteristics)
+	assert.Empty(info.AllOf)
+
+	// ...but NOT on insulin...
+	require.Len(info.NoneOf, 1)
+	assert.True(info.NoneOf[0].HasMedicationCharacteristics)
+
+	// ...and over 65 OR with CHF OR NOT male
+	require.Len(info.AnyOf, 1)
+	require.Len(info.AnyOf[0], 3)
+	assert.True(info.AnyOf[0][0].IsPatientSearch())
+	assert.Len(info.AnyOf[0][0].PatientQueryValues["birthdate"], 2)
+	assert.True(info.AnyOf[0][1].HasConditionCharacteristics)
+	require.Len(info.AnyOf[0][2].NoneOf, 1)
+	assert.Equal("male", info.AnyOf[0][2].NoneOf[0].PatientQueryValues.Get("gender"))
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadNestedGroupCharacteristics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	group := new(fhir.Group)
+	data, err := ioutil.ReadFile("../fixtures/sample-group-boolean.json")
+	require.NoError(err)
+	require.NoError(json.Unmarshal(data, group))
+
+	info, err := LoadGroupCharacteristicInfo(group, nil)
+	require.NoError(err)
+	assert.Equal("male", info.PatientQueryValues.Get("gender"))
+	require.Len(info.NoneOf, 1)
+	nested := info.NoneOf[0]
+	require.Len(nested.AnyOf, 1)
+	require.Len(nested.AnyOf[0], 2)
+	assert.Equal("http://hl7.org/fhir/sid/icd-9|296.21", nested.AnyOf[0][0].ConditionQueryValues.Get("code"))
+	assert.Equal("http://hl7.org/fhir/sid/icd-9|427.31", nested.AnyOf[0][1].ConditionQueryValues.Get("code"))
+
+	// Groups loaded from Mongo have bson.M contained resources
+	doc, err := bson.Marshal(group)
+	require.NoError(err)
+	fromDB := new(fhir.Group)
+	require.NoError(bson.Unmarshal(doc, fromDB))
+	require.IsType(bson.M{}, fromDB.Contained[0])
+	info, err = LoadGroupCharacteristicInfo(fromDB, nil)
+	require.NoError(err)
+	require.Len(info.NoneOf, 1)
+	require.Len(info.NoneOf[0].AnyOf, 1)
+	assert.Len(info.NoneOf[0].AnyOf[0], 2)
+
+	// Without the group (or a database), there's nowhere to look for the nested group
+	_, err = LoadCharacteristicInfo(group.Characteristic)
+	assert.Error(err)
+}
+
+func (suite *CharacteristicInfoSuite) TestLoadSelfReferencingGroup() {
+	group := &fhir.Group{
+		DomainResource: fhir.DomainResource{Resource: fhir.Resource{Id: "loop"}},
+	}
+	loop := characteristic("http://interventionengine.org/fhir/cs/group-characteristic", "group", nil)
+	loop.Extension = []fhir.Extension{{Url: GroupExtensionURL, ValueReference: &fhir.Reference{Reference: "#loop"}}}
+	group.Characteristic = []fhir.GroupCharacteristicComponent{loop}
+	group.Contained = []interface{}{group}
+
+	_, err := LoadGroupCharacteristicInfo(group, nil)
+	suite.Assert().Error(err)
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,247 @@
+package groups
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GroupSearchHandler handles patient searches by the groupId parameter when the group's members have to be resolved
+// (or read from its snapshot), and patient searches using named queries with a source (see ConfigNamedQuery).  Rather
+// than listing every member or referenced patient in the query, which large sets can't fit in Mongo's 16MB limit, the
+// patients matching the rest of the search are joined with the resolved set using $lookup.  It must be added as
+// middleware for the Patient resource, and it responds just like the FHIR server's search, aborting the rest of the
+// handlers.
+//
+// Other searches are left to the FHIR server (which uses GroupBSONBuilder and QueryBSONBuilder), including searches of
+// actual groups and groups that are simple patient searches, searches of more than one group or ORed named queries,
+// searches using _include or _revinclude, and invalid searches (so the FHIR server reports the errors).
+func GroupSearchHandler(c *gin.Context) {
+	if c.Request.Method != "GET" || c.Param("id") != "" {
+		return
+	}
+	values := c.Request.URL.Query()
+	codes, hasGroup := values[GroupParamInfo.Name]
+	if (!hasGroup && len(values[QueryParamInfo.Name]) == 0) ||
+		len(values[search.IncludeParam]) > 0 || len(values[search.RevIncludeParam]) > 0 {
+		return
+	}
+	if hasGroup && (len(codes) != 1 || strings.Contains(codes[0], ",")) {
+		return
+	}
+
+	// TODO: Get the searcher that is actually used in the FHIR server (requires registration refactoring)
+	searcher := search.NewMongoSearcher(server.Database)
+	r := newPatientSetResolver(searcher)
+	defer r.Close()
+	var sets []*mgo.Collection
+	if hasGroup {
+		_, members, err := groupMembership(codes[0], r)
+		if err != nil || members == nil {
+			return
+		}
+		sets = append(sets, members)
+		values.Del(GroupParamInfo.Name)
+	}
+	var queries []string
+	for _, value := range values[QueryParamInfo.Name] {
+		set, err := sourceQuerySet(value, r)
+		if err != nil {
+			return
+		}
+		if set != nil {
+			sets = append(sets, set)
+		} else {
+			queries = append(queries, value)
+		}
+	}
+	if len(sets) == 0 {
+		return
+	}
+	values.Del(QueryParamInfo.Name)
+	for _, value := range queries {
+		values.Add(QueryParamInfo.Name, value)
+	}
+	query, options, ok := parseGroupSearch(searcher, search.Query{Resource: "Patient", Query: values.Encode()})
+	if !ok {
+		return
+	}
+	members, err := r.intersect(sets)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	patients, total, err := searchGroupMembers(members, query, options)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	bundle := new(fhir.Bundle)
+	bundle.Id = bson.NewObjectId().Hex()
+	bundle.Type = "searchset"
+	for i := range patients {
+		bundle.Entry = append(bundle.Entry, fhir.BundleEntryComponent{
+			Resource: &patients[i],
+			Search:   &fhir.BundleEntrySearchComponent{Mode: "match"},
+		})
+	}
+	bundleTotal := uint32(total)
+	bundle.Total = &bundleTotal
+	baseURL := url.URL{Scheme: "http", Host: c.Request.Host, Path: "/Patient"}
+	if c.Request.TLS != nil {
+		baseURL.Scheme = "https"
+	}
+	bundle.Link = groupSearchLinks(baseURL, search.Query{Resource: "Patient", Query: c.Request.URL.RawQuery}, total)
+
+	c.Set("bundle", bundle)
+	c.Set("Resource", "Patient")
+	c.Set("Action", "search")
+	c.JSON(http.StatusOK, bundle)
+	c.Abort()
+}
+
+// sourceQuerySet resolves the _query value to a set of patients if it's a single patient named query with a source,
+// returning nil if it isn't
+func sourceQuerySet(value string, r *patientSetResolver) (*mgo.Collection, error) {
+	if strings.Contains(value, ",") {
+		return nil, nil
+	}
+	name, args, err := parseNamedQuery(value)
+	if err != nil {
+		return nil, err
+	}
+	q, _ := DefaultNamedQueryRegistry.Lookup("Patient", name)
+	cq, ok := q.(*ConfigNamedQuery)
+	if !ok || cq.Source == nil {
+		return nil, nil
+	}
+	if args, err = namedQueryArgs(q, args); err != nil {
+		return nil, err
+	}
+	return cq.sourceSet(args, r)
+}
+
+// parseGroupSearch returns the query object and options for the search, or false if the search is invalid (since the
+// searcher panics for invalid searches)
+func parseGroupSearch(searcher *search.MongoSearcher, q search.Query) (query bson.M, options *search.QueryOptions, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	return searcher.CreateQueryObject(q), q.Options(), true
+}
+
+// searchGroupMembers finds the page of patients matching the query who are in the set of members, along with the
+// total number of matching members
+func searchGroupMembers(members *mgo.Collection, query bson.M, options *search.QueryOptions) (patients []fhir.Patient, total int, err error) {
+	patientsC := members.Database.C("patients")
+	joined := []bson.M{
+		{"$match": query},
+		{"$lookup": bson.M{
+			"from":         members.Name,
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "_groupMember",
+		}},
+		{"$match": bson.M{"_groupMember.0": bson.M{"$exists": true}}},
+	}
+
+	counted := append(joined[:len(joined):len(joined)], bson.M{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": 1}}})
+	var counts []struct {
+		Total int `bson:"total"`
+	}
+	if err := patientsC.Pipe(counted).AllowDiskUse().All(&counts); err != nil {
+		return nil, 0, err
+	}
+	if len(counts) > 0 {
+		total = counts[0].Total
+	}
+
+	pipeline := joined
+	if len(options.Sort) > 0 {
+		var sortD bson.D
+		for _, s := range options.Sort {
+			// Like the FHIR server, only the first path of each sort parameter is used
+			order := 1
+			if s.Descending {
+				order = -1
+			}
+			sortD = append(sortD, bson.DocElem{Name: mongoSortField(s.Parameter.Paths[0].Path), Value: order})
+		}
+		pipeline = append(pipeline, bson.M{"$sort": sortD})
+	}
+	if options.Offset > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": options.Offset})
+	}
+	if options.Count > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": options.Count})
+	}
+	patients = []fhir.Patient{}
+	if err := patientsC.Pipe(pipeline).AllowDiskUse().All(&patients); err != nil {
+		return nil, 0, err
+	}
+	return patients, total, nil
+}
+
+var bracketIndexPattern = regexp.MustCompile(`\[(\d+)\]([^\.]+)`)
+
+// mongoSortField converts a search parameter path to the Mongo field, just as the FHIR server does (e.g.,
+// "[]name.[0]given" becomes "name.given.0")
+func mongoSortField(path string) string {
+	return strings.Replace(bracketIndexPattern.ReplaceAllString(path, "$2.$1"), "[]", "", -1)
+}
+
+// groupSearchLinks returns the self, first, previous, next, and last paging links for the search, which are the same
+// as the FHIR server's
+func groupSearchLinks(baseURL url.URL, q search.Query, total int) []fhir.BundleLinkComponent {
+	params := q.URLQueryParameters(true)
+	offset := 0
+	if o, err := strconv.Atoi(params.Get(search.OffsetParam)); err == nil && o > 0 {
+		offset = o
+	}
+	count := search.NewQueryOptions().Count
+	if n, err := strconv.Atoi(params.Get(search.CountParam)); err == nil && n > 0 {
+		count = n
+	}
+
+	link := func(relation string, offset, count int) fhir.BundleLinkComponent {
+		params.Set(search.OffsetParam, strconv.Itoa(offset))
+		params.Set(search.CountParam, strconv.Itoa(count))
+		u := baseURL
+		u.RawQuery = params.Encode()
+		return fhir.BundleLinkComponent{Relation: relation, Url: u.String()}
+	}
+
+	links := []fhir.BundleLinkComponent{link("self", offset, count), link("first", 0, count)}
+	if offset > 0 {
+		// Paging may be uneven (e.g., count=10&offset=5)
+		previous := offset - count
+		if previous < 0 {
+			previous = 0
+		}
+		links = append(links, link("previous", previous, offset-previous))
+	}
+	if total > offset+count {
+		links = append(links, link("next", offset+count, count))
+	}
+	remainder := (total - offset) % count
+	if total < offset {
+		remainder = 0
+	}
+	last := total - remainder
+	if remainder == 0 && total > count {
+		last = total - count
+	}
+	return append(links, link("last", last, count))
+}
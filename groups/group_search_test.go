@@ -0,0 +1,239 @@
+package groups
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestGroupSearchLinksSuite(t *testing.T) {
+	suite.Run(t, new(GroupSearchLinksSuite))
+}
+
+type GroupSearchLinksSuite struct {
+	suite.Suite
+}
+
+func (suite *GroupSearchLinksSuite) TestGroupSearchLinks() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	baseURL := url.URL{Scheme: "http", Host: "ie-server", Path: "/Patient"}
+	links := groupSearchLinks(baseURL, search.Query{Resource: "Patient", Query: "groupId=123&_count=10&_offset=5"}, 42)
+	require.Len(links, 5)
+	relations := make(map[string]url.Values)
+	for _, link := range links {
+		u, err := url.Parse(link.Url)
+		require.NoError(err)
+		assert.Equal("/Patient", u.Path)
+		assert.Equal("123", u.Query().Get("groupId"))
+		relations[link.Relation] = u.Query()
+	}
+	assert.Equal("5", relations["self"].Get("_offset"))
+	assert.Equal("0", relations["first"].Get("_offset"))
+	assert.Equal("0", relations["previous"].Get("_offset"))
+	assert.Equal("5", relations["previous"].Get("_count"))
+	assert.Equal("15", relations["next"].Get("_offset"))
+	assert.Equal("35", relations["last"].Get("_offset"))
+
+	// The first page of a single page doesn't have previous or next links
+	links = groupSearchLinks(baseURL, search.Query{Resource: "Patient", Query: "groupId=123"}, 1)
+	require.Len(links, 3)
+	assert.Equal("self", links[0].Relation)
+	assert.Equal("first", links[1].Relation)
+	assert.Equal("last", links[2].Relation)
+}
+
+func (suite *GroupSearchLinksSuite) TestMongoSortField() {
+	assert := suite.Assert()
+
+	assert.Equal("birthDate", mongoSortField("birthDate"))
+	assert.Equal("name.family", mongoSortField("[]name.[]family"))
+	assert.Equal("name.given.0", mongoSortField("[]name.[0]given"))
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestGroupSearchSuite(t *testing.T) {
+	suite.Run(t, new(GroupSearchSuite))
+}
+
+type GroupSearchSuite struct {
+	testutil.MongoSuite
+	Group     *fhir.Group
+	PatientID string
+}
+
+func (suite *GroupSearchSuite) SetupTest() {
+	require := suite.Require()
+
+	// Setup the database
+	server.Database = suite.DB()
+
+	// Store the group
+	suite.Group = new(fhir.Group)
+	suite.InsertFixture("groups", "../fixtures/sample-group.json", suite.Group)
+
+	// Store the bundle of data to match the group
+	bundleFile, err := os.Open("../fixtures/sample-group-data-bundle.json")
+	require.NoError(err)
+	defer bundleFile.Close()
+	ctx, rw, _ := gin.CreateTestContext()
+	ctx.Request, err = http.NewRequest("POST", "http://ie-server/", bundleFile)
+	require.NoError(err)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	server.NewBatchController(server.NewMongoDataAccessLayer(suite.DB())).Post(ctx)
+	require.Equal(200, rw.Code)
+	bundle := new(fhir.Bundle)
+	require.NoError(json.NewDecoder(rw.Body).Decode(bundle))
+	suite.PatientID = bundle.Entry[0].Resource.(*fhir.Patient).Id
+}
+
+func (suite *GroupSearchSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *GroupSearchSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+// search runs the search through the handler, returning the bundle if the handler responded, or nil if it left the
+// search to the FHIR server
+func (suite *GroupSearchSuite) search(query string) *fhir.Bundle {
+	require := suite.Require()
+
+	e := gin.New()
+	e.GET("/Patient", GroupSearchHandler, func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://ie-server/Patient?"+query, nil)
+	require.NoError(err)
+	e.ServeHTTP(rw, req)
+	if rw.Code == http.StatusNoContent {
+		return nil
+	}
+	require.Equal(http.StatusOK, rw.Code)
+	bundle := new(fhir.Bundle)
+	require.NoError(json.NewDecoder(rw.Body).Decode(bundle))
+	return bundle
+}
+
+func (suite *GroupSearchSuite) TestSearchJoinsResolvedMembers() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	bundle := suite.search("groupId=" + suite.Group.Id + "&_query=group")
+	require.NotNil(bundle)
+	assert.Equal("searchset", bundle.Type)
+	require.NotNil(bundle.Total)
+	assert.Equal(uint32(1), *bundle.Total)
+	require.Len(bundle.Entry, 1)
+	assert.Equal(suite.PatientID, bundle.Entry[0].Resource.(*fhir.Patient).Id)
+	assert.Equal("match", bundle.Entry[0].Search.Mode)
+	assert.NotEmpty(bundle.Link)
+
+	// The rest of the search still applies
+	bundle = suite.search("groupId=" + suite.Group.Id + "&gender=female")
+	require.NotNil(bundle)
+	assert.Equal(uint32(0), *bundle.Total)
+	assert.Empty(bundle.Entry)
+
+	// The resolution sets are dropped
+	names, err := suite.DB().CollectionNames()
+	require.NoError(err)
+	for _, name := range names {
+		assert.NotContains(name, "groupresolution.")
+	}
+}
+
+func (suite *GroupSearchSuite) TestSearchUsesFreshSnapshot() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	suite.Group.Extension = []fhir.Extension{{Url: MaterializedExtensionURL, ValueBoolean: boolPtr(true)}}
+	require.NoError(suite.DB().C("groups").UpdateId(suite.Group.Id, suite.Group))
+	_, err := NewGroupMaterializer(suite.DB()).Refresh(suite.Group, time.Now())
+	require.NoError(err)
+	// Remove the group's data, so only the snapshot still has the patient
+	_, err = suite.DB().C("conditions").RemoveAll(nil)
+	require.NoError(err)
+
+	bundle := suite.search("groupId=" + suite.Group.Id)
+	require.NotNil(bundle)
+	require.Len(bundle.Entry, 1)
+	assert.Equal(suite.PatientID, bundle.Entry[0].Resource.(*fhir.Patient).Id)
+}
+
+func (suite *GroupSearchSuite) TestSearchLeavesOtherSearchesToServer() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	actual := &fhir.Group{
+		DomainResource: fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Group", Id: "imported-cohort"}},
+		Actual:         boolPtr(true),
+		Member: []fhir.GroupMemberComponent{
+			{Entity: &fhir.Reference{Reference: "Patient/1", ReferencedID: "1", Type: "Patient"}},
+		},
+	}
+	require.NoError(suite.DB().C("groups").Insert(actual))
+
+	assert.Nil(suite.search("gender=male"))
+	assert.Nil(suite.search("groupId=imported-cohort"))
+	assert.Nil(suite.search("groupId=" + suite.Group.Id + ",imported-cohort"))
+	assert.Nil(suite.search("groupId=" + suite.Group.Id + "&_revinclude=Condition:patient"))
+	assert.Nil(suite.search("groupId=" + suite.Group.Id + "&foo=bar"))
+	assert.Nil(suite.search("groupId=unknown"))
+}
+
+func (suite *GroupSearchSuite) TestSearchJoinsSourceNamedQuery() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	DefaultNamedQueryRegistry.Register(&ConfigNamedQuery{
+		QueryName:       "test-encounter-status",
+		QueryResource:   "Patient",
+		QueryParameters: []NamedQueryParameter{{Name: "status", Required: true}},
+		Source:          &NamedQuerySource{Resource: "Encounter", Reference: "patient"},
+		Query:           "status={{.status}}",
+	})
+
+	bundle := suite.search("_query=test-encounter-status;status=finished")
+	require.NotNil(bundle)
+	require.Len(bundle.Entry, 1)
+	assert.Equal(suite.PatientID, bundle.Entry[0].Resource.(*fhir.Patient).Id)
+
+	// The rest of the search still applies, including group membership
+	bundle = suite.search("_query=test-encounter-status;status=finished&gender=female")
+	require.NotNil(bundle)
+	assert.Empty(bundle.Entry)
+	bundle = suite.search("_query=test-encounter-status;status=finished&groupId=" + suite.Group.Id)
+	require.NotNil(bundle)
+	assert.Len(bundle.Entry, 1)
+	bundle = suite.search("_query=test-encounter-status;status=planned")
+	require.NotNil(bundle)
+	assert.Empty(bundle.Entry)
+
+	// Named queries without a source are left to the FHIR server
+	assert.Nil(suite.search("_query=group"))
+
+	// The source sets are dropped
+	names, err := suite.DB().CollectionNames()
+	require.NoError(err)
+	for _, name := range names {
+		assert.NotContains(name, "groupresolution.")
+	}
+}
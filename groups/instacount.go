@@ -9,6 +9,9 @@ import (
 	"github.com/intervention-engine/fhir/server"
 )
 
+// InstaCountAllHandler counts the patients matching the posted group's characteristics, along with their confirmed
+// conditions and their encounters.  Breakdowns of the patients can optionally be requested using the query parameters
+// described in ParseBreakdownOptions.
 func InstaCountAllHandler(c *gin.Context) {
 	group := &fhir.Group{}
 	if err := server.FHIRBind(c, group); err != nil {
@@ -16,7 +19,13 @@ func InstaCountAllHandler(c *gin.Context) {
 		return
 	}
 
-	cInfo, err := LoadCharacteristicInfo(group.Characteristic)
+	options, err := ParseBreakdownOptions(c.Request.URL.Query())
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	cInfo, err := LoadGroupCharacteristicInfo(group, server.Database)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -24,17 +33,38 @@ func InstaCountAllHandler(c *gin.Context) {
 
 	// TODO: Get the searcher that is actually used in the FHIR server (requires registration refactoring)
 	searcher := search.NewMongoSearcher(server.Database)
-	patients, conditions, encounters, err := resolveGroupCounts(cInfo, searcher)
+	r := newPatientSetResolver(searcher)
+	defer r.Close()
+	set, err := r.resolve(cInfo)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	patients, err := set.Count()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	conditions, encounters, err := resolveGroupCounts(set, server.Database)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	newResultMap := map[string]int{
+	newResultMap := map[string]interface{}{
 		"patients":   patients,
 		"conditions": conditions,
 		"encounters": encounters,
 	}
 
+	if options.Any() {
+		breakdowns, err := computeBreakdowns(set, options, server.Database)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		newResultMap["breakdowns"] = breakdowns
+	}
+
 	c.JSON(http.StatusOK, newResultMap)
 }
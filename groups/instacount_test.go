@@ -1,12 +1,15 @@
 package groups
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/server"
 	"github.com/intervention-engine/ie/testutil"
 	"github.com/stretchr/testify/suite"
@@ -117,3 +120,131 @@ func (suite *InstacountSuite) TestInstaCountAllHandlerWithOredCodes() {
 	assert.Equal(1, counts["conditions"])
 	assert.Equal(1, counts["encounters"])
 }
+
+func (suite *InstacountSuite) TestInstaCountAllHandlerWithClinicalCharacteristics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Store the medications, observations, risk assessments, and procedures
+	bundleFile, err := os.Open("../fixtures/sample-group-clinical-data-bundle.json")
+	require.NoError(err)
+	ctx, rw, _ := gin.CreateTestContext()
+	ctx.Request, err = http.NewRequest("POST", "http://ie-server/", bundleFile)
+	require.NoError(err)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	server.NewBatchController(server.NewMongoDataAccessLayer(suite.DB())).Post(ctx)
+	require.Equal(200, rw.Code)
+
+	handler := InstaCountAllHandler
+	groupFile, _ := os.Open("../fixtures/sample-group-clinical.json")
+
+	ctx, w, _ := gin.CreateTestContext()
+	ctx.Request, _ = http.NewRequest("POST", "/InstaCountAll", groupFile)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	handler(ctx)
+	require.Equal(http.StatusOK, w.Code)
+
+	counts := make(map[string]int)
+	err = json.NewDecoder(w.Body).Decode(&counts)
+	require.NoError(err)
+
+	// Only Mickey is on warfarin, has a most recent HbA1c > 9, a stroke risk >= 4, and a completed CABG.  Minnie's
+	// medication is completed, her most recent HbA1c is 7.4, her stroke risk is 3, and her CABG was aborted.
+	assert.Equal(1, counts["patients"])
+	assert.Equal(0, counts["conditions"])
+	assert.Equal(0, counts["encounters"])
+}
+
+func (suite *InstacountSuite) TestInstaCountAllHandlerWithExcludedNestedGroup() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	handler := InstaCountAllHandler
+	groupFile, _ := os.Open("../fixtures/sample-group-boolean.json")
+
+	ctx, w, _ := gin.CreateTestContext()
+	ctx.Request, _ = http.NewRequest("POST", "/InstaCountAll", groupFile)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	handler(ctx)
+	require.Equal(http.StatusOK, w.Code)
+
+	counts := make(map[string]int)
+	err := json.NewDecoder(w.Body).Decode(&counts)
+	require.NoError(err)
+
+	// Both patients are male, but the first has major depression, so only the second is counted
+	assert.Equal(1, counts["patients"])
+	assert.Equal(0, counts["conditions"])
+	assert.Equal(0, counts["encounters"])
+}
+
+func (suite *InstacountSuite) TestInstaCountAllHandlerWithTimeWindows() {
+	assert := suite.Assert()
+
+	// The psych visit in the sample data was on April 1, 2015
+	visit := fhir.GroupCharacteristicComponent{
+		Code:                 &fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://loinc.org", Code: "46240-8"}}},
+		ValueCodeableConcept: &fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://www.ama-assn.org/go/cpt", Code: "90791"}}},
+	}
+
+	visit.Period = &fhir.Period{
+		Start: &fhir.FHIRDateTime{Time: time.Date(2015, time.March, 1, 0, 0, 0, 0, time.Local), Precision: fhir.Date},
+		End:   &fhir.FHIRDateTime{Time: time.Date(2015, time.April, 30, 0, 0, 0, 0, time.Local), Precision: fhir.Date},
+	}
+	assert.Equal(1, suite.instaCount(visit)["patients"])
+
+	visit.Period = nil
+	visit.Extension = []fhir.Extension{{Url: LookbackExtensionURL, ValueQuantity: &fhir.Quantity{Value: float64Ptr(90), Code: "d"}}}
+	assert.Equal(0, suite.instaCount(visit)["patients"])
+
+	two := int32(2)
+	visit.Extension = []fhir.Extension{{Url: MinOccurrencesExtensionURL, ValueInteger: &two}}
+	assert.Equal(0, suite.instaCount(visit)["patients"])
+}
+
+func (suite *InstacountSuite) instaCount(characteristics ...fhir.GroupCharacteristicComponent) map[string]int {
+	require := suite.Require()
+
+	group := &fhir.Group{Type: "person", Actual: new(bool), Characteristic: characteristics}
+	data, err := json.Marshal(group)
+	require.NoError(err)
+
+	ctx, w, _ := gin.CreateTestContext()
+	ctx.Request, _ = http.NewRequest("POST", "/InstaCountAll", bytes.NewReader(data))
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	InstaCountAllHandler(ctx)
+	require.Equal(http.StatusOK, w.Code)
+
+	counts := make(map[string]int)
+	require.NoError(json.NewDecoder(w.Body).Decode(&counts))
+	return counts
+}
+
+func (suite *InstacountSuite) TestInstaCountAllHandlerWithBreakdowns() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	groupFile, _ := os.Open("../fixtures/sample-group.json")
+	ctx, w, _ := gin.CreateTestContext()
+	ctx.Request, _ = http.NewRequest("POST", "/InstaCountAll?breakdown=gender,age,risk,conditions"+
+		"&riskMethod=http://interventionengine.org/risk-assessments|Simple&riskBands=0,4,7", groupFile)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	InstaCountAllHandler(ctx)
+	require.Equal(http.StatusOK, w.Code)
+
+	var result struct {
+		Patients   int
+		Breakdowns Breakdowns
+	}
+	require.NoError(json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(1, result.Patients)
+	assert.Equal([]BreakdownCount{{"male", 1}}, result.Breakdowns.Gender)
+	assert.Equal([]BreakdownCount{{"unknown", 1}}, result.Breakdowns.Age)
+	assert.Equal([]BreakdownCount{{"none", 1}}, result.Breakdowns.Risk)
+	// The refuted atrial fibrillation isn't counted, but each of the depression's codes are
+	require.Len(result.Breakdowns.Conditions, 3)
+	for _, cc := range result.Breakdowns.Conditions {
+		assert.Equal(1, cc.Patients)
+		assert.NotEqual("427.31", cc.Code)
+	}
+}
@@ -0,0 +1,326 @@
+package groups
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NamedQuery is a server-side query that can be run using the _query search parameter on its resource.  Arguments are
+// passed after the name, separated by semicolons (e.g., _query=recent-ed-visit;days=14).  Since commas separate ORed
+// values in FHIR searches, _query=a,b matches the resources matching either named query.
+type NamedQuery interface {
+	Name() string
+	Resource() string
+	Parameters() []NamedQueryParameter
+	BSON(args map[string]string, searcher *search.MongoSearcher) (bson.M, error)
+}
+
+// NamedQueryParameter is an argument a named query accepts.  Required arguments must be passed, while other arguments
+// that aren't passed are given their Default (which is empty if the parameter doesn't have one).
+type NamedQueryParameter struct {
+	Name     string `json:"name"`
+	Default  string `json:"default,omitempty"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// NamedQueryFunc is a named query implemented in Go
+type NamedQueryFunc struct {
+	QueryName       string
+	QueryResource   string
+	QueryParameters []NamedQueryParameter
+	Builder         func(args map[string]string, searcher *search.MongoSearcher) (bson.M, error)
+}
+
+// Name returns the query's name
+func (q *NamedQueryFunc) Name() string {
+	return q.QueryName
+}
+
+// Resource returns the resource the query searches
+func (q *NamedQueryFunc) Resource() string {
+	return q.QueryResource
+}
+
+// Parameters returns the arguments the query accepts
+func (q *NamedQueryFunc) Parameters() []NamedQueryParameter {
+	return q.QueryParameters
+}
+
+// BSON builds the query using the Builder
+func (q *NamedQueryFunc) BSON(args map[string]string, searcher *search.MongoSearcher) (bson.M, error) {
+	return q.Builder(args, searcher)
+}
+
+// ConfigNamedQuery is a named query defined in configuration.  Its Query is a FHIR search query string on its
+// Resource, which may use the (escaped) arguments as Go template values (e.g., "gender={{.gender}}").  The daysAgo template
+// function returns the date a number of days ago (e.g., "date=ge{{daysAgo .days}}").
+//
+// If Source is set, the Query searches the Source's resource instead, and matches the resources that the results
+// refer to using the Source's Reference search parameter.  For example, patients with recent ED visits can be found
+// by searching encounters and matching the patients they refer to.
+type ConfigNamedQuery struct {
+	QueryName       string                `json:"name"`
+	QueryResource   string                `json:"resource"`
+	QueryParameters []NamedQueryParameter `json:"parameters,omitempty"`
+	Query           string                `json:"query"`
+	Source          *NamedQuerySource     `json:"source,omitempty"`
+	template        *template.Template
+}
+
+// NamedQuerySource is the resource a ConfigNamedQuery searches when it doesn't search its own resource
+type NamedQuerySource struct {
+	Resource  string `json:"resource"`
+	Reference string `json:"reference"`
+}
+
+var namedQueryFuncs = template.FuncMap{
+	"daysAgo": func(days string) (string, error) {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err != nil {
+			return "", fmt.Errorf("Invalid number of days: %s", days)
+		}
+		return time.Now().AddDate(0, 0, -n).Format("2006-01-02"), nil
+	},
+}
+
+// Name returns the query's name
+func (q *ConfigNamedQuery) Name() string {
+	return q.QueryName
+}
+
+// Resource returns the resource the query searches
+func (q *ConfigNamedQuery) Resource() string {
+	return q.QueryResource
+}
+
+// Parameters returns the arguments the query accepts
+func (q *ConfigNamedQuery) Parameters() []NamedQueryParameter {
+	return q.QueryParameters
+}
+
+// BSON fills in the query string with the arguments and converts it to BSON.  Queries with a Source resolve the
+// resources the Source's results refer to, which are listed in the query, so they are limited to maxGroupParamIDs
+// resources.  Patient searches using a single such query are usually handled by GroupSearchHandler instead, which
+// joins the patients with the resolved set.
+func (q *ConfigNamedQuery) BSON(args map[string]string, searcher *search.MongoSearcher) (bson.M, error) {
+	if q.Source == nil {
+		query, err := q.query(args)
+		if err != nil {
+			return nil, err
+		}
+		return createQueryObject(searcher, search.Query{Resource: q.QueryResource, Query: query})
+	}
+
+	r := newPatientSetResolver(searcher)
+	defer r.Close()
+	set, err := q.sourceSet(args, r)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := setIDs(set, maxGroupParamIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Named query %s can't be searched: %v", q.QueryName, err)
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}, nil
+}
+
+// query fills in the query string with the (escaped) arguments
+func (q *ConfigNamedQuery) query(args map[string]string) (string, error) {
+	if q.template == nil {
+		if err := q.compile(); err != nil {
+			return "", err
+		}
+	}
+	// Escape the arguments so they can't add their own search parameters
+	escaped := make(map[string]string, len(args))
+	for k, v := range args {
+		escaped[k] = url.QueryEscape(v)
+	}
+	var buf bytes.Buffer
+	if err := q.template.Execute(&buf, escaped); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sourceSet searches the Source's resource and writes the IDs of the resources that the results refer to (using the
+// Source's Reference) to a new set, without loading them into memory
+func (q *ConfigNamedQuery) sourceSet(args map[string]string, r *patientSetResolver) (*mgo.Collection, error) {
+	query, err := q.query(args)
+	if err != nil {
+		return nil, err
+	}
+	source, err := createQueryObject(r.searcher, search.Query{Resource: q.Source.Resource, Query: query})
+	if err != nil {
+		return nil, err
+	}
+	info, ok := search.SearchParameterDictionary[q.Source.Resource][q.Source.Reference]
+	if !ok || info.Type != "reference" || len(info.Paths) == 0 {
+		return nil, fmt.Errorf("Unknown %s reference: %s", q.Source.Resource, q.Source.Reference)
+	}
+	field := strings.Replace(info.Paths[0].Path, "[]", "", -1)
+	return r.recordSet(q.Source.Resource, source, field, 1)
+}
+
+func (q *ConfigNamedQuery) compile() (err error) {
+	q.template, err = template.New(q.QueryName).Funcs(namedQueryFuncs).Option("missingkey=error").Parse(q.Query)
+	return err
+}
+
+// createQueryObject converts the FHIR search to BSON, returning invalid searches as errors rather than panicking
+func createQueryObject(searcher *search.MongoSearcher, q search.Query) (object bson.M, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Invalid named query search %s?%s: %v", q.Resource, q.Query, r)
+		}
+	}()
+	return searcher.CreateQueryObject(q), nil
+}
+
+// NamedQueryRegistry keeps track of the named queries by resource and name
+type NamedQueryRegistry struct {
+	mutex   sync.RWMutex
+	queries map[string]map[string]NamedQuery
+}
+
+// Register registers the named query, replacing any query with the same resource and name, and enables the _query
+// parameter on its resource
+func (r *NamedQueryRegistry) Register(q NamedQuery) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.queries == nil {
+		r.queries = make(map[string]map[string]NamedQuery)
+	}
+	if r.queries[q.Resource()] == nil {
+		r.queries[q.Resource()] = make(map[string]NamedQuery)
+		info := QueryParamInfo
+		info.Resource = q.Resource()
+		search.GlobalRegistry().RegisterParameterInfo(info)
+	}
+	r.queries[q.Resource()][q.Name()] = q
+}
+
+// Lookup finds the named query for the resource
+func (r *NamedQueryRegistry) Lookup(resource, name string) (NamedQuery, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	q, ok := r.queries[resource][name]
+	return q, ok
+}
+
+// Names returns the sorted names of the resource's named queries
+func (r *NamedQueryRegistry) Names(resource string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var names []string
+	for name := range r.queries[resource] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadConfig registers the named queries in the JSON file, which contains an array of ConfigNamedQuery objects
+func (r *NamedQueryRegistry) LoadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var queries []*ConfigNamedQuery
+	if err := json.Unmarshal(data, &queries); err != nil {
+		return err
+	}
+	for _, q := range queries {
+		if q.QueryName == "" || q.QueryResource == "" {
+			return fmt.Errorf("Named queries in %s require a name and resource", path)
+		}
+		if err := q.compile(); err != nil {
+			return fmt.Errorf("Invalid query for named query %s: %v", q.QueryName, err)
+		}
+	}
+	for _, q := range queries {
+		r.Register(q)
+	}
+	return nil
+}
+
+// DefaultNamedQueryRegistry is the registry used by the _query parameter
+var DefaultNamedQueryRegistry = new(NamedQueryRegistry)
+
+// parseNamedQuery splits the _query value into the query name and its arguments (e.g., "recent-ed-visit;days=14")
+func parseNamedQuery(value string) (name string, args map[string]string, err error) {
+	parts := strings.Split(value, ";")
+	name = strings.TrimSpace(parts[0])
+	args = make(map[string]string)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return "", nil, fmt.Errorf("Invalid named query argument: %s", part)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return "", nil, err
+		}
+		args[strings.TrimSpace(kv[0])] = v
+	}
+	return name, args, nil
+}
+
+// namedQueryArgs checks the arguments against the query's parameters, filling in defaults
+func namedQueryArgs(q NamedQuery, args map[string]string) (map[string]string, error) {
+	result := make(map[string]string)
+	known := make(map[string]bool)
+	for _, p := range q.Parameters() {
+		known[p.Name] = true
+		if v, ok := args[p.Name]; ok {
+			result[p.Name] = v
+		} else if p.Required {
+			return nil, fmt.Errorf("Named query %s requires the %s argument", q.Name(), p.Name)
+		} else {
+			result[p.Name] = p.Default
+		}
+	}
+	for name := range args {
+		if !known[name] {
+			return nil, fmt.Errorf("Named query %s doesn't accept the %s argument", q.Name(), name)
+		}
+	}
+	return result, nil
+}
+
+func init() {
+	// The frontend sends _query=group along with the groupId parameter, so it matches everything
+	DefaultNamedQueryRegistry.Register(&NamedQueryFunc{
+		QueryName:     "group",
+		QueryResource: "Patient",
+		Builder: func(args map[string]string, searcher *search.MongoSearcher) (bson.M, error) {
+			return bson.M{}, nil
+		},
+	})
+
+	// in-group matches the patients in a group, like the groupId parameter
+	DefaultNamedQueryRegistry.Register(&NamedQueryFunc{
+		QueryName:       "in-group",
+		QueryResource:   "Patient",
+		QueryParameters: []NamedQueryParameter{{Name: "id", Required: true}},
+		Builder: func(args map[string]string, searcher *search.MongoSearcher) (bson.M, error) {
+			param, err := GroupParamParser(GroupParamInfo, search.SearchParamData{Value: args["id"]})
+			if err != nil {
+				return nil, err
+			}
+			return GroupBSONBuilder(param, searcher)
+		},
+	})
+}
@@ -0,0 +1,168 @@
+package groups
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/search"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestNamedQuerySuite(t *testing.T) {
+	suite.Run(t, new(NamedQuerySuite))
+}
+
+type NamedQuerySuite struct {
+	suite.Suite
+}
+
+func (suite *NamedQuerySuite) TestParseNamedQuery() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	name, args, err := parseNamedQuery("group")
+	require.NoError(err)
+	assert.Equal("group", name)
+	assert.Empty(args)
+
+	name, args, err = parseNamedQuery("recent-ed-visit;days=14;type=a%3Bb")
+	require.NoError(err)
+	assert.Equal("recent-ed-visit", name)
+	assert.Equal(map[string]string{"days": "14", "type": "a;b"}, args)
+
+	_, _, err = parseNamedQuery("recent-ed-visit;14")
+	assert.Error(err)
+}
+
+func (suite *NamedQuerySuite) TestNamedQueryArgs() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	q := &NamedQueryFunc{
+		QueryName:       "test",
+		QueryResource:   "Patient",
+		QueryParameters: []NamedQueryParameter{{Name: "id", Required: true}, {Name: "days", Default: "30"}, {Name: "gender"}},
+	}
+	args, err := namedQueryArgs(q, map[string]string{"id": "1"})
+	require.NoError(err)
+	assert.Equal(map[string]string{"id": "1", "days": "30", "gender": ""}, args)
+
+	_, err = namedQueryArgs(q, map[string]string{"days": "7"})
+	assert.Error(err)
+	_, err = namedQueryArgs(q, map[string]string{"id": "1", "foo": "bar"})
+	assert.Error(err)
+}
+
+func (suite *NamedQuerySuite) TestRegistry() {
+	assert := suite.Assert()
+
+	r := new(NamedQueryRegistry)
+	r.Register(&NamedQueryFunc{QueryName: "b", QueryResource: "Patient"})
+	r.Register(&NamedQueryFunc{QueryName: "a", QueryResource: "Patient"})
+	r.Register(&NamedQueryFunc{QueryName: "a", QueryResource: "Condition"})
+
+	q, ok := r.Lookup("Condition", "a")
+	assert.True(ok)
+	assert.Equal("Condition", q.Resource())
+	_, ok = r.Lookup("Condition", "b")
+	assert.False(ok)
+	assert.Equal([]string{"a", "b"}, r.Names("Patient"))
+
+	// Registering a query enables the _query parameter on its resource
+	assert.Equal(QueryParamInfo.Type, search.SearchParameterDictionary["Condition"]["_query"].Type)
+}
+
+func (suite *NamedQuerySuite) TestDefaultRegistry() {
+	assert := suite.Assert()
+
+	_, ok := DefaultNamedQueryRegistry.Lookup("Patient", "group")
+	assert.True(ok)
+	_, ok = DefaultNamedQueryRegistry.Lookup("Patient", "in-group")
+	assert.True(ok)
+}
+
+func (suite *NamedQuerySuite) TestLoadConfig() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	r := new(NamedQueryRegistry)
+	require.NoError(r.LoadConfig("../config/named_queries.json"))
+	assert.Equal([]string{"born-between", "recent-ed-visit"}, r.Names("Patient"))
+
+	q, _ := r.Lookup("Patient", "recent-ed-visit")
+	assert.Equal(&NamedQuerySource{Resource: "Encounter", Reference: "patient"}, q.(*ConfigNamedQuery).Source)
+
+	f, err := ioutil.TempFile("", "named_queries")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"name": "broken", "resource": "Patient", "query": "gender={{.gender"}]`)
+	f.Close()
+	assert.Error(r.LoadConfig(f.Name()))
+}
+
+func (suite *NamedQuerySuite) TestConfigNamedQueryBSON() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	searcher := search.NewMongoSearcher(nil)
+	q := &ConfigNamedQuery{QueryName: "gender", QueryResource: "Patient", Query: "gender={{.gender}}"}
+	obtained, err := q.BSON(map[string]string{"gender": "male"}, searcher)
+	require.NoError(err)
+	assert.Equal(searcher.CreateQueryObject(search.Query{Resource: "Patient", Query: "gender=male"}), obtained)
+
+	// Arguments can't add their own search parameters
+	obtained, err = q.BSON(map[string]string{"gender": "male&name=Bob"}, searcher)
+	require.NoError(err)
+	assert.Equal(searcher.CreateQueryObject(search.Query{Resource: "Patient", Query: "gender=male%26name%3DBob"}), obtained)
+
+	// Invalid searches are errors rather than panics
+	q = &ConfigNamedQuery{QueryName: "bad", QueryResource: "Patient", Query: "foo={{.foo}}"}
+	_, err = q.BSON(map[string]string{"foo": "bar"}, searcher)
+	assert.Error(err)
+}
+
+func (suite *NamedQuerySuite) TestDaysAgo() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	daysAgo := namedQueryFuncs["daysAgo"].(func(string) (string, error))
+	date, err := daysAgo("14")
+	require.NoError(err)
+	assert.Equal(time.Now().AddDate(0, 0, -14).Format("2006-01-02"), date)
+
+	_, err = daysAgo("two weeks")
+	assert.Error(err)
+}
+
+func (suite *NamedQuerySuite) TestQueryBSONBuilderWithArgs() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	info := QueryParamInfo
+	info.Resource = "Encounter"
+	DefaultNamedQueryRegistry.Register(&NamedQueryFunc{
+		QueryName:       "test-status",
+		QueryResource:   "Encounter",
+		QueryParameters: []NamedQueryParameter{{Name: "status", Default: "finished"}},
+		Builder: func(args map[string]string, searcher *search.MongoSearcher) (bson.M, error) {
+			return bson.M{"status": args["status"]}, nil
+		},
+	})
+
+	param, err := QueryParamParser(info, search.SearchParamData{Value: "test-status;status=planned"})
+	require.NoError(err)
+	obtained, err := QueryBSONBuilder(param, search.NewMongoSearcher(nil))
+	require.NoError(err)
+	assert.Equal(bson.M{"status": "planned"}, obtained)
+
+	// The query is registered for encounters, not patients
+	param, err = QueryParamParser(QueryParamInfo, search.SearchParamData{Value: "test-status"})
+	require.NoError(err)
+	_, err = QueryBSONBuilder(param, search.NewMongoSearcher(nil))
+	assert.Error(err)
+}
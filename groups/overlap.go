@@ -0,0 +1,243 @@
+package groups
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+)
+
+// MaxOverlapGroups is the maximum number of groups that can be compared at once.  Every combination of groups is a
+// region of the overlap, so the number of regions grows exponentially.
+const MaxOverlapGroups = 6
+
+// OverlapRequest is the body of a group overlap request.  Each group is either a reference to a stored group (e.g.,
+// {"reference": "Group/5813ba9e1b9a2b5b5e5f4e6a"}) or an inline group definition, as accepted by InstaCountAllHandler.
+type OverlapRequest struct {
+	Groups []json.RawMessage `json:"groups"`
+}
+
+// OverlapResult contains the number of patients in each group, in all of the groups (the intersection), and in any of
+// the groups (the union).  Regions break the union down by exactly which groups the patients are in, so the patients
+// in one group but not another (the difference) can be found by adding up the regions including the first group but
+// not the second.
+type OverlapResult struct {
+	Groups       []OverlapGroup  `json:"groups"`
+	Intersection int             `json:"intersection"`
+	Union        int             `json:"union"`
+	Regions      []OverlapRegion `json:"regions"`
+}
+
+// OverlapGroup is the number of patients in one of the compared groups
+type OverlapGroup struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Patients int    `json:"patients"`
+}
+
+// OverlapRegion is the number of patients in exactly the groups (by index) and none of the other groups.  The
+// patient IDs are only included if requested.
+type OverlapRegion struct {
+	Groups     []int    `json:"groups"`
+	Patients   int      `json:"patients"`
+	PatientIDs []string `json:"patientIds,omitempty"`
+}
+
+// GroupOverlapHandler compares two or more groups, counting the patients in each region of their overlap.  Stored
+// groups can be passed by ID, reference, or remote URL using the groupId query parameter (repeated or comma-separated), and stored or inline
+// groups can be posted in an OverlapRequest.  If the patients query parameter is true, each region includes its
+// patient IDs.
+func GroupOverlapHandler(c *gin.Context) {
+	var groups []*fhir.Group
+	for _, param := range c.Request.URL.Query()["groupId"] {
+		for _, id := range strings.Split(param, ",") {
+			group, err := findOverlapGroup(id)
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			groups = append(groups, group)
+		}
+	}
+	if c.Request.Method == "POST" {
+		req := new(OverlapRequest)
+		if err := c.BindJSON(req); err != nil {
+			return
+		}
+		for _, raw := range req.Groups {
+			group, err := parseOverlapGroup(raw)
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) < 2 || len(groups) > MaxOverlapGroups {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Between 2 and %d groups can be compared", MaxOverlapGroups))
+		return
+	}
+
+	// TODO: Get the searcher that is actually used in the FHIR server (requires registration refactoring)
+	r := newPatientSetResolver(search.NewMongoSearcher(server.Database))
+	defer r.Close()
+	result, err := r.overlap(groups, c.Query("patients") == "true")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func findOverlapGroup(id string) (*fhir.Group, error) {
+	ref, err := ParseGroupReference(id)
+	if err != nil {
+		return nil, err
+	}
+	group, err := FindGroup(ref, server.Database)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("Group not found: %s", id)
+	}
+	return group, err
+}
+
+// parseOverlapGroup parses a reference to a stored group or an inline group
+func parseOverlapGroup(raw json.RawMessage) (*fhir.Group, error) {
+	var ref struct {
+		Reference    string `json:"reference"`
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(raw, &ref); err != nil {
+		return nil, err
+	}
+	switch {
+	case ref.Reference != "":
+		return findOverlapGroup(ref.Reference)
+	case ref.ResourceType == "Group":
+		group := new(fhir.Group)
+		if err := json.Unmarshal(raw, group); err != nil {
+			return nil, err
+		}
+		return group, nil
+	}
+	return nil, errors.New("Each group must be a reference or a Group resource")
+}
+
+// overlap resolves each group to a set of patients, then streams through the union of the sets, using the groups
+// each patient is in to find their region
+func (r *patientSetResolver) overlap(groups []*fhir.Group, withPatients bool) (*OverlapResult, error) {
+	result := &OverlapResult{Groups: make([]OverlapGroup, len(groups))}
+	sets := make([]*mgo.Collection, len(groups))
+	for i, group := range groups {
+		set, err := r.groupSet(group)
+		if err != nil {
+			return nil, err
+		}
+		n, err := set.Count()
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+		result.Groups[i] = OverlapGroup{ID: group.Id, Name: group.Name, Patients: n}
+	}
+
+	union, err := r.union(sets)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := make([]OverlapRegion, 1<<uint(len(groups)))
+	err = eachBatch(union, func(ids []string) error {
+		masks := make(map[string]uint, len(ids))
+		for i, set := range sets {
+			found, err := members(set, ids)
+			if err != nil {
+				return err
+			}
+			for _, id := range found {
+				masks[id] |= 1 << uint(i)
+			}
+		}
+		for _, id := range ids {
+			region := &regions[masks[id]]
+			region.Patients++
+			if withPatients {
+				region.PatientIDs = append(region.PatientIDs, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	all := uint(len(regions) - 1)
+	for mask := uint(1); mask <= all; mask++ {
+		regions[mask].Groups = maskGroups(mask, len(groups))
+		sort.Strings(regions[mask].PatientIDs)
+		result.Union += regions[mask].Patients
+	}
+	result.Intersection = regions[all].Patients
+	result.Regions = orderRegions(regions[1:])
+	return result, nil
+}
+
+// groupSet resolves the group to a set of patients.  Actual groups list their members, so they aren't resolved.
+func (r *patientSetResolver) groupSet(group *fhir.Group) (*mgo.Collection, error) {
+	if group.Actual != nil && *group.Actual {
+		set := r.newSet()
+		return set, insertIDs(set, groupMemberPatientIDs(group))
+	}
+
+	info, err := LoadGroupCharacteristicInfo(group, r.db)
+	if err != nil {
+		return nil, err
+	}
+	return r.resolve(info)
+}
+
+// maskGroups returns the indexes of the groups in the mask
+func maskGroups(mask uint, n int) []int {
+	var groups []int
+	for i := 0; i < n; i++ {
+		if mask&(1<<uint(i)) != 0 {
+			groups = append(groups, i)
+		}
+	}
+	return groups
+}
+
+// orderRegions orders the regions by the number of groups they're in, and then by the groups' indexes
+func orderRegions(regions []OverlapRegion) []OverlapRegion {
+	sort.Stable(byRegionGroups(regions))
+	return regions
+}
+
+type byRegionGroups []OverlapRegion
+
+func (r byRegionGroups) Len() int {
+	return len(r)
+}
+func (r byRegionGroups) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+func (r byRegionGroups) Less(i, j int) bool {
+	a, b := r[i].Groups, r[j].Groups
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return false
+}
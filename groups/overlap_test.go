@@ -0,0 +1,188 @@
+package groups
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestOverlapRegionSuite(t *testing.T) {
+	suite.Run(t, new(OverlapRegionSuite))
+}
+
+type OverlapRegionSuite struct {
+	suite.Suite
+}
+
+func (suite *OverlapRegionSuite) TestMaskGroups() {
+	assert := suite.Assert()
+
+	assert.Equal([]int{0}, maskGroups(1, 3))
+	assert.Equal([]int{0, 2}, maskGroups(5, 3))
+	assert.Equal([]int{0, 1, 2}, maskGroups(7, 3))
+}
+
+func (suite *OverlapRegionSuite) TestOrderRegions() {
+	regions := []OverlapRegion{{Groups: []int{0, 1}}, {Groups: []int{1}}, {Groups: []int{0, 2}}, {Groups: []int{0}}}
+	suite.Assert().Equal([]OverlapRegion{{Groups: []int{0}}, {Groups: []int{1}}, {Groups: []int{0, 1}}, {Groups: []int{0, 2}}},
+		orderRegions(regions))
+}
+
+func (suite *OverlapRegionSuite) TestParseOverlapGroup() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	group, err := parseOverlapGroup(json.RawMessage(`{"resourceType": "Group", "name": "Inline", "actual": false}`))
+	require.NoError(err)
+	assert.Equal("Inline", group.Name)
+
+	_, err = parseOverlapGroup(json.RawMessage(`{"name": "Neither"}`))
+	assert.Error(err)
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestOverlapSuite(t *testing.T) {
+	suite.Run(t, new(OverlapSuite))
+}
+
+type OverlapSuite struct {
+	testutil.MongoSuite
+	Group    *fhir.Group
+	Patients []string
+}
+
+func (suite *OverlapSuite) SetupTest() {
+	require := suite.Require()
+
+	// Setup the database
+	server.Database = suite.DB()
+
+	// Store the group of males with major depression
+	suite.Group = new(fhir.Group)
+	suite.InsertFixture("groups", "../fixtures/sample-group.json", suite.Group)
+
+	// Store the bundle of data: two males, one of whom has major depression
+	bundleFile, err := os.Open("../fixtures/sample-group-data-bundle.json")
+	require.NoError(err)
+	defer bundleFile.Close()
+	ctx, rw, _ := gin.CreateTestContext()
+	ctx.Request, err = http.NewRequest("POST", "http://ie-server/", bundleFile)
+	require.NoError(err)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	server.NewBatchController(server.NewMongoDataAccessLayer(suite.DB())).Post(ctx)
+	require.Equal(200, rw.Code)
+	bundle := new(fhir.Bundle)
+	require.NoError(json.NewDecoder(rw.Body).Decode(bundle))
+	suite.Patients = []string{bundle.Entry[0].Resource.(*fhir.Patient).Id, bundle.Entry[4].Resource.(*fhir.Patient).Id}
+}
+
+func (suite *OverlapSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *OverlapSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *OverlapSuite) TestOverlapWithInlineGroup() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	males, err := json.Marshal(&fhir.Group{
+		DomainResource: fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Group"}},
+		Name:           "Males",
+		Actual:         boolPtr(false),
+		Characteristic: []fhir.GroupCharacteristicComponent{
+			characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "male")),
+		},
+	})
+	require.NoError(err)
+	body, err := json.Marshal(map[string]interface{}{
+		"groups": []interface{}{
+			map[string]string{"reference": "Group/" + suite.Group.Id},
+			json.RawMessage(males),
+		},
+	})
+	require.NoError(err)
+
+	result := suite.overlap("POST", "?patients=true", body)
+	require.Len(result.Groups, 2)
+	assert.Equal(1, result.Groups[0].Patients)
+	assert.Equal(2, result.Groups[1].Patients)
+	assert.Equal("Males", result.Groups[1].Name)
+	assert.Equal(1, result.Intersection)
+	assert.Equal(2, result.Union)
+
+	require.Len(result.Regions, 3)
+	assert.Equal([]int{0}, result.Regions[0].Groups)
+	assert.Equal(0, result.Regions[0].Patients)
+	assert.Equal([]int{1}, result.Regions[1].Groups)
+	assert.Equal([]string{suite.Patients[1]}, result.Regions[1].PatientIDs)
+	assert.Equal([]int{0, 1}, result.Regions[2].Groups)
+	assert.Equal([]string{suite.Patients[0]}, result.Regions[2].PatientIDs)
+}
+
+func (suite *OverlapSuite) TestOverlapWithStoredGroupIDs() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// An actual group (like a huddle) containing just the second patient
+	huddle := &fhir.Group{
+		DomainResource: fhir.DomainResource{Resource: fhir.Resource{ResourceType: "Group", Id: bson.NewObjectId().Hex()}},
+		Actual:         boolPtr(true),
+		Member: []fhir.GroupMemberComponent{
+			{Entity: &fhir.Reference{Reference: "Patient/" + suite.Patients[1], ReferencedID: suite.Patients[1], Type: "Patient"}},
+		},
+	}
+	require.NoError(suite.DB().C("groups").Insert(huddle))
+
+	result := suite.overlap("GET", "?groupId="+suite.Group.Id+","+huddle.Id, nil)
+	assert.Equal(0, result.Intersection)
+	assert.Equal(2, result.Union)
+	require.Len(result.Regions, 3)
+	assert.Equal(1, result.Regions[0].Patients)
+	assert.Equal(1, result.Regions[1].Patients)
+	assert.Nil(result.Regions[0].PatientIDs)
+}
+
+func (suite *OverlapSuite) TestOverlapRequiresTwoGroups() {
+	e := gin.New()
+	e.GET("/GroupOverlap", GroupOverlapHandler)
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://ie-server/GroupOverlap?groupId="+suite.Group.Id, nil)
+	suite.Require().NoError(err)
+	e.ServeHTTP(rw, req)
+	suite.Assert().Equal(http.StatusBadRequest, rw.Code)
+}
+
+func (suite *OverlapSuite) overlap(method, query string, body []byte) *OverlapResult {
+	require := suite.Require()
+
+	e := gin.New()
+	e.GET("/GroupOverlap", GroupOverlapHandler)
+	e.POST("/GroupOverlap", GroupOverlapHandler)
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest(method, "http://ie-server/GroupOverlap"+query, ioutil.NopCloser(bytes.NewReader(body)))
+	require.NoError(err)
+	req.Header.Add("Content-Type", "application/json")
+	e.ServeHTTP(rw, req)
+	require.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	result := new(OverlapResult)
+	require.NoError(json.NewDecoder(rw.Body).Decode(result))
+	return result
+}
@@ -0,0 +1,310 @@
+package groups
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// resolutionBatchSize is the number of patient IDs read or queried at a time when processing patient sets, which
+// keeps each $in query far below Mongo's 16MB document limit no matter how large the sets are
+const resolutionBatchSize = 10000
+
+// patientSetResolver resolves characteristics to sets of patients stored in scratch collections, with one document
+// (containing only the patient ID as its _id) per patient.  Sets are created by aggregation pipelines that write their
+// results using $out, and are combined by streaming through them in batches, so the full list of IDs is never loaded
+// into memory or sent in a single query.  Close must be called to drop the scratch collections.
+type patientSetResolver struct {
+	db       *mgo.Database
+	searcher *search.MongoSearcher
+	prefix   string
+	sets     []*mgo.Collection
+}
+
+func newPatientSetResolver(searcher *search.MongoSearcher) *patientSetResolver {
+	return &patientSetResolver{
+		db:       searcher.GetDB(),
+		searcher: searcher,
+		prefix:   "groupresolution." + bson.NewObjectId().Hex() + ".",
+	}
+}
+
+// Close drops the resolver's scratch collections
+func (r *patientSetResolver) Close() {
+	for _, set := range r.sets {
+		if err := dropSet(set); err != nil {
+			log.Printf("Error dropping group resolution collection %s: %v", set.Name, err)
+		}
+	}
+	r.sets = nil
+}
+
+// dropSet drops the set's collection.  Pipelines without results may not have created their collections, and sets
+// may have been renamed (see replaceSet), so sets that don't exist aren't an error.
+func dropSet(set *mgo.Collection) error {
+	if err := set.DropCollection(); err != nil && err.Error() != "ns not found" {
+		return err
+	}
+	return nil
+}
+
+// replaceSet replaces the target set's patients with the patients in the set, which is renamed to the target (so it
+// no longer exists under its own name)
+func replaceSet(target, set *mgo.Collection) error {
+	n, err := set.Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return dropSet(target)
+	}
+	return set.Database.Session.Run(bson.D{
+		{Name: "renameCollection", Value: set.FullName},
+		{Name: "to", Value: target.FullName},
+		{Name: "dropTarget", Value: true},
+	}, nil)
+}
+
+func (r *patientSetResolver) newSet() *mgo.Collection {
+	set := r.db.C(fmt.Sprintf("%s%d", r.prefix, len(r.sets)))
+	r.sets = append(r.sets, set)
+	return set
+}
+
+// queryObject returns the Mongo query for the FHIR search
+func (r *patientSetResolver) queryObject(resource string, values url.Values) bson.M {
+	return r.searcher.CreateQueryObject(search.Query{Resource: resource, Query: values.Encode()})
+}
+
+// aggregate runs the pipeline on the collection and writes its results, which must only contain patient IDs as _id,
+// to a new set
+func (r *patientSetResolver) aggregate(collection string, pipeline []bson.M) (*mgo.Collection, error) {
+	set := r.newSet()
+	pipeline = append(pipeline, bson.M{"$out": set.Name})
+	var discard []bson.M
+	if err := r.db.C(collection).Pipe(pipeline).AllowDiskUse().All(&discard); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// patientSearchSet finds the patients matching the query values
+func (r *patientSetResolver) patientSearchSet(values url.Values) (*mgo.Collection, error) {
+	pipeline := []bson.M{
+		{"$match": r.queryObject("Patient", values)},
+		{"$project": bson.M{"_id": 1}},
+	}
+	return r.aggregate("patients", pipeline)
+}
+
+// recordSet finds the patients referred to (using the reference field) by at least min of the resources matching the
+// query
+func (r *patientSetResolver) recordSet(resource string, query bson.M, field string, min int) (*mgo.Collection, error) {
+	ref := field + ".referenceid"
+	pipeline := []bson.M{
+		{"$match": query},
+		{"$match": bson.M{ref: bson.M{"$exists": true}}},
+		{"$group": bson.M{"_id": "$" + ref, "count": bson.M{"$sum": 1}}},
+	}
+	if min > 1 {
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"count": bson.M{"$gte": min}}})
+	}
+	pipeline = append(pipeline, bson.M{"$project": bson.M{"_id": 1}})
+	return r.aggregate(fhir.PluralizeLowerResourceName(resource), pipeline)
+}
+
+// intersect returns the set of patients in all of the sets.  It streams through the smallest set, keeping the patients
+// that are also in every other set.
+func (r *patientSetResolver) intersect(sets []*mgo.Collection) (*mgo.Collection, error) {
+	if len(sets) == 1 {
+		return sets[0], nil
+	}
+
+	counts := make(map[string]int, len(sets))
+	for _, set := range sets {
+		n, err := set.Count()
+		if err != nil {
+			return nil, err
+		}
+		counts[set.Name] = n
+	}
+	sorted := append([]*mgo.Collection(nil), sets...)
+	sort.Stable(bySetCount{sets: sorted, counts: counts})
+
+	result := r.newSet()
+	err := eachBatch(sorted[0], func(ids []string) error {
+		for _, set := range sorted[1:] {
+			if len(ids) == 0 {
+				return nil
+			}
+			found, err := members(set, ids)
+			if err != nil {
+				return err
+			}
+			ids = found
+		}
+		return insertIDs(result, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// union returns the set of patients in any of the sets
+func (r *patientSetResolver) union(sets []*mgo.Collection) (*mgo.Collection, error) {
+	if len(sets) == 1 {
+		return sets[0], nil
+	}
+
+	result := r.newSet()
+	for _, set := range sets {
+		err := eachBatch(set, func(ids []string) error {
+			existing, err := members(result, ids)
+			if err != nil {
+				return err
+			}
+			return insertIDs(result, without(ids, existing))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// subtract returns the set of patients in the set but not in any of the excluded sets
+func (r *patientSetResolver) subtract(set *mgo.Collection, excluded []*mgo.Collection) (*mgo.Collection, error) {
+	result := r.newSet()
+	err := eachBatch(set, func(ids []string) error {
+		for _, ex := range excluded {
+			if len(ids) == 0 {
+				return nil
+			}
+			found, err := members(ex, ids)
+			if err != nil {
+				return err
+			}
+			ids = without(ids, found)
+		}
+		return insertIDs(result, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// setIDs returns the sorted IDs of the patients in the set, or an error if there are more than max of them.  Since
+// the IDs are loaded into memory (usually to list them in a query), max keeps them well within Mongo's limits.
+func setIDs(set *mgo.Collection, max int) ([]string, error) {
+	n, err := set.Count()
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("%d patients are too many to list (the maximum is %d)", n, max)
+	}
+	ids := make([]string, 0, n)
+	err = eachBatch(set, func(batch []string) error {
+		ids = append(ids, batch...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// eachBatch calls the function with each batch of patient IDs in the set
+func eachBatch(set *mgo.Collection, fn func(ids []string) error) error {
+	iter := set.Find(nil).Select(bson.M{"_id": 1}).Batch(resolutionBatchSize).Iter()
+	ids := make([]string, 0, resolutionBatchSize)
+	var doc struct {
+		ID string `bson:"_id"`
+	}
+	for iter.Next(&doc) {
+		ids = append(ids, doc.ID)
+		if len(ids) == resolutionBatchSize {
+			if err := fn(ids); err != nil {
+				iter.Close()
+				return err
+			}
+			ids = ids[:0]
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return fn(ids)
+	}
+	return nil
+}
+
+// members returns the IDs that are in the set
+func members(set *mgo.Collection, ids []string) ([]string, error) {
+	var docs []struct {
+		ID string `bson:"_id"`
+	}
+	if err := set.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&docs); err != nil {
+		return nil, err
+	}
+	found := make([]string, len(docs))
+	for i := range docs {
+		found[i] = docs[i].ID
+	}
+	return found, nil
+}
+
+// without returns the IDs that aren't in the excluded IDs
+func without(ids, excluded []string) []string {
+	if len(excluded) == 0 {
+		return ids
+	}
+	ex := make(map[string]bool, len(excluded))
+	for _, id := range excluded {
+		ex[id] = true
+	}
+	var result []string
+	for _, id := range ids {
+		if !ex[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func insertIDs(set *mgo.Collection, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		docs[i] = bson.M{"_id": id}
+	}
+	return set.Insert(docs...)
+}
+
+// bySetCount sorts sets by their number of patients (smallest first)
+type bySetCount struct {
+	sets   []*mgo.Collection
+	counts map[string]int
+}
+
+func (s bySetCount) Len() int {
+	return len(s.sets)
+}
+func (s bySetCount) Swap(i, j int) {
+	s.sets[i], s.sets[j] = s.sets[j], s.sets[i]
+}
+func (s bySetCount) Less(i, j int) bool {
+	return s.counts[s.sets[i].Name] < s.counts[s.sets[j].Name]
+}
@@ -0,0 +1,382 @@
+package groups
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MaterializedExtensionURL is the URL of the group extension that indicates the group's membership should be
+// materialized into a snapshot.  Its valueBoolean must be true.
+const MaterializedExtensionURL = "http://interventionengine.org/fhir/extension/group/materialized"
+
+// GroupSnapshot is the materialized membership of a characteristic group.  Since groups may have any number of
+// patients, the members are stored in their own collection (see SnapshotMembers) rather than in the snapshot.  A
+// snapshot is marked Stale when resources of the types its group searches (its Resources) change, and is only used
+// while it is not stale.
+type GroupSnapshot struct {
+	GroupID   string    `bson:"_id" json:"groupId"`
+	Count     int       `bson:"count" json:"count"`
+	Resources []string  `bson:"resources" json:"resources"`
+	Refreshed time.Time `bson:"refreshed" json:"refreshed"`
+	Stale     bool      `bson:"stale" json:"stale"`
+}
+
+// SnapshotMembers returns the collection of the patients in the group's snapshot, which has one document (containing
+// only the patient ID as its _id) per patient
+func SnapshotMembers(db *mgo.Database, groupID string) *mgo.Collection {
+	return db.C("groupsnapshotmembers." + groupID)
+}
+
+// MembershipChange records a patient entering or leaving a materialized group.  When a group is first materialized,
+// its patients are recorded as entering it with Initial set.
+type MembershipChange struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	GroupID   string        `bson:"group" json:"groupId"`
+	PatientID string        `bson:"patient" json:"patientId"`
+	Change    string        `bson:"change" json:"change"`
+	Date      time.Time     `bson:"date" json:"date"`
+	Initial   bool          `bson:"initial,omitempty" json:"initial,omitempty"`
+}
+
+// The kinds of membership changes
+const (
+	MembershipEntered = "entered"
+	MembershipLeft    = "left"
+)
+
+// IsMaterialized indicates if the group is a characteristic group whose membership should be materialized
+func IsMaterialized(group *fhir.Group) bool {
+	if group.Actual != nil && *group.Actual {
+		return false
+	}
+	ext := findExtension(group.Extension, MaterializedExtensionURL)
+	return ext != nil && ext.ValueBoolean != nil && *ext.ValueBoolean
+}
+
+// GroupMaterializer keeps the snapshots of materialized groups up to date.  Snapshots can be refreshed on a schedule
+// (using RefreshAll) and/or whenever resources change (using Middleware and Start).  If DB is nil, the FHIR server's
+// database is used.
+type GroupMaterializer struct {
+	DB *mgo.Database
+
+	mutex   sync.Mutex
+	changed chan struct{}
+}
+
+// NewGroupMaterializer returns a GroupMaterializer using the database
+func NewGroupMaterializer(db *mgo.Database) *GroupMaterializer {
+	return &GroupMaterializer{DB: db, changed: make(chan struct{}, 1)}
+}
+
+func (m *GroupMaterializer) db() *mgo.Database {
+	if m.DB != nil {
+		return m.DB
+	}
+	return server.Database
+}
+
+// RefreshAll refreshes the snapshots of every materialized group
+func (m *GroupMaterializer) RefreshAll() error {
+	return m.refreshMatching(bson.M{})
+}
+
+// RefreshStale refreshes the snapshots of materialized groups that are stale or have never been materialized
+func (m *GroupMaterializer) RefreshStale() error {
+	var fresh []struct {
+		ID string `bson:"_id"`
+	}
+	if err := m.db().C("groupsnapshots").Find(bson.M{"stale": false}).Select(bson.M{"_id": 1}).All(&fresh); err != nil {
+		return err
+	}
+	ids := make([]string, len(fresh))
+	for i := range fresh {
+		ids[i] = fresh[i].ID
+	}
+	return m.refreshMatching(bson.M{"_id": bson.M{"$nin": ids}})
+}
+
+func (m *GroupMaterializer) refreshMatching(query bson.M) error {
+	query["extension"] = bson.M{"$elemMatch": bson.M{"url": MaterializedExtensionURL, "valueBoolean": true}}
+	var groups []fhir.Group
+	if err := m.db().C("groups").Find(query).All(&groups); err != nil {
+		return err
+	}
+	for i := range groups {
+		if _, err := m.Refresh(&groups[i], time.Now()); err != nil {
+			log.Printf("Error refreshing snapshot for group %s: %v", groups[i].Id, err)
+		}
+	}
+	return nil
+}
+
+// Refresh resolves the group's membership, records who entered or left the group since the last snapshot, and saves
+// the new snapshot.  Groups that aren't materialized have their snapshots (but not their changes) removed.
+func (m *GroupMaterializer) Refresh(group *fhir.Group, now time.Time) (*GroupSnapshot, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	db := m.db()
+	snapshots := db.C("groupsnapshots")
+	members := SnapshotMembers(db, group.Id)
+	if !IsMaterialized(group) {
+		if err := snapshots.RemoveId(group.Id); err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		return nil, dropSet(members)
+	}
+
+	info, err := LoadGroupCharacteristicInfo(group, db)
+	if err != nil {
+		return nil, err
+	}
+	r := newPatientSetResolver(search.NewMongoSearcher(db))
+	defer r.Close()
+	current, err := r.resolve(info)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := snapshots.FindId(group.Id).Count()
+	if err != nil {
+		return nil, err
+	}
+	initial := n == 0
+
+	// The previous members are still in the snapshot's collection, so the changes are the differences between it and
+	// the current set
+	entered, err := r.subtract(current, []*mgo.Collection{members})
+	if err != nil {
+		return nil, err
+	}
+	left, err := r.subtract(members, []*mgo.Collection{current})
+	if err != nil {
+		return nil, err
+	}
+	changes := db.C("groupmembershipchanges")
+	if err := recordMembershipChanges(changes, entered, group.Id, MembershipEntered, now, initial); err != nil {
+		return nil, err
+	}
+	if err := recordMembershipChanges(changes, left, group.Id, MembershipLeft, now, false); err != nil {
+		return nil, err
+	}
+
+	count, err := current.Count()
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceSet(members, current); err != nil {
+		return nil, err
+	}
+
+	resources := info.ResourceTypes()
+	if referencesGroups(group) {
+		resources = append(resources, "Group")
+	}
+	snapshot := &GroupSnapshot{GroupID: group.Id, Count: count, Resources: resources, Refreshed: now}
+	if _, err := snapshots.UpsertId(group.Id, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// recordMembershipChanges records the change for each of the patients in the set
+func recordMembershipChanges(changes, set *mgo.Collection, groupID, change string, date time.Time, initial bool) error {
+	return eachBatch(set, func(ids []string) error {
+		docs := make([]interface{}, len(ids))
+		for i, pid := range ids {
+			docs[i] = &MembershipChange{ID: bson.NewObjectId(), GroupID: groupID, PatientID: pid, Change: change, Date: date, Initial: initial}
+		}
+		return changes.Insert(docs...)
+	})
+}
+
+// referencesGroups indicates if any of the group's characteristics refer to other groups, whose changes may affect
+// its membership
+func referencesGroups(group *fhir.Group) bool {
+	for _, characteristic := range group.Characteristic {
+		if findExtension(characteristic.Extension, GroupExtensionURL) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// FreshSnapshot returns the group's snapshot, or nil if the group has no snapshot or it is stale
+func (m *GroupMaterializer) FreshSnapshot(groupID string) (*GroupSnapshot, error) {
+	snapshot := new(GroupSnapshot)
+	if err := m.db().C("groupsnapshots").FindId(groupID).One(snapshot); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if snapshot.Stale {
+		return nil, nil
+	}
+	return snapshot, nil
+}
+
+// MarkAllStale marks every snapshot stale
+func (m *GroupMaterializer) MarkAllStale() error {
+	return m.markStale(bson.M{})
+}
+
+// MarkStale marks the snapshots of groups that search any of the resource types stale
+func (m *GroupMaterializer) MarkStale(resourceTypes ...string) error {
+	if len(resourceTypes) == 0 {
+		return nil
+	}
+	return m.markStale(bson.M{"resources": bson.M{"$in": resourceTypes}})
+}
+
+// MarkGroupsStale marks the snapshots of the groups stale (e.g., because the groups themselves changed)
+func (m *GroupMaterializer) MarkGroupsStale(groupIDs ...string) error {
+	if len(groupIDs) == 0 {
+		return nil
+	}
+	return m.markStale(bson.M{"_id": bson.M{"$in": groupIDs}})
+}
+
+func (m *GroupMaterializer) markStale(query bson.M) error {
+	query["stale"] = false
+	_, err := m.db().C("groupsnapshots").UpdateAll(query, bson.M{"$set": bson.M{"stale": true}})
+	return err
+}
+
+// markChanged marks the snapshots that may be affected by the resources the request changed stale.  The resource type
+// is set in the context by the FHIR server's controllers.  For batches, the types are taken from the response bundle,
+// but since deleted entries don't have resources, batches with deletes mark every snapshot stale.
+func (m *GroupMaterializer) markChanged(c *gin.Context) error {
+	resource, _ := c.Get("Resource")
+	switch resource {
+	case "Bundle":
+		value, _ := c.Get("Bundle")
+		bundle, ok := value.(*fhir.Bundle)
+		if !ok {
+			return m.MarkAllStale()
+		}
+		var types, groupIDs []string
+		for _, entry := range bundle.Entry {
+			if entry.Resource == nil {
+				return m.MarkAllStale()
+			}
+			resourceType := reflect.TypeOf(entry.Resource).Elem().Name()
+			types = append(types, resourceType)
+			if group, ok := entry.Resource.(*fhir.Group); ok {
+				groupIDs = append(groupIDs, group.Id)
+			}
+		}
+		if err := m.MarkGroupsStale(groupIDs...); err != nil {
+			return err
+		}
+		return m.MarkStale(types...)
+	case "Group":
+		if id := c.Param("id"); id != "" {
+			if err := m.MarkGroupsStale(id); err != nil {
+				return err
+			}
+		}
+		return m.MarkStale("Group")
+	case nil:
+		return m.MarkAllStale()
+	default:
+		return m.MarkStale(resource.(string))
+	}
+}
+
+// Middleware marks the snapshots that may be affected stale whenever a resource is created, updated, or deleted, and
+// signals the materializer (if it has been started) to refresh them.
+func (m *GroupMaterializer) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.IsAborted() || c.Request.Method == "GET" || c.Request.Method == "HEAD" {
+			return
+		}
+		if err := m.markChanged(c); err != nil {
+			log.Printf("Error marking group snapshots stale: %v", err)
+			return
+		}
+		select {
+		case m.changed <- struct{}{}:
+		default:
+			// A refresh is already pending
+		}
+	}
+}
+
+// Start refreshes the stale snapshots after resources change, waiting for the delay first so that a burst of changes
+// (e.g., a batch upload) results in a single refresh.  Call the returned function to stop.
+func (m *GroupMaterializer) Start(delay time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-m.changed:
+				select {
+				case <-time.After(delay):
+				case <-done:
+					return
+				}
+				if err := m.RefreshStale(); err != nil {
+					log.Printf("Error refreshing group snapshots: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// MembershipChangesHandler lists the patients who entered or left a materialized group.  The since query parameter
+// (a date or date-time) limits the changes to those on or after it, defaulting to the last 7 days.  The change query
+// parameter limits the changes to "entered" or "left".  Patients recorded as entering when the group was first
+// materialized are only included if includeInitial is true.
+func MembershipChangesHandler(c *gin.Context) {
+	since := time.Now().AddDate(0, 0, -7)
+	if s := c.Query("since"); s != "" {
+		dt, err := parseDate(s)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		since = dt
+	}
+
+	query := bson.M{"group": c.Param("id"), "date": bson.M{"$gte": since}}
+	switch change := c.Query("change"); change {
+	case MembershipEntered, MembershipLeft:
+		query["change"] = change
+	case "":
+	default:
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Unknown change: %s", change))
+		return
+	}
+	if c.Query("includeInitial") != "true" {
+		query["initial"] = bson.M{"$ne": true}
+	}
+
+	changes := []MembershipChange{}
+	if err := server.Database.C("groupmembershipchanges").Find(query).Sort("date", "patient").All(&changes); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, changes)
+}
+
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
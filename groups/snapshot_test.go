@@ -0,0 +1,273 @@
+package groups
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMaterializedGroupSuite(t *testing.T) {
+	suite.Run(t, new(MaterializedGroupSuite))
+}
+
+type MaterializedGroupSuite struct {
+	suite.Suite
+}
+
+func (suite *MaterializedGroupSuite) TestIsMaterialized() {
+	assert := suite.Assert()
+
+	group := &fhir.Group{Actual: boolPtr(false)}
+	assert.False(IsMaterialized(group))
+
+	group.Extension = []fhir.Extension{{Url: MaterializedExtensionURL, ValueBoolean: boolPtr(false)}}
+	assert.False(IsMaterialized(group))
+
+	group.Extension[0].ValueBoolean = boolPtr(true)
+	assert.True(IsMaterialized(group))
+
+	// Actual groups already list their members
+	group.Actual = boolPtr(true)
+	assert.False(IsMaterialized(group))
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestSnapshotSuite(t *testing.T) {
+	suite.Run(t, new(SnapshotSuite))
+}
+
+type SnapshotSuite struct {
+	testutil.MongoSuite
+	Group     *fhir.Group
+	PatientID string
+}
+
+func (suite *SnapshotSuite) SetupTest() {
+	require := suite.Require()
+
+	// Setup the database
+	server.Database = suite.DB()
+
+	// Store the group, marked as materialized
+	suite.Group = new(fhir.Group)
+	groupFile, err := os.Open("../fixtures/sample-group.json")
+	require.NoError(err)
+	defer groupFile.Close()
+	require.NoError(json.NewDecoder(groupFile).Decode(suite.Group))
+	suite.Group.Id = bson.NewObjectId().Hex()
+	suite.Group.Extension = []fhir.Extension{{Url: MaterializedExtensionURL, ValueBoolean: boolPtr(true)}}
+	require.NoError(suite.DB().C("groups").Insert(suite.Group))
+
+	// Store the bundle of data to match the group
+	bundleFile, err := os.Open("../fixtures/sample-group-data-bundle.json")
+	require.NoError(err)
+	defer bundleFile.Close()
+	ctx, rw, _ := gin.CreateTestContext()
+	ctx.Request, err = http.NewRequest("POST", "http://ie-server/", bundleFile)
+	require.NoError(err)
+	ctx.Request.Header.Add("Content-Type", "application/json")
+	server.NewBatchController(server.NewMongoDataAccessLayer(suite.DB())).Post(ctx)
+	require.Equal(200, rw.Code)
+	bundle := new(fhir.Bundle)
+	require.NoError(json.NewDecoder(rw.Body).Decode(bundle))
+	suite.PatientID = bundle.Entry[0].Resource.(*fhir.Patient).Id
+}
+
+func (suite *SnapshotSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *SnapshotSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *SnapshotSuite) TestRefreshRecordsMembershipChanges() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	m := NewGroupMaterializer(suite.DB())
+	first := time.Date(2016, time.November, 1, 12, 0, 0, 0, time.UTC)
+	snapshot, err := m.Refresh(suite.Group, first)
+	require.NoError(err)
+	assert.Equal(1, snapshot.Count)
+	assert.Equal([]string{"Condition", "Patient"}, snapshot.Resources)
+	assert.False(snapshot.Stale)
+	assert.Equal([]string{suite.PatientID}, suite.snapshotMembers())
+
+	var changes []MembershipChange
+	require.NoError(suite.DB().C("groupmembershipchanges").Find(bson.M{"group": suite.Group.Id}).All(&changes))
+	require.Len(changes, 1)
+	assert.Equal(suite.PatientID, changes[0].PatientID)
+	assert.Equal(MembershipEntered, changes[0].Change)
+	assert.True(changes[0].Initial)
+
+	// Pretend another patient was in the group before, so they are recorded as leaving it
+	require.NoError(SnapshotMembers(suite.DB(), suite.Group.Id).Insert(bson.M{"_id": "gone"}))
+	second := first.Add(24 * time.Hour)
+	_, err = m.Refresh(suite.Group, second)
+	require.NoError(err)
+	assert.Equal([]string{suite.PatientID}, suite.snapshotMembers())
+
+	changes = nil
+	require.NoError(suite.DB().C("groupmembershipchanges").Find(bson.M{"group": suite.Group.Id, "date": second}).All(&changes))
+	require.Len(changes, 1)
+	assert.Equal("gone", changes[0].PatientID)
+	assert.Equal(MembershipLeft, changes[0].Change)
+	assert.False(changes[0].Initial)
+}
+
+func (suite *SnapshotSuite) TestRefreshAllAndMarkStale() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	m := NewGroupMaterializer(suite.DB())
+	require.NoError(m.RefreshAll())
+	snapshot, err := m.FreshSnapshot(suite.Group.Id)
+	require.NoError(err)
+	require.NotNil(snapshot)
+	assert.Equal(1, snapshot.Count)
+
+	require.NoError(m.MarkAllStale())
+	snapshot, err = m.FreshSnapshot(suite.Group.Id)
+	require.NoError(err)
+	assert.Nil(snapshot)
+
+	require.NoError(m.RefreshStale())
+	snapshot, err = m.FreshSnapshot(suite.Group.Id)
+	require.NoError(err)
+	assert.NotNil(snapshot)
+}
+
+func (suite *SnapshotSuite) TestMiddlewareMarksAffectedSnapshotsStale() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	m := NewGroupMaterializer(suite.DB())
+	_, err := m.Refresh(suite.Group, time.Now())
+	require.NoError(err)
+	other := &GroupSnapshot{GroupID: "other", Resources: []string{"Observation"}, Refreshed: time.Now()}
+	require.NoError(suite.DB().C("groupsnapshots").Insert(other))
+
+	isStale := func(id string) bool {
+		snapshot, err := m.FreshSnapshot(id)
+		require.NoError(err)
+		return snapshot == nil
+	}
+	write := func(method, route, path, resource string, set func(c *gin.Context)) {
+		e := gin.New()
+		handler := func(c *gin.Context) {
+			c.Set("Resource", resource)
+			if set != nil {
+				set(c)
+			}
+			c.Status(http.StatusOK)
+		}
+		e.Handle(method, route, m.Middleware(), handler)
+		req, err := http.NewRequest(method, "http://ie-server"+path, nil)
+		require.NoError(err)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The group doesn't search medications, so they don't affect it
+	write("POST", "/MedicationStatement", "/MedicationStatement", "MedicationStatement", nil)
+	assert.False(isStale(suite.Group.Id))
+	assert.False(isStale("other"))
+
+	write("PUT", "/Encounter/:id", "/Encounter/123", "Encounter", nil)
+	assert.True(isStale(suite.Group.Id))
+	assert.False(isStale("other"))
+
+	// Batches affect the groups that search any of the types in the response
+	require.NoError(suite.DB().C("groupsnapshots").UpdateId(suite.Group.Id, bson.M{"$set": bson.M{"stale": false}}))
+	write("POST", "/", "/", "Bundle", func(c *gin.Context) {
+		c.Set("Bundle", &fhir.Bundle{Entry: []fhir.BundleEntryComponent{{Resource: &fhir.Observation{}}}})
+	})
+	assert.False(isStale(suite.Group.Id))
+	assert.True(isStale("other"))
+
+	// Updating a group only affects its own snapshot (and those of groups that refer to other groups)
+	write("PUT", "/Group/:id", "/Group/123", "Group", nil)
+	assert.False(isStale(suite.Group.Id))
+	write("PUT", "/Group/:id", "/Group/"+suite.Group.Id, "Group", nil)
+	assert.True(isStale(suite.Group.Id))
+}
+
+func (suite *SnapshotSuite) TestGroupBSONBuilderUsesFreshSnapshot() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Save a snapshot that differs from the live membership so we can tell which was used
+	snapshot := &GroupSnapshot{GroupID: suite.Group.Id, Count: 1, Resources: []string{"Patient"}, Refreshed: time.Now()}
+	require.NoError(suite.DB().C("groupsnapshots").Insert(snapshot))
+	require.NoError(SnapshotMembers(suite.DB(), suite.Group.Id).Insert(bson.M{"_id": "snapshotted"}))
+
+	param, err := GroupParamParser(GroupParamInfo, search.SearchParamData{Value: suite.Group.Id})
+	require.NoError(err)
+	obtained, err := GroupBSONBuilder(param, search.NewMongoSearcher(suite.DB()))
+	require.NoError(err)
+	assert.Equal(bson.M{"_id": bson.M{"$in": []string{"snapshotted"}}}, obtained)
+
+	// Stale snapshots aren't used
+	require.NoError(NewGroupMaterializer(suite.DB()).MarkAllStale())
+	obtained, err = GroupBSONBuilder(param, search.NewMongoSearcher(suite.DB()))
+	require.NoError(err)
+	assert.Equal(bson.M{"_id": bson.M{"$in": []string{suite.PatientID}}}, obtained)
+}
+
+func (suite *SnapshotSuite) TestMembershipChangesHandler() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	m := NewGroupMaterializer(suite.DB())
+	_, err := m.Refresh(suite.Group, time.Now().AddDate(0, 0, -1))
+	require.NoError(err)
+	require.NoError(SnapshotMembers(suite.DB(), suite.Group.Id).Insert(bson.M{"_id": "gone"}))
+	_, err = m.Refresh(suite.Group, time.Now())
+	require.NoError(err)
+
+	changesFor := func(query string) []MembershipChange {
+		e := gin.New()
+		e.GET("/GroupMembershipChanges/:id", MembershipChangesHandler)
+		rw := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://ie-server/GroupMembershipChanges/"+suite.Group.Id+query, nil)
+		require.NoError(err)
+		e.ServeHTTP(rw, req)
+		require.Equal(http.StatusOK, rw.Code)
+		var changes []MembershipChange
+		require.NoError(json.NewDecoder(rw.Body).Decode(&changes))
+		return changes
+	}
+
+	// By default, the initial membership isn't included
+	changes := changesFor("")
+	require.Len(changes, 1)
+	assert.Equal("gone", changes[0].PatientID)
+	assert.Equal(MembershipLeft, changes[0].Change)
+
+	assert.Len(changesFor("?includeInitial=true"), 2)
+	assert.Len(changesFor("?includeInitial=true&change=entered"), 1)
+	assert.Empty(changesFor("?since=2100-01-01"))
+}
+
+func (suite *SnapshotSuite) snapshotMembers() []string {
+	var ids []string
+	suite.Require().NoError(eachBatch(SnapshotMembers(suite.DB(), suite.Group.Id), func(batch []string) error {
+		ids = append(ids, batch...)
+		return nil
+	}))
+	return ids
+}
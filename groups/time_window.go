@@ -0,0 +1,123 @@
+package groups
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+)
+
+// LookbackExtensionURL is the URL of the characteristic extension that limits a characteristic to records within a
+// number of days, weeks, months, or years before today.  Its valueQuantity uses the UCUM codes d, wk, mo, or a (e.g.,
+// {"value": 90, "system": "http://unitsofmeasure.org", "code": "d"}).
+const LookbackExtensionURL = "http://interventionengine.org/fhir/extension/group/characteristic/lookback"
+
+// MinOccurrencesExtensionURL is the URL of the characteristic extension that requires patients to have at least a
+// number of matching records.  Its valueInteger is the minimum.
+const MinOccurrencesExtensionURL = "http://interventionengine.org/fhir/extension/group/characteristic/minOccurrences"
+
+// TimeWindow limits a characteristic to records on or after Start and on or before End (either of which may be nil),
+// and to patients with at least MinOccurrences of those records.
+type TimeWindow struct {
+	Start          *time.Time
+	End            *time.Time
+	MinOccurrences int
+}
+
+// dateQueryValues returns the values for the resource's date search parameter
+func (w *TimeWindow) dateQueryValues() []string {
+	var values []string
+	if w.Start != nil {
+		values = append(values, "ge"+w.Start.Format("2006-01-02T15:04:05.000-07:00"))
+	}
+	if w.End != nil {
+		values = append(values, "le"+w.End.Format("2006-01-02T15:04:05.000-07:00"))
+	}
+	return values
+}
+
+// checkWindow checks that the info's time window makes sense for its characteristics
+func (c *CharacteristicInfo) checkWindow() error {
+	if c.Window == nil {
+		return nil
+	}
+	if c.HasPatientCharacteristics {
+		return errors.New("Age and gender characteristics can't have a time window")
+	}
+	if c.Window.MinOccurrences > 1 && (len(c.ObservationCharacteristics) > 0 || len(c.RiskAssessmentCharacteristics) > 0) {
+		return errors.New("Observation and risk assessment characteristics only use the most recent value, so can't have minOccurrences")
+	}
+	return nil
+}
+
+// loadTimeWindow loads the time window from the characteristic's period and lookback and minOccurrences extensions.
+// If the characteristic has none of these, it returns nil.  If it has both a period start and a lookback, the later
+// of the two is used.
+func loadTimeWindow(characteristic fhir.GroupCharacteristicComponent) (*TimeWindow, error) {
+	w := new(TimeWindow)
+	hasWindow := false
+
+	if p := characteristic.Period; p != nil {
+		if p.Start != nil {
+			start := p.Start.Time
+			w.Start = &start
+			hasWindow = true
+		}
+		if p.End != nil {
+			end := p.End.Time
+			if p.End.Precision == fhir.Date {
+				// A date-only end includes the whole day
+				end = end.AddDate(0, 0, 1).Add(-1 * time.Millisecond)
+			}
+			w.End = &end
+			hasWindow = true
+		}
+	}
+
+	if ext := findExtension(characteristic.Extension, LookbackExtensionURL); ext != nil {
+		start, err := lookbackStart(ext.ValueQuantity, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if w.Start == nil || start.After(*w.Start) {
+			w.Start = &start
+		}
+		hasWindow = true
+	}
+
+	if ext := findExtension(characteristic.Extension, MinOccurrencesExtensionURL); ext != nil {
+		if ext.ValueInteger == nil || *ext.ValueInteger < 1 {
+			return nil, fmt.Errorf("Characteristic %v requires a positive minOccurrences valueInteger", characteristic.Code)
+		}
+		w.MinOccurrences = int(*ext.ValueInteger)
+		hasWindow = true
+	}
+
+	if !hasWindow {
+		return nil, nil
+	}
+	return w, nil
+}
+
+func lookbackStart(q *fhir.Quantity, now time.Time) (time.Time, error) {
+	if q == nil || q.Value == nil || *q.Value < 0 {
+		return time.Time{}, fmt.Errorf("Lookback requires a non-negative valueQuantity")
+	}
+	n := int(*q.Value)
+	unit := q.Code
+	if unit == "" {
+		unit = q.Unit
+	}
+	switch unit {
+	case "d", "day", "days":
+		return now.AddDate(0, 0, -n), nil
+	case "wk", "week", "weeks":
+		return now.AddDate(0, 0, -7*n), nil
+	case "mo", "month", "months":
+		return now.AddDate(0, -n, 0), nil
+	case "a", "year", "years":
+		return now.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("Unknown lookback unit: %s", unit)
+}
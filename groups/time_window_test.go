@@ -0,0 +1,140 @@
+package groups
+
+import (
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTimeWindowSuite(t *testing.T) {
+	suite.Run(t, new(TimeWindowSuite))
+}
+
+type TimeWindowSuite struct {
+	suite.Suite
+}
+
+func (suite *TimeWindowSuite) TestLoadCharacteristicWithoutWindow() {
+	w, err := loadTimeWindow(characteristic("http://loinc.org", "46240-8", codeValue("http://snomed.info/sct", "4525004")))
+	suite.Require().NoError(err)
+	suite.Assert().Nil(w)
+}
+
+func (suite *TimeWindowSuite) TestLoadPeriodWindow() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ch := characteristic("http://loinc.org", "46240-8", codeValue("http://snomed.info/sct", "4525004"))
+	ch.Period = &fhir.Period{
+		Start: &fhir.FHIRDateTime{Time: time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: fhir.Date},
+		End:   &fhir.FHIRDateTime{Time: time.Date(2016, time.March, 31, 0, 0, 0, 0, time.UTC), Precision: fhir.Date},
+	}
+	w, err := loadTimeWindow(ch)
+	require.NoError(err)
+	require.NotNil(w)
+	assert.Equal(time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), *w.Start)
+	// The whole end day is included
+	assert.Equal(time.Date(2016, time.March, 31, 23, 59, 59, 999000000, time.UTC), *w.End)
+	assert.Equal(0, w.MinOccurrences)
+	assert.Equal([]string{"ge2016-01-01T00:00:00.000+00:00", "le2016-03-31T23:59:59.999+00:00"}, w.dateQueryValues())
+}
+
+func (suite *TimeWindowSuite) TestLoadLookbackAndMinOccurrencesWindow() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ch := characteristic("http://loinc.org", "46240-8", codeValue("http://snomed.info/sct", "4525004"))
+	min := int32(2)
+	ch.Extension = []fhir.Extension{
+		{Url: LookbackExtensionURL, ValueQuantity: &fhir.Quantity{Value: float64Ptr(90), System: "http://unitsofmeasure.org", Code: "d"}},
+		{Url: MinOccurrencesExtensionURL, ValueInteger: &min},
+	}
+	before := time.Now().AddDate(0, 0, -90)
+	w, err := loadTimeWindow(ch)
+	require.NoError(err)
+	require.NotNil(w)
+	assert.False(w.Start.Before(before))
+	assert.True(w.Start.Before(time.Now().AddDate(0, 0, -89)))
+	assert.Nil(w.End)
+	assert.Equal(2, w.MinOccurrences)
+}
+
+func (suite *TimeWindowSuite) TestLookbackStart() {
+	assert := suite.Assert()
+
+	now := time.Date(2016, time.March, 31, 12, 0, 0, 0, time.UTC)
+	start, err := lookbackStart(&fhir.Quantity{Value: float64Ptr(2), Code: "wk"}, now)
+	assert.NoError(err)
+	assert.Equal(time.Date(2016, time.March, 17, 12, 0, 0, 0, time.UTC), start)
+	start, err = lookbackStart(&fhir.Quantity{Value: float64Ptr(1), Unit: "years"}, now)
+	assert.NoError(err)
+	assert.Equal(time.Date(2015, time.March, 31, 12, 0, 0, 0, time.UTC), start)
+	_, err = lookbackStart(&fhir.Quantity{Value: float64Ptr(1), Code: "fortnight"}, now)
+	assert.Error(err)
+	_, err = lookbackStart(nil, now)
+	assert.Error(err)
+}
+
+func (suite *TimeWindowSuite) TestWindowedCharacteristicsAreSeparated() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ed := characteristic("http://loinc.org", "46240-8", codeValue("http://snomed.info/sct", "4525004"))
+	ed.Extension = []fhir.Extension{{Url: LookbackExtensionURL, ValueQuantity: &fhir.Quantity{Value: float64Ptr(90), Code: "d"}}}
+	info, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{
+		characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "male")),
+		characteristic("http://loinc.org", "11450-4", codeValue("http://hl7.org/fhir/sid/icd-9", "428.0")),
+		ed,
+	})
+	require.NoError(err)
+	assert.Nil(info.Window)
+	assert.True(info.HasConditionCharacteristics)
+	assert.False(info.HasEncounterCharacteristics)
+	require.Len(info.AllOf, 1)
+	windowed := info.AllOf[0]
+	require.NotNil(windowed.Window)
+	assert.True(windowed.HasEncounterCharacteristics)
+
+	// The window is added to the encounter query, but not to the info's own query values
+	values := windowed.windowedQueryValues(windowed.EncounterQueryValues, "date")
+	assert.Equal(windowed.Window.dateQueryValues(), values["date"])
+	assert.Equal("http://snomed.info/sct|4525004", values.Get("type"))
+	assert.Empty(windowed.EncounterQueryValues["date"])
+}
+
+func (suite *TimeWindowSuite) TestMinOccurrences() {
+	assert := suite.Assert()
+
+	info := newCharacteristicInfo()
+	assert.Equal(1, info.minOccurrences())
+	info.Window = &TimeWindow{}
+	assert.Equal(1, info.minOccurrences())
+	info.Window.MinOccurrences = 2
+	assert.Equal(2, info.minOccurrences())
+}
+
+func (suite *TimeWindowSuite) TestInvalidWindows() {
+	assert := suite.Assert()
+
+	gender := characteristic("http://loinc.org", "21840-4", codeValue("http://hl7.org/fhir/administrative-gender", "male"))
+	gender.Extension = []fhir.Extension{{Url: LookbackExtensionURL, ValueQuantity: &fhir.Quantity{Value: float64Ptr(90), Code: "d"}}}
+	_, err := LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{gender})
+	assert.Error(err)
+
+	hba1c := characteristic("http://loinc.org", "4548-4", nil)
+	hba1c.ValueQuantity = &fhir.Quantity{Value: float64Ptr(9), Comparator: ">"}
+	min := int32(3)
+	hba1c.Extension = []fhir.Extension{{Url: MinOccurrencesExtensionURL, ValueInteger: &min}}
+	_, err = LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{hba1c})
+	assert.Error(err)
+
+	zero := int32(0)
+	ed := characteristic("http://loinc.org", "46240-8", codeValue("http://snomed.info/sct", "4525004"))
+	ed.Extension = []fhir.Extension{{Url: MinOccurrencesExtensionURL, ValueInteger: &zero}}
+	_, err = LoadCharacteristicInfo([]fhir.GroupCharacteristicComponent{ed})
+	assert.Error(err)
+}
@@ -0,0 +1,54 @@
+package ie
+
+import "time"
+
+// HuddleSummary the printable overview of a huddle and the patients scheduled for it
+type HuddleSummary struct {
+	HuddleID string                `json:"huddle_id"`
+	Name     string                `json:"name"`
+	Date     time.Time             `json:"date"`
+	Members  []HuddleSummaryMember `json:"members"`
+}
+
+// HuddleSummaryMember a patient in the huddle, why they are there, and what happened to them recently
+type HuddleSummaryMember struct {
+	Patient           Patient               `json:"patient"`
+	Reason            string                `json:"reason"`
+	RecentEncounters  []EncounterSummary    `json:"recent_encounters"`
+	OpenNotifications []NotificationSummary `json:"open_notifications"`
+}
+
+// EncounterSummary the parts of an encounter worth printing on a huddle summary
+type EncounterSummary struct {
+	ID    string    `json:"id"`
+	Type  string    `json:"type"`
+	Start time.Time `json:"start"`
+}
+
+// NotificationSummary the parts of a notification worth printing on a huddle summary
+type NotificationSummary struct {
+	ID          string    `json:"id"`
+	Reason      string    `json:"reason"`
+	RequestedOn time.Time `json:"requested_on"`
+}
+
+// LatestRiskAssessments returns the most recent risk assessment for each risk assessment group
+func (m *HuddleSummaryMember) LatestRiskAssessments() []RiskAssessment {
+	var latest []RiskAssessment
+	idx := make(map[string]int)
+	for _, ra := range m.Patient.RecentRiskAssessments {
+		i, ok := idx[ra.GroupID]
+		if !ok {
+			idx[ra.GroupID] = len(latest)
+			latest = append(latest, ra)
+		} else if ra.Date.After(latest[i].Date) {
+			latest[i] = ra
+		}
+	}
+	return latest
+}
+
+// HuddleSummaryService describes the interface for building a HuddleSummary
+type HuddleSummaryService interface {
+	HuddleSummary(id string) (*HuddleSummary, error)
+}
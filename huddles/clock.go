@@ -0,0 +1,33 @@
+package huddles
+
+import "time"
+
+// Clock provides the current time to the huddle scheduler.  Injecting a clock allows the scheduler to run as if it
+// were a different day, which is how simulations (and tests) step through time without waiting for it.
+type Clock interface {
+	Now() time.Time
+}
+
+// FixedClock is a Clock that always returns the same time.  Change Time to move the clock.
+type FixedClock struct {
+	Time time.Time
+}
+
+// Now returns the clock's fixed time
+func (c *FixedClock) Now() time.Time {
+	return c.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func today() time.Time {
+	return startOfDay(time.Now())
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -1,13 +1,19 @@
 package huddles
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/server"
 )
 
 type HuddleSchedulerController struct {
 	configs []HuddleConfig
+	// Store provides the huddles, risk scores, and encounters for metrics.  If it isn't set, the FHIR server's
+	// database is used.
+	Store HuddleStore
 }
 
 func (h *HuddleSchedulerController) AddConfig(config *HuddleConfig) {
@@ -27,3 +33,50 @@ func (h *HuddleSchedulerController) ScheduleHandler(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, scheduledHuddles)
 }
+
+// MetricsHandler calculates the huddle metrics for each config (or only the config with the requested name) over
+// the requested date range.  Dates are formatted as YYYY-MM-DD; the range defaults to the 90 days ending today.
+func (h *HuddleSchedulerController) MetricsHandler(c *gin.Context) {
+	end := today()
+	if endStr := c.Query("end"); endStr != "" {
+		var err error
+		if end, err = time.ParseInLocation("2006-01-02", endStr, time.Local); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	start := end.AddDate(0, 0, -90)
+	if startStr := c.Query("start"); startStr != "" {
+		var err error
+		if start, err = time.ParseInLocation("2006-01-02", startStr, time.Local); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	name := c.Query("name")
+	var metrics []*HuddleMetrics
+	for i := range h.configs {
+		if name != "" && h.configs[i].Name != name {
+			continue
+		}
+		m, err := CalculateHuddleMetrics(h.store(), &h.configs[i], start, end)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		metrics = append(metrics, m)
+	}
+	if name != "" && len(metrics) == 0 {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("No huddle config with name: %s", name))
+		return
+	}
+	c.JSON(http.StatusOK, metrics)
+}
+
+func (h *HuddleSchedulerController) store() HuddleStore {
+	if h.Store != nil {
+		return h.Store
+	}
+	return &MongoHuddleStore{DB: server.Database}
+}
@@ -0,0 +1,263 @@
+package huddles
+
+import (
+	"sort"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie/notifications"
+)
+
+// OutcomeWindowInDays is how long after a discussion an ED visit or readmission is attributed to that discussion
+const OutcomeWindowInDays = 30
+
+// EDVisitDefinitionNames and ReadmissionDefinitionNames are the names of the notification definitions whose
+// encounters count as ED visits and readmissions in the outcome metrics.  The definitions are looked up in the
+// notifications.DefaultNotificationDefinitionRegistry whenever metrics are calculated, so definitions loaded from
+// configuration (or reloaded at runtime) are used, and computed readmissions count along with coded ones.
+var (
+	EDVisitDefinitionNames     = []string{"ER Visit"}
+	ReadmissionDefinitionNames = []string{"Readmission", "Computed Readmission"}
+)
+
+// HuddleMetrics summarizes how well the huddles for a config were run over a date range.  Scheduled counts every
+// huddle membership, Discussed counts the memberships that were marked reviewed, and RolledOver counts the
+// memberships that were only there because they weren't discussed in an earlier huddle.
+type HuddleMetrics struct {
+	Name           string            `json:"name"`
+	Start          time.Time         `json:"start"`
+	End            time.Time         `json:"end"`
+	Huddles        int               `json:"huddles"`
+	Scheduled      int               `json:"scheduled"`
+	Discussed      int               `json:"discussed"`
+	DiscussionRate float64           `json:"discussionRate"`
+	RolledOver     int               `json:"rolledOver"`
+	RollOverRate   float64           `json:"rollOverRate"`
+	RiskBands      []RiskBandMetrics `json:"riskBands"`
+	Outcomes       OutcomeMetrics    `json:"outcomes"`
+}
+
+// RiskBandMetrics compares how often patients in a risk band were actually discussed to how often the config says
+// they should be.  IdealDays converts the IdealFrequency (in huddles) to days based on the configured huddle days.
+type RiskBandMetrics struct {
+	MinScore                      float64 `json:"minScore"`
+	MaxScore                      float64 `json:"maxScore"`
+	IdealFrequency                int     `json:"idealFrequency"`
+	IdealDays                     float64 `json:"idealDays"`
+	Patients                      int     `json:"patients"`
+	Intervals                     int     `json:"intervals"`
+	AverageDaysBetweenDiscussions float64 `json:"averageDaysBetweenDiscussions"`
+}
+
+// OutcomeMetrics counts the discussions that were followed by an ED visit or readmission within OutcomeWindowInDays
+type OutcomeMetrics struct {
+	Discussions              int     `json:"discussions"`
+	EDVisitsWithin30Days     int     `json:"edVisitsWithin30Days"`
+	EDVisitRate              float64 `json:"edVisitRate"`
+	ReadmissionsWithin30Days int     `json:"readmissionsWithin30Days"`
+	ReadmissionRate          float64 `json:"readmissionRate"`
+}
+
+type discussion struct {
+	PatientID string
+	Date      time.Time
+}
+
+// CalculateHuddleMetrics loads the huddles held for the config between start and end (inclusive), along with the
+// discussed patients' current risk scores and subsequent encounters, from the store and calculates the metrics for
+// them.
+func CalculateHuddleMetrics(store HuddleStore, config *HuddleConfig, start, end time.Time) (*HuddleMetrics, error) {
+	huddles, err := store.HuddlesInRange(config.LeaderID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var patientIDs []string
+	seen := make(map[string]bool)
+	for _, d := range findDiscussions(huddles) {
+		if !seen[d.PatientID] {
+			seen[d.PatientID] = true
+			patientIDs = append(patientIDs, d.PatientID)
+		}
+	}
+
+	scores := make(map[string]float64)
+	if config.RiskConfig != nil && len(patientIDs) > 0 {
+		if scores, err = store.CurrentRiskScores(config.RiskConfig.RiskMethod, patientIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	encounters, err := store.PatientEncounters(patientIDs, start, end.AddDate(0, 0, OutcomeWindowInDays+1))
+	if err != nil {
+		return nil, err
+	}
+
+	return computeHuddleMetrics(config, start, end, huddles, scores, encounters), nil
+}
+
+func computeHuddleMetrics(config *HuddleConfig, start, end time.Time, huddles []*Huddle, scores map[string]float64, encounters []models.Encounter) *HuddleMetrics {
+	m := &HuddleMetrics{Name: config.Name, Start: start, End: end, Huddles: len(huddles)}
+	for _, h := range huddles {
+		for _, member := range h.HuddleMembers() {
+			m.Scheduled++
+			if member.Reviewed() != nil {
+				m.Discussed++
+			}
+			if member.ReasonIsRollOver() {
+				m.RolledOver++
+			}
+		}
+	}
+	m.DiscussionRate = rate(m.Discussed, m.Scheduled)
+	m.RollOverRate = rate(m.RolledOver, m.Scheduled)
+
+	discussions := findDiscussions(huddles)
+	m.RiskBands = computeRiskBandMetrics(config, discussions, scores)
+	m.Outcomes = computeOutcomeMetrics(discussions, encounters)
+	return m
+}
+
+func computeRiskBandMetrics(config *HuddleConfig, discussions []discussion, scores map[string]float64) []RiskBandMetrics {
+	if config.RiskConfig == nil {
+		return nil
+	}
+
+	daysPerHuddle := 7.0
+	if len(config.Days) > 0 {
+		daysPerHuddle = 7.0 / float64(len(config.Days))
+	}
+	bands := make([]RiskBandMetrics, len(config.RiskConfig.FrequencyConfigs))
+	for i, fc := range config.RiskConfig.FrequencyConfigs {
+		bands[i] = RiskBandMetrics{
+			MinScore:       fc.MinScore,
+			MaxScore:       fc.MaxScore,
+			IdealFrequency: fc.IdealFrequency,
+			IdealDays:      float64(fc.IdealFrequency) * daysPerHuddle,
+		}
+	}
+
+	// Discussions are sorted by date, so each patient's dates are in order
+	datesByPatient := make(map[string][]time.Time)
+	for _, d := range discussions {
+		datesByPatient[d.PatientID] = append(datesByPatient[d.PatientID], d.Date)
+	}
+
+	totalDays := make([]float64, len(bands))
+	for pid, dates := range datesByPatient {
+		score, ok := scores[pid]
+		if !ok {
+			continue
+		}
+		for i := range bands {
+			if score >= bands[i].MinScore && score <= bands[i].MaxScore {
+				bands[i].Patients++
+				for j := 1; j < len(dates); j++ {
+					bands[i].Intervals++
+					totalDays[i] += dates[j].Sub(dates[j-1]).Hours() / 24
+				}
+				break
+			}
+		}
+	}
+	for i := range bands {
+		if bands[i].Intervals > 0 {
+			bands[i].AverageDaysBetweenDiscussions = totalDays[i] / float64(bands[i].Intervals)
+		}
+	}
+	return bands
+}
+
+func computeOutcomeMetrics(discussions []discussion, encounters []models.Encounter) OutcomeMetrics {
+	o := OutcomeMetrics{Discussions: len(discussions)}
+	edVisitDefs := registeredDefinitions(EDVisitDefinitionNames)
+	readmissionDefs := registeredDefinitions(ReadmissionDefinitionNames)
+	encountersByPatient := make(map[string][]*models.Encounter)
+	for i := range encounters {
+		if encounters[i].Patient != nil {
+			pid := encounters[i].Patient.ReferencedID
+			encountersByPatient[pid] = append(encountersByPatient[pid], &encounters[i])
+		}
+	}
+
+	for _, d := range discussions {
+		windowEnd := d.Date.AddDate(0, 0, OutcomeWindowInDays)
+		var edVisit, readmission bool
+		for _, enc := range encountersByPatient[d.PatientID] {
+			if enc.Period == nil || enc.Period.Start == nil {
+				continue
+			}
+			if s := enc.Period.Start.Time; !s.After(d.Date) || s.After(windowEnd) {
+				continue
+			}
+			edVisit = edVisit || anyTriggers(edVisitDefs, enc)
+			readmission = readmission || anyTriggers(readmissionDefs, enc)
+		}
+		if edVisit {
+			o.EDVisitsWithin30Days++
+		}
+		if readmission {
+			o.ReadmissionsWithin30Days++
+		}
+	}
+	o.EDVisitRate = rate(o.EDVisitsWithin30Days, o.Discussions)
+	o.ReadmissionRate = rate(o.ReadmissionsWithin30Days, o.Discussions)
+	return o
+}
+
+// registeredDefinitions returns the definitions with the names that are currently registered
+func registeredDefinitions(names []string) []notifications.NotificationDefinition {
+	var defs []notifications.NotificationDefinition
+	for _, name := range names {
+		if def := notifications.DefaultNotificationDefinitionRegistry.Get(name); def != nil {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+// anyTriggers returns true if the creation of the encounter triggers any of the definitions
+func anyTriggers(defs []notifications.NotificationDefinition, encounter *models.Encounter) bool {
+	for _, def := range defs {
+		if def.Triggers(encounter, "create") {
+			return true
+		}
+	}
+	return false
+}
+
+// findDiscussions returns the reviewed huddle members, sorted by the date of the huddle they were discussed in
+func findDiscussions(huddles []*Huddle) []discussion {
+	var discussions []discussion
+	for _, h := range huddles {
+		if h.ActiveDateTime() == nil {
+			continue
+		}
+		for _, member := range h.HuddleMembers() {
+			if member.Reviewed() != nil {
+				discussions = append(discussions, discussion{PatientID: member.ID(), Date: h.ActiveDateTime().Time})
+			}
+		}
+	}
+	sort.Sort(byDiscussionDate(discussions))
+	return discussions
+}
+
+type byDiscussionDate []discussion
+
+func (d byDiscussionDate) Len() int {
+	return len(d)
+}
+func (d byDiscussionDate) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+func (d byDiscussionDate) Less(i, j int) bool {
+	return d[i].Date.Before(d[j].Date)
+}
+
+func rate(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
@@ -0,0 +1,184 @@
+package huddles
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie/notifications"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestHuddleMetricsSuite(t *testing.T) {
+	suite.Run(t, new(HuddleMetricsSuite))
+}
+
+type HuddleMetricsSuite struct {
+	suite.Suite
+}
+
+func (suite *HuddleMetricsSuite) TestComputeHuddleMetrics() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	config := createHuddleConfig(true, false, 1, time.Monday)
+	feb1 := time.Date(2016, time.February, 1, 0, 0, 0, 0, time.UTC)
+	feb8 := time.Date(2016, time.February, 8, 0, 0, 0, 0, time.UTC)
+	feb15 := time.Date(2016, time.February, 15, 0, 0, 0, 0, time.UTC)
+
+	// Patient 1 is discussed every week, patient 2 is skipped and rolled over to the next week, and patient 3 is
+	// discussed every other week
+	h1 := NewHuddle(config.Name, config.LeaderID, feb1)
+	addMember(h1, bsonID(1), false, true)
+	addMember(h1, bsonID(2), false, false)
+	addMember(h1, bsonID(3), false, true)
+	h2 := NewHuddle(config.Name, config.LeaderID, feb8)
+	addMember(h2, bsonID(1), false, true)
+	addMember(h2, bsonID(2), true, true)
+	h3 := NewHuddle(config.Name, config.LeaderID, feb15)
+	addMember(h3, bsonID(1), false, true)
+	addMember(h3, bsonID(3), false, true)
+
+	scores := map[string]float64{bsonID(1): 9, bsonID(2): 6, bsonID(3): 5}
+	encounters := []models.Encounter{
+		// ED visit within 30 days of both of patient 3's discussions
+		metricsEncounter(bsonID(3), "4525004", time.Date(2016, time.February, 21, 0, 0, 0, 0, time.UTC)),
+		// Readmission within 30 days of patient 2's discussion
+		metricsEncounter(bsonID(2), "417005", time.Date(2016, time.February, 18, 0, 0, 0, 0, time.UTC)),
+		// Readmission before patient 2 was discussed
+		metricsEncounter(bsonID(2), "417005", time.Date(2016, time.January, 27, 0, 0, 0, 0, time.UTC)),
+		// Readmission more than 30 days after patient 1's last discussion
+		metricsEncounter(bsonID(1), "417005", time.Date(2016, time.April, 1, 0, 0, 0, 0, time.UTC)),
+	}
+
+	m := computeHuddleMetrics(config, feb1, feb15, []*Huddle{h3, h1, h2}, scores, encounters)
+	assert.Equal("Test Huddle Config", m.Name)
+	assert.Equal(3, m.Huddles)
+	assert.Equal(7, m.Scheduled)
+	assert.Equal(6, m.Discussed)
+	assert.InDelta(6.0/7.0, m.DiscussionRate, 0.0001)
+	assert.Equal(1, m.RolledOver)
+	assert.InDelta(1.0/7.0, m.RollOverRate, 0.0001)
+
+	require.Len(m.RiskBands, 3)
+	assert.Equal(RiskBandMetrics{MinScore: 8, MaxScore: 10, IdealFrequency: 1, IdealDays: 7, Patients: 1, Intervals: 2, AverageDaysBetweenDiscussions: 7}, m.RiskBands[0])
+	assert.Equal(RiskBandMetrics{MinScore: 6, MaxScore: 7, IdealFrequency: 2, IdealDays: 14, Patients: 1}, m.RiskBands[1])
+	assert.Equal(RiskBandMetrics{MinScore: 3, MaxScore: 5, IdealFrequency: 4, IdealDays: 28, Patients: 1, Intervals: 1, AverageDaysBetweenDiscussions: 14}, m.RiskBands[2])
+
+	assert.Equal(6, m.Outcomes.Discussions)
+	assert.Equal(2, m.Outcomes.EDVisitsWithin30Days)
+	assert.InDelta(2.0/6.0, m.Outcomes.EDVisitRate, 0.0001)
+	assert.Equal(1, m.Outcomes.ReadmissionsWithin30Days)
+	assert.InDelta(1.0/6.0, m.Outcomes.ReadmissionRate, 0.0001)
+}
+
+func (suite *HuddleMetricsSuite) TestComputeHuddleMetricsWithNoHuddles() {
+	config := createHuddleConfig(false, true, 1, time.Monday)
+	m := computeHuddleMetrics(config, time.Now().AddDate(0, 0, -7), time.Now(), nil, nil, nil)
+	suite.Assert().Equal(0, m.Scheduled)
+	suite.Assert().Equal(0.0, m.DiscussionRate)
+	suite.Assert().Nil(m.RiskBands)
+	suite.Assert().Equal(OutcomeMetrics{}, m.Outcomes)
+}
+
+func (suite *HuddleMetricsSuite) TestCalculateHuddleMetricsFromStore() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	config := createHuddleConfig(true, false, 1, time.Monday)
+	feb1 := time.Date(2016, time.February, 1, 0, 0, 0, 0, time.Local)
+	feb8 := time.Date(2016, time.February, 8, 0, 0, 0, 0, time.Local)
+	mar7 := time.Date(2016, time.March, 7, 0, 0, 0, 0, time.Local)
+
+	store := NewMemoryHuddleStore()
+	h1 := NewHuddle(config.Name, config.LeaderID, feb1)
+	addMember(h1, bsonID(1), false, true)
+	addMember(h1, bsonID(2), false, false)
+	h2 := NewHuddle(config.Name, config.LeaderID, feb8)
+	addMember(h2, bsonID(1), false, true)
+	// The huddle after the range isn't included
+	h3 := NewHuddle(config.Name, config.LeaderID, mar7)
+	addMember(h3, bsonID(2), false, true)
+	for _, h := range []*Huddle{h1, h2, h3} {
+		require.NoError(store.SaveHuddle(h))
+	}
+	require.NoError(store.StoreRiskScore(bsonID(1), config.RiskConfig.RiskMethod, 9, feb1))
+	require.NoError(store.StoreRiskScore(bsonID(2), config.RiskConfig.RiskMethod, 6, feb1))
+	store.AddEncounters(
+		metricsEncounter(bsonID(1), "4525004", time.Date(2016, time.February, 10, 0, 0, 0, 0, time.Local)),
+		metricsEncounter(bsonID(2), "4525004", time.Date(2016, time.February, 10, 0, 0, 0, 0, time.Local)),
+	)
+
+	m, err := CalculateHuddleMetrics(store, config, feb1, feb8)
+	require.NoError(err)
+	assert.Equal(2, m.Huddles)
+	assert.Equal(3, m.Scheduled)
+	assert.Equal(2, m.Discussed)
+	require.Len(m.RiskBands, 3)
+	assert.Equal(1, m.RiskBands[0].Patients)
+	assert.Equal(1, m.RiskBands[0].Intervals)
+	// Patient 2 wasn't discussed, so only patient 1's ED visit counts (for both of their discussions)
+	assert.Equal(2, m.Outcomes.Discussions)
+	assert.Equal(2, m.Outcomes.EDVisitsWithin30Days)
+}
+
+func (suite *HuddleMetricsSuite) TestOutcomeMetricsUseRegisteredDefinitions() {
+	assert := suite.Assert()
+
+	registry := notifications.DefaultNotificationDefinitionRegistry
+	defaults := registry.GetAll()
+	defer registry.Replace(defaults)
+
+	urgentCare := models.Coding{System: "http://snomed.info/sct", Code: "702927004"}
+	admission := models.Coding{System: "http://snomed.info/sct", Code: "32485007"}
+	computed := notifications.NewReadmissionWindowNotificationDefinition("Computed Readmission",
+		models.Coding{System: "http://snomed.info/sct", Code: "417005"}, []models.Coding{admission}, 30)
+	computed.Discharges = func(patient *models.Reference, excludeID string, since, until time.Time) ([]models.Encounter, error) {
+		return []models.Encounter{{Status: "finished", Type: []models.CodeableConcept{{Coding: []models.Coding{admission}}}}}, nil
+	}
+	// The configured ED visit definition replaces the default one, and computed readmissions count
+	registry.Replace([]notifications.NotificationDefinition{
+		notifications.NewEncounterTypeNotificationDefinition("ER Visit", urgentCare, []models.Coding{urgentCare}),
+		computed,
+	})
+
+	feb1 := time.Date(2016, time.February, 1, 0, 0, 0, 0, time.Local)
+	feb10 := time.Date(2016, time.February, 10, 0, 0, 0, 0, time.Local)
+	discussions := []discussion{{PatientID: bsonID(1), Date: feb1}, {PatientID: bsonID(2), Date: feb1}, {PatientID: bsonID(3), Date: feb1}}
+	encounters := []models.Encounter{
+		metricsEncounter(bsonID(1), "702927004", feb10),
+		metricsEncounter(bsonID(2), "32485007", feb10),
+		metricsEncounter(bsonID(3), "4525004", feb10),
+	}
+	o := computeOutcomeMetrics(discussions, encounters)
+	assert.Equal(3, o.Discussions)
+	assert.Equal(1, o.EDVisitsWithin30Days)
+	assert.Equal(1, o.ReadmissionsWithin30Days)
+}
+
+func addMember(h *Huddle, patientID string, rolledOver bool, reviewed bool) {
+	if rolledOver {
+		h.AddHuddleMemberDueToRollOver(patientID, h.ActiveDateTime().Time.AddDate(0, 0, -7), riskScoreReason())
+	} else {
+		h.AddHuddleMemberDueToRiskScore(patientID)
+	}
+	if reviewed {
+		m := &h.Member[len(h.Member)-1]
+		m.Extension = append(m.Extension, models.Extension{
+			Url:           "http://interventionengine.org/fhir/extension/group/member/reviewed",
+			ValueDateTime: &models.FHIRDateTime{Time: h.ActiveDateTime().Time, Precision: models.Timestamp},
+		})
+	}
+}
+
+func metricsEncounter(patientID, code string, date time.Time) models.Encounter {
+	return models.Encounter{
+		Type: []models.CodeableConcept{
+			{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: code}}},
+		},
+		Patient: &models.Reference{Reference: "Patient/" + patientID, ReferencedID: patientID, Type: "Patient"},
+		Period:  &models.Period{Start: &models.FHIRDateTime{Time: date, Precision: models.Timestamp}},
+	}
+}
@@ -1,32 +1,33 @@
 package huddles
 
 import (
-	"fmt"
 	"hash/fnv"
 	"log"
 	"math"
 	"sort"
-	"strings"
 	"time"
 
-	"gopkg.in/mgo.v2/bson"
-
 	"github.com/intervention-engine/fhir/models"
-	"github.com/intervention-engine/fhir/search"
 	"github.com/intervention-engine/fhir/server"
 )
 
 // HuddleScheduler schedules huddles based on the passed in config.
 type HuddleScheduler struct {
 	Config            *HuddleConfig
+	Clock             Clock
+	Store             HuddleStore
 	Huddles           []*Huddle
 	patientScheduling patientSchedulingInfoMap
 }
 
-// NewHuddleScheduler initializes a new huddle scheduler based on the passed in config.
+// NewHuddleScheduler initializes a new huddle scheduler based on the passed in config.  The scheduler uses the
+// system clock and the FHIR server's database; set Clock and Store to schedule huddles as if it were a different
+// time or using different data.
 func NewHuddleScheduler(config *HuddleConfig) *HuddleScheduler {
 	return &HuddleScheduler{
 		Config:            config,
+		Clock:             systemClock{},
+		Store:             &MongoHuddleStore{DB: server.Database},
 		patientScheduling: make(patientSchedulingInfoMap),
 	}
 }
@@ -104,10 +105,10 @@ func (hs *HuddleScheduler) ScheduleHuddles() ([]*Huddle, error) {
 		return nil, err
 	}
 
-	// Store the huddles in the database
+	// Store the huddles
 	var lastErr error
 	for i := range hs.Huddles {
-		if _, err := server.Database.C("groups").UpsertId(hs.Huddles[i].Id, hs.Huddles[i]); err != nil {
+		if err := hs.Store.SaveHuddle(hs.Huddles[i]); err != nil {
 			lastErr = err
 			log.Printf("Error storing huddle: %s\n", err)
 		}
@@ -124,85 +125,34 @@ func (hs *HuddleScheduler) populatePatientInfosWithRiskScores() error {
 	}
 
 	// Find all of the patients in the scoring ranges used to schedule huddles
-	// NOTE: We don't use IE search framework because prediction.probabilityDecimal is not a search parameter.
-	// That said, we could consider creating a custom search param in the future if we really wanted...
-	riskQuery := bson.M{
-		"method.coding": bson.M{
-			"$elemMatch": bson.M{
-				"system": hs.Config.RiskConfig.RiskMethod.System,
-				"code":   hs.Config.RiskConfig.RiskMethod.Code,
-			},
-		},
-		"meta.tag": bson.M{
-			"$elemMatch": bson.M{
-				"system": "http://interventionengine.org/tags/",
-				"code":   "MOST_RECENT",
-			},
-		},
-		"subject.external": false,
-	}
-
-	if len(hs.Config.RiskConfig.FrequencyConfigs) == 1 {
-		frqCfg := hs.Config.RiskConfig.FrequencyConfigs[0]
-		riskQuery["prediction.probabilityDecimal"] = bson.M{
-			"$gte": frqCfg.MinScore,
-			"$lte": frqCfg.MaxScore,
-		}
-	} else {
-		ranges := make([]bson.M, len(hs.Config.RiskConfig.FrequencyConfigs))
-		for i := range hs.Config.RiskConfig.FrequencyConfigs {
-			frqCfg := hs.Config.RiskConfig.FrequencyConfigs[i]
-			ranges[i] = bson.M{
-				"prediction.probabilityDecimal": bson.M{
-					"$gte": frqCfg.MinScore,
-					"$lte": frqCfg.MaxScore,
-				},
-			}
-		}
-		riskQuery["$or"] = ranges
-	}
-
-	selector := bson.M{
-		"_id": 0,
-		"subject.referenceid":           1,
-		"prediction.probabilityDecimal": 1,
+	scores, err := hs.Store.MostRecentRiskScores(hs.Config.RiskConfig.RiskMethod, hs.Config.RiskConfig.FrequencyConfigs)
+	if err != nil {
+		return err
 	}
-	iter := server.Database.C("riskassessments").Find(riskQuery).Select(selector).Iter()
-	result := models.RiskAssessment{}
-	for iter.Next(&result) {
-		psInfo := hs.patientScheduling.SafeGet(result.Subject.ReferencedID)
-		psInfo.Score = result.Prediction[0].ProbabilityDecimal
+	for patientID, score := range scores {
+		score := score
+		hs.patientScheduling.SafeGet(patientID).Score = &score
 	}
-
-	return iter.Close()
+	return nil
 }
 
 func (hs *HuddleScheduler) populatePatientInfosWithHuddleInfo() error {
 	// Find all of the huddles by the leader id and dates before today
-	searcher := search.NewMongoSearcher(server.Database)
-	queryStr := fmt.Sprintf("leader=Practitioner/%s&activedatetime=lt%s", hs.Config.LeaderID, today().Format("2006-01-02T-07:00"))
-	mgoQuery := searcher.CreateQueryWithoutOptions(search.Query{Resource: "Group", Query: queryStr})
-	selector := bson.M{
-		"_id": 0,
-		"member.entity.referenceid": 1,
+	huddles, err := hs.Store.HuddlesBefore(hs.Config.LeaderID, hs.today())
+	if err != nil {
+		return err
 	}
-	iter := mgoQuery.Sort("-extension.activeDateTime.time").Select(selector).Iter()
 
 	// Iterate through them, setting the last huddle as appropriate
-	i := -1 // Start with -1 because we will record last huddle relative to now (so -1 is one huddle ago)
-	result := models.Group{}
-	for iter.Next(&result) {
-		for _, member := range result.Member {
+	for i := range huddles {
+		// Record last huddle relative to now (so -1 is one huddle ago)
+		huddleIdx := -1 - i
+		for _, member := range huddles[i].Member {
 			psInfo := hs.patientScheduling.SafeGet(member.Entity.ReferencedID)
-			if psInfo.LastHuddle == nil || i > *psInfo.LastHuddle {
-				psInfo.SetLastHuddle(i, hs.Config)
+			if psInfo.LastHuddle == nil || huddleIdx > *psInfo.LastHuddle {
+				psInfo.SetLastHuddle(huddleIdx, hs.Config)
 			}
 		}
-		i--
-	}
-
-	if err := iter.Close(); err != nil {
-		return err
 	}
 
 	// Some of the patients won't have a last huddle, but we should still set their nearest/furthest huddle if possible
@@ -222,7 +172,7 @@ func (hs *HuddleScheduler) createHuddles() error {
 	// Step through one day at a time, starting today, until we have created the requested number of huddles
 	hs.Huddles = make([]*Huddle, 0, hs.Config.LookAhead)
 	checkRollOversAndEvents := true
-	for t := today(); len(hs.Huddles) < hs.Config.LookAhead; t = t.AddDate(0, 0, 1) {
+	for t := hs.today(); len(hs.Huddles) < hs.Config.LookAhead; t = t.AddDate(0, 0, 1) {
 		if !hs.Config.IsHuddleDay(t) {
 			continue
 		}
@@ -235,7 +185,7 @@ func (hs *HuddleScheduler) createHuddles() error {
 		huddleIdx := len(hs.Huddles)
 
 		// If this is today's huddle and any patients are marked reviewed already, then do NOT reschedule this huddle!
-		if huddle != nil && huddle.ActiveDateTime() != nil && huddle.ActiveDateTime().Time == today() {
+		if huddle != nil && huddle.ActiveDateTime() != nil && huddle.ActiveDateTime().Time == hs.today() {
 			huddleInProgress := false
 			for _, member := range huddle.HuddleMembers() {
 				if member.Reviewed() != nil {
@@ -318,16 +268,7 @@ func (hs *HuddleScheduler) getTargetHuddleSize() int {
 }
 
 func (hs *HuddleScheduler) findExistingHuddle(date time.Time) (*Huddle, error) {
-	searcher := search.NewMongoSearcher(server.Database)
-	queryStr := fmt.Sprintf("leader=Practitioner/%s&activedatetime=%s&_sort=activedatetime&_count=1", hs.Config.LeaderID, date.Format("2006-01-02T-07:00"))
-	var huddles []*models.Group
-	if err := searcher.CreateQuery(search.Query{Resource: "Group", Query: queryStr}).All(&huddles); err != nil {
-		return nil, err
-	} else if len(huddles) > 0 {
-		huddle := Huddle(*huddles[0])
-		return &huddle, nil
-	}
-	return nil, nil
+	return hs.Store.FindHuddle(hs.Config.LeaderID, date)
 }
 
 func (hs *HuddleScheduler) addMembersBasedOnRiskScores(huddle *Huddle, huddleIdx, targetSize int) {
@@ -454,7 +395,7 @@ func (hs *HuddleScheduler) addMembersBasedOnRecentEncounters(huddle *Huddle, hud
 		lowInclDate := time.Date(y, m, d, 0, 0, 0, 0, date.Location())
 
 		// Don't bother looking for events in the future!
-		if lowInclDate.After(time.Now()) {
+		if lowInclDate.After(hs.Clock.Now()) {
 			continue
 		}
 
@@ -462,50 +403,8 @@ func (hs *HuddleScheduler) addMembersBasedOnRecentEncounters(huddle *Huddle, hud
 		y, m, d = date.AddDate(0, 0, 1).Date()
 		highExclDate := time.Date(y, m, d, 0, 0, 0, 0, date.Location())
 
-		// Build up the query to get all possible encounters that might trigger a huddle
-		fmt := "2006-01-02T15:04:05.000-07:00"
-		queryStr := "date=ge" + lowInclDate.Format(fmt) + "&date=lt" + highExclDate.Format(fmt) + "&status=arrived,in-progress,onleave,finished"
-		if len(eventConfig.TypeCodes) > 0 {
-			codeVals := make([]string, len(eventConfig.TypeCodes))
-			for i, code := range eventConfig.TypeCodes {
-				codeVals[i] = code.System + "|" + code.Code
-			}
-			queryStr += "&type=" + strings.Join(codeVals, ",")
-		}
-
-		searcher := search.NewMongoSearcher(server.Database)
-		encQuery := searcher.CreateQueryObject(search.Query{Resource: "Encounter", Query: queryStr})
-
-		// FOR NOW: We essentially copy/paste the encounter code we used in the previous version of the scheduler,
-		// but we should revisit at some point since we may be able to streamline this WITHOUT a pipeline.
-
-		// This pipeline starts with the encounter date/code query, sorts them by date, left-joins the huddles and then
-		// returns only the info we care about.
-		pipeline := []bson.M{
-			{"$match": encQuery},
-			{"$sort": bson.M{"period.start": -1}},
-			{"$lookup": bson.M{
-				"from":         "groups",
-				"localField":   "patient.referenceid",
-				"foreignField": "member.entity.referenceid",
-				"as":           "_groups",
-			}},
-			{"$project": bson.M{
-				"_id":       0,
-				"patientID": "$patient.referenceid",
-				"type":      1,
-				"period":    1,
-				"huddles":   "$_groups",
-			}},
-		}
-
-		var results []struct {
-			PatientID string                   `bson:"patientID"`
-			Type      []models.CodeableConcept `bson:"type"`
-			Period    *models.Period           `bson:"period"`
-			Huddles   []models.Group           `bson:"huddles"`
-		}
-		if err := server.Database.C("encounters").Pipe(pipeline).All(&results); err != nil {
+		results, err := hs.Store.FindRecentEncounters(lowInclDate, highExclDate, eventConfig.TypeCodes)
+		if err != nil {
 			return err
 		}
 
@@ -522,10 +421,9 @@ func (hs *HuddleScheduler) addMembersBasedOnRecentEncounters(huddle *Huddle, hud
 					if d, matches := dateMatches(result.Period, &code, lowInclDate, highExclDate); matches {
 						// Collect the PAST huddles, already in the database
 						var huddles []*Huddle
-						for i := range result.Huddles {
-							h := Huddle(result.Huddles[i])
+						for _, h := range result.Huddles {
 							if h.ActiveDateTime() != nil && h.ActiveDateTime().Time.Before(huddle.ActiveDateTime().Time) {
-								huddles = append(huddles, &h)
+								huddles = append(huddles, h)
 							}
 						}
 						// If the patient has been discussed in a huddle since the date, then don't schedule again
@@ -568,14 +466,13 @@ func (hs *HuddleScheduler) addMembersBasedOnRollOvers(huddle *Huddle) {
 	}
 
 	// Find the patients that need to roll over (i.e., the ones not reviewed in the huddle x days ago)
-	expiredHuddleDay := today().AddDate(0, 0, -1*hs.Config.RollOverDelayInDays)
+	expiredHuddleDay := hs.today().AddDate(0, 0, -1*hs.Config.RollOverDelayInDays)
 	expiredHuddle, err := hs.findExistingHuddle(expiredHuddleDay)
 	if err != nil {
 		log.Printf("Error searching on previous huddle (%s) to detect rollover patients\n", expiredHuddleDay.Format("Jan 2"))
 	} else if expiredHuddle != nil {
 		// Check for unreviewed patients
-		eh := Huddle(*expiredHuddle)
-		for _, member := range eh.HuddleMembers() {
+		for _, member := range expiredHuddle.HuddleMembers() {
 			if member.Reviewed() == nil {
 				huddle.AddHuddleMemberDueToRollOver(member.ID(), expiredHuddleDay, member.Reason())
 			}
@@ -590,17 +487,8 @@ func (hs *HuddleScheduler) printInfo() {
 	}
 }
 
-var _nowValueForTestingOnly *time.Time
-
-func now() time.Time {
-	if _nowValueForTestingOnly != nil {
-		return *_nowValueForTestingOnly
-	}
-	return time.Now()
-}
-func today() time.Time {
-	now := now()
-	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+func (hs *HuddleScheduler) today() time.Time {
+	return startOfDay(hs.Clock.Now())
 }
 
 func hash(s string) uint32 {
@@ -117,12 +117,12 @@ func (suite *HuddleSchedulerSuite) TestCreatePopulatedHuddleForNewHuddle() {
 func createPopulatedHuddle(date time.Time, config *HuddleConfig, doRollOver bool) (*models.Group, error) {
 	oldLookAhead := config.LookAhead
 	config.LookAhead = 1
-	_nowValueForTestingOnly = &date
 	defer func() {
 		config.LookAhead = oldLookAhead
-		_nowValueForTestingOnly = nil
 	}()
-	huddles, err := NewHuddleScheduler(config).ScheduleHuddles()
+	hs := NewHuddleScheduler(config)
+	hs.Clock = &FixedClock{Time: date}
+	huddles, err := hs.ScheduleHuddles()
 	if err != nil {
 		return nil, err
 	}
@@ -1263,49 +1263,61 @@ func (suite *HuddleSchedulerSuite) storePatientAndScores(id string, scores ...in
 	p.Id = id
 	require.NoError(suite.DB().C("patients").Insert(p))
 
-	if len(scores) > 0 {
-		day := 24 * time.Hour
-		date := time.Date(2016, time.March, 21, 0, 0, 0, 0, time.UTC).Add(time.Duration(-7*len(scores)) * day)
-		for i, score := range scores {
-			ra := new(models.RiskAssessment)
-			ra.Id = bson.NewObjectId().Hex()
-			ra.Subject = &models.Reference{
-				Reference:    "Patient/" + id,
-				ReferencedID: id,
-				Type:         "Patient",
-				External:     new(bool),
-			}
-			ra.Date = &models.FHIRDateTime{Time: date, Precision: models.Timestamp}
-			ra.Method = &models.CodeableConcept{
-				Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "Test"}},
-				Text:   "Test Risk Assessment",
-			}
-			ra.Basis = []models.Reference{
-				{Reference: "http://foo.org/pie/" + ra.Id},
-			}
-			scoreFlt := float64(score)
-			ra.Prediction = []models.RiskAssessmentPredictionComponent{
+	for _, ra := range newRiskAssessments(id, scores...) {
+		require.NoError(suite.DB().C("riskassessments").Insert(ra))
+	}
+}
+
+// newRiskAssessments creates the weekly risk assessments stored by storePatientAndScores
+func newRiskAssessments(id string, scores ...int) []models.RiskAssessment {
+	ras := make([]models.RiskAssessment, len(scores))
+	day := 24 * time.Hour
+	date := time.Date(2016, time.March, 21, 0, 0, 0, 0, time.UTC).Add(time.Duration(-7*len(scores)) * day)
+	for i, score := range scores {
+		ra := &ras[i]
+		ra.Id = bson.NewObjectId().Hex()
+		ra.Subject = &models.Reference{
+			Reference:    "Patient/" + id,
+			ReferencedID: id,
+			Type:         "Patient",
+			External:     new(bool),
+		}
+		ra.Date = &models.FHIRDateTime{Time: date, Precision: models.Timestamp}
+		ra.Method = &models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "Test"}},
+			Text:   "Test Risk Assessment",
+		}
+		ra.Basis = []models.Reference{
+			{Reference: "http://foo.org/pie/" + ra.Id},
+		}
+		scoreFlt := float64(score)
+		ra.Prediction = []models.RiskAssessmentPredictionComponent{
+			{
+				ProbabilityDecimal: &scoreFlt,
+				Outcome:            &models.CodeableConcept{Text: "Something Bad"},
+			},
+		}
+		if i == len(scores)-1 {
+			ra.Meta = new(models.Meta)
+			ra.Meta.Tag = []models.Coding{
 				{
-					ProbabilityDecimal: &scoreFlt,
-					Outcome:            &models.CodeableConcept{Text: "Something Bad"},
+					System: "http://interventionengine.org/tags/",
+					Code:   "MOST_RECENT",
 				},
 			}
-			if i == len(scores)-1 {
-				ra.Meta = new(models.Meta)
-				ra.Meta.Tag = []models.Coding{
-					{
-						System: "http://interventionengine.org/tags/",
-						Code:   "MOST_RECENT",
-					},
-				}
-			}
-			require.NoError(suite.DB().C("riskassessments").Insert(ra))
-			date = date.Add(7 * 24 * time.Hour)
 		}
+		date = date.Add(7 * 24 * time.Hour)
 	}
+	return ras
 }
 
 func (suite *HuddleSchedulerSuite) storeEncounter(patientID string, code string, startDate *time.Time, endDate *time.Time) *models.Encounter {
+	enc := newEncounter(patientID, code, startDate, endDate)
+	suite.Require().NoError(suite.DB().C("encounters").Insert(enc))
+	return enc
+}
+
+func newEncounter(patientID string, code string, startDate *time.Time, endDate *time.Time) *models.Encounter {
 	enc := new(models.Encounter)
 	enc.Id = bson.NewObjectId().Hex()
 	enc.Status = "finished"
@@ -1329,14 +1341,15 @@ func (suite *HuddleSchedulerSuite) storeEncounter(patientID string, code string,
 	if endDate != nil {
 		enc.Period.End = &models.FHIRDateTime{Time: *endDate, Precision: models.Timestamp}
 	}
-	err := suite.DB().C("encounters").Insert(enc)
-	suite.Require().NoError(err)
 	return enc
 }
 
 func (suite *HuddleSchedulerSuite) storeHuddleWithDetails(date time.Time, leaderID string, defaultReason *models.CodeableConcept, reasonMap map[string]*models.CodeableConcept, reviewedMap map[string]time.Time, patients ...string) {
-	require := require.New(suite.T())
+	g := newHuddleWithDetails(date, leaderID, defaultReason, reasonMap, reviewedMap, patients...)
+	suite.Require().NoError(suite.DB().C("groups").Insert(g))
+}
 
+func newHuddleWithDetails(date time.Time, leaderID string, defaultReason *models.CodeableConcept, reasonMap map[string]*models.CodeableConcept, reviewedMap map[string]time.Time, patients ...string) *models.Group {
 	g := new(models.Group)
 	g.Id = bson.NewObjectId().Hex()
 	g.Meta = &models.Meta{
@@ -1393,8 +1406,7 @@ func (suite *HuddleSchedulerSuite) storeHuddleWithDetails(date time.Time, leader
 			External:     new(bool),
 		}
 	}
-
-	require.NoError(suite.DB().C("groups").Insert(g))
+	return g
 }
 
 func (suite *HuddleSchedulerSuite) storeHuddle(date time.Time, leaderID string, reason *models.CodeableConcept, patients ...string) {
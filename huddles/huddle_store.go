@@ -0,0 +1,248 @@
+package huddles
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// HuddleStore provides the huddle scheduler with the risk scores, encounters, and huddles it needs, and stores the
+// huddles it schedules.
+type HuddleStore interface {
+	// MostRecentRiskScores returns the most recent risk scores calculated using the method, keyed by patient ID,
+	// for the patients whose scores fall into any of the frequency configs' ranges
+	MostRecentRiskScores(method models.Coding, ranges []RiskScoreFrequencyConfig) (map[string]float64, error)
+	// HuddlesBefore returns the leader's huddles before the date (ignoring the time), most recent first
+	HuddlesBefore(leaderID string, date time.Time) ([]*Huddle, error)
+	// FindHuddle returns the leader's huddle on the date (ignoring the time), or nil if there isn't one
+	FindHuddle(leaderID string, date time.Time) (*Huddle, error)
+	// FindRecentEncounters returns the arrived, in-progress, onleave, and finished encounters of the given types
+	// that occur at some point on or after lowIncl and before highExcl, most recent first
+	FindRecentEncounters(lowIncl, highExcl time.Time, types []EventCode) ([]RecentEncounter, error)
+	// SaveHuddle inserts or updates the huddle
+	SaveHuddle(huddle *Huddle) error
+	// HuddlesInRange returns the leader's huddles from start through end (ignoring the times)
+	HuddlesInRange(leaderID string, start, end time.Time) ([]*Huddle, error)
+	// CurrentRiskScores returns the patients' most recent risk scores calculated using the method, keyed by patient ID
+	CurrentRiskScores(method models.Coding, patientIDs []string) (map[string]float64, error)
+	// PatientEncounters returns the patients' encounters that start after lowExcl and on or before highIncl
+	PatientEncounters(patientIDs []string, lowExcl, highIncl time.Time) ([]models.Encounter, error)
+}
+
+// RecentEncounter is an encounter that may trigger a huddle discussion, along with every huddle the patient is in
+type RecentEncounter struct {
+	PatientID string                   `bson:"patientID"`
+	Type      []models.CodeableConcept `bson:"type"`
+	Period    *models.Period           `bson:"period"`
+	Huddles   []*Huddle                `bson:"huddles"`
+}
+
+// MongoHuddleStore is a HuddleStore backed by the FHIR server's Mongo database
+type MongoHuddleStore struct {
+	DB *mgo.Database
+}
+
+// MostRecentRiskScores finds the risk assessments tagged MOST_RECENT in the riskassessments collection
+func (s *MongoHuddleStore) MostRecentRiskScores(method models.Coding, ranges []RiskScoreFrequencyConfig) (map[string]float64, error) {
+	// NOTE: We don't use IE search framework because prediction.probabilityDecimal is not a search parameter.
+	// That said, we could consider creating a custom search param in the future if we really wanted...
+	riskQuery := bson.M{
+		"method.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": method.System,
+				"code":   method.Code,
+			},
+		},
+		"meta.tag": bson.M{
+			"$elemMatch": bson.M{
+				"system": "http://interventionengine.org/tags/",
+				"code":   "MOST_RECENT",
+			},
+		},
+		"subject.external": false,
+	}
+
+	if len(ranges) == 1 {
+		riskQuery["prediction.probabilityDecimal"] = bson.M{
+			"$gte": ranges[0].MinScore,
+			"$lte": ranges[0].MaxScore,
+		}
+	} else {
+		or := make([]bson.M, len(ranges))
+		for i := range ranges {
+			or[i] = bson.M{
+				"prediction.probabilityDecimal": bson.M{
+					"$gte": ranges[i].MinScore,
+					"$lte": ranges[i].MaxScore,
+				},
+			}
+		}
+		riskQuery["$or"] = or
+	}
+
+	selector := bson.M{
+		"_id":                           0,
+		"subject.referenceid":           1,
+		"prediction.probabilityDecimal": 1,
+	}
+	scores := make(map[string]float64)
+	iter := s.DB.C("riskassessments").Find(riskQuery).Select(selector).Iter()
+	result := models.RiskAssessment{}
+	for iter.Next(&result) {
+		scores[result.Subject.ReferencedID] = *result.Prediction[0].ProbabilityDecimal
+	}
+	return scores, iter.Close()
+}
+
+// HuddlesBefore searches the groups collection for the leader's huddles before the date
+func (s *MongoHuddleStore) HuddlesBefore(leaderID string, date time.Time) ([]*Huddle, error) {
+	searcher := search.NewMongoSearcher(s.DB)
+	queryStr := fmt.Sprintf("leader=Practitioner/%s&activedatetime=lt%s", leaderID, date.Format("2006-01-02T-07:00"))
+	mgoQuery := searcher.CreateQueryWithoutOptions(search.Query{Resource: "Group", Query: queryStr})
+	var huddles []*Huddle
+	err := mgoQuery.Sort("-extension.activeDateTime.time").All(&huddles)
+	return huddles, err
+}
+
+// FindHuddle searches the groups collection for the leader's huddle on the date
+func (s *MongoHuddleStore) FindHuddle(leaderID string, date time.Time) (*Huddle, error) {
+	searcher := search.NewMongoSearcher(s.DB)
+	queryStr := fmt.Sprintf("leader=Practitioner/%s&activedatetime=%s&_sort=activedatetime&_count=1", leaderID, date.Format("2006-01-02T-07:00"))
+	var huddles []*Huddle
+	if err := searcher.CreateQuery(search.Query{Resource: "Group", Query: queryStr}).All(&huddles); err != nil {
+		return nil, err
+	} else if len(huddles) > 0 {
+		return huddles[0], nil
+	}
+	return nil, nil
+}
+
+// FindRecentEncounters searches the encounters collection, joining each encounter to the patient's huddles
+func (s *MongoHuddleStore) FindRecentEncounters(lowIncl, highExcl time.Time, types []EventCode) ([]RecentEncounter, error) {
+	// Build up the query to get all possible encounters that might trigger a huddle
+	fmt := "2006-01-02T15:04:05.000-07:00"
+	queryStr := "date=ge" + lowIncl.Format(fmt) + "&date=lt" + highExcl.Format(fmt) + "&status=arrived,in-progress,onleave,finished"
+	if len(types) > 0 {
+		codeVals := make([]string, len(types))
+		for i, code := range types {
+			codeVals[i] = code.System + "|" + code.Code
+		}
+		queryStr += "&type=" + strings.Join(codeVals, ",")
+	}
+
+	searcher := search.NewMongoSearcher(s.DB)
+	encQuery := searcher.CreateQueryObject(search.Query{Resource: "Encounter", Query: queryStr})
+
+	// This pipeline starts with the encounter date/code query, sorts them by date, left-joins the huddles and then
+	// returns only the info we care about.
+	pipeline := []bson.M{
+		{"$match": encQuery},
+		{"$sort": bson.M{"period.start": -1}},
+		{"$lookup": bson.M{
+			"from":         "groups",
+			"localField":   "patient.referenceid",
+			"foreignField": "member.entity.referenceid",
+			"as":           "_groups",
+		}},
+		{"$project": bson.M{
+			"_id":       0,
+			"patientID": "$patient.referenceid",
+			"type":      1,
+			"period":    1,
+			"huddles":   "$_groups",
+		}},
+	}
+
+	var results []RecentEncounter
+	err := s.DB.C("encounters").Pipe(pipeline).All(&results)
+	return results, err
+}
+
+// SaveHuddle upserts the huddle into the groups collection
+func (s *MongoHuddleStore) SaveHuddle(huddle *Huddle) error {
+	_, err := s.DB.C("groups").UpsertId(huddle.Id, huddle)
+	return err
+}
+
+// HuddlesInRange searches the groups collection for the leader's huddles in the range
+func (s *MongoHuddleStore) HuddlesInRange(leaderID string, start, end time.Time) ([]*Huddle, error) {
+	searcher := search.NewMongoSearcher(s.DB)
+	queryStr := fmt.Sprintf("leader=Practitioner/%s&activedatetime=ge%s&activedatetime=le%s", leaderID,
+		start.Format("2006-01-02T-07:00"), end.Format("2006-01-02T-07:00"))
+	var huddles []*Huddle
+	err := searcher.CreateQueryWithoutOptions(search.Query{Resource: "Group", Query: queryStr}).All(&huddles)
+	return huddles, err
+}
+
+// CurrentRiskScores finds the patients' risk assessments tagged MOST_RECENT in the riskassessments collection
+func (s *MongoHuddleStore) CurrentRiskScores(method models.Coding, patientIDs []string) (map[string]float64, error) {
+	riskQuery := bson.M{
+		"method.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": method.System,
+				"code":   method.Code,
+			},
+		},
+		"meta.tag": bson.M{
+			"$elemMatch": bson.M{
+				"system": "http://interventionengine.org/tags/",
+				"code":   "MOST_RECENT",
+			},
+		},
+		"subject.referenceid": bson.M{"$in": patientIDs},
+	}
+	selector := bson.M{
+		"_id":                           0,
+		"subject.referenceid":           1,
+		"prediction.probabilityDecimal": 1,
+	}
+	scores := make(map[string]float64)
+	iter := s.DB.C("riskassessments").Find(riskQuery).Select(selector).Iter()
+	result := models.RiskAssessment{}
+	for iter.Next(&result) {
+		if len(result.Prediction) > 0 && result.Prediction[0].ProbabilityDecimal != nil {
+			scores[result.Subject.ReferencedID] = *result.Prediction[0].ProbabilityDecimal
+		}
+	}
+	return scores, iter.Close()
+}
+
+// PatientEncounters finds the patients' encounters in the encounters collection
+func (s *MongoHuddleStore) PatientEncounters(patientIDs []string, lowExcl, highIncl time.Time) ([]models.Encounter, error) {
+	query := bson.M{
+		"patient.referenceid": bson.M{"$in": patientIDs},
+		"period.start.time": bson.M{
+			"$gt":  lowExcl,
+			"$lte": highIncl,
+		},
+	}
+	var encounters []models.Encounter
+	err := s.DB.C("encounters").Find(query).All(&encounters)
+	return encounters, err
+}
+
+// StoreRiskScore inserts a risk assessment for the score, moving the MOST_RECENT tag from the patient's previous one
+func (s *MongoHuddleStore) StoreRiskScore(patientID string, method models.Coding, score float64, date time.Time) error {
+	c := s.DB.C("riskassessments")
+	mostRecentQuery := bson.M{
+		"subject.referenceid": patientID,
+		"method.coding": bson.M{
+			"$elemMatch": bson.M{"system": method.System, "code": method.Code},
+		},
+		"meta.tag.code": "MOST_RECENT",
+	}
+	if _, err := c.UpdateAll(mostRecentQuery, bson.M{"$unset": bson.M{"meta": ""}}); err != nil {
+		return err
+	}
+	return c.Insert(newMostRecentRiskAssessment(patientID, method, score, date))
+}
+
+// StoreEncounter inserts the encounter into the encounters collection
+func (s *MongoHuddleStore) StoreEncounter(encounter *models.Encounter) error {
+	return s.DB.C("encounters").Insert(encounter)
+}
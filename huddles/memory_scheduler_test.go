@@ -0,0 +1,207 @@
+package huddles
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMemoryHuddleSchedulerSuite(t *testing.T) {
+	suite.Run(t, new(MemoryHuddleSchedulerSuite))
+}
+
+// MemoryHuddleSchedulerSuite runs the scheduler against a MemoryHuddleStore with a fixed clock, so it doesn't need a
+// database and the dates it checks are always the same.
+type MemoryHuddleSchedulerSuite struct {
+	suite.Suite
+	Store *MemoryHuddleStore
+	Clock *FixedClock
+}
+
+func (suite *MemoryHuddleSchedulerSuite) SetupTest() {
+	suite.Store = NewMemoryHuddleStore()
+	// Monday, March 21, 2016
+	suite.Clock = &FixedClock{Time: time.Date(2016, time.March, 21, 10, 30, 0, 0, time.Local)}
+}
+
+func (suite *MemoryHuddleSchedulerSuite) TestScheduleHuddlesByRiskScore() {
+	assert := suite.Assert()
+
+	suite.storeScores(bsonID(1), 5, 4, 7)  // every 2 weeks
+	suite.storeScores(bsonID(2), 1, 1, 1)  // never
+	suite.storeScores(bsonID(3), 1, 2, 3)  // every 4 weeks
+	suite.storeScores(bsonID(4), 9, 9, 10) // every week
+	suite.storeScores(bsonID(5), 7, 6, 5)  // every 4 weeks
+
+	huddles := suite.scheduleHuddles(createHuddleConfig(true, false, 0, time.Monday))
+	t := suite.today()
+	suite.assertHuddle(huddles[0], t, bsonID(4), bsonID(1))
+	suite.assertHuddle(huddles[1], t.AddDate(0, 0, 7), bsonID(4), bsonID(5))
+	suite.assertHuddle(huddles[2], t.AddDate(0, 0, 14), bsonID(4), bsonID(1))
+	// Patient 3 comes first because they're both due, but 3 has never been discussed before
+	suite.assertHuddle(huddles[3], t.AddDate(0, 0, 21), bsonID(3), bsonID(4))
+
+	// Now just make sure they were really stored
+	assert.Equal(huddles, suite.Store.Huddles(), "Stored huddles should match returned huddles")
+}
+
+func (suite *MemoryHuddleSchedulerSuite) TestScheduleHuddlesByEncounterEvents() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	t := suite.Clock.Now()
+	daysAgo := func(days int) *time.Time {
+		result := t.AddDate(0, 0, -1*days)
+		return &result
+	}
+	suite.Store.AddEncounters(
+		*newEncounter(bsonID(1), "HOSP", daysAgo(15), daysAgo(10)), // 10 days ago -- don't trigger
+		*newEncounter(bsonID(2), "HOSP", daysAgo(10), daysAgo(4)),  // discharged 4 days ago -- trigger discharge
+		*newEncounter(bsonID(3), "HOSP", daysAgo(6), daysAgo(4)),   // whole stay in last 7 days -- trigger discharge
+		*newEncounter(bsonID(4), "HOSP", daysAgo(6), nil),          // admit 6 days ago, ongoing -- trigger admit
+		*newEncounter(bsonID(5), "HOSP", daysAgo(10), nil),         // admit 10 days ago, ongoing -- don't trigger
+		*newEncounter(bsonID(6), "ER", daysAgo(1), daysAgo(1)),     // ED visit yesterday -- trigger ED
+		*newEncounter(bsonID(7), "FOO", daysAgo(2), daysAgo(1)),    // Unrecognized code -- don't trigger
+	)
+
+	huddles := suite.scheduleHuddles(createHuddleConfig(false, true, 0, time.Monday))
+	suite.assertHuddle(huddles[0], suite.today(), bsonID(6), bsonID(3), bsonID(4), bsonID(2))
+	for i := 1; i < 4; i++ {
+		suite.assertHuddle(huddles[i], suite.today().AddDate(0, 0, 7*i))
+	}
+
+	reasons := map[string]string{
+		bsonID(2): "Hospital Discharge",
+		bsonID(3): "Hospital Discharge",
+		bsonID(4): "Hospital Admission",
+		bsonID(6): "Emergency Room Visit",
+	}
+	for id, reason := range reasons {
+		m := huddles[0].FindHuddleMember(id)
+		require.NotNil(m)
+		assert.Equal(reason, m.Reason().Text)
+	}
+
+	// Scheduling again should give the same results (and not bump the patients to the next huddle)
+	again := suite.scheduleHuddles(createHuddleConfig(false, true, 0, time.Monday))
+	suite.assertHuddle(again[0], suite.today(), bsonID(6), bsonID(3), bsonID(4), bsonID(2))
+}
+
+func (suite *MemoryHuddleSchedulerSuite) TestRollOverPatientsToTodaysHuddle() {
+	require := suite.Require()
+
+	lastHuddle := suite.today().AddDate(0, 0, -3)
+	suite.storeScores(bsonID(1), 1, 1, 1) // never
+	suite.storeScores(bsonID(2), 5, 5, 4) // every 4 weeks
+	suite.storeScores(bsonID(3), 8, 8, 7) // every 2 weeks
+	suite.storeScores(bsonID(4), 8, 9, 8) // every week
+	suite.storeScores(bsonID(5), 8, 9, 8) // every week
+	suite.storeScores(bsonID(6), 8, 8, 7) // every 2 weeks
+	config := createHuddleConfig(true, true, 3, lastHuddle.Weekday(), suite.today().Weekday())
+
+	// Store the last huddle with five patients, two of whom were reviewed
+	reasonMap := map[string]*models.CodeableConcept{
+		bsonID(2): manualAdditionReason("I've got a hunch"),
+	}
+	reviewedMap := map[string]time.Time{
+		bsonID(4): lastHuddle,
+		bsonID(6): lastHuddle,
+	}
+	suite.storeHuddle(newHuddleWithDetails(lastHuddle, config.LeaderID, riskScoreReason(), reasonMap, reviewedMap, bsonID(2), bsonID(3), bsonID(4), bsonID(5), bsonID(6)))
+
+	huddles := suite.scheduleHuddles(config)
+	ha := suite.assertHuddle(huddles[0], suite.today(), bsonID(2), bsonID(3), bsonID(4), bsonID(5))
+	require.Len(ha.Member, 4)
+	ha.AssertMember(0, bsonID(2), rollOverReason(lastHuddle, manualAdditionReason("I've got a hunch")))
+	ha.AssertMember(1, bsonID(3), rollOverReason(lastHuddle, riskScoreReason()))
+	ha.AssertMember(2, bsonID(4), riskScoreReason())
+	ha.AssertMember(3, bsonID(5), riskScoreReason())
+}
+
+func (suite *MemoryHuddleSchedulerSuite) TestInProgressHuddleIsntOverwritten() {
+	assert := suite.Assert()
+
+	today := suite.today()
+	lastHuddle := today.AddDate(0, 0, -3)
+	suite.storeScores(bsonID(1), 1, 1, 1)
+	suite.storeScores(bsonID(2), 5, 5, 4)
+	suite.storeScores(bsonID(3), 8, 8, 7)
+	suite.storeScores(bsonID(4), 8, 9, 8)
+	suite.storeScores(bsonID(5), 8, 9, 8)
+	suite.storeScores(bsonID(6), 8, 8, 5)
+	config := createHuddleConfig(true, true, 3, lastHuddle.Weekday(), today.Weekday())
+
+	reasonMap := map[string]*models.CodeableConcept{
+		bsonID(4): manualAdditionReason("I've got a hunch"),
+	}
+	reviewedMap := map[string]time.Time{
+		bsonID(3): lastHuddle,
+		bsonID(5): lastHuddle,
+	}
+	suite.storeHuddle(newHuddleWithDetails(lastHuddle, config.LeaderID, riskScoreReason(), reasonMap, reviewedMap, bsonID(3), bsonID(4), bsonID(5), bsonID(6)))
+	// Today's huddle has one reviewed patient, so it's in progress
+	suite.storeHuddle(newHuddleWithDetails(today, config.LeaderID, riskScoreReason(), nil, map[string]time.Time{bsonID(2): today}, bsonID(1), bsonID(2)))
+
+	huddles := suite.scheduleHuddles(config)
+	ha := suite.assertHuddle(huddles[0], today, bsonID(1), bsonID(2))
+	assert.Equal(today, ha.FindHuddleMember(bsonID(2)).Reviewed().Time)
+
+	ha = suite.assertHuddle(huddles[1], today.AddDate(0, 0, 4), bsonID(6), bsonID(4), bsonID(5), bsonID(3))
+	ha.AssertMember(0, bsonID(6), rollOverReason(lastHuddle, riskScoreReason()))
+}
+
+func (suite *MemoryHuddleSchedulerSuite) TestSchedulersWithDifferentClocks() {
+	suite.storeScores(bsonID(1), 9)
+
+	// Two huddles, led by different leaders, that meet on different days are scheduled from different clocks
+	monday := createHuddleConfig(true, false, 0, time.Monday)
+	wednesday := createHuddleConfig(true, false, 0, time.Wednesday)
+	wednesday.LeaderID = "456"
+
+	mondayHuddles := suite.scheduleHuddles(monday)
+	hs := NewHuddleScheduler(wednesday)
+	hs.Store = suite.Store
+	hs.Clock = &FixedClock{Time: suite.Clock.Now().AddDate(0, 0, 16)}
+	wednesdayHuddles, err := hs.ScheduleHuddles()
+	suite.Require().NoError(err)
+
+	suite.assertHuddle(mondayHuddles[0], suite.today(), bsonID(1))
+	suite.assertHuddle(wednesdayHuddles[0], suite.today().AddDate(0, 0, 16), bsonID(1))
+	suite.Assert().Len(suite.Store.Huddles(), 8)
+}
+
+func (suite *MemoryHuddleSchedulerSuite) today() time.Time {
+	return startOfDay(suite.Clock.Now())
+}
+
+func (suite *MemoryHuddleSchedulerSuite) storeScores(id string, scores ...int) {
+	suite.Store.AddRiskAssessments(newRiskAssessments(id, scores...)...)
+}
+
+func (suite *MemoryHuddleSchedulerSuite) storeHuddle(g *models.Group) {
+	h := Huddle(*g)
+	suite.Require().NoError(suite.Store.SaveHuddle(&h))
+}
+
+func (suite *MemoryHuddleSchedulerSuite) scheduleHuddles(config *HuddleConfig) []*Huddle {
+	hs := NewHuddleScheduler(config)
+	hs.Store = suite.Store
+	hs.Clock = suite.Clock
+	huddles, err := hs.ScheduleHuddles()
+	suite.Require().NoError(err)
+	suite.Require().Len(huddles, config.LookAhead)
+	return huddles
+}
+
+func (suite *MemoryHuddleSchedulerSuite) assertHuddle(h *Huddle, date time.Time, memberIDs ...string) *HuddleAssertions {
+	g := models.Group(*h)
+	ha := NewHuddleAssertions(&g, suite.Assert())
+	ha.AssertValidHuddleProfile()
+	ha.AssertActiveDateTimeEqual(date)
+	ha.AssertMemberIDs(memberIDs...)
+	return ha
+}
@@ -0,0 +1,318 @@
+package huddles
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// MemoryHuddleStore is a HuddleStore that keeps everything in memory.  It is useful for simulations and tests, where
+// a database isn't needed (or wanted).  It answers queries the same way the MongoHuddleStore does.
+type MemoryHuddleStore struct {
+	mutex           sync.RWMutex
+	riskAssessments []models.RiskAssessment
+	encounters      []models.Encounter
+	huddles         []*Huddle
+}
+
+// NewMemoryHuddleStore returns an empty MemoryHuddleStore
+func NewMemoryHuddleStore() *MemoryHuddleStore {
+	return &MemoryHuddleStore{}
+}
+
+// AddRiskAssessments adds risk assessments to the store.  As in the database, only risk assessments tagged
+// MOST_RECENT are used for scheduling.
+func (s *MemoryHuddleStore) AddRiskAssessments(ras ...models.RiskAssessment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.riskAssessments = append(s.riskAssessments, ras...)
+}
+
+// AddEncounters adds encounters to the store
+func (s *MemoryHuddleStore) AddEncounters(encounters ...models.Encounter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.encounters = append(s.encounters, encounters...)
+}
+
+// StoreRiskScore adds a risk assessment for the score, removing the MOST_RECENT tag from the patient's previous one
+func (s *MemoryHuddleStore) StoreRiskScore(patientID string, method models.Coding, score float64, date time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.riskAssessments {
+		ra := &s.riskAssessments[i]
+		if ra.Subject != nil && ra.Subject.ReferencedID == patientID && ra.Method != nil && ra.Method.MatchesCode(method.System, method.Code) {
+			ra.Meta = nil
+		}
+	}
+	s.riskAssessments = append(s.riskAssessments, *newMostRecentRiskAssessment(patientID, method, score, date))
+	return nil
+}
+
+// StoreEncounter adds the encounter to the store
+func (s *MemoryHuddleStore) StoreEncounter(encounter *models.Encounter) error {
+	s.AddEncounters(*encounter)
+	return nil
+}
+
+// Huddles returns copies of all the huddles in the store, sorted by date
+func (s *MemoryHuddleStore) Huddles() []*Huddle {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	huddles := make([]*Huddle, len(s.huddles))
+	for i := range s.huddles {
+		huddles[i] = copyHuddle(s.huddles[i])
+	}
+	sort.Stable(byActiveDateTime(huddles))
+	return huddles
+}
+
+// MostRecentRiskScores finds the risk assessments tagged MOST_RECENT for patients whose scores are in the ranges
+func (s *MemoryHuddleStore) MostRecentRiskScores(method models.Coding, ranges []RiskScoreFrequencyConfig) (map[string]float64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	scores := make(map[string]float64)
+	for i := range s.riskAssessments {
+		ra := &s.riskAssessments[i]
+		if ra.Subject == nil || ra.Subject.External == nil || *ra.Subject.External {
+			continue
+		}
+		if ra.Method == nil || !ra.Method.MatchesCode(method.System, method.Code) || !isMostRecent(ra.Meta) {
+			continue
+		}
+		if len(ra.Prediction) == 0 || ra.Prediction[0].ProbabilityDecimal == nil {
+			continue
+		}
+		score := *ra.Prediction[0].ProbabilityDecimal
+		for _, r := range ranges {
+			if score >= r.MinScore && score <= r.MaxScore {
+				scores[ra.Subject.ReferencedID] = score
+				break
+			}
+		}
+	}
+	return scores, nil
+}
+
+// HuddlesBefore finds the leader's huddles before the date, most recent first
+func (s *MemoryHuddleStore) HuddlesBefore(leaderID string, date time.Time) ([]*Huddle, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	day := startOfDay(date)
+	var huddles []*Huddle
+	for _, h := range s.huddles {
+		if isLedBy(h, leaderID) && h.ActiveDateTime().Time.Before(day) {
+			huddles = append(huddles, copyHuddle(h))
+		}
+	}
+	sort.Stable(sort.Reverse(byActiveDateTime(huddles)))
+	return huddles, nil
+}
+
+// FindHuddle finds the leader's earliest huddle on the date, or nil if there isn't one
+func (s *MemoryHuddleStore) FindHuddle(leaderID string, date time.Time) (*Huddle, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	low := startOfDay(date)
+	high := low.AddDate(0, 0, 1)
+	var found *Huddle
+	for _, h := range s.huddles {
+		if !isLedBy(h, leaderID) {
+			continue
+		}
+		t := h.ActiveDateTime().Time
+		if !t.Before(low) && t.Before(high) && (found == nil || t.Before(found.ActiveDateTime().Time)) {
+			found = h
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return copyHuddle(found), nil
+}
+
+// FindRecentEncounters finds the matching encounters, most recent first, along with the patients' huddles
+func (s *MemoryHuddleStore) FindRecentEncounters(lowIncl, highExcl time.Time, types []EventCode) ([]RecentEncounter, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var results []RecentEncounter
+	for i := range s.encounters {
+		enc := &s.encounters[i]
+		if enc.Patient == nil || enc.Period == nil || !isEventStatus(enc.Status) {
+			continue
+		}
+		// These mirror the FHIR server's date=ge and date=lt searches on periods
+		p := enc.Period
+		ge := p.End == nil || (p.Start != nil && !p.Start.Time.Before(lowIncl)) || p.End.Time.After(lowIncl)
+		lt := p.Start == nil || p.Start.Time.Before(highExcl)
+		if !ge || !lt {
+			continue
+		}
+		if len(types) > 0 {
+			matches := false
+			for j := range types {
+				matches = matches || codeMatches(enc.Type, &types[j])
+			}
+			if !matches {
+				continue
+			}
+		}
+
+		result := RecentEncounter{PatientID: enc.Patient.ReferencedID, Type: enc.Type, Period: enc.Period}
+		for _, h := range s.huddles {
+			if h.FindHuddleMember(result.PatientID) != nil {
+				result.Huddles = append(result.Huddles, copyHuddle(h))
+			}
+		}
+		results = append(results, result)
+	}
+	sort.Stable(byRecentEncounterStart(results))
+	return results, nil
+}
+
+// SaveHuddle stores a copy of the huddle, replacing any huddle with the same ID
+func (s *MemoryHuddleStore) SaveHuddle(huddle *Huddle) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.huddles {
+		if s.huddles[i].Id == huddle.Id {
+			s.huddles[i] = copyHuddle(huddle)
+			return nil
+		}
+	}
+	s.huddles = append(s.huddles, copyHuddle(huddle))
+	return nil
+}
+
+// HuddlesInRange finds the leader's huddles from start through end, sorted by date
+func (s *MemoryHuddleStore) HuddlesInRange(leaderID string, start, end time.Time) ([]*Huddle, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	low := startOfDay(start)
+	high := startOfDay(end).AddDate(0, 0, 1)
+	var huddles []*Huddle
+	for _, h := range s.huddles {
+		if !isLedBy(h, leaderID) {
+			continue
+		}
+		if t := h.ActiveDateTime().Time; !t.Before(low) && t.Before(high) {
+			huddles = append(huddles, copyHuddle(h))
+		}
+	}
+	sort.Stable(byActiveDateTime(huddles))
+	return huddles, nil
+}
+
+// CurrentRiskScores finds the patients' risk assessments tagged MOST_RECENT
+func (s *MemoryHuddleStore) CurrentRiskScores(method models.Coding, patientIDs []string) (map[string]float64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	patients := make(map[string]bool, len(patientIDs))
+	for _, id := range patientIDs {
+		patients[id] = true
+	}
+	scores := make(map[string]float64)
+	for i := range s.riskAssessments {
+		ra := &s.riskAssessments[i]
+		if ra.Subject == nil || !patients[ra.Subject.ReferencedID] {
+			continue
+		}
+		if ra.Method == nil || !ra.Method.MatchesCode(method.System, method.Code) || !isMostRecent(ra.Meta) {
+			continue
+		}
+		if len(ra.Prediction) > 0 && ra.Prediction[0].ProbabilityDecimal != nil {
+			scores[ra.Subject.ReferencedID] = *ra.Prediction[0].ProbabilityDecimal
+		}
+	}
+	return scores, nil
+}
+
+// PatientEncounters finds the patients' encounters that start after lowExcl and on or before highIncl
+func (s *MemoryHuddleStore) PatientEncounters(patientIDs []string, lowExcl, highIncl time.Time) ([]models.Encounter, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	patients := make(map[string]bool, len(patientIDs))
+	for _, id := range patientIDs {
+		patients[id] = true
+	}
+	var encounters []models.Encounter
+	for _, enc := range s.encounters {
+		if enc.Patient == nil || !patients[enc.Patient.ReferencedID] || enc.Period == nil || enc.Period.Start == nil {
+			continue
+		}
+		if t := enc.Period.Start.Time; t.After(lowExcl) && !t.After(highIncl) {
+			encounters = append(encounters, enc)
+		}
+	}
+	return encounters, nil
+}
+
+// copyHuddle copies the huddle deeply enough that the scheduler's changes to the copy's members (and the members'
+// extensions) don't affect the original
+func copyHuddle(h *Huddle) *Huddle {
+	c := *h
+	c.Member = make([]models.GroupMemberComponent, len(h.Member))
+	for i := range h.Member {
+		c.Member[i] = h.Member[i]
+		c.Member[i].Extension = append([]models.Extension(nil), h.Member[i].Extension...)
+	}
+	return &c
+}
+
+func isLedBy(h *Huddle, leaderID string) bool {
+	leader := h.Leader()
+	return leader != nil && leader.ReferencedID == leaderID && h.ActiveDateTime() != nil
+}
+
+func isMostRecent(meta *models.Meta) bool {
+	if meta == nil {
+		return false
+	}
+	for _, tag := range meta.Tag {
+		if tag.System == "http://interventionengine.org/tags/" && tag.Code == "MOST_RECENT" {
+			return true
+		}
+	}
+	return false
+}
+
+func isEventStatus(status string) bool {
+	switch status {
+	case "arrived", "in-progress", "onleave", "finished":
+		return true
+	}
+	return false
+}
+
+type byActiveDateTime []*Huddle
+
+func (h byActiveDateTime) Len() int {
+	return len(h)
+}
+func (h byActiveDateTime) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h byActiveDateTime) Less(i, j int) bool {
+	return h[i].ActiveDateTime().Time.Before(h[j].ActiveDateTime().Time)
+}
+
+type byRecentEncounterStart []RecentEncounter
+
+func (e byRecentEncounterStart) Len() int {
+	return len(e)
+}
+func (e byRecentEncounterStart) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+func (e byRecentEncounterStart) Less(i, j int) bool {
+	return startTime(e[i].Period).After(startTime(e[j].Period))
+}
+
+func startTime(p *models.Period) time.Time {
+	if p == nil || p.Start == nil {
+		return time.Time{}
+	}
+	return p.Start.Time
+}
@@ -0,0 +1,349 @@
+package huddles
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SimulatedPopulation is a synthetic patient population used to simulate huddle scheduling.  ReviewRate is the
+// chance (from 0 to 1) that a patient on a huddle is actually discussed.  Individual patients may override it.
+type SimulatedPopulation struct {
+	ReviewRate float64
+	Patients   []SimulatedPatient
+}
+
+// SimulatedPatient represents a patient's risk score trajectory and encounters over the course of a simulation.
+// Scores and encounters are keyed by Day, the number of days after the start of the simulation on which they occur.
+type SimulatedPatient struct {
+	ID         string
+	ReviewRate *float64
+	Scores     []SimulatedScore
+	Encounters []SimulatedEncounter
+}
+
+// SimulatedScore is a risk score calculated for a patient on a simulation day
+type SimulatedScore struct {
+	Day   int
+	Score float64
+}
+
+// SimulatedEncounter is an encounter that starts on a simulation day and lasts LengthInDays days (0 for encounters
+// that end the same day).  System and Code are the encounter type.
+type SimulatedEncounter struct {
+	Day          int
+	LengthInDays int
+	System       string
+	Code         string
+}
+
+// SimulationReport contains the results of a simulation, one entry for each simulated week, along with the huddle
+// metrics for the whole simulation
+type SimulationReport struct {
+	Name    string          `json:"name"`
+	Start   time.Time       `json:"start"`
+	Weeks   []SimulatedWeek `json:"weeks"`
+	Metrics *HuddleMetrics  `json:"metrics"`
+}
+
+// SimulatedWeek summarizes the huddles held during one week of a simulation.  Overdue counts the patients who, at
+// the end of the week, have gone more huddles without discussion than their risk score's MaxFrequency allows.
+// RepeatDiscussions counts discussions of patients who had been discussed before, and WithinFrequency counts those
+// that happened within the MinFrequency and MaxFrequency for the patient's risk score.
+type SimulatedWeek struct {
+	Week               int       `json:"week"`
+	Start              time.Time `json:"start"`
+	Huddles            int       `json:"huddles"`
+	Scheduled          int       `json:"scheduled"`
+	MinHuddleSize      int       `json:"minHuddleSize"`
+	MaxHuddleSize      int       `json:"maxHuddleSize"`
+	AverageHuddleSize  float64   `json:"averageHuddleSize"`
+	Discussed          int       `json:"discussed"`
+	RolledOver         int       `json:"rolledOver"`
+	Overdue            int       `json:"overdue"`
+	RepeatDiscussions  int       `json:"repeatDiscussions"`
+	WithinFrequency    int       `json:"withinFrequency"`
+	FrequencyAdherence float64   `json:"frequencyAdherence"`
+}
+
+// SimulationStore is a HuddleStore that simulations can also store risk scores and encounters in
+type SimulationStore interface {
+	HuddleStore
+	// StoreRiskScore stores the score as the patient's most recent risk score calculated using the method
+	StoreRiskScore(patientID string, method models.Coding, score float64, date time.Time) error
+	// StoreEncounter stores the encounter
+	StoreEncounter(encounter *models.Encounter) error
+}
+
+// Simulation runs the huddle scheduler every night for a number of weeks, starting on the Start date, against a
+// synthetic population.  Before each nightly run, the scores and encounters that occur on or before that day are
+// stored.  After each run, members of that day's huddle are randomly marked as reviewed according to their review
+// rate.  Given the same Seed, the simulation always produces the same results.
+//
+// If Store is nil, the simulation runs against a new MemoryHuddleStore.  Otherwise the Store should be empty (and
+// certainly NOT a production database), since the simulation writes risk assessments, encounters, and huddles to it.
+type Simulation struct {
+	Config     *HuddleConfig
+	Population *SimulatedPopulation
+	Start      time.Time
+	Weeks      int
+	Seed       int64
+	Store      SimulationStore
+
+	clock    *FixedClock
+	rand     *rand.Rand
+	patients []*simulatedPatientState
+	held     int
+}
+
+type simulatedPatientState struct {
+	*SimulatedPatient
+	nextScore     int
+	nextEncounter int
+	score         *float64
+	eligibleSince int
+	lastDiscussed *int
+}
+
+// Run runs the simulation and reports the results week by week
+func (s *Simulation) Run() (*SimulationReport, error) {
+	s.init()
+
+	report := &SimulationReport{Name: s.Config.Name, Start: startOfDay(s.Start)}
+	day, dayNum := report.Start, 0
+	for w := 0; w < s.Weeks; w++ {
+		week := SimulatedWeek{Week: w + 1, Start: day}
+		for i := 0; i < 7; i++ {
+			if err := s.simulateDay(day, dayNum, &week); err != nil {
+				return nil, err
+			}
+			day, dayNum = day.AddDate(0, 0, 1), dayNum+1
+		}
+		s.finishWeek(&week)
+		report.Weeks = append(report.Weeks, week)
+	}
+
+	metrics, err := CalculateHuddleMetrics(s.Store, s.Config, report.Start, day.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	report.Metrics = metrics
+	return report, nil
+}
+
+func (s *Simulation) init() {
+	if s.Store == nil {
+		s.Store = NewMemoryHuddleStore()
+	}
+	s.clock = &FixedClock{}
+	s.rand = rand.New(rand.NewSource(s.Seed))
+	s.held = 0
+	s.patients = make([]*simulatedPatientState, len(s.Population.Patients))
+	for i := range s.Population.Patients {
+		p := &s.Population.Patients[i]
+		sort.Sort(byScoreDay(p.Scores))
+		sort.Sort(byEncounterDay(p.Encounters))
+		s.patients[i] = &simulatedPatientState{SimulatedPatient: p}
+	}
+}
+
+func (s *Simulation) simulateDay(day time.Time, dayNum int, week *SimulatedWeek) error {
+	for _, p := range s.patients {
+		if err := s.storeEvents(p, day, dayNum); err != nil {
+			return err
+		}
+	}
+
+	// The scheduler runs nightly, so schedule in the early morning of the simulated day
+	s.clock.Time = day.Add(time.Hour)
+	hs := NewHuddleScheduler(s.Config)
+	hs.Clock = s.clock
+	hs.Store = s.Store
+	huddles, err := hs.ScheduleHuddles()
+	if err != nil {
+		return err
+	}
+
+	if len(huddles) > 0 && huddles[0].ActiveDateTime() != nil && huddles[0].ActiveDateTime().Time.Equal(day) {
+		return s.holdHuddle(huddles[0], day, week)
+	}
+	return nil
+}
+
+func (s *Simulation) storeEvents(p *simulatedPatientState, day time.Time, dayNum int) error {
+	for ; p.nextScore < len(p.Scores) && p.Scores[p.nextScore].Day <= dayNum; p.nextScore++ {
+		score := p.Scores[p.nextScore].Score
+		if err := s.Store.StoreRiskScore(p.ID, s.riskMethod(), score, day); err != nil {
+			return err
+		}
+		if p.score == nil {
+			p.eligibleSince = s.held
+		}
+		p.score = &score
+	}
+	for ; p.nextEncounter < len(p.Encounters) && p.Encounters[p.nextEncounter].Day <= dayNum; p.nextEncounter++ {
+		e := p.Encounters[p.nextEncounter]
+		start := day.AddDate(0, 0, e.Day-dayNum).Add(12 * time.Hour)
+		if err := s.Store.StoreEncounter(newSimulatedEncounter(p.ID, e, start)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Simulation) riskMethod() models.Coding {
+	if s.Config.RiskConfig != nil {
+		return s.Config.RiskConfig.RiskMethod
+	}
+	return models.Coding{}
+}
+
+func newMostRecentRiskAssessment(patientID string, method models.Coding, score float64, date time.Time) *models.RiskAssessment {
+	return &models.RiskAssessment{
+		DomainResource: models.DomainResource{
+			Resource: models.Resource{
+				Id: bson.NewObjectId().Hex(),
+				Meta: &models.Meta{
+					Tag: []models.Coding{{System: "http://interventionengine.org/tags/", Code: "MOST_RECENT"}},
+				},
+			},
+		},
+		Subject:    &models.Reference{Reference: "Patient/" + patientID, ReferencedID: patientID, Type: "Patient", External: new(bool)},
+		Date:       &models.FHIRDateTime{Time: date, Precision: models.Timestamp},
+		Method:     &models.CodeableConcept{Coding: []models.Coding{method}},
+		Prediction: []models.RiskAssessmentPredictionComponent{{ProbabilityDecimal: &score}},
+	}
+}
+
+func newSimulatedEncounter(patientID string, e SimulatedEncounter, start time.Time) *models.Encounter {
+	return &models.Encounter{
+		DomainResource: models.DomainResource{
+			Resource: models.Resource{Id: bson.NewObjectId().Hex()},
+		},
+		Status: "finished",
+		Type: []models.CodeableConcept{
+			{Coding: []models.Coding{{System: e.System, Code: e.Code}}},
+		},
+		Patient: &models.Reference{Reference: "Patient/" + patientID, ReferencedID: patientID, Type: "Patient", External: new(bool)},
+		Period: &models.Period{
+			Start: &models.FHIRDateTime{Time: start, Precision: models.Timestamp},
+			End:   &models.FHIRDateTime{Time: start.AddDate(0, 0, e.LengthInDays), Precision: models.Timestamp},
+		},
+	}
+}
+
+// holdHuddle randomly reviews the members of the huddle, records the results in the week, and stores the reviews
+func (s *Simulation) holdHuddle(huddle *Huddle, day time.Time, week *SimulatedWeek) error {
+	size := len(huddle.Member)
+	week.Huddles++
+	week.Scheduled += size
+	if week.Huddles == 1 || size < week.MinHuddleSize {
+		week.MinHuddleSize = size
+	}
+	if size > week.MaxHuddleSize {
+		week.MaxHuddleSize = size
+	}
+
+	for i := range huddle.Member {
+		member := HuddleMember(huddle.Member[i])
+		if member.ReasonIsRollOver() {
+			week.RolledOver++
+		}
+		p := s.findPatient(member.ID())
+		reviewRate := s.Population.ReviewRate
+		if p != nil && p.ReviewRate != nil {
+			reviewRate = *p.ReviewRate
+		}
+		if s.rand.Float64() >= reviewRate {
+			continue
+		}
+
+		huddle.Member[i].Extension = append(huddle.Member[i].Extension, models.Extension{
+			Url:           "http://interventionengine.org/fhir/extension/group/member/reviewed",
+			ValueDateTime: &models.FHIRDateTime{Time: day.Add(10 * time.Hour), Precision: models.Timestamp},
+		})
+		week.Discussed++
+		if p != nil {
+			s.recordDiscussion(p, week)
+		}
+	}
+	s.held++
+
+	return s.Store.SaveHuddle(huddle)
+}
+
+func (s *Simulation) recordDiscussion(p *simulatedPatientState, week *SimulatedWeek) {
+	if p.lastDiscussed != nil && p.score != nil {
+		if cfg := s.Config.FindRiskScoreFrequencyConfigByScore(*p.score); cfg != nil {
+			week.RepeatDiscussions++
+			gap := s.held - *p.lastDiscussed
+			if gap >= cfg.MinFrequency && gap <= cfg.MaxFrequency {
+				week.WithinFrequency++
+			}
+		}
+	}
+	held := s.held
+	p.lastDiscussed = &held
+}
+
+func (s *Simulation) finishWeek(week *SimulatedWeek) {
+	if week.Huddles > 0 {
+		week.AverageHuddleSize = float64(week.Scheduled) / float64(week.Huddles)
+	}
+	week.FrequencyAdherence = rate(week.WithinFrequency, week.RepeatDiscussions)
+
+	// The last huddle held is s.held-1.  Patients never discussed are treated as if they were last discussed just
+	// before the first huddle held after they were scored.
+	for _, p := range s.patients {
+		if p.score == nil {
+			continue
+		}
+		cfg := s.Config.FindRiskScoreFrequencyConfigByScore(*p.score)
+		if cfg == nil {
+			continue
+		}
+		last := p.eligibleSince - 1
+		if p.lastDiscussed != nil {
+			last = *p.lastDiscussed
+		}
+		if s.held-1 >= last+cfg.MaxFrequency {
+			week.Overdue++
+		}
+	}
+}
+
+func (s *Simulation) findPatient(id string) *simulatedPatientState {
+	for _, p := range s.patients {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+type byScoreDay []SimulatedScore
+
+func (s byScoreDay) Len() int {
+	return len(s)
+}
+func (s byScoreDay) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byScoreDay) Less(i, j int) bool {
+	return s[i].Day < s[j].Day
+}
+
+type byEncounterDay []SimulatedEncounter
+
+func (e byEncounterDay) Len() int {
+	return len(e)
+}
+func (e byEncounterDay) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+func (e byEncounterDay) Less(i, j int) bool {
+	return e[i].Day < e[j].Day
+}
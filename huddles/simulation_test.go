@@ -0,0 +1,103 @@
+package huddles
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestSimulationSuite(t *testing.T) {
+	suite.Run(t, new(SimulationSuite))
+}
+
+// SimulationSuite runs simulations against the default MemoryHuddleStore, so it doesn't need a database
+type SimulationSuite struct {
+	suite.Suite
+}
+
+func (suite *SimulationSuite) TestSimulationWithEveryoneReviewed() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	report, err := newTestSimulation(1).Run()
+	require.NoError(err)
+	assert.Equal("Test Huddle Config", report.Name)
+	require.Len(report.Weeks, 4)
+
+	// Target huddle size is ceil(1/1 + 1/2 + 1/4) = 2, so the first huddle has the two highest risk patients
+	first := report.Weeks[0]
+	assert.Equal(1, first.Week)
+	assert.Equal(time.Date(2016, time.March, 7, 0, 0, 0, 0, time.Local), first.Start)
+	assert.Equal(1, first.Huddles)
+	assert.Equal(2, first.Scheduled)
+	assert.Equal(2, first.Discussed)
+	assert.Equal(0, first.Overdue)
+	for _, week := range report.Weeks {
+		assert.Equal(1, week.Huddles)
+		assert.Equal(week.Scheduled, week.Discussed)
+		assert.Equal(0, week.RolledOver)
+		assert.Equal(first.Start.AddDate(0, 0, 7*(week.Week-1)), week.Start)
+	}
+	// The highest risk patient is discussed every huddle, so every week after the first has a repeat discussion
+	for _, week := range report.Weeks[1:] {
+		assert.True(week.RepeatDiscussions > 0)
+	}
+
+	// The metrics are calculated from the simulation's store
+	require.NotNil(report.Metrics)
+	assert.Equal(4, report.Metrics.Huddles)
+	assert.Equal(report.Metrics.Scheduled, report.Metrics.Discussed)
+	assert.Equal(1.0, report.Metrics.DiscussionRate)
+	assert.Equal(report.Metrics.Discussed, report.Metrics.Outcomes.Discussions)
+}
+
+func (suite *SimulationSuite) TestSimulationWithNoOneReviewed() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	report, err := newTestSimulation(0).Run()
+	require.NoError(err)
+	require.Len(report.Weeks, 4)
+
+	// The highest risk patient should be discussed every huddle, so is overdue as soon as the first huddle is missed
+	assert.Equal(0, report.Weeks[0].Discussed)
+	assert.Equal(1, report.Weeks[0].Overdue)
+	require.NotNil(report.Metrics)
+	assert.Equal(0, report.Metrics.Discussed)
+	for _, week := range report.Weeks[1:] {
+		assert.Equal(0, week.Discussed)
+		assert.True(week.RolledOver > 0)
+		assert.True(week.Overdue >= 1)
+		assert.Equal(0.0, week.FrequencyAdherence)
+	}
+}
+
+func (suite *SimulationSuite) TestSimulationIsDeterministic() {
+	require := suite.Require()
+
+	first, err := newTestSimulation(0.5).Run()
+	require.NoError(err)
+	second, err := newTestSimulation(0.5).Run()
+	require.NoError(err)
+	suite.Assert().Equal(first, second)
+}
+
+func newTestSimulation(reviewRate float64) *Simulation {
+	return &Simulation{
+		Config: createHuddleConfig(true, false, 1, time.Monday),
+		Population: &SimulatedPopulation{
+			ReviewRate: reviewRate,
+			Patients: []SimulatedPatient{
+				{ID: bsonID(1), Scores: []SimulatedScore{{Day: 0, Score: 9}}},
+				{ID: bsonID(2), Scores: []SimulatedScore{{Day: 0, Score: 6}}},
+				{ID: bsonID(3), Scores: []SimulatedScore{{Day: 0, Score: 4}}},
+			},
+		},
+		Start: time.Date(2016, time.March, 7, 0, 0, 0, 0, time.Local),
+		Weeks: 4,
+		Seed:  42,
+	}
+}
@@ -6,7 +6,7 @@ import "time"
 type Membership struct {
 	ID         string    `bson:"_id,omitempty" json:"id,omitempty"`
 	CareTeamID string    `bson:"care_team_id" json:"care_team_id" binding:"required"`
-	PatientID  string    `bson:"care_team_id" json:"patient_id" binding:"required"`
+	PatientID  string    `bson:"patient_id" json:"patient_id" binding:"required"`
 	CreatedAt  time.Time `bson:"created_at,omitempty" json:"created_at,omitempty"`
 }
 
@@ -14,4 +14,5 @@ type Membership struct {
 type MembershipService interface {
 	CreateMembership(mem Membership) error
 	PatientMemberships(id string) ([]Membership, error)
+	CareTeamMemberships(id string) ([]Membership, error)
 }
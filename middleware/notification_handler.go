@@ -1,27 +1,56 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/ie/delivery"
+	"github.com/intervention-engine/ie/mongo"
 	"github.com/intervention-engine/ie/notifications"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type NotificationHandler struct {
 	Registry *notifications.NotificationDefinitionRegistry
+	// Recipients finds the recipients of each notification, based on its subject.  If it isn't set, notifications
+	// are routed to the patient's care teams using mongoCareTeamRecipients.
+	Recipients notifications.RecipientsFunc
+	// Dispatcher delivers each notification to its recipients' preferred channels.  If it isn't set,
+	// delivery.DefaultDispatcher is used, and if that isn't set either, notifications aren't delivered.
+	Dispatcher *delivery.Dispatcher
 }
 
+// Handle returns the middleware that creates notifications for created and updated resources, including the
+// resources in batch and transaction bundles.  For updates, the previous version of the resource is loaded before the
+// update, so definitions implementing notifications.UpdateNotificationDefinition can be triggered by transitions.
+// Previous versions are only loaded for the resource types those definitions are triggered by.
 func (h *NotificationHandler) Handle() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var previous interface{}
+		var batchPrevious map[string]interface{}
+		if c.Request.Method == "PUT" {
+			previous = h.loadPrevious(c)
+		} else if c.Request.Method == "POST" && strings.Trim(c.Request.URL.Path, "/") == "" {
+			// Batch and transaction bundles are posted to the server's base URL
+			batchPrevious = h.loadBatchPrevious(c)
+		}
+
 		c.Next()
 		if c.IsAborted() {
 			return
 		}
-		if c.Request.Method != "POST" {
+		if c.Request.Method != "POST" && c.Request.Method != "PUT" {
 			return
 		}
 
@@ -37,26 +66,258 @@ func (h *NotificationHandler) Handle() gin.HandlerFunc {
 				log.Printf("Error creating notification for resource: %#v", resource)
 				return
 			}
+			action := actionType.(string)
+			baseURL := h.getBaseURL(c.Request)
 
-			var reg *notifications.NotificationDefinitionRegistry
-			if h.Registry != nil {
-				reg = h.Registry
-			} else {
-				reg = notifications.DefaultNotificationDefinitionRegistry
+			if bundle, ok := resource.(*models.Bundle); ok && action == "batch" {
+				h.notifyBatch(bundle, batchPrevious, baseURL)
+				return
+			}
+			h.notify(resource, action, previous, baseURL)
+		}
+	}
+}
+
+// notify creates the notifications triggered by the resource.  Updates only trigger definitions implementing
+// notifications.UpdateNotificationDefinition, and only if the previous version was loaded, since transitions can't be
+// detected without it (e.g., for conditional updates like PUT /Encounter?identifier=123).  A notification isn't
+// created if the definition already notified about the same source resource (see notificationKey), or if it already
+// notified about the patient within its suppression window (see notifications.RateLimitedNotificationDefinition).
+// The definitions' lookups about the resource are memoized, so each is made once however many definitions check it.
+func (h *NotificationHandler) notify(resource interface{}, action string, previous interface{}, baseURL string) {
+	defer notifications.MemoizeLookups(resource)()
+	for _, def := range h.registry().GetAll() {
+		var notification *models.CommunicationRequest
+		if action == "update" {
+			if previous == nil {
+				continue
+			}
+			if ud, ok := def.(notifications.UpdateNotificationDefinition); ok && ud.TriggersUpdate(previous, resource) {
+				notification = ud.GetUpdateNotification(previous, resource, baseURL)
 			}
-			for _, def := range reg.GetAll() {
-				if def.Triggers(resource, actionType.(string)) {
-					notification := def.GetNotification(resource, actionType.(string), h.getBaseURL(c.Request))
-					if err := server.Database.C("communicationrequests").Insert(notification); err != nil {
-						log.Printf("Error creating notification.\n\tNotification: %#v\n\tResource: %#v\n\tError: %#v", notification, resource, err)
-						return
-					}
-				}
+		} else if def.Triggers(resource, action) {
+			notification = def.GetNotification(resource, action, baseURL)
+		}
+		if notification == nil {
+			continue
+		}
+		if rl, ok := def.(notifications.RateLimitedNotificationDefinition); ok && h.isSuppressed(def.Name(), notification, rl.SuppressionWindow()) {
+			continue
+		}
+		key := notifications.NotificationKey(def.Name(), resource)
+		if err := insertNotificationKey(key, def.Name(), notification); mgo.IsDup(err) {
+			// The notification was already created (possibly by a concurrent request)
+			continue
+		} else if err != nil {
+			log.Printf("Error recording notification key %s: %v", key, err)
+			return
+		}
+		notification.Identifier = append(notification.Identifier, notifications.NotificationKeyIdentifier(key))
+		h.addRecipients(notification)
+		if err := server.Database.C("communicationrequests").Insert(notification); err != nil {
+			log.Printf("Error creating notification.\n\tNotification: %#v\n\tResource: %#v\n\tError: %#v", notification, resource, err)
+			// Remove the key, so the notification can be created when the resource is re-sent
+			if err := server.Database.C("notificationkeys").RemoveId(key); err != nil {
+				log.Printf("Error removing notification key %s: %v", key, err)
+			}
+			return
+		}
+		if dispatcher := h.dispatcher(); dispatcher != nil {
+			dispatcher.Dispatch(notification)
+		}
+	}
+}
+
+func (h *NotificationHandler) registry() *notifications.NotificationDefinitionRegistry {
+	if h.Registry != nil {
+		return h.Registry
+	}
+	return notifications.DefaultNotificationDefinitionRegistry
+}
+
+func (h *NotificationHandler) dispatcher() *delivery.Dispatcher {
+	if h.Dispatcher != nil {
+		return h.Dispatcher
+	}
+	return delivery.DefaultDispatcher
+}
+
+// notificationKey records that a definition created a notification about a source resource (see
+// notifications.NotificationKey).  Keys are stored in the notificationkeys collection with the key as the _id, so a key
+// can only be inserted once, and the same notification is never created twice, even by concurrent requests.  The
+// definition, subject, and time are recorded so the definition's recent notifications about a patient can be found
+// (see isSuppressed).
+type notificationKey struct {
+	Key            string    `bson:"_id"`
+	Definition     string    `bson:"definition"`
+	Subject        string    `bson:"subject,omitempty"`
+	RequestedOn    time.Time `bson:"requestedOn"`
+	NotificationID string    `bson:"notification"`
+}
+
+// insertNotificationKey records the key of the definition's notification before the notification is created.  If the
+// key was already recorded, the error satisfies mgo.IsDup.
+func insertNotificationKey(key, definitionName string, notification *models.CommunicationRequest) error {
+	k := notificationKey{Key: key, Definition: definitionName, RequestedOn: time.Now(), NotificationID: notification.Id}
+	if notification.Subject != nil {
+		k.Subject = notification.Subject.ReferencedID
+	}
+	if notification.RequestedOn != nil {
+		k.RequestedOn = notification.RequestedOn.Time
+	}
+	return server.Database.C("notificationkeys").Insert(&k)
+}
+
+// isSuppressed returns true if the definition already notified about the same patient within the suppression window.
+// The definition's notifications are found by their keys, so definitions with the same reason (e.g., Readmission and
+// Computed Readmission) don't suppress each other.
+func (h *NotificationHandler) isSuppressed(definitionName string, notification *models.CommunicationRequest, window time.Duration) bool {
+	if window <= 0 || notification.Subject == nil {
+		return false
+	}
+	query := bson.M{
+		"definition":  definitionName,
+		"subject":     notification.Subject.ReferencedID,
+		"requestedOn": bson.M{"$gte": time.Now().Add(-window)},
+	}
+	count, err := server.Database.C("notificationkeys").Find(query).Count()
+	if err != nil {
+		log.Printf("Error checking for suppressed notification: %v", err)
+		return false
+	}
+	return count > 0
+}
+
+// addRecipients routes the notification to the recipients of notifications about its subject.  If the recipients
+// can't be found, the notification is still created (without recipients).
+func (h *NotificationHandler) addRecipients(notification *models.CommunicationRequest) {
+	if len(notification.Recipient) > 0 {
+		return
+	}
+	recipients := h.Recipients
+	if recipients == nil {
+		recipients = mongoCareTeamRecipients
+	}
+	r, err := recipients(notification.Subject)
+	if err != nil {
+		log.Printf("Error finding notification recipients for subject %#v: %v", notification.Subject, err)
+		return
+	}
+	notification.Recipient = r
+}
+
+// mongoCareTeamRecipients routes notifications to the patient's care teams (and their leaders) using the care teams
+// and memberships stored in the server's database
+func mongoCareTeamRecipients(patient *models.Reference) ([]models.Reference, error) {
+	memberships := &mongo.MembershipService{C: server.Database.C("care_team_memberships")}
+	careTeams := &mongo.CareTeamService{C: server.Database.C("care_teams")}
+	return notifications.CareTeamRecipients(memberships, careTeams)(patient)
+}
+
+// notifyBatch creates the notifications triggered by each of the entries in a batch or transaction response bundle.
+// Entries that were created (by POST or PUT) are treated as creates, and entries that were updated by a PUT are
+// treated as updates of the previous versions loaded before the batch was processed.  Since the previous versions of
+// resources updated by conditional PUTs aren't known, those updates don't trigger notifications (just as conditional
+// updates of single resources don't).
+func (h *NotificationHandler) notifyBatch(bundle *models.Bundle, previous map[string]interface{}, baseURL string) {
+	for _, entry := range bundle.Entry {
+		if entry.Resource == nil || entry.Response == nil {
+			continue
+		}
+		switch entry.Response.Status {
+		case "201":
+			h.notify(entry.Resource, "create", nil, baseURL)
+		case "200":
+			if p, ok := previous[batchEntryKey(entry.Resource)]; ok {
+				h.notify(entry.Resource, "update", p, baseURL)
 			}
 		}
 	}
 }
 
+// loadPrevious loads the version of the resource being updated (e.g., by PUT /Encounter/123).  Since the resource
+// type isn't set until the request is handled, it is taken from the path.  If there is no previous version (e.g., the
+// update creates the resource), or no definition is triggered by updates of the resource type, nil is returned.
+func (h *NotificationHandler) loadPrevious(c *gin.Context) interface{} {
+	id := c.Param("id")
+	parts := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
+	if id == "" || len(parts) < 2 || !h.registry().TriggeredByUpdates(parts[len(parts)-2]) {
+		return nil
+	}
+	return h.findPrevious(parts[len(parts)-2], id)
+}
+
+// loadBatchPrevious loads the versions of the resources that a batch or transaction bundle updates with (non-
+// conditional) PUTs, keyed by resource type and id (e.g., Encounter/123).  Only resource types that definitions are
+// triggered by updates of are loaded, so large batches of other resources don't cost a read per entry.  The request
+// body is read to find the entries, so it is replaced for the batch controller.
+func (h *NotificationHandler) loadBatchPrevious(c *gin.Context) map[string]interface{} {
+	previous := make(map[string]interface{})
+	if c.Request.Body == nil || !h.hasUpdateDefinitions() {
+		return previous
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	c.Request.Body.Close()
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error reading batch request for notifications: %v", err)
+		return previous
+	}
+
+	bundle := new(models.Bundle)
+	if err := json.Unmarshal(body, bundle); err != nil {
+		// The batch controller reports invalid bundles
+		return previous
+	}
+	for _, entry := range bundle.Entry {
+		if entry.Request == nil || entry.Request.Method != "PUT" || strings.Contains(entry.Request.Url, "?") {
+			continue
+		}
+		parts := strings.Split(strings.Trim(entry.Request.Url, "/"), "/")
+		if len(parts) != 2 || !h.registry().TriggeredByUpdates(parts[0]) {
+			continue
+		}
+		if p := h.findPrevious(parts[0], parts[1]); p != nil {
+			previous[parts[0]+"/"+parts[1]] = p
+		}
+	}
+	return previous
+}
+
+// hasUpdateDefinitions returns true if any of the definitions can be triggered by updates, so batches don't have to be
+// read when none can
+func (h *NotificationHandler) hasUpdateDefinitions() bool {
+	for _, def := range h.registry().GetAll() {
+		if ud, ok := def.(notifications.UpdateNotificationDefinition); ok && len(ud.UpdateResourceTypes()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *NotificationHandler) findPrevious(resourceType, id string) (previous interface{}) {
+	defer func() {
+		// NewStructForResourceName panics for unknown resource types, which don't have previous versions
+		if r := recover(); r != nil {
+			previous = nil
+		}
+	}()
+	previous = models.NewStructForResourceName(resourceType)
+	if err := server.Database.C(models.PluralizeLowerResourceName(resourceType)).FindId(id).One(previous); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Printf("Error loading previous version of %s/%s for notifications: %v", resourceType, id, err)
+		}
+		return nil
+	}
+	return previous
+}
+
+// batchEntryKey returns the resource type and id of a bundle entry's resource (e.g., Encounter/123)
+func batchEntryKey(resource interface{}) string {
+	id, _ := models.GetResourceID(resource)
+	return reflect.TypeOf(resource).Elem().Name() + "/" + id
+}
+
 func (h *NotificationHandler) getBaseURL(r *http.Request) string {
 	newURL := url.URL(*r.URL)
 	if newURL.Host == "" {
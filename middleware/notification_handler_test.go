@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -13,6 +16,7 @@ import (
 	"github.com/intervention-engine/ie/testutil"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // In order for 'go test' to run this suite, we need to create
@@ -35,7 +39,8 @@ func (n *NotificationHandlerSuite) SetupTest() {
 	//register notification handler middleware
 	n.Handler = &NotificationHandler{Registry: &notifications.NotificationDefinitionRegistry{}}
 	mwConfig := map[string][]gin.HandlerFunc{
-		"Encounter": []gin.HandlerFunc{n.Handler.Handle()}}
+		"Encounter": []gin.HandlerFunc{n.Handler.Handle()},
+		"Batch":     []gin.HandlerFunc{n.Handler.Handle()}}
 
 	//set up routes and middleware
 	e := gin.New()
@@ -116,7 +121,293 @@ func (n *NotificationHandlerSuite) TestNotificationDoesNotTrigger() {
 	assert.Equal(0, count)
 }
 
-//  Dummy notification definition for testing
+func (n *NotificationHandlerSuite) TestUpdateNotificationTriggers() {
+	require := n.Require()
+	assert := n.Assert()
+
+	n.Handler.Registry.Register(new(PlannedEncounterNotificationDefinition))
+	n.Handler.Registry.Register(new(InProgressEncounterNotificationDefinition))
+
+	// Create the planned encounter, which triggers the planned notification
+	data, err := ioutil.ReadFile("../fixtures/encounter-planned.json")
+	require.NoError(err)
+	res, err := http.Post(n.Server.URL+"/Encounter", "application/json", bytes.NewReader(data))
+	require.NoError(err)
+	require.Equal(201, res.StatusCode)
+	encounter := new(models.Encounter)
+	require.NoError(json.NewDecoder(res.Body).Decode(encounter))
+	res.Body.Close()
+
+	put := func(status string) {
+		encounter.Status = status
+		body, err := json.Marshal(encounter)
+		require.NoError(err)
+		req, err := http.NewRequest("PUT", n.Server.URL+"/Encounter/"+encounter.Id, bytes.NewReader(body))
+		require.NoError(err)
+		req.Header.Add("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		res.Body.Close()
+		require.Equal(200, res.StatusCode)
+	}
+
+	// Updating it to in-progress triggers the in-progress notification (but not the planned notification again)
+	put("in-progress")
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(2, count)
+	count, err = n.NotificationCollection.Find(bson.M{"_id": "456"}).Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	// Updating it again doesn't trigger the in-progress notification again
+	put("in-progress")
+	count, err = n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(2, count)
+}
+
+func (n *NotificationHandlerSuite) TestConditionalUpdateDoesNotTrigger() {
+	require := n.Require()
+	assert := n.Assert()
+
+	n.Handler.Registry.Register(new(InProgressEncounterNotificationDefinition))
+
+	encounter := n.readEncounter("../fixtures/encounter-planned.json", "V1")
+	body, err := json.Marshal(encounter)
+	require.NoError(err)
+	res, err := http.Post(n.Server.URL+"/Encounter", "application/json", bytes.NewReader(body))
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(201, res.StatusCode)
+
+	// Since the previous version isn't loaded for conditional updates, the transition isn't detected
+	encounter.Status = "in-progress"
+	body, err = json.Marshal(encounter)
+	require.NoError(err)
+	req, err := http.NewRequest("PUT", n.Server.URL+"/Encounter?identifier=http://hospital.example.org/visits|V1", bytes.NewReader(body))
+	require.NoError(err)
+	req.Header.Add("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(200, res.StatusCode)
+
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(0, count)
+}
+
+func (n *NotificationHandlerSuite) TestBatchNotificationTriggers() {
+	require := n.Require()
+	assert := n.Assert()
+
+	defs, err := notifications.ParseNotificationDefinitions([]byte(`[{"type": "encounter-type", "name": "ER Visit",
+		"reason": {"system": "http://snomed.info/sct", "code": "4525004"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99283"}]}]`))
+	require.NoError(err)
+	n.Handler.Registry.RegisterAll(defs)
+
+	// The ER encounter created by the batch triggers the notification, but the office visit doesn't
+	n.postBatch(
+		models.BundleEntryComponent{
+			Resource: n.readEncounter("../fixtures/encounter-er-visit.json", "V1"),
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Encounter"},
+		},
+		models.BundleEntryComponent{
+			Resource: n.readEncounter("../fixtures/encounter-office-visit.json", "V2"),
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Encounter"},
+		},
+	)
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+}
+
+func (n *NotificationHandlerSuite) TestBatchUpdateNotificationTriggers() {
+	require := n.Require()
+	assert := n.Assert()
+
+	n.Handler.Registry.Register(new(InProgressEncounterNotificationDefinition))
+
+	response := n.postBatch(models.BundleEntryComponent{
+		Resource: n.readEncounter("../fixtures/encounter-planned.json", "V1"),
+		Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Encounter"},
+	})
+	encounter := response.Entry[0].Resource.(*models.Encounter)
+
+	// Updating it to in-progress with a PUT triggers the notification
+	encounter.Status = "in-progress"
+	n.postBatch(models.BundleEntryComponent{
+		Resource: encounter,
+		Request:  &models.BundleEntryRequestComponent{Method: "PUT", Url: "Encounter/" + encounter.Id},
+	})
+	count, err := n.NotificationCollection.Find(bson.M{"_id": "456"}).Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+}
+
+func (n *NotificationHandlerSuite) TestBatchConditionalUpdateDoesNotTrigger() {
+	require := n.Require()
+	assert := n.Assert()
+
+	n.Handler.Registry.Register(new(InProgressEncounterNotificationDefinition))
+
+	encounter := n.readEncounter("../fixtures/encounter-planned.json", "V1")
+	n.postBatch(models.BundleEntryComponent{
+		Resource: encounter,
+		Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Encounter"},
+	})
+
+	// Since the previous version isn't loaded for conditional updates, the transition isn't detected
+	encounter.Status = "in-progress"
+	n.postBatch(models.BundleEntryComponent{
+		Resource: encounter,
+		Request: &models.BundleEntryRequestComponent{
+			Method: "PUT",
+			Url:    "Encounter?identifier=http://hospital.example.org/visits|V1",
+		},
+	})
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(0, count)
+}
+
+func (n *NotificationHandlerSuite) TestDuplicateNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	defs, err := notifications.ParseNotificationDefinitions([]byte(`[{"type": "encounter-type", "name": "ER Visit",
+		"reason": {"system": "http://snomed.info/sct", "code": "4525004"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99283"}]}]`))
+	require.NoError(err)
+	n.Handler.Registry.RegisterAll(defs)
+
+	// Re-sending the same encounter (which is assigned a new id) doesn't create another notification
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V1")
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V1")
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	// But a different encounter does
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V2")
+	count, err = n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(2, count)
+
+	notification := new(models.CommunicationRequest)
+	require.NoError(n.NotificationCollection.Find(nil).One(notification))
+	require.Len(notification.Identifier, 1)
+	assert.Equal(notifications.NotificationKeySystem, notification.Identifier[0].System)
+
+	// Each notification's key is recorded
+	count, err = n.DB().C("notificationkeys").FindId(notification.Identifier[0].Value).Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+}
+
+func (n *NotificationHandlerSuite) TestSuppressedNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	defs, err := notifications.ParseNotificationDefinitions([]byte(`[{"type": "encounter-type", "name": "ER Visit", "suppressionWindow": "24h",
+		"reason": {"system": "http://snomed.info/sct", "code": "4525004"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99283"}]}]`))
+	require.NoError(err)
+	n.Handler.Registry.RegisterAll(defs)
+
+	// A second ER visit for the patient within the window doesn't create another notification
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V1")
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V2")
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+}
+
+func (n *NotificationHandlerSuite) TestSuppressionIsPerDefinition() {
+	require := n.Require()
+	assert := n.Assert()
+
+	// Both definitions have the same reason, but each is only suppressed by its own notifications
+	defs, err := notifications.ParseNotificationDefinitions([]byte(`[
+		{"type": "encounter-type", "name": "ER Visit", "suppressionWindow": "24h",
+		"reason": {"system": "http://snomed.info/sct", "code": "4525004"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99283"}]},
+		{"type": "encounter-type", "name": "Emergency Visit", "suppressionWindow": "24h",
+		"reason": {"system": "http://snomed.info/sct", "code": "4525004"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99283"}]}]`))
+	require.NoError(err)
+	n.Handler.Registry.RegisterAll(defs)
+
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V1")
+	count, err := n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(2, count)
+
+	n.postEncounter("../fixtures/encounter-er-visit.json", "V2")
+	count, err = n.NotificationCollection.Count()
+	require.NoError(err)
+	assert.Equal(2, count)
+}
+
+func (n *NotificationHandlerSuite) TestNotificationKeysAreUnique() {
+	require := n.Require()
+	assert := n.Assert()
+
+	notification := &models.CommunicationRequest{Subject: &models.Reference{Reference: "Patient/1", ReferencedID: "1", Type: "Patient"}}
+	notification.Id = bson.NewObjectId().Hex()
+	require.NoError(insertNotificationKey("ER Visit|Encounter/123", "ER Visit", notification))
+	assert.True(mgo.IsDup(insertNotificationKey("ER Visit|Encounter/123", "ER Visit", notification)))
+	require.NoError(insertNotificationKey("Admission|Encounter/123", "Admission", notification))
+
+	key := new(notificationKey)
+	require.NoError(n.DB().C("notificationkeys").FindId("ER Visit|Encounter/123").One(key))
+	assert.Equal("ER Visit", key.Definition)
+	assert.Equal("1", key.Subject)
+	assert.Equal(notification.Id, key.NotificationID)
+}
+
+// readEncounter reads the encounter in the fixture, without its id and with a visit identifier
+func (n *NotificationHandlerSuite) readEncounter(fixture, visit string) *models.Encounter {
+	require := n.Require()
+	data, err := ioutil.ReadFile(fixture)
+	require.NoError(err)
+	encounter := new(models.Encounter)
+	require.NoError(json.Unmarshal(data, encounter))
+	encounter.Id = ""
+	encounter.Identifier = []models.Identifier{{System: "http://hospital.example.org/visits", Value: visit}}
+	return encounter
+}
+
+// postEncounter posts the encounter in the fixture, with a visit identifier
+func (n *NotificationHandlerSuite) postEncounter(fixture, visit string) {
+	require := n.Require()
+	body, err := json.Marshal(n.readEncounter(fixture, visit))
+	require.NoError(err)
+	res, err := http.Post(n.Server.URL+"/Encounter", "application/json", bytes.NewReader(body))
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(201, res.StatusCode)
+}
+
+// postBatch posts a batch bundle with the entries, returning the response bundle
+func (n *NotificationHandlerSuite) postBatch(entries ...models.BundleEntryComponent) *models.Bundle {
+	require := n.Require()
+	bundle := &models.Bundle{Type: "batch", Entry: entries}
+	body, err := json.Marshal(bundle)
+	require.NoError(err)
+	res, err := http.Post(n.Server.URL+"/", "application/json", bytes.NewReader(body))
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(200, res.StatusCode)
+	response := new(models.Bundle)
+	require.NoError(json.NewDecoder(res.Body).Decode(response))
+	require.Len(response.Entry, len(entries))
+	return response
+}
+
+// Dummy notification definition for testing
 type PlannedEncounterNotificationDefinition struct{}
 
 func (def *PlannedEncounterNotificationDefinition) Name() string {
@@ -136,3 +427,34 @@ func (def *PlannedEncounterNotificationDefinition) GetNotification(resource inte
 	}
 	return nil
 }
+
+// Dummy update notification definition for testing
+type InProgressEncounterNotificationDefinition struct{}
+
+func (def *InProgressEncounterNotificationDefinition) Name() string {
+	return "In-Progress Encounter"
+}
+func (def *InProgressEncounterNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	return false
+}
+func (def *InProgressEncounterNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	return nil
+}
+func (def *InProgressEncounterNotificationDefinition) UpdateResourceTypes() []string {
+	return []string{"Encounter"}
+}
+func (def *InProgressEncounterNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	prev, ok := previous.(*models.Encounter)
+	enc := resource.(*models.Encounter)
+	return ok && prev.Status != "in-progress" && enc.Status == "in-progress"
+}
+func (def *InProgressEncounterNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		enc := resource.(*models.Encounter)
+		cr := &models.CommunicationRequest{}
+		cr.Id = "456"
+		cr.Subject = enc.Patient
+		return cr
+	}
+	return nil
+}
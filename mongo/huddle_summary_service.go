@@ -0,0 +1,138 @@
+package mongo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/huddles"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// recentEncounterLimit is how many of a patient's latest encounters are included in a huddle summary
+const recentEncounterLimit = 3
+
+// HuddleSummaryService mongodb huddle summary service.  C is the groups collection; the patients, encounters and
+// notifications are read from the same database.
+type HuddleSummaryService struct {
+	C *mgo.Collection
+}
+
+// HuddleSummary build the summary for the huddle with the given id
+func (s *HuddleSummaryService) HuddleSummary(id string) (*ie.HuddleSummary, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	var group models.Group
+	err := s.C.FindId(id).One(&group)
+	if err != nil {
+		return nil, err
+	}
+	huddle := huddles.Huddle(group)
+
+	summary := &ie.HuddleSummary{HuddleID: huddle.Id, Name: huddle.Name}
+	if dt := huddle.ActiveDateTime(); dt != nil {
+		summary.Date = dt.Time
+	}
+
+	now := time.Now()
+	members := huddle.HuddleMembers()
+	ids := make([]string, len(members))
+	for i := range members {
+		ids[i] = members[i].ID()
+	}
+	patients, err := s.patients(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		p, ok := patients[member.ID()]
+		if !ok {
+			continue
+		}
+		sm := ie.HuddleSummaryMember{Patient: p}
+		if reason := member.Reason(); reason != nil {
+			sm.Reason = reason.Text
+		}
+		if sm.RecentEncounters, err = s.recentEncounters(p.ID); err != nil {
+			return nil, err
+		}
+		if sm.OpenNotifications, err = s.openNotifications(p.ID, now); err != nil {
+			return nil, err
+		}
+		summary.Members = append(summary.Members, sm)
+	}
+
+	return summary, nil
+}
+
+func (s *HuddleSummaryService) patients(ids []string) (map[string]ie.Patient, error) {
+	var data []Patient
+	err := s.C.Database.C("patients").Find(bson.M{"_id": bson.M{"$in": ids}}).All(&data)
+	if err != nil {
+		return nil, err
+	}
+	pp := make(map[string]ie.Patient, len(data))
+	for _, patient := range data {
+		pp[patient.Id] = newPatient(patient)
+	}
+	return pp, nil
+}
+
+func (s *HuddleSummaryService) recentEncounters(patientID string) ([]ie.EncounterSummary, error) {
+	var encounters []models.Encounter
+	err := s.C.Database.C("encounters").Find(bson.M{"patient.referenceid": patientID}).
+		Sort("-period.start.time").Limit(recentEncounterLimit).All(&encounters)
+	if err != nil {
+		return nil, err
+	}
+	ee := make([]ie.EncounterSummary, len(encounters))
+	for i, enc := range encounters {
+		ee[i].ID = enc.Id
+		if len(enc.Type) > 0 {
+			ee[i].Type = codeableConceptText(enc.Type[0])
+		}
+		if enc.Period != nil && enc.Period.Start != nil {
+			ee[i].Start = enc.Period.Start.Time
+		}
+	}
+	return ee, nil
+}
+
+func (s *HuddleSummaryService) openNotifications(patientID string, now time.Time) ([]ie.NotificationSummary, error) {
+	var crs []models.CommunicationRequest
+	query := bson.M{"$and": []bson.M{{"subject.referenceid": patientID}, OpenNotificationQuery(now)}}
+	err := s.C.Database.C("communicationrequests").Find(query).Sort("-requestedOn.time").All(&crs)
+	if err != nil {
+		return nil, err
+	}
+	nn := make([]ie.NotificationSummary, len(crs))
+	for i, cr := range crs {
+		nn[i].ID = cr.Id
+		if len(cr.Reason) > 0 {
+			nn[i].Reason = codeableConceptText(cr.Reason[0])
+		}
+		if cr.RequestedOn != nil {
+			nn[i].RequestedOn = cr.RequestedOn.Time
+		}
+	}
+	return nn, nil
+}
+
+func codeableConceptText(cc models.CodeableConcept) string {
+	if cc.Text != "" {
+		return cc.Text
+	}
+	for _, coding := range cc.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+	}
+	if len(cc.Coding) > 0 {
+		return cc.Coding[0].Code
+	}
+	return ""
+}
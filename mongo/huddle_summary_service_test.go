@@ -0,0 +1,82 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestHuddleSummaryServiceSuite(t *testing.T) {
+	suite.Run(t, new(HuddleSummaryServiceSuite))
+}
+
+type HuddleSummaryServiceSuite struct {
+	testutil.MongoSuite
+	Service *HuddleSummaryService
+	Huddle  *models.Group
+}
+
+func (suite *HuddleSummaryServiceSuite) SetupTest() {
+	require := suite.Require()
+
+	suite.Service = &HuddleSummaryService{C: suite.DB().C("groups")}
+	suite.Huddle = new(models.Group)
+	suite.InsertFixture("groups", "../fixtures/huddle.json", suite.Huddle)
+	patient := &models.Patient{
+		DomainResource: models.DomainResource{Resource: models.Resource{Id: "1111111111111111111"}},
+		Name:           []models.HumanName{{Family: []string{"Banks"}, Given: []string{"Jacqueline"}}},
+	}
+	require.NoError(suite.DB().C("patients").Insert(patient))
+}
+
+func (suite *HuddleSummaryServiceSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *HuddleSummaryServiceSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *HuddleSummaryServiceSuite) TestOpenNotifications() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	now := time.Now()
+	insert := func(status string, requestedOn time.Time, snoozedUntil *time.Time) string {
+		cr := &models.CommunicationRequest{
+			Status:      status,
+			Subject:     &models.Reference{Reference: "Patient/1111111111111111111", ReferencedID: "1111111111111111111", Type: "Patient"},
+			RequestedOn: &models.FHIRDateTime{Time: requestedOn, Precision: models.Timestamp},
+		}
+		cr.Id = bson.NewObjectId().Hex()
+		if snoozedUntil != nil {
+			cr.ScheduledDateTime = &models.FHIRDateTime{Time: *snoozedUntil, Precision: models.Timestamp}
+		}
+		require.NoError(suite.DB().C("communicationrequests").Insert(cr))
+		return cr.Id
+	}
+	requested := insert("requested", now.Add(-1*time.Hour), nil)
+	acknowledged := insert("accepted", now.Add(-2*time.Hour), nil)
+	insert("completed", now.Add(-3*time.Hour), nil)
+	insert("rejected", now.Add(-4*time.Hour), nil)
+	later := now.Add(time.Hour)
+	insert("suspended", now.Add(-5*time.Hour), &later)
+	earlier := now.Add(-time.Minute)
+	unsnoozed := insert("suspended", now.Add(-6*time.Hour), &earlier)
+
+	// Acknowledged notifications and notifications whose snooze has ended are still open
+	summary, err := suite.Service.HuddleSummary(suite.Huddle.Id)
+	require.NoError(err)
+	require.Len(summary.Members, 1)
+	notifications := summary.Members[0].OpenNotifications
+	require.Len(notifications, 3)
+	assert.Equal(requested, notifications[0].ID)
+	assert.Equal(acknowledged, notifications[1].ID)
+	assert.Equal(unsnoozed, notifications[2].ID)
+}
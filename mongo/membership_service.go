@@ -16,8 +16,15 @@ func (m *MembershipService) CreateMembership(mem ie.Membership) error {
 	return m.C.Insert(mem)
 }
 
-// PatientMemberships list of memberships for a given care team
+// PatientMemberships list of care team memberships for a given patient
 func (m *MembershipService) PatientMemberships(id string) ([]ie.Membership, error) {
+	var mems []ie.Membership
+	err := m.C.Find(bson.M{"patient_id": id}).All(&mems)
+	return mems, err
+}
+
+// CareTeamMemberships list of patient memberships for a given care team
+func (m *MembershipService) CareTeamMemberships(id string) ([]ie.Membership, error) {
 	var mems []ie.Membership
 	err := m.C.Find(bson.M{"care_team_id": id}).All(&mems)
 	return mems, err
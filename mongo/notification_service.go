@@ -0,0 +1,99 @@
+package mongo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NotificationService mongodb notification service
+type NotificationService struct {
+	C *mgo.Collection
+}
+
+// Notification find a notification with the given id
+func (s *NotificationService) Notification(id string) (*models.CommunicationRequest, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	var n models.CommunicationRequest
+	err := s.C.FindId(id).One(&n)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// UpdateNotificationStatus stores the status, scheduled time, and status change extensions of a notification moved to
+// a new state (see ie.TransitionNotification), as long as its stored status is still the previous status.  Only those
+// fields are updated, so the delivery statuses recorded while the notification was being transitioned are kept.  If
+// another request changed the status first, ie.ErrNotificationStatusChanged is returned.
+func (s *NotificationService) UpdateNotificationStatus(n *models.CommunicationRequest, previousStatus string) error {
+	if !bson.IsObjectIdHex(n.Id) {
+		return errors.New("bad id")
+	}
+	urls := []string{ie.NotificationStatusChangedByExtensionURL, ie.NotificationStatusChangedAtExtensionURL}
+	set := bson.M{"status": n.Status}
+	update := bson.M{
+		"$set":  set,
+		"$pull": bson.M{"extension": bson.M{"url": bson.M{"$in": urls}}},
+	}
+	if n.ScheduledDateTime != nil {
+		set["scheduledDateTime"] = n.ScheduledDateTime
+	} else {
+		update["$unset"] = bson.M{"scheduledDateTime": ""}
+	}
+	err := s.C.Update(bson.M{"_id": n.Id, "status": previousStatus}, update)
+	if err == mgo.ErrNotFound {
+		if count, countErr := s.C.FindId(n.Id).Count(); countErr == nil && count > 0 {
+			return ie.ErrNotificationStatusChanged
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Mongo can't pull and push the same array in one update, so the changes are pushed separately.  If another
+	// request changed the status in the meantime, its changes are kept instead.
+	var changes []models.Extension
+	for _, e := range n.Extension {
+		if e.Url == ie.NotificationStatusChangedByExtensionURL || e.Url == ie.NotificationStatusChangedAtExtensionURL {
+			changes = append(changes, e)
+		}
+	}
+	selector := bson.M{
+		"_id":           n.Id,
+		"status":        n.Status,
+		"extension.url": bson.M{"$ne": ie.NotificationStatusChangedByExtensionURL},
+	}
+	err = s.C.Update(selector, bson.M{"$push": bson.M{"extension": bson.M{"$each": changes}}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// NotificationsForCareTeam list of notifications sent to a given care team, most recent first.  Digests of the team's
+// notifications aren't listed.
+func (s *NotificationService) NotificationsForCareTeam(id string) ([]models.CommunicationRequest, error) {
+	var nn []models.CommunicationRequest
+	digest := bson.M{"system": ie.NotificationDigestCategory.System, "code": ie.NotificationDigestCategory.Code}
+	query := bson.M{
+		"recipient":       bson.M{"$elemMatch": bson.M{"type": ie.CareTeamReferenceType, "referenceid": id}},
+		"category.coding": bson.M{"$not": bson.M{"$elemMatch": digest}},
+	}
+	err := s.C.Find(query).Sort("-requestedOn.time").All(&nn)
+	return nn, err
+}
+
+// OpenNotificationQuery matches notifications that still need attention (see ie.IsOpenNotification), including snoozed
+// notifications whose snooze has ended
+func OpenNotificationQuery(now time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"status": bson.M{"$in": ie.OpenNotificationStatuses}},
+		{"status": ie.NotificationStatuses[ie.NotificationSnoozed], "scheduledDateTime.time": bson.M{"$not": bson.M{"$gt": now}}}}}
+}
@@ -0,0 +1,110 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestNotificationServiceSuite(t *testing.T) {
+	suite.Run(t, new(NotificationServiceSuite))
+}
+
+type NotificationServiceSuite struct {
+	testutil.MongoSuite
+	Service *NotificationService
+}
+
+func (suite *NotificationServiceSuite) SetupTest() {
+	suite.Service = &NotificationService{C: suite.DB().C("communicationrequests")}
+}
+
+func (suite *NotificationServiceSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *NotificationServiceSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *NotificationServiceSuite) TestNotificationsForCareTeamExcludesDigests() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	team := &ie.CareTeam{ID: bson.NewObjectId().Hex(), Name: "Team A"}
+	now := time.Now()
+	insert := func(category *models.CodeableConcept, requestedOn time.Time) string {
+		cr := &models.CommunicationRequest{
+			Status:      "requested",
+			Category:    category,
+			Recipient:   []models.Reference{team.Reference()},
+			RequestedOn: &models.FHIRDateTime{Time: requestedOn, Precision: models.Timestamp},
+		}
+		cr.Id = bson.NewObjectId().Hex()
+		require.NoError(suite.Service.C.Insert(cr))
+		return cr.Id
+	}
+	notification := insert(nil, now.Add(-time.Hour))
+	insert(&models.CodeableConcept{Coding: []models.Coding{ie.NotificationDigestCategory}}, now)
+
+	nn, err := suite.Service.NotificationsForCareTeam(team.ID)
+	require.NoError(err)
+	require.Len(nn, 1)
+	assert.Equal(notification, nn[0].Id)
+}
+
+func (suite *NotificationServiceSuite) TestUpdateNotificationStatus() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	now := time.Now()
+	stored := &models.CommunicationRequest{Status: "requested"}
+	stored.Id = bson.NewObjectId().Hex()
+	require.NoError(suite.Service.C.Insert(stored))
+
+	// The notification is read and snoozed, while its delivery status is recorded by another request
+	n, err := suite.Service.Notification(stored.Id)
+	require.NoError(err)
+	require.NoError(ie.TransitionNotification(n, ie.NotificationSnoozed, "Optometrist Prime", timePtr(now.Add(time.Hour)), now))
+	delivery := models.Extension{Url: "http://example.org/fhir/extension/delivery", ValueString: "delivered"}
+	require.NoError(suite.Service.C.UpdateId(stored.Id, bson.M{"$push": bson.M{"extension": delivery}}))
+	require.NoError(suite.Service.UpdateNotificationStatus(n, "requested"))
+
+	updated, err := suite.Service.Notification(stored.Id)
+	require.NoError(err)
+	assert.Equal("suspended", updated.Status)
+	require.NotNil(updated.ScheduledDateTime)
+	require.Len(updated.Extension, 3)
+	assert.Equal(delivery.Url, updated.Extension[0].Url)
+	assert.Equal(ie.NotificationStatusChangedByExtensionURL, updated.Extension[1].Url)
+	assert.Equal(ie.NotificationStatusChangedAtExtensionURL, updated.Extension[2].Url)
+
+	// Acknowledging it replaces the status change extensions and unschedules it
+	require.NoError(ie.TransitionNotification(updated, ie.NotificationAcknowledged, "Optometrist Deux", nil, now))
+	require.NoError(suite.Service.UpdateNotificationStatus(updated, "suspended"))
+	acknowledged, err := suite.Service.Notification(stored.Id)
+	require.NoError(err)
+	assert.Equal("accepted", acknowledged.Status)
+	assert.Nil(acknowledged.ScheduledDateTime)
+	require.Len(acknowledged.Extension, 3)
+	assert.Equal("Optometrist Deux", acknowledged.Extension[1].ValueString)
+
+	// A transition from a status that was already changed by another request fails
+	require.NoError(ie.TransitionNotification(n, ie.NotificationDismissed, "Optometrist Prime", nil, now))
+	assert.Equal(ie.ErrNotificationStatusChanged, suite.Service.UpdateNotificationStatus(n, "requested"))
+	unchanged, err := suite.Service.Notification(stored.Id)
+	require.NoError(err)
+	assert.Equal("accepted", unchanged.Status)
+	assert.Equal("Optometrist Deux", unchanged.Extension[1].ValueString)
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
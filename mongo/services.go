@@ -61,6 +61,46 @@ func (s *Services) MembershipService() ie.Adapter {
 			col := col(session, "care_team_memberships")
 			service := &MembershipService{C: col}
 			ctx.Set("membershipService", service)
+			h(ctx)
+		}
+	}
+}
+
+func (s *Services) TaskService() ie.Adapter {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			session := s.S.Copy()
+			defer session.Close()
+			col := col(session, "tasks")
+			service := &TaskService{C: col}
+			ctx.Set("taskService", service)
+			h(ctx)
+		}
+	}
+}
+
+func (s *Services) HuddleSummaryService() ie.Adapter {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			session := s.S.Copy()
+			defer session.Close()
+			col := col(session, "groups")
+			service := &HuddleSummaryService{C: col}
+			ctx.Set("huddleSummaryService", service)
+			h(ctx)
+		}
+	}
+}
+
+func (s *Services) NotificationService() ie.Adapter {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			session := s.S.Copy()
+			defer session.Close()
+			col := col(session, "communicationrequests")
+			service := &NotificationService{C: col}
+			ctx.Set("notificationService", service)
+			h(ctx)
 		}
 	}
 }
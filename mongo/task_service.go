@@ -0,0 +1,95 @@
+package mongo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TaskService mongodb task service
+type TaskService struct {
+	C *mgo.Collection
+}
+
+var openTaskQuery = bson.M{"$nin": []string{ie.TaskStatusCompleted, ie.TaskStatusCancelled}}
+
+// Task find a task with the given id
+func (s *TaskService) Task(id string) (*ie.Task, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	var t ie.Task
+	err := s.C.FindId(id).One(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Tasks list of all tasks
+func (s *TaskService) Tasks() ([]ie.Task, error) {
+	return s.findTasks(nil)
+}
+
+// CreateTask store a new task, defaulting its status to requested
+func (s *TaskService) CreateTask(t *ie.Task) error {
+	t.ID = compensateForBsonFail(bson.NewObjectId().String())
+	if t.Status == "" {
+		t.Status = ie.TaskStatusRequested
+	}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = t.CreatedAt
+	return s.C.Insert(t)
+}
+
+// UpdateTask replace the stored task with the given one
+func (s *TaskService) UpdateTask(t *ie.Task) error {
+	if !bson.IsObjectIdHex(t.ID) {
+		return errors.New("bad id")
+	}
+	return s.C.UpdateId(t.ID, t)
+}
+
+// TasksForPatient list of all tasks for a given patient
+func (s *TaskService) TasksForPatient(id string) ([]ie.Task, error) {
+	return s.findTasks(bson.M{"patient_id": id})
+}
+
+// TasksForCareTeam list of all tasks assigned to a given care team
+func (s *TaskService) TasksForCareTeam(id string) ([]ie.Task, error) {
+	return s.findTasks(bson.M{"care_team_id": id})
+}
+
+// OverdueTasks list of open tasks whose due date is before now
+func (s *TaskService) OverdueTasks(now time.Time) ([]ie.Task, error) {
+	return s.findTasks(bson.M{"status": openTaskQuery, "due_date": bson.M{"$lt": now}})
+}
+
+// OpenTasksForHuddle list of open tasks for the patients who are members of the given huddle
+func (s *TaskService) OpenTasksForHuddle(id string) ([]ie.Task, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	var huddle models.Group
+	err := s.C.Database.C("groups").FindId(id).One(&huddle)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(huddle.Member))
+	for _, m := range huddle.Member {
+		if m.Entity != nil {
+			ids = append(ids, m.Entity.ReferencedID)
+		}
+	}
+	return s.findTasks(bson.M{"patient_id": bson.M{"$in": ids}, "status": openTaskQuery})
+}
+
+func (s *TaskService) findTasks(query bson.M) ([]ie.Task, error) {
+	var tt []ie.Task
+	err := s.C.Find(query).Sort("due_date").All(&tt)
+	return tt, err
+}
@@ -0,0 +1,75 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTaskServiceSuite(t *testing.T) {
+	suite.Run(t, new(TaskServiceSuite))
+}
+
+type TaskServiceSuite struct {
+	testutil.MongoSuite
+	Service *TaskService
+}
+
+func (suite *TaskServiceSuite) SetupTest() {
+	suite.Service = &TaskService{C: suite.DB().C("tasks")}
+}
+
+func (suite *TaskServiceSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *TaskServiceSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *TaskServiceSuite) TestOpenTasksForHuddle() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	huddle := &models.Group{
+		DomainResource: models.DomainResource{Resource: models.Resource{Id: bson.NewObjectId().Hex()}},
+		Member: []models.GroupMemberComponent{
+			{Entity: &models.Reference{Reference: "Patient/1", ReferencedID: "1", Type: "Patient"}},
+			{Entity: &models.Reference{Reference: "Patient/2", ReferencedID: "2", Type: "Patient"}},
+		},
+	}
+	require.NoError(suite.DB().C("groups").Insert(huddle))
+
+	nextWeek := time.Now().AddDate(0, 0, 7)
+	create := func(patientID, status string) string {
+		task := &ie.Task{Title: "Call patient", PatientID: patientID, PractitionerID: "123", Status: status, DueDate: &nextWeek}
+		require.NoError(suite.Service.CreateTask(task))
+		return task.ID
+	}
+	requested := create("1", ie.TaskStatusRequested)
+	inProgress := create("2", ie.TaskStatusInProgress)
+	create("1", ie.TaskStatusCompleted)
+	create("2", ie.TaskStatusCancelled)
+	create("3", ie.TaskStatusRequested)
+
+	// Only the open tasks for the huddle's patients are listed
+	tasks, err := suite.Service.OpenTasksForHuddle(huddle.Id)
+	require.NoError(err)
+	var ids []string
+	for _, t := range tasks {
+		ids = append(ids, t.ID)
+	}
+	assert.Len(ids, 2)
+	assert.Contains(ids, requested)
+	assert.Contains(ids, inProgress)
+
+	_, err = suite.Service.OpenTasksForHuddle(bson.NewObjectId().Hex())
+	assert.Error(err)
+}
@@ -0,0 +1,106 @@
+package ie
+
+import (
+	"errors"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// Notification states that care teams move notifications (CommunicationRequests) through, and the CommunicationRequest
+// status that represents each of them.  Notifications are created as requested.
+const (
+	NotificationRequested    = "requested"
+	NotificationAcknowledged = "acknowledged"
+	NotificationCompleted    = "completed"
+	NotificationDismissed    = "dismissed"
+	NotificationSnoozed      = "snoozed"
+)
+
+// NotificationStatuses maps each notification state to its CommunicationRequest status
+var NotificationStatuses = map[string]string{
+	NotificationRequested:    "requested",
+	NotificationAcknowledged: "accepted",
+	NotificationCompleted:    "completed",
+	NotificationDismissed:    "rejected",
+	NotificationSnoozed:      "suspended",
+}
+
+// NotificationDigestCategory is the category of digest notifications, which summarize a care team's unacknowledged
+// notifications rather than being about a patient
+var NotificationDigestCategory = models.Coding{System: "http://interventionengine.org/fhir/cs/communicationrequest-category", Code: "digest", Display: "Notification digest"}
+
+// OpenNotificationStatuses are the CommunicationRequest statuses of notifications that still need attention.  Snoozed
+// (suspended) notifications are open again once they are no longer snoozed.
+var OpenNotificationStatuses = []string{"proposed", "planned", "requested", "received", "accepted", "in-progress"}
+
+// Extensions recording who last changed the state of a notification, and when
+const (
+	NotificationStatusChangedByExtensionURL = "http://interventionengine.org/fhir/extension/communicationrequest/statusChangedBy"
+	NotificationStatusChangedAtExtensionURL = "http://interventionengine.org/fhir/extension/communicationrequest/statusChangedAt"
+)
+
+// ErrInvalidNotificationTransition is returned when a notification is asked to move to a state it cannot reach from
+// its current one (e.g., a completed or dismissed notification is snoozed)
+var ErrInvalidNotificationTransition = errors.New("invalid notification state transition")
+
+// ErrNotificationStatusChanged is returned when a notification's status is changed by another request while it is
+// being moved to a new state
+var ErrNotificationStatusChanged = errors.New("notification status was changed by another request")
+
+// ErrInvalidSnooze is returned when a notification is snoozed without a time in the future to snooze it until
+var ErrInvalidSnooze = errors.New("notifications must be snoozed until a time in the future")
+
+// IsOpenNotification indicates if the notification still needs attention: it hasn't been completed or dismissed, and
+// it isn't snoozed
+func IsOpenNotification(n *models.CommunicationRequest, now time.Time) bool {
+	if n.Status == NotificationStatuses[NotificationSnoozed] {
+		return n.ScheduledDateTime == nil || !n.ScheduledDateTime.Time.After(now)
+	}
+	for _, s := range OpenNotificationStatuses {
+		if n.Status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionNotification moves the notification to the given state (acknowledged, completed, dismissed, or snoozed),
+// recording the user that acted on it and when.  Snoozed notifications are scheduled for the time they were snoozed
+// until.  Completed and dismissed notifications are final.
+func TransitionNotification(n *models.CommunicationRequest, state, user string, snoozedUntil *time.Time, now time.Time) error {
+	status, ok := NotificationStatuses[state]
+	if !ok || state == NotificationRequested {
+		return ErrInvalidNotificationTransition
+	}
+	if n.Status == NotificationStatuses[NotificationCompleted] || n.Status == NotificationStatuses[NotificationDismissed] {
+		return ErrInvalidNotificationTransition
+	}
+	if state == NotificationSnoozed {
+		if snoozedUntil == nil || !snoozedUntil.After(now) {
+			return ErrInvalidSnooze
+		}
+		n.ScheduledDateTime = &models.FHIRDateTime{Time: *snoozedUntil, Precision: models.Timestamp}
+	} else {
+		n.ScheduledDateTime = nil
+	}
+	n.Status = status
+
+	var ext []models.Extension
+	for _, e := range n.Extension {
+		if e.Url != NotificationStatusChangedByExtensionURL && e.Url != NotificationStatusChangedAtExtensionURL {
+			ext = append(ext, e)
+		}
+	}
+	n.Extension = append(ext,
+		models.Extension{Url: NotificationStatusChangedByExtensionURL, ValueString: user},
+		models.Extension{Url: NotificationStatusChangedAtExtensionURL, ValueDateTime: &models.FHIRDateTime{Time: now, Precision: models.Timestamp}})
+	return nil
+}
+
+// NotificationService describes the interface for finding and updating notifications (CommunicationRequests)
+type NotificationService interface {
+	Notification(id string) (*models.CommunicationRequest, error)
+	UpdateNotificationStatus(n *models.CommunicationRequest, previousStatus string) error
+	NotificationsForCareTeam(id string) ([]models.CommunicationRequest, error)
+}
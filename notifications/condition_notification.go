@@ -0,0 +1,99 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+func init() {
+	RegisterNotificationDefinitionType("condition-watch-list", func(config []byte) (NotificationDefinition, error) {
+		c := new(ConditionWatchListNotificationConfig)
+		if err := json.Unmarshal(config, c); err != nil {
+			return nil, err
+		}
+		if len(c.Codes) == 0 {
+			return nil, errors.New("Condition watch list notification definitions require at least one code")
+		}
+		return NewConditionWatchListNotificationDefinition(c.Name, c.Reason, c.Codes), nil
+	})
+}
+
+// ConditionWatchListNotificationConfig is the JSON configuration of a ConditionWatchListNotificationDefinition (with
+// the "condition-watch-list" type)
+type ConditionWatchListNotificationConfig struct {
+	NotificationDefinitionConfig
+	Reason models.Coding   `json:"reason"`
+	Codes  []models.Coding `json:"codes"`
+}
+
+// ConditionWatchListNotificationDefinition is triggered by new diagnoses of any of the conditions on its watch list.
+// Refuted conditions and conditions entered in error don't trigger the notification.
+type ConditionWatchListNotificationDefinition struct {
+	name   string
+	reason models.Coding
+	codes  []models.Coding
+}
+
+// NewConditionWatchListNotificationDefinition creates a definition triggered by new conditions with any of the codes
+func NewConditionWatchListNotificationDefinition(name string, reason models.Coding, codes []models.Coding) *ConditionWatchListNotificationDefinition {
+	return &ConditionWatchListNotificationDefinition{name: name, reason: reason, codes: codes}
+}
+
+func (def *ConditionWatchListNotificationDefinition) Name() string {
+	return def.name
+}
+
+func (def *ConditionWatchListNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	return action == "create" && def.matches(resource)
+}
+
+func (def *ConditionWatchListNotificationDefinition) UpdateResourceTypes() []string {
+	return []string{"Condition"}
+}
+
+// TriggersUpdate returns true if the updated condition is on the watch list but its previous version wasn't (e.g., its
+// code was corrected or it was no longer refuted)
+func (def *ConditionWatchListNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	return transitioned(def.matches, previous, resource)
+}
+
+func (def *ConditionWatchListNotificationDefinition) matches(resource interface{}) bool {
+	condition, ok := resource.(*models.Condition)
+	if !ok || condition.Code == nil || condition.VerificationStatus == "refuted" || condition.VerificationStatus == "entered-in-error" {
+		return false
+	}
+	return models.CodeableConcepts{*condition.Code}.AnyMatchesAnyCode(def.codes)
+}
+
+func (def *ConditionWatchListNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	if def.Triggers(resource, action) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *ConditionWatchListNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *ConditionWatchListNotificationDefinition) notification(resource interface{}, baseURL string) *models.CommunicationRequest {
+	condition := resource.(*models.Condition)
+	return newNotification("Condition", condition.Id, condition.Patient, def.reason, baseURL)
+}
+
+// Definition of the default condition watch list
+
+var WatchedConditionNotificationDefinition = NewConditionWatchListNotificationDefinition(
+	"Watched Condition",
+	models.Coding{System: NotificationReasonSystem, Code: "watched-condition", Display: "New diagnosis of a watched condition"},
+	[]models.Coding{
+		{System: "http://snomed.info/sct", Code: "84114007", Display: "Heart failure (disorder)"},
+		{System: "http://snomed.info/sct", Code: "22298006", Display: "Myocardial infarction (disorder)"},
+		{System: "http://snomed.info/sct", Code: "230690007", Display: "Cerebrovascular accident (disorder)"},
+		{System: "http://snomed.info/sct", Code: "91302008", Display: "Sepsis (disorder)"},
+		{System: "http://snomed.info/sct", Code: "233604007", Display: "Pneumonia (disorder)"}})
@@ -0,0 +1,199 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// NotificationDefinitionConfig contains the settings common to all configured notification definitions.  The Type
+// indicates which kind of definition to create (e.g., "encounter-type"), and the rest of the configuration is
+// specific to that type.  A definition is suppressed when any of the definitions named in ExcludeIfTriggered are
+// also triggered by the same resource (e.g., an admission notification isn't sent for a readmission).  If a
+// SuppressionWindow is specified (e.g., "24h"), the definition doesn't notify about a patient more than once in the
+// window.
+type NotificationDefinitionConfig struct {
+	Type               string   `json:"type"`
+	Name               string   `json:"name"`
+	ExcludeIfTriggered []string `json:"excludeIfTriggered,omitempty"`
+	SuppressionWindow  string   `json:"suppressionWindow,omitempty"`
+}
+
+// NotificationDefinitionFactory creates a notification definition from its JSON configuration
+type NotificationDefinitionFactory func(config []byte) (NotificationDefinition, error)
+
+var definitionFactories = struct {
+	sync.RWMutex
+	m map[string]NotificationDefinitionFactory
+}{m: make(map[string]NotificationDefinitionFactory)}
+
+// RegisterNotificationDefinitionType registers the factory used to create configured definitions of the type
+func RegisterNotificationDefinitionType(definitionType string, factory NotificationDefinitionFactory) {
+	definitionFactories.Lock()
+	defer definitionFactories.Unlock()
+	definitionFactories.m[definitionType] = factory
+}
+
+// ParseNotificationDefinitions creates the notification definitions in the JSON array of configurations
+func ParseNotificationDefinitions(data []byte) ([]NotificationDefinition, error) {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return nil, err
+	}
+
+	defs := make([]NotificationDefinition, len(raws))
+	configs := make([]NotificationDefinitionConfig, len(raws))
+	byName := make(map[string]NotificationDefinition)
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &configs[i]); err != nil {
+			return nil, err
+		}
+		config := configs[i]
+		if config.Name == "" {
+			return nil, errors.New("Notification definitions require a name")
+		}
+		if _, ok := byName[config.Name]; ok {
+			return nil, fmt.Errorf("Duplicate notification definition: %s", config.Name)
+		}
+		definitionFactories.RLock()
+		factory, ok := definitionFactories.m[config.Type]
+		definitionFactories.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("Unknown type for notification definition %s: %s", config.Name, config.Type)
+		}
+		def, err := factory(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid notification definition %s: %v", config.Name, err)
+		}
+		defs[i] = def
+		byName[config.Name] = def
+	}
+
+	// Exclusions refer to other definitions by name, so they're resolved once all of the definitions are created
+	for i, config := range configs {
+		if len(config.ExcludeIfTriggered) == 0 && config.SuppressionWindow == "" {
+			continue
+		}
+		configured := &configuredNotificationDefinition{NotificationDefinition: defs[i]}
+		for _, name := range config.ExcludeIfTriggered {
+			other, ok := byName[name]
+			if !ok || name == config.Name {
+				return nil, fmt.Errorf("Invalid exclusion for notification definition %s: %s", config.Name, name)
+			}
+			configured.exclusions = append(configured.exclusions, other)
+		}
+		if config.SuppressionWindow != "" {
+			window, err := time.ParseDuration(config.SuppressionWindow)
+			if err != nil || window < 0 {
+				return nil, fmt.Errorf("Invalid suppression window for notification definition %s: %s", config.Name, config.SuppressionWindow)
+			}
+			configured.suppressionWindow = window
+		}
+		defs[i] = configured
+	}
+	return defs, nil
+}
+
+// configuredNotificationDefinition adds the common configuration to a definition: it is suppressed when any of its
+// exclusions are also triggered, and it has a suppression window
+type configuredNotificationDefinition struct {
+	NotificationDefinition
+	exclusions        []NotificationDefinition
+	suppressionWindow time.Duration
+}
+
+func (def *configuredNotificationDefinition) SuppressionWindow() time.Duration {
+	return def.suppressionWindow
+}
+
+func (def *configuredNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	if !def.NotificationDefinition.Triggers(resource, action) {
+		return false
+	}
+	for _, other := range def.exclusions {
+		if other.Triggers(resource, action) {
+			return false
+		}
+	}
+	return true
+}
+
+func (def *configuredNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	if def.Triggers(resource, action) {
+		return def.NotificationDefinition.GetNotification(resource, action, baseURL)
+	}
+	return nil
+}
+
+// UpdateResourceTypes returns the wrapped definition's types, or none if it isn't triggered by updates
+func (def *configuredNotificationDefinition) UpdateResourceTypes() []string {
+	if ud, ok := def.NotificationDefinition.(UpdateNotificationDefinition); ok {
+		return ud.UpdateResourceTypes()
+	}
+	return nil
+}
+
+// TriggersUpdate returns false unless the wrapped definition is triggered by updates.  Exclusions are checked as if the
+// updated resource were new.
+func (def *configuredNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	ud, ok := def.NotificationDefinition.(UpdateNotificationDefinition)
+	if !ok || !ud.TriggersUpdate(previous, resource) {
+		return false
+	}
+	for _, other := range def.exclusions {
+		if other.Triggers(resource, "create") {
+			return false
+		}
+	}
+	return true
+}
+
+func (def *configuredNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		return def.NotificationDefinition.(UpdateNotificationDefinition).GetUpdateNotification(previous, resource, baseURL)
+	}
+	return nil
+}
+
+// NotificationDefinitionLoader loads the notification definitions in a JSON configuration file into a registry,
+// replacing the registry's definitions.  It can be reloaded at runtime to pick up changes to the file.
+type NotificationDefinitionLoader struct {
+	Path     string
+	Registry *NotificationDefinitionRegistry
+}
+
+// Load loads the definitions.  If the file is invalid, the registry's definitions are left as they were.
+func (l *NotificationDefinitionLoader) Load() error {
+	data, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		return err
+	}
+	defs, err := ParseNotificationDefinitions(data)
+	if err != nil {
+		return err
+	}
+	l.Registry.Replace(defs)
+	log.Printf("Loaded %d notification definitions from %s\n", len(defs), l.Path)
+	return nil
+}
+
+// ReloadHandler reloads the definitions and responds with the names of the loaded definitions
+func (l *NotificationDefinitionLoader) ReloadHandler(c *gin.Context) {
+	if err := l.Load(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var names []string
+	for _, def := range l.Registry.GetAll() {
+		names = append(names, def.Name())
+	}
+	c.JSON(http.StatusOK, gin.H{"definitions": names})
+}
@@ -0,0 +1,160 @@
+package notifications
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestNotificationConfigSuite(t *testing.T) {
+	suite.Run(t, new(NotificationConfigSuite))
+}
+
+type NotificationConfigSuite struct {
+	suite.Suite
+}
+
+func (n *NotificationConfigSuite) TestConfiguredDefinitionsMatchDefaults() {
+	require := n.Require()
+	assert := n.Assert()
+
+	data, err := ioutil.ReadFile("../config/notification_definitions.json")
+	require.NoError(err)
+	defs, err := ParseNotificationDefinitions(data)
+	require.NoError(err)
+	defaults := DefaultNotificationDefinitionRegistry.GetAll()
+	// The configuration also has the medication change definitions, which don't have defaults
+	require.Len(defs, len(defaults)+2)
+	for _, def := range defs[len(defaults):] {
+		assert.IsType(new(MedicationChangeNotificationDefinition), def)
+	}
+
+	for _, fixture := range []string{"encounter-inpatient", "encounter-readmission", "encounter-er-visit", "encounter-office-visit"} {
+		encounter, err := UnmarshallEncounter("../fixtures/" + fixture + ".json")
+		require.NoError(err)
+		for i, def := range defaults {
+			assert.Equal(def.Name(), defs[i].Name())
+			assert.Equal(def.Triggers(encounter, "create"), defs[i].Triggers(encounter, "create"), "%s: %s", fixture, def.Name())
+			assert.False(defs[i].Triggers(encounter, "update"))
+		}
+	}
+
+	// The admission definition is excluded for readmissions
+	encounter, err := UnmarshallEncounter("../fixtures/encounter-readmission.json")
+	require.NoError(err)
+	assert.Nil(defs[0].GetNotification(encounter, "create", "http://intervention-engine.org"))
+	cr := defs[1].GetNotification(encounter, "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	assert.Equal("417005", cr.Reason[0].Coding[0].Code)
+}
+
+func (n *NotificationConfigSuite) TestInvalidDefinitions() {
+	assert := n.Assert()
+
+	for _, config := range []string{
+		`{"type": "encounter-type"}`,
+		`[{"type": "encounter-type", "types": [{"system": "http://snomed.info/sct", "code": "1"}]}]`,
+		`[{"type": "unknown", "name": "Unknown"}]`,
+		`[{"type": "encounter-type", "name": "No Types"}]`,
+		`[{"type": "encounter-type", "name": "A", "types": [{"system": "http://snomed.info/sct", "code": "1"}]},
+		  {"type": "encounter-type", "name": "A", "types": [{"system": "http://snomed.info/sct", "code": "2"}]}]`,
+		`[{"type": "encounter-type", "name": "A", "excludeIfTriggered": ["B"], "types": [{"system": "http://snomed.info/sct", "code": "1"}]}]`,
+		`[{"type": "encounter-type", "name": "A", "excludeIfTriggered": ["A"], "types": [{"system": "http://snomed.info/sct", "code": "1"}]}]`,
+		`[{"type": "encounter-type", "name": "A", "suppressionWindow": "a day", "types": [{"system": "http://snomed.info/sct", "code": "1"}]}]`,
+		`[{"type": "encounter-type", "name": "A", "suppressionWindow": "-1h", "types": [{"system": "http://snomed.info/sct", "code": "1"}]}]`,
+		`[{"type": "readmission-window", "name": "A"}]`,
+		`[{"type": "readmission-window", "name": "A", "windowInDays": -30, "types": [{"system": "http://snomed.info/sct", "code": "1"}]}]`,
+	} {
+		_, err := ParseNotificationDefinitions([]byte(config))
+		assert.Error(err, config)
+	}
+}
+
+func (n *NotificationConfigSuite) TestSuppressionWindow() {
+	require := n.Require()
+	assert := n.Assert()
+
+	defs, err := ParseNotificationDefinitions([]byte(`[
+		{"type": "encounter-type", "name": "A", "suppressionWindow": "12h", "types": [{"system": "http://snomed.info/sct", "code": "1"}]},
+		{"type": "encounter-type", "name": "B", "types": [{"system": "http://snomed.info/sct", "code": "2"}]}]`))
+	require.NoError(err)
+	require.Len(defs, 2)
+
+	rl, ok := defs[0].(RateLimitedNotificationDefinition)
+	require.True(ok)
+	assert.Equal(12*time.Hour, rl.SuppressionWindow())
+	assert.Equal("A", rl.Name())
+	_, ok = defs[1].(RateLimitedNotificationDefinition)
+	assert.False(ok)
+}
+
+func (n *NotificationConfigSuite) TestLoadAndReload() {
+	require := n.Require()
+	assert := n.Assert()
+
+	f, err := ioutil.TempFile("", "notification_definitions")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	registry := new(NotificationDefinitionRegistry)
+	registry.Register(ERVisitNotificationDefinition)
+	loader := &NotificationDefinitionLoader{Path: f.Name(), Registry: registry}
+
+	require.NoError(ioutil.WriteFile(f.Name(), []byte(`[{"type": "encounter-type", "name": "Office Visit",
+		"reason": {"system": "http://snomed.info/sct", "code": "185349003"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99201"}]}]`), 0644))
+	require.NoError(loader.Load())
+	require.Len(registry.GetAll(), 1)
+	assert.NotNil(registry.Get("Office Visit"))
+	assert.Nil(registry.Get("ER Visit"))
+
+	encounter, err := UnmarshallEncounter("../fixtures/encounter-office-visit.json")
+	require.NoError(err)
+	assert.True(registry.Get("Office Visit").Triggers(encounter, "create"))
+
+	// An invalid file leaves the definitions as they were
+	require.NoError(ioutil.WriteFile(f.Name(), []byte(`[{"type": "unknown", "name": "Broken"}]`), 0644))
+	assert.Error(loader.Load())
+	assert.NotNil(registry.Get("Office Visit"))
+
+	// Reloading through the handler picks up changes to the file
+	require.NoError(ioutil.WriteFile(f.Name(), []byte(`[{"type": "encounter-type", "name": "Readmission",
+		"reason": {"system": "http://snomed.info/sct", "code": "417005"},
+		"types": [{"system": "http://snomed.info/sct", "code": "417005"}]}]`), 0644))
+	e := gin.New()
+	e.POST("/ReloadNotificationDefinitions", loader.ReloadHandler)
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://ie-server/ReloadNotificationDefinitions", nil)
+	require.NoError(err)
+	e.ServeHTTP(rw, req)
+	require.Equal(http.StatusOK, rw.Code)
+	var body struct {
+		Definitions []string `json:"definitions"`
+	}
+	require.NoError(json.NewDecoder(rw.Body).Decode(&body))
+	assert.Equal([]string{"Readmission"}, body.Definitions)
+	assert.Nil(registry.Get("Office Visit"))
+}
+
+func (n *NotificationConfigSuite) TestNewEncounterTypeNotificationDefinition() {
+	require := n.Require()
+	assert := n.Assert()
+
+	reason := models.Coding{System: "http://snomed.info/sct", Code: "4525004"}
+	def := NewEncounterTypeNotificationDefinition("ED", reason, []models.Coding{{System: "http://www.ama-assn.org/go/cpt", Code: "99283"}})
+	encounter, err := UnmarshallEncounter("../fixtures/encounter-er-visit.json")
+	require.NoError(err)
+	assert.Equal("ED", def.Name())
+	assert.True(def.Triggers(encounter, "create"))
+}
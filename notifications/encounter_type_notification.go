@@ -1,22 +1,47 @@
 package notifications
 
 import (
-	"time"
+	"encoding/json"
+	"errors"
 
 	"github.com/intervention-engine/fhir/models"
-	"gopkg.in/mgo.v2/bson"
 )
 
 func init() {
-	DefaultNotificationDefinitionRegistry.RegisterAll([]NotificationDefinition{
-		AdmissionNotificationDefinition,
-		ReadmissionNotificationDefinition,
-		ERVisitNotificationDefinition})
+	RegisterNotificationDefinitionType("encounter-type", func(config []byte) (NotificationDefinition, error) {
+		c := new(EncounterTypeNotificationConfig)
+		if err := json.Unmarshal(config, c); err != nil {
+			return nil, err
+		}
+		if len(c.Types) == 0 {
+			return nil, errors.New("Encounter type notification definitions require at least one type")
+		}
+		def := NewEncounterTypeNotificationDefinition(c.Name, c.Reason, c.Types)
+		def.statuses = c.Statuses
+		return def, nil
+	})
+}
+
+// EncounterTypeNotificationConfig is the JSON configuration of an EncounterTypeNotificationDefinition (with the
+// "encounter-type" type).  The notification is triggered when an encounter with any of the Types is created.  If
+// Statuses are specified, the encounter must also have one of the statuses, so an encounter that is created as
+// "planned" can trigger the notification when it is later updated to "in-progress" or "finished".
+type EncounterTypeNotificationConfig struct {
+	NotificationDefinitionConfig
+	Reason   models.Coding   `json:"reason"`
+	Types    []models.Coding `json:"types"`
+	Statuses []string        `json:"statuses,omitempty"`
+}
+
+// NewEncounterTypeNotificationDefinition creates a definition triggered by new encounters with any of the types
+func NewEncounterTypeNotificationDefinition(name string, reason models.Coding, types []models.Coding) *EncounterTypeNotificationDefinition {
+	return &EncounterTypeNotificationDefinition{name: name, reason: reason, types: types}
 }
 
 type EncounterTypeNotificationDefinition struct {
 	name                  string
 	types                 []models.Coding
+	statuses              []string
 	reason                models.Coding
 	additionalConstraints func(resource interface{}, action string) bool
 }
@@ -26,102 +51,114 @@ func (def *EncounterTypeNotificationDefinition) Name() string {
 }
 
 func (def *EncounterTypeNotificationDefinition) Triggers(resource interface{}, action string) bool {
-	if action != "create" {
-		return false
-	}
+	return action == "create" && def.matches(resource)
+}
+
+func (def *EncounterTypeNotificationDefinition) UpdateResourceTypes() []string {
+	return []string{"Encounter"}
+}
+
+// TriggersUpdate returns true if the updated encounter matches the definition but its previous version didn't (e.g.,
+// its type was corrected, or its status became one of the definition's statuses)
+func (def *EncounterTypeNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	return transitioned(def.matches, previous, resource)
+}
 
+func (def *EncounterTypeNotificationDefinition) matches(resource interface{}) bool {
 	encounter, ok := resource.(*models.Encounter)
-	if ok && models.CodeableConcepts(encounter.Type).AnyMatchesAnyCode(def.types) {
-		if def.additionalConstraints != nil {
-			return def.additionalConstraints(resource, action)
-		}
-		return true
+	if !ok || !models.CodeableConcepts(encounter.Type).AnyMatchesAnyCode(def.types) {
+		return false
+	}
+	if len(def.statuses) > 0 && !containsString(def.statuses, encounter.Status) {
+		return false
 	}
-	return false
+	if def.additionalConstraints != nil {
+		return def.additionalConstraints(resource, "create")
+	}
+	return true
 }
 
 func (def *EncounterTypeNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
 	if def.Triggers(resource, action) {
-		encounter := resource.(*models.Encounter)
-		cr := models.CommunicationRequest{}
-		cr.Id = bson.NewObjectId().Hex()
-		cr.Category = &models.CodeableConcept{Coding: make([]models.Coding, 1)}
-		cr.Category.Coding[0].System = "http://snomed.info/sct"
-		cr.Category.Coding[0].Code = "185087000"
-		//cr.Recipient = TODO
-		cr.Payload = make([]models.CommunicationRequestPayloadComponent, 1)
-		cr.Payload[0].ContentReference = &models.Reference{
-			Reference:    baseURL + "/Encounter/" + encounter.Id,
-			Type:         "Encounter",
-			ReferencedID: encounter.Id}
-		cr.Status = "requested"
-		cr.Reason = make([]models.CodeableConcept, 1)
-		cr.Reason[0] = models.CodeableConcept{Coding: make([]models.Coding, 1)}
-		cr.Reason[0].Coding[0] = def.reason
-		cr.Subject = encounter.Patient
-		cr.RequestedOn = &models.FHIRDateTime{Precision: models.Timestamp, Time: time.Now()}
-		return &cr
+		return def.notification(resource, baseURL)
 	}
 	return nil
 }
 
-// Definition of Encounter-based Notifications.  In the future, this could be externalized to a configuration file or database.
+func (def *EncounterTypeNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *EncounterTypeNotificationDefinition) notification(resource interface{}, baseURL string) *models.CommunicationRequest {
+	encounter := resource.(*models.Encounter)
+	return newNotification("Encounter", encounter.Id, encounter.Patient, def.reason, baseURL)
+}
+
+// Definition of the default Encounter-based Notifications.  These can be replaced by definitions in a configuration
+// file (see config/notification_definitions.json) using a NotificationDefinitionLoader.
 
 var AdmissionNotificationDefinition = &EncounterTypeNotificationDefinition{
 	name:   "Inpatient Admission",
 	reason: models.Coding{System: "http://snomed.info/sct", Code: "32485007", Display: "Hospital admission (procedure)"},
 	additionalConstraints: func(resource interface{}, action string) bool {
-		// Don't trigger the admission notification if it's also a re-admission
-		return !ReadmissionNotificationDefinition.Triggers(resource, action)
+		// Don't trigger the admission notification if it's also a re-admission (coded or computed)
+		return !ReadmissionNotificationDefinition.Triggers(resource, action) &&
+			!ComputedReadmissionNotificationDefinition.Triggers(resource, action)
 	},
-	types: []models.Coding{
-		models.Coding{System: "http://snomed.info/sct", Code: "10378005", Display: "Hospital admission, emergency, from emergency room, accidental injury (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "112689000", Display: "Hospital admission, elective, with complete pre-admission work-up (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "112690009", Display: "Hospital admission, boarder, for social reasons (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "1505002", Display: "Hospital admission for isolation (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "15584006", Display: "Hospital admission, elective, with partial pre-admission work-up (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "18083007", Display: "Hospital admission, emergency, indirect (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "183430001", Display: "Holiday relief admission (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "183452005", Display: "Emergency hospital admission (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "183477006", Display: "Admit cardiothoracic emergency (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "183481006", Display: "Non-urgent hospital admission (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "183497001", Display: "Non-urgent trauma admission (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "19951005", Display: "Hospital admission, emergency, from emergency room, medical nature (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "2252009", Display: "Hospital admission, urgent, 48 hours (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "23473000", Display: "Hospital admission, for research investigation (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "25986004", Display: "Hospital admission, under police custody (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "266938001", Display: "Hospital patient (finding)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "2876009", Display: "Hospital admission, type unclassified, explain by report (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "304568006", Display: "Admission for respite care (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305335007", Display: "Admission to establishment (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305337004", Display: "Admission to community hospital (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305338009", Display: "Admission to general practice hospital (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305339001", Display: "Admission to private hospital (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305341000", Display: "Admission to tertiary referral hospital (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305342007", Display: "Admission to ward (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305343002", Display: "Admission to day ward (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "305344008", Display: "Admission to day hospital (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "308540004", Display: "Inpatient stay (finding)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "313385005", Display: "Admit cardiology emergency (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "32485007", Display: "Hospital admission (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "36723004", Display: "Hospital admission, pre-nursing home placement (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "394656005", Display: "Inpatient care (regime/therapy)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "405614004", Display: "Unexpected hospital admission (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "416683003", Display: "Admit heart failure emergency (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "4563007", Display: "Hospital admission, transfer from other hospital or health care facility (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "45702004", Display: "Hospital admission, precertified by medical audit action (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "48183000", Display: "Hospital admission, special (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "50699000", Display: "Hospital admission, short-term (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "52748007", Display: "Hospital admission, involuntary (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "55402005", Display: "Hospital admission, for laboratory work-up, radiography, etc. (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "63551005", Display: "Hospital admission, from remote area, by means of special transportation (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "65043002", Display: "Hospital admission, short-term, day care (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "70755000", Display: "Hospital admission, by legal authority (commitment) (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "71290004", Display: "Hospital admission, limited to designated procedures (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "73607007", Display: "Hospital admission, emergency, from emergency room (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "78680009", Display: "Hospital admission, emergency, direct (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "81672003", Display: "Hospital admission, elective, without pre-admission work-up (procedure)"},
-		models.Coding{System: "http://snomed.info/sct", Code: "8715000", Display: "Hospital admission, elective (procedure)"}}}
+	types: inpatientAdmissionTypes}
+
+// inpatientAdmissionTypes are the types of inpatient admission encounters
+var inpatientAdmissionTypes = []models.Coding{
+	models.Coding{System: "http://snomed.info/sct", Code: "10378005", Display: "Hospital admission, emergency, from emergency room, accidental injury (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "112689000", Display: "Hospital admission, elective, with complete pre-admission work-up (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "112690009", Display: "Hospital admission, boarder, for social reasons (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "1505002", Display: "Hospital admission for isolation (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "15584006", Display: "Hospital admission, elective, with partial pre-admission work-up (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "18083007", Display: "Hospital admission, emergency, indirect (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "183430001", Display: "Holiday relief admission (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "183452005", Display: "Emergency hospital admission (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "183477006", Display: "Admit cardiothoracic emergency (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "183481006", Display: "Non-urgent hospital admission (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "183497001", Display: "Non-urgent trauma admission (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "19951005", Display: "Hospital admission, emergency, from emergency room, medical nature (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "2252009", Display: "Hospital admission, urgent, 48 hours (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "23473000", Display: "Hospital admission, for research investigation (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "25986004", Display: "Hospital admission, under police custody (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "266938001", Display: "Hospital patient (finding)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "2876009", Display: "Hospital admission, type unclassified, explain by report (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "304568006", Display: "Admission for respite care (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305335007", Display: "Admission to establishment (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305337004", Display: "Admission to community hospital (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305338009", Display: "Admission to general practice hospital (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305339001", Display: "Admission to private hospital (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305341000", Display: "Admission to tertiary referral hospital (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305342007", Display: "Admission to ward (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305343002", Display: "Admission to day ward (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "305344008", Display: "Admission to day hospital (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "308540004", Display: "Inpatient stay (finding)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "313385005", Display: "Admit cardiology emergency (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "32485007", Display: "Hospital admission (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "36723004", Display: "Hospital admission, pre-nursing home placement (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "394656005", Display: "Inpatient care (regime/therapy)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "405614004", Display: "Unexpected hospital admission (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "416683003", Display: "Admit heart failure emergency (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "4563007", Display: "Hospital admission, transfer from other hospital or health care facility (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "45702004", Display: "Hospital admission, precertified by medical audit action (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "48183000", Display: "Hospital admission, special (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "50699000", Display: "Hospital admission, short-term (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "52748007", Display: "Hospital admission, involuntary (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "55402005", Display: "Hospital admission, for laboratory work-up, radiography, etc. (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "63551005", Display: "Hospital admission, from remote area, by means of special transportation (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "65043002", Display: "Hospital admission, short-term, day care (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "70755000", Display: "Hospital admission, by legal authority (commitment) (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "71290004", Display: "Hospital admission, limited to designated procedures (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "73607007", Display: "Hospital admission, emergency, from emergency room (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "78680009", Display: "Hospital admission, emergency, direct (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "81672003", Display: "Hospital admission, elective, without pre-admission work-up (procedure)"},
+	models.Coding{System: "http://snomed.info/sct", Code: "8715000", Display: "Hospital admission, elective (procedure)"}}
 
 var ReadmissionNotificationDefinition = &EncounterTypeNotificationDefinition{
 	name:   "Readmission",
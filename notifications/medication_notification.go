@@ -0,0 +1,136 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+func init() {
+	RegisterNotificationDefinitionType("medication-change", func(config []byte) (NotificationDefinition, error) {
+		c := new(MedicationChangeNotificationConfig)
+		if err := json.Unmarshal(config, c); err != nil {
+			return nil, err
+		}
+		if c.Change != MedicationStart && c.Change != MedicationStop {
+			return nil, fmt.Errorf("Medication change must be %s or %s", MedicationStart, MedicationStop)
+		}
+		if len(c.Medications) == 0 {
+			return nil, errors.New("Medication change notification definitions require at least one medication")
+		}
+		return NewMedicationChangeNotificationDefinition(c.Name, c.Reason, c.Change, c.Medications), nil
+	})
+}
+
+// The medication changes that trigger notifications
+const (
+	MedicationStart = "start"
+	MedicationStop  = "stop"
+)
+
+// MedicationChangeNotificationConfig is the JSON configuration of a MedicationChangeNotificationDefinition (with the
+// "medication-change" type)
+type MedicationChangeNotificationConfig struct {
+	NotificationDefinitionConfig
+	Reason      models.Coding   `json:"reason"`
+	Change      string          `json:"change"`
+	Medications []models.Coding `json:"medications"`
+}
+
+// MedicationChangeNotificationDefinition is triggered when a patient starts or stops one of its medications, as
+// recorded by a MedicationStatement or MedicationOrder.  Starts are new, active statements or orders (or updates that
+// make them active).  Stops are statements or orders that are created or updated as completed (or stopped).  Since
+// patients start and stop medications all the time, there are no default medication change definitions; they are
+// configured with the medications worth notifying care teams about.
+type MedicationChangeNotificationDefinition struct {
+	name        string
+	reason      models.Coding
+	change      string
+	medications []models.Coding
+}
+
+// NewMedicationChangeNotificationDefinition creates a definition triggered by the change (MedicationStart or
+// MedicationStop) to any of the medications.  Without medications, it is never triggered.
+func NewMedicationChangeNotificationDefinition(name string, reason models.Coding, change string, medications []models.Coding) *MedicationChangeNotificationDefinition {
+	return &MedicationChangeNotificationDefinition{name: name, reason: reason, change: change, medications: medications}
+}
+
+func (def *MedicationChangeNotificationDefinition) Name() string {
+	return def.name
+}
+
+func (def *MedicationChangeNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	return action == "create" && def.matches(resource)
+}
+
+func (def *MedicationChangeNotificationDefinition) UpdateResourceTypes() []string {
+	return []string{"MedicationStatement", "MedicationOrder"}
+}
+
+// TriggersUpdate returns true if the update started or stopped the medication (e.g., an active statement became
+// completed)
+func (def *MedicationChangeNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	return transitioned(def.matches, previous, resource)
+}
+
+func (def *MedicationChangeNotificationDefinition) matches(resource interface{}) bool {
+	status, medication, _, ok := medicationDetails(resource)
+	if !ok {
+		return false
+	}
+	switch def.change {
+	case MedicationStart:
+		if status != "active" {
+			return false
+		}
+	case MedicationStop:
+		if status != "completed" && status != "stopped" {
+			return false
+		}
+	default:
+		return false
+	}
+	return medication != nil && models.CodeableConcepts{*medication}.AnyMatchesAnyCode(def.medications)
+}
+
+func (def *MedicationChangeNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	if def.Triggers(resource, action) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *MedicationChangeNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *MedicationChangeNotificationDefinition) notification(resource interface{}, baseURL string) *models.CommunicationRequest {
+	_, _, patient, _ := medicationDetails(resource)
+	switch r := resource.(type) {
+	case *models.MedicationStatement:
+		return newNotification("MedicationStatement", r.Id, patient, def.reason, baseURL)
+	case *models.MedicationOrder:
+		return newNotification("MedicationOrder", r.Id, patient, def.reason, baseURL)
+	}
+	return nil
+}
+
+// medicationDetails returns the status, medication code, and patient of a MedicationStatement or MedicationOrder.
+// Statements that the medication wasn't taken don't have a status, since they don't start or stop anything.
+func medicationDetails(resource interface{}) (status string, medication *models.CodeableConcept, patient *models.Reference, ok bool) {
+	switch r := resource.(type) {
+	case *models.MedicationStatement:
+		if r.WasNotTaken != nil && *r.WasNotTaken {
+			return "", r.MedicationCodeableConcept, r.Patient, true
+		}
+		return r.Status, r.MedicationCodeableConcept, r.Patient, true
+	case *models.MedicationOrder:
+		return r.Status, r.MedicationCodeableConcept, r.Patient, true
+	}
+	return "", nil, nil, false
+}
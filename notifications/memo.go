@@ -0,0 +1,58 @@
+package notifications
+
+import (
+	"reflect"
+	"sync"
+)
+
+// memos holds the memoized lookups for each resource being notified about (see MemoizeLookups), keyed by the pointer
+// to the resource and then by the lookup
+var memos = struct {
+	sync.Mutex
+	m map[interface{}]map[interface{}]interface{}
+}{m: make(map[interface{}]map[interface{}]interface{})}
+
+// MemoizeLookups memoizes the database lookups that definitions make about the resource (e.g., the patient's
+// discharges before an admission) until the returned function is called.  A resource is usually checked by several
+// definitions, some more than once (e.g., as another definition's exclusion, and again when its notification is
+// created), so callers that check every definition, like the notification middleware, should wrap the checks so each
+// lookup is only made once.  Resources that aren't pointers aren't memoized.
+func MemoizeLookups(resource interface{}) (done func()) {
+	if value := reflect.ValueOf(resource); value.Kind() != reflect.Ptr || value.IsNil() {
+		return func() {}
+	}
+	memos.Lock()
+	defer memos.Unlock()
+	if _, ok := memos.m[resource]; ok {
+		// The caller that started memoizing the resource's lookups stops memoizing them
+		return func() {}
+	}
+	memos.m[resource] = make(map[interface{}]interface{})
+	return func() {
+		memos.Lock()
+		defer memos.Unlock()
+		delete(memos.m, resource)
+	}
+}
+
+// memoized returns the result of the lookup about the resource, only calling lookup if the result wasn't already
+// memoized (or if the resource's lookups aren't being memoized).  The key identifies the lookup.
+func memoized(resource, key interface{}, lookup func() interface{}) interface{} {
+	memos.Lock()
+	memo, ok := memos.m[resource]
+	if ok {
+		if result, found := memo[key]; found {
+			memos.Unlock()
+			return result
+		}
+	}
+	memos.Unlock()
+
+	result := lookup()
+	if ok {
+		memos.Lock()
+		memo[key] = result
+		memos.Unlock()
+	}
+	return result
+}
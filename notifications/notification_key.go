@@ -0,0 +1,64 @@
+package notifications
+
+import (
+	"reflect"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// NotificationKeySystem is the identifier system for the keys that make notifications idempotent
+const NotificationKeySystem = "http://interventionengine.org/notification-keys"
+
+// NotificationKey identifies the notification a definition creates for a source resource, so the same notification
+// isn't created again when the resource is re-sent.  The source is identified by its business identifier when it has
+// one (since a re-sent resource is usually assigned a new id), and otherwise by its id.  If the source has a version,
+// each version is a different source.
+func NotificationKey(definitionName string, resource interface{}) string {
+	return definitionName + "|" + sourceKey(resource)
+}
+
+// NotificationKeyIdentifier returns the identifier recording the notification's key
+func NotificationKeyIdentifier(key string) models.Identifier {
+	return models.Identifier{System: NotificationKeySystem, Value: key}
+}
+
+func sourceKey(resource interface{}) string {
+	value := reflect.ValueOf(resource)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	resourceType := value.Elem().Type().Name()
+
+	var key string
+	if identifier := firstIdentifier(value.Elem().FieldByName("Identifier")); identifier != nil {
+		key = resourceType + "?identifier=" + identifier.System + "|" + identifier.Value
+	} else {
+		id, _ := models.GetResourceID(resource)
+		key = resourceType + "/" + id
+	}
+	if meta, ok := models.GetResourceMeta(resource); ok && meta != nil && meta.VersionId != "" {
+		key += "/_history/" + meta.VersionId
+	}
+	return key
+}
+
+// firstIdentifier returns the first identifier with a value from a resource's Identifier field, which is a slice of
+// identifiers for most resources but a single identifier for some (e.g., RiskAssessment)
+func firstIdentifier(field reflect.Value) *models.Identifier {
+	if !field.IsValid() {
+		return nil
+	}
+	switch identifiers := field.Interface().(type) {
+	case []models.Identifier:
+		for i := range identifiers {
+			if identifiers[i].Value != "" {
+				return &identifiers[i]
+			}
+		}
+	case *models.Identifier:
+		if identifiers != nil && identifiers.Value != "" {
+			return identifiers
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package notifications
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestNotificationKeySuite(t *testing.T) {
+	suite.Run(t, new(NotificationKeySuite))
+}
+
+type NotificationKeySuite struct {
+	suite.Suite
+}
+
+func (n *NotificationKeySuite) TestKeyUsesIdentifier() {
+	require := n.Require()
+	assert := n.Assert()
+
+	encounter, err := UnmarshallEncounter("../fixtures/encounter-er-visit.json")
+	require.NoError(err)
+	encounter.Id = "1"
+	encounter.Identifier = []models.Identifier{{System: "http://hospital.example.org/encounters"}, {System: "http://hospital.example.org/visits", Value: "V123"}}
+	assert.Equal("ER Visit|Encounter?identifier=http://hospital.example.org/visits|V123", NotificationKey("ER Visit", encounter))
+
+	// The same encounter, re-sent with a new id, has the same key
+	resent := *encounter
+	resent.Id = "2"
+	assert.Equal(NotificationKey("ER Visit", encounter), NotificationKey("ER Visit", &resent))
+
+	// But each definition has its own key
+	assert.NotEqual(NotificationKey("ER Visit", encounter), NotificationKey("Admission", encounter))
+}
+
+func (n *NotificationKeySuite) TestKeyUsesIdWithoutIdentifier() {
+	obs := &models.Observation{}
+	obs.Id = "123"
+	n.Equal("Critical Lab Result|Observation/123", NotificationKey("Critical Lab Result", obs))
+
+	ra := &models.RiskAssessment{Identifier: &models.Identifier{Value: "R1"}}
+	ra.Id = "456"
+	n.Equal("High Risk|RiskAssessment?identifier=|R1", NotificationKey("High Risk", ra))
+}
+
+func (n *NotificationKeySuite) TestKeyUsesVersion() {
+	obs := &models.Observation{}
+	obs.Id = "123"
+	obs.Meta = &models.Meta{VersionId: "2"}
+	n.Equal("Critical Lab Result|Observation/123/_history/2", NotificationKey("Critical Lab Result", obs))
+}
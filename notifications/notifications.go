@@ -1,6 +1,12 @@
 package notifications
 
-import "github.com/intervention-engine/fhir/models"
+import (
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
 
 /* The NotificationDefinition interface should be implemented by all notification definitions */
 type NotificationDefinition interface {
@@ -9,22 +15,128 @@ type NotificationDefinition interface {
 	GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest
 }
 
-// Setup the registry that keeps track of all the notification definitions
+// UpdateNotificationDefinition is implemented by notification definitions that can also be triggered by updates.  They
+// are passed the previous version of the resource, so they can be triggered by transitions (e.g., an encounter's status
+// becoming finished) rather than by every update to a resource that already triggered the notification.
+// UpdateResourceTypes returns the types of the resources whose updates can trigger the definition, so previous
+// versions are only loaded for those types.
+type UpdateNotificationDefinition interface {
+	NotificationDefinition
+	UpdateResourceTypes() []string
+	TriggersUpdate(previous, resource interface{}) bool
+	GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest
+}
+
+// RateLimitedNotificationDefinition is implemented by notification definitions that notify about a patient at most once
+// in their suppression window, so re-sent or replayed data doesn't flood the patient's care teams with notifications.
+// A zero window doesn't suppress any notifications.
+type RateLimitedNotificationDefinition interface {
+	NotificationDefinition
+	SuppressionWindow() time.Duration
+}
+
+// Setup the registry that keeps track of all the notification definitions.  Definitions may be replaced at runtime
+// (e.g., when they are reloaded from configuration), so the registry is safe for concurrent use.
 
 type NotificationDefinitionRegistry struct {
-	defs []NotificationDefinition
+	mutex sync.RWMutex
+	defs  []NotificationDefinition
 }
 
 func (r *NotificationDefinitionRegistry) Register(def NotificationDefinition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.defs = append(r.defs, def)
 }
 
 func (r *NotificationDefinitionRegistry) RegisterAll(slice []NotificationDefinition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.defs = append(r.defs, slice...)
 }
 
+// Replace replaces all of the registered definitions at once
+func (r *NotificationDefinitionRegistry) Replace(slice []NotificationDefinition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.defs = append([]NotificationDefinition(nil), slice...)
+}
+
 func (r *NotificationDefinitionRegistry) GetAll() []NotificationDefinition {
-	return r.defs
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]NotificationDefinition(nil), r.defs...)
+}
+
+// Get returns the registered definition with the name, or nil if there isn't one
+func (r *NotificationDefinitionRegistry) Get(name string) NotificationDefinition {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, def := range r.defs {
+		if def.Name() == name {
+			return def
+		}
+	}
+	return nil
+}
+
+// TriggeredByUpdates returns true if any of the registered definitions can be triggered by updates of the resource type
+func (r *NotificationDefinitionRegistry) TriggeredByUpdates(resourceType string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, def := range r.defs {
+		if ud, ok := def.(UpdateNotificationDefinition); ok && containsString(ud.UpdateResourceTypes(), resourceType) {
+			return true
+		}
+	}
+	return false
 }
 
 var DefaultNotificationDefinitionRegistry = new(NotificationDefinitionRegistry)
+
+func init() {
+	DefaultNotificationDefinitionRegistry.RegisterAll([]NotificationDefinition{
+		AdmissionNotificationDefinition,
+		ReadmissionNotificationDefinition,
+		ComputedReadmissionNotificationDefinition,
+		ERVisitNotificationDefinition,
+		CriticalLabNotificationDefinition,
+		HighRiskNotificationDefinition,
+		WatchedConditionNotificationDefinition})
+}
+
+// newNotification creates a requested notification about the resource, for the subject (the patient), with the reason.
+// Recipients are added when the notification is created (see RecipientsFunc).
+func newNotification(resourceType, id string, subject *models.Reference, reason models.Coding, baseURL string) *models.CommunicationRequest {
+	cr := models.CommunicationRequest{}
+	cr.Id = bson.NewObjectId().Hex()
+	cr.Category = &models.CodeableConcept{Coding: make([]models.Coding, 1)}
+	cr.Category.Coding[0].System = "http://snomed.info/sct"
+	cr.Category.Coding[0].Code = "185087000"
+	cr.Payload = make([]models.CommunicationRequestPayloadComponent, 1)
+	cr.Payload[0].ContentReference = &models.Reference{
+		Reference:    baseURL + "/" + resourceType + "/" + id,
+		Type:         resourceType,
+		ReferencedID: id}
+	cr.Status = "requested"
+	cr.Reason = make([]models.CodeableConcept, 1)
+	cr.Reason[0] = models.CodeableConcept{Coding: make([]models.Coding, 1)}
+	cr.Reason[0].Coding[0] = reason
+	cr.Subject = subject
+	cr.RequestedOn = &models.FHIRDateTime{Precision: models.Timestamp, Time: time.Now()}
+	return &cr
+}
+
+// transitioned returns true if the resource matches but its previous version didn't (or there is no previous version)
+func transitioned(matches func(resource interface{}) bool, previous, resource interface{}) bool {
+	return matches(resource) && (previous == nil || !matches(previous))
+}
+
+func containsString(slice []string, s string) bool {
+	for i := range slice {
+		if slice[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -110,10 +110,14 @@ func (n *NotificationSuite) TestNotificationDefinitionRegistration() {
 	assert := n.Assert()
 
 	defs := DefaultNotificationDefinitionRegistry.GetAll()
-	assert.Len(defs, 3)
+	assert.Len(defs, 7)
 	assert.True(IsRegistered(AdmissionNotificationDefinition))
 	assert.True(IsRegistered(ReadmissionNotificationDefinition))
+	assert.True(IsRegistered(ComputedReadmissionNotificationDefinition))
 	assert.True(IsRegistered(ERVisitNotificationDefinition))
+	assert.True(IsRegistered(CriticalLabNotificationDefinition))
+	assert.True(IsRegistered(HighRiskNotificationDefinition))
+	assert.True(IsRegistered(WatchedConditionNotificationDefinition))
 }
 
 func (n *NotificationSuite) AssertEncounterNotificationContents(cr *models.CommunicationRequest, reason *models.Coding) {
@@ -0,0 +1,149 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+func init() {
+	RegisterNotificationDefinitionType("critical-observation", func(config []byte) (NotificationDefinition, error) {
+		c := new(CriticalObservationNotificationConfig)
+		if err := json.Unmarshal(config, c); err != nil {
+			return nil, err
+		}
+		if len(c.Limits) == 0 && len(c.Interpretations) == 0 {
+			return nil, errors.New("Critical observation notification definitions require limits or interpretations")
+		}
+		for _, l := range c.Limits {
+			if l.Low == nil && l.High == nil {
+				return nil, errors.New("Critical limits require a low or high value")
+			}
+		}
+		return NewCriticalObservationNotificationDefinition(c.Name, c.Reason, c.Limits, c.Interpretations), nil
+	})
+}
+
+// NotificationReasonSystem is the code system for notification reasons that don't have a standard code
+const NotificationReasonSystem = "http://interventionengine.org/notification-reasons"
+
+// CriticalLimit is the range of normal values for an observation with the code.  Values below the Low limit or above
+// the High limit are critical.  If a Unit is specified, values in other units aren't compared.
+type CriticalLimit struct {
+	Code models.Coding `json:"code"`
+	Low  *float64      `json:"low,omitempty"`
+	High *float64      `json:"high,omitempty"`
+	Unit string        `json:"unit,omitempty"`
+}
+
+// CriticalObservationNotificationConfig is the JSON configuration of a CriticalObservationNotificationDefinition (with
+// the "critical-observation" type)
+type CriticalObservationNotificationConfig struct {
+	NotificationDefinitionConfig
+	Reason          models.Coding   `json:"reason"`
+	Limits          []CriticalLimit `json:"limits,omitempty"`
+	Interpretations []models.Coding `json:"interpretations,omitempty"`
+}
+
+// CriticalObservationNotificationDefinition is triggered by new observations with critical values, either because
+// the value is outside of the critical limits for its code, or because it is interpreted as critical (e.g., HH or LL)
+type CriticalObservationNotificationDefinition struct {
+	name            string
+	reason          models.Coding
+	limits          []CriticalLimit
+	interpretations []models.Coding
+}
+
+// NewCriticalObservationNotificationDefinition creates a definition triggered by observations outside of the limits
+// or with any of the interpretations
+func NewCriticalObservationNotificationDefinition(name string, reason models.Coding, limits []CriticalLimit, interpretations []models.Coding) *CriticalObservationNotificationDefinition {
+	return &CriticalObservationNotificationDefinition{name: name, reason: reason, limits: limits, interpretations: interpretations}
+}
+
+func (def *CriticalObservationNotificationDefinition) Name() string {
+	return def.name
+}
+
+func (def *CriticalObservationNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	return action == "create" && def.matches(resource)
+}
+
+func (def *CriticalObservationNotificationDefinition) UpdateResourceTypes() []string {
+	return []string{"Observation"}
+}
+
+// TriggersUpdate returns true if the updated observation is critical but its previous version wasn't (e.g., its value
+// was corrected)
+func (def *CriticalObservationNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	return transitioned(def.matches, previous, resource)
+}
+
+func (def *CriticalObservationNotificationDefinition) matches(resource interface{}) bool {
+	obs, ok := resource.(*models.Observation)
+	if !ok || obs.Status == "cancelled" || obs.Status == "entered-in-error" {
+		return false
+	}
+	if obs.Interpretation != nil {
+		for _, i := range def.interpretations {
+			if obs.Interpretation.MatchesCode(i.System, i.Code) {
+				return true
+			}
+		}
+	}
+	if obs.Code == nil || obs.ValueQuantity == nil || obs.ValueQuantity.Value == nil {
+		return false
+	}
+	value := *obs.ValueQuantity.Value
+	for _, l := range def.limits {
+		if !obs.Code.MatchesCode(l.Code.System, l.Code.Code) {
+			continue
+		}
+		if l.Unit != "" && l.Unit != obs.ValueQuantity.Unit && l.Unit != obs.ValueQuantity.Code {
+			continue
+		}
+		if (l.Low != nil && value < *l.Low) || (l.High != nil && value > *l.High) {
+			return true
+		}
+	}
+	return false
+}
+
+func (def *CriticalObservationNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	if def.Triggers(resource, action) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *CriticalObservationNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *CriticalObservationNotificationDefinition) notification(resource interface{}, baseURL string) *models.CommunicationRequest {
+	obs := resource.(*models.Observation)
+	return newNotification("Observation", obs.Id, obs.Subject, def.reason, baseURL)
+}
+
+func criticalValue(v float64) *float64 {
+	return &v
+}
+
+// Definition of the default critical lab notification, using common critical limits
+
+var CriticalLabNotificationDefinition = NewCriticalObservationNotificationDefinition(
+	"Critical Lab Result",
+	models.Coding{System: NotificationReasonSystem, Code: "critical-lab", Display: "Critical lab result"},
+	[]CriticalLimit{
+		{Code: models.Coding{System: "http://loinc.org", Code: "2823-3", Display: "Potassium"}, Low: criticalValue(2.8), High: criticalValue(6.2), Unit: "mmol/L"},
+		{Code: models.Coding{System: "http://loinc.org", Code: "2951-2", Display: "Sodium"}, Low: criticalValue(120), High: criticalValue(160), Unit: "mmol/L"},
+		{Code: models.Coding{System: "http://loinc.org", Code: "2345-7", Display: "Glucose"}, Low: criticalValue(40), High: criticalValue(450), Unit: "mg/dL"},
+		{Code: models.Coding{System: "http://loinc.org", Code: "718-7", Display: "Hemoglobin"}, Low: criticalValue(7), Unit: "g/dL"},
+		{Code: models.Coding{System: "http://loinc.org", Code: "6301-6", Display: "INR"}, High: criticalValue(5)}},
+	[]models.Coding{
+		{System: "http://hl7.org/fhir/v2/0078", Code: "HH", Display: "Critically high"},
+		{System: "http://hl7.org/fhir/v2/0078", Code: "LL", Display: "Critically low"},
+		{System: "http://hl7.org/fhir/v2/0078", Code: "AA", Display: "Critically abnormal"}})
@@ -0,0 +1,170 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	RegisterNotificationDefinitionType("readmission-window", func(config []byte) (NotificationDefinition, error) {
+		c := new(ReadmissionWindowNotificationConfig)
+		if err := json.Unmarshal(config, c); err != nil {
+			return nil, err
+		}
+		if len(c.Types) == 0 {
+			return nil, errors.New("Readmission window notification definitions require at least one type")
+		}
+		if c.WindowInDays < 0 {
+			return nil, errors.New("Readmission window notification definitions require a positive window")
+		}
+		if c.WindowInDays == 0 {
+			c.WindowInDays = DefaultReadmissionWindowInDays
+		}
+		return NewReadmissionWindowNotificationDefinition(c.Name, c.Reason, c.Types, c.WindowInDays), nil
+	})
+}
+
+// DefaultReadmissionWindowInDays is how soon after a discharge an inpatient admission is considered a readmission,
+// unless a definition is configured with a different window
+const DefaultReadmissionWindowInDays = 30
+
+// DischargesFunc finds the patient's encounters, other than the excluded one, that ended (i.e., the patient was
+// discharged) between since and until
+type DischargesFunc func(patient *models.Reference, excludeID string, since, until time.Time) ([]models.Encounter, error)
+
+// ReadmissionWindowNotificationConfig is the JSON configuration of a ReadmissionWindowNotificationDefinition (with
+// the "readmission-window" type).  The Types are the types of inpatient encounters, and WindowInDays defaults to
+// DefaultReadmissionWindowInDays.
+type ReadmissionWindowNotificationConfig struct {
+	NotificationDefinitionConfig
+	Reason       models.Coding   `json:"reason"`
+	Types        []models.Coding `json:"types"`
+	WindowInDays int             `json:"windowInDays,omitempty"`
+}
+
+// ReadmissionWindowNotificationDefinition is triggered by new inpatient admissions (encounters with any of the
+// types) that start within the window after the patient was discharged from another inpatient encounter.  Unlike
+// ReadmissionNotificationDefinition, it doesn't rely on the source system coding the encounter as a readmission, so
+// encounters that are already coded with the definition's reason are left to the coded definition.
+type ReadmissionWindowNotificationDefinition struct {
+	name         string
+	reason       models.Coding
+	types        []models.Coding
+	windowInDays int
+	Discharges   DischargesFunc
+}
+
+// NewReadmissionWindowNotificationDefinition creates a definition triggered by inpatient admissions within the
+// window (in days) after an inpatient discharge.  Discharges are found in the encounters collection.
+func NewReadmissionWindowNotificationDefinition(name string, reason models.Coding, types []models.Coding, windowInDays int) *ReadmissionWindowNotificationDefinition {
+	return &ReadmissionWindowNotificationDefinition{name: name, reason: reason, types: types, windowInDays: windowInDays, Discharges: mongoDischarges}
+}
+
+func (def *ReadmissionWindowNotificationDefinition) Name() string {
+	return def.name
+}
+
+func (def *ReadmissionWindowNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	return action == "create" && def.isAdmission(resource) && def.isReadmission(resource.(*models.Encounter))
+}
+
+func (def *ReadmissionWindowNotificationDefinition) UpdateResourceTypes() []string {
+	return []string{"Encounter"}
+}
+
+// TriggersUpdate returns true if the updated encounter is a readmission but its previous version wasn't an inpatient
+// admission (e.g., its type was corrected)
+func (def *ReadmissionWindowNotificationDefinition) TriggersUpdate(previous, resource interface{}) bool {
+	return transitioned(def.isAdmission, previous, resource) && def.isReadmission(resource.(*models.Encounter))
+}
+
+func (def *ReadmissionWindowNotificationDefinition) isAdmission(resource interface{}) bool {
+	encounter, ok := resource.(*models.Encounter)
+	if !ok || encounter.Patient == nil || encounter.Status == "cancelled" {
+		return false
+	}
+	types := models.CodeableConcepts(encounter.Type)
+	return types.AnyMatchesAnyCode(def.types) && !types.AnyMatchesCode(def.reason.System, def.reason.Code)
+}
+
+// isReadmission looks for a discharge from an inpatient encounter (including an encounter coded as a readmission)
+// within the window before the encounter started (or before now, if the encounter doesn't have a start).  If the
+// discharges can't be found, the encounter isn't considered a readmission, so the patient's care teams are still
+// notified about the admission.  The lookup is memoized (see MemoizeLookups).
+func (def *ReadmissionWindowNotificationDefinition) isReadmission(encounter *models.Encounter) bool {
+	return memoized(encounter, def, func() interface{} {
+		return def.findDischarge(encounter)
+	}).(bool)
+}
+
+func (def *ReadmissionWindowNotificationDefinition) findDischarge(encounter *models.Encounter) bool {
+	admitted := time.Now()
+	if encounter.Period != nil && encounter.Period.Start != nil {
+		admitted = encounter.Period.Start.Time
+	}
+	discharges, err := def.Discharges(encounter.Patient, encounter.Id, admitted.AddDate(0, 0, -def.windowInDays), admitted)
+	if err != nil {
+		log.Printf("Error finding discharges before encounter %s: %v", encounter.Id, err)
+		return false
+	}
+	for i := range discharges {
+		if discharges[i].Status == "cancelled" {
+			continue
+		}
+		types := models.CodeableConcepts(discharges[i].Type)
+		if types.AnyMatchesAnyCode(def.types) || types.AnyMatchesCode(def.reason.System, def.reason.Code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (def *ReadmissionWindowNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	if def.Triggers(resource, action) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *ReadmissionWindowNotificationDefinition) GetUpdateNotification(previous, resource interface{}, baseURL string) *models.CommunicationRequest {
+	if def.TriggersUpdate(previous, resource) {
+		return def.notification(resource, baseURL)
+	}
+	return nil
+}
+
+func (def *ReadmissionWindowNotificationDefinition) notification(resource interface{}, baseURL string) *models.CommunicationRequest {
+	encounter := resource.(*models.Encounter)
+	return newNotification("Encounter", encounter.Id, encounter.Patient, def.reason, baseURL)
+}
+
+// mongoDischarges finds the patient's other encounters in the encounters collection that ended between since and
+// until
+func mongoDischarges(patient *models.Reference, excludeID string, since, until time.Time) ([]models.Encounter, error) {
+	if patient == nil || server.Database == nil {
+		return nil, nil
+	}
+	query := bson.M{
+		"_id":                 bson.M{"$ne": excludeID},
+		"patient.referenceid": patient.ReferencedID,
+		"period.end.time":     bson.M{"$gte": since, "$lte": until},
+	}
+	var encounters []models.Encounter
+	err := server.Database.C("encounters").Find(query).All(&encounters)
+	return encounters, err
+}
+
+// Definition of the default computed readmission notification, using the same types as the default admission
+// notification and the same reason as the default (coded) readmission notification
+
+var ComputedReadmissionNotificationDefinition = NewReadmissionWindowNotificationDefinition(
+	"Computed Readmission",
+	ReadmissionNotificationDefinition.reason,
+	inpatientAdmissionTypes,
+	DefaultReadmissionWindowInDays)
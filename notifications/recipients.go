@@ -0,0 +1,46 @@
+package notifications
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+)
+
+// RecipientsFunc finds the recipients of notifications about the patient
+type RecipientsFunc func(patient *models.Reference) ([]models.Reference, error)
+
+// CareTeamRecipients routes notifications to the care teams the patient belongs to, and to the leaders of those teams.
+// Memberships in care teams that no longer exist are ignored.
+func CareTeamRecipients(memberships ie.MembershipService, careTeams ie.CareTeamService) RecipientsFunc {
+	return func(patient *models.Reference) ([]models.Reference, error) {
+		if patient == nil || patient.ReferencedID == "" {
+			return nil, nil
+		}
+		mems, err := memberships.PatientMemberships(patient.ReferencedID)
+		if err != nil {
+			return nil, err
+		}
+
+		var recipients []models.Reference
+		teams := make(map[string]bool)
+		leaders := make(map[string]bool)
+		for _, mem := range mems {
+			if teams[mem.CareTeamID] {
+				continue
+			}
+			teams[mem.CareTeamID] = true
+			team, err := careTeams.CareTeam(mem.CareTeamID)
+			if err != nil {
+				if err.Error() == "not found" {
+					continue
+				}
+				return nil, err
+			}
+			recipients = append(recipients, team.Reference())
+			if team.Leader != "" && !leaders[team.Leader] {
+				leaders[team.Leader] = true
+				recipients = append(recipients, models.Reference{Display: team.Leader})
+			}
+		}
+		return recipients, nil
+	}
+}
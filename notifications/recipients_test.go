@@ -0,0 +1,118 @@
+package notifications
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/stretchr/testify/suite"
+)
+
+type RecipientsSuite struct {
+	suite.Suite
+	Memberships []ie.Membership
+	TeamsDB     map[string]ie.CareTeam
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestRecipientsSuite(t *testing.T) {
+	suite.Run(t, new(RecipientsSuite))
+}
+
+func (suite *RecipientsSuite) SetupTest() {
+	suite.TeamsDB = map[string]ie.CareTeam{
+		"58c314acb367c1ff54d19e9e": {ID: "58c314acb367c1ff54d19e9e", Name: "The AutoDocs", Leader: "Optometrist Prime"},
+		"58c314acb367c1ff54d19e9f": {ID: "58c314acb367c1ff54d19e9f", Name: "RoboDocs"},
+	}
+	suite.Memberships = []ie.Membership{
+		{CareTeamID: "58c314acb367c1ff54d19e9e", PatientID: "1"},
+		{CareTeamID: "58c314acb367c1ff54d19e9f", PatientID: "1"},
+		{CareTeamID: "58c314acb367c1ff54d19e9e", PatientID: "2"},
+		{CareTeamID: "58c314acb367c1ff54d19ea0", PatientID: "2"},
+	}
+}
+
+func (suite *RecipientsSuite) TestCareTeamRecipients() {
+	recipients, err := CareTeamRecipients(suite, suite)(&models.Reference{Reference: "Patient/1", Type: "Patient", ReferencedID: "1"})
+	suite.Require().NoError(err)
+	suite.Require().Len(recipients, 3)
+	suite.Equal("CareTeam/58c314acb367c1ff54d19e9e", recipients[0].Reference)
+	suite.Equal("The AutoDocs", recipients[0].Display)
+	suite.Equal(models.Reference{Display: "Optometrist Prime"}, recipients[1])
+	suite.Equal("CareTeam/58c314acb367c1ff54d19e9f", recipients[2].Reference)
+}
+
+func (suite *RecipientsSuite) TestCareTeamRecipientsIgnoresMissingTeams() {
+	recipients, err := CareTeamRecipients(suite, suite)(&models.Reference{Reference: "Patient/2", Type: "Patient", ReferencedID: "2"})
+	suite.Require().NoError(err)
+	suite.Len(recipients, 2)
+}
+
+func (suite *RecipientsSuite) TestCareTeamRecipientsWithoutMemberships() {
+	recipients, err := CareTeamRecipients(suite, suite)(&models.Reference{Reference: "Patient/3", Type: "Patient", ReferencedID: "3"})
+	suite.Require().NoError(err)
+	suite.Empty(recipients)
+
+	recipients, err = CareTeamRecipients(suite, suite)(nil)
+	suite.Require().NoError(err)
+	suite.Empty(recipients)
+}
+
+// Mock Services
+
+func (suite *RecipientsSuite) CreateMembership(mem ie.Membership) error {
+	suite.Memberships = append(suite.Memberships, mem)
+	return nil
+}
+
+func (suite *RecipientsSuite) PatientMemberships(id string) ([]ie.Membership, error) {
+	var mems []ie.Membership
+	for _, mem := range suite.Memberships {
+		if mem.PatientID == id {
+			mems = append(mems, mem)
+		}
+	}
+	return mems, nil
+}
+
+func (suite *RecipientsSuite) CareTeamMemberships(id string) ([]ie.Membership, error) {
+	var mems []ie.Membership
+	for _, mem := range suite.Memberships {
+		if mem.CareTeamID == id {
+			mems = append(mems, mem)
+		}
+	}
+	return mems, nil
+}
+
+func (suite *RecipientsSuite) CareTeam(id string) (*ie.CareTeam, error) {
+	if ct, ok := suite.TeamsDB[id]; ok {
+		return &ct, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (suite *RecipientsSuite) CareTeams() ([]ie.CareTeam, error) {
+	var cc []ie.CareTeam
+	for _, ct := range suite.TeamsDB {
+		cc = append(cc, ct)
+	}
+	return cc, nil
+}
+
+func (suite *RecipientsSuite) CreateCareTeam(c *ie.CareTeam) error {
+	suite.TeamsDB[c.ID] = *c
+	return nil
+}
+
+func (suite *RecipientsSuite) UpdateCareTeam(c *ie.CareTeam) error {
+	suite.TeamsDB[c.ID] = *c
+	return nil
+}
+
+func (suite *RecipientsSuite) DeleteCareTeam(id string) error {
+	delete(suite.TeamsDB, id)
+	return nil
+}
@@ -0,0 +1,320 @@
+package notifications
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestResourceNotificationSuite(t *testing.T) {
+	suite.Run(t, new(ResourceNotificationSuite))
+}
+
+type ResourceNotificationSuite struct {
+	suite.Suite
+}
+
+var testPatient = &models.Reference{Reference: "http://intervention-engine.org/Patient/5540f2041cd4623133000001", ReferencedID: "5540f2041cd4623133000001", Type: "Patient"}
+
+func (n *ResourceNotificationSuite) TestCriticalLabNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	potassium := func(value float64, unit string) *models.Observation {
+		return &models.Observation{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+			Status:         "final",
+			Code:           &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "2823-3"}}},
+			Subject:        testPatient,
+			ValueQuantity:  &models.Quantity{Value: &value, Unit: unit},
+		}
+	}
+
+	def := CriticalLabNotificationDefinition
+	assert.True(def.Triggers(potassium(6.5, "mmol/L"), "create"))
+	assert.True(def.Triggers(potassium(2.5, "mmol/L"), "create"))
+	assert.False(def.Triggers(potassium(4.1, "mmol/L"), "create"))
+	assert.False(def.Triggers(potassium(6.5, "mmol/L"), "delete"))
+	// Values in other units aren't compared
+	assert.False(def.Triggers(potassium(6.5, "mg/dL"), "create"))
+
+	cancelled := potassium(6.5, "mmol/L")
+	cancelled.Status = "entered-in-error"
+	assert.False(def.Triggers(cancelled, "create"))
+
+	// Observations interpreted as critical trigger the notification regardless of their values
+	flagged := potassium(4.1, "mmol/L")
+	flagged.Interpretation = &models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/v2/0078", Code: "HH"}}}
+	assert.True(def.Triggers(flagged, "create"))
+
+	cr := def.GetNotification(potassium(6.5, "mmol/L"), "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	n.assertNotification(cr, "Observation", "critical-lab")
+	assert.Nil(def.GetNotification(potassium(4.1, "mmol/L"), "create", "http://intervention-engine.org"))
+}
+
+func (n *ResourceNotificationSuite) TestHighRiskNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	assessment := func(score float64) *models.RiskAssessment {
+		return &models.RiskAssessment{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+			Subject:        testPatient,
+			Method:         &models.CodeableConcept{Coding: []models.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "Simple"}}},
+			Prediction:     []models.RiskAssessmentPredictionComponent{{ProbabilityDecimal: &score}},
+		}
+	}
+	previous := func(score float64, found bool, err error) PreviousRiskScoreFunc {
+		return func(*models.RiskAssessment) (float64, bool, error) {
+			return score, found, err
+		}
+	}
+
+	def := NewRiskThresholdNotificationDefinition("High Risk", HighRiskNotificationDefinition.reason, HighRiskNotificationDefinition.method, 6)
+	def.PreviousScore = previous(3, true, nil)
+	assert.True(def.Triggers(assessment(7), "create"))
+	assert.True(def.Triggers(assessment(6), "create"))
+	assert.False(def.Triggers(assessment(5), "create"))
+	assert.False(def.Triggers(assessment(7), "update"))
+
+	// Patients who were already high risk don't trigger the notification again
+	def.PreviousScore = previous(8, true, nil)
+	assert.False(def.Triggers(assessment(7), "create"))
+
+	// Patients' first assessments only need to be above the threshold
+	def.PreviousScore = previous(0, false, nil)
+	assert.True(def.Triggers(assessment(7), "create"))
+	def.PreviousScore = previous(0, false, errors.New("Database is down"))
+	assert.True(def.Triggers(assessment(7), "create"))
+
+	// Assessments using other methods are ignored
+	other := assessment(4)
+	other.Method.Coding[0].Code = "MultiFactor"
+	assert.False(def.Triggers(other, "create"))
+
+	cr := def.GetNotification(assessment(7), "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	n.assertNotification(cr, "RiskAssessment", "high-risk")
+}
+
+func (n *ResourceNotificationSuite) TestWatchedConditionNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	condition := func(code, verificationStatus string) *models.Condition {
+		return &models.Condition{
+			DomainResource:     models.DomainResource{Resource: models.Resource{Id: "1"}},
+			Patient:            testPatient,
+			Code:               &models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: code}}},
+			VerificationStatus: verificationStatus,
+		}
+	}
+
+	def := WatchedConditionNotificationDefinition
+	assert.True(def.Triggers(condition("84114007", "confirmed"), "create"))
+	assert.True(def.Triggers(condition("84114007", ""), "create"))
+	assert.False(def.Triggers(condition("84114007", "refuted"), "create"))
+	assert.False(def.Triggers(condition("38341003", "confirmed"), "create"))
+	assert.False(def.Triggers(condition("84114007", "confirmed"), "update"))
+
+	cr := def.GetNotification(condition("84114007", "confirmed"), "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	n.assertNotification(cr, "Condition", "watched-condition")
+}
+
+func (n *ResourceNotificationSuite) TestMedicationChangeNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	statement := func(status string) *models.MedicationStatement {
+		return &models.MedicationStatement{
+			DomainResource:            models.DomainResource{Resource: models.Resource{Id: "1"}},
+			Patient:                   testPatient,
+			Status:                    status,
+			MedicationCodeableConcept: &models.CodeableConcept{Coding: []models.Coding{{System: "http://www.nlm.nih.gov/research/umls/rxnorm", Code: "197361"}}},
+		}
+	}
+	order := &models.MedicationOrder{
+		DomainResource: models.DomainResource{Resource: models.Resource{Id: "2"}},
+		Patient:        testPatient,
+		Status:         "stopped",
+	}
+
+	medications := []models.Coding{{System: "http://www.nlm.nih.gov/research/umls/rxnorm", Code: "197361"}}
+	start := NewMedicationChangeNotificationDefinition("Amlodipine Started",
+		models.Coding{System: NotificationReasonSystem, Code: "medication-start"}, MedicationStart, medications)
+	stop := NewMedicationChangeNotificationDefinition("Amlodipine Stopped",
+		models.Coding{System: NotificationReasonSystem, Code: "medication-stop"}, MedicationStop, medications)
+	assert.True(start.Triggers(statement("active"), "create"))
+	assert.False(stop.Triggers(statement("active"), "create"))
+	assert.True(stop.Triggers(statement("completed"), "create"))
+	assert.False(start.Triggers(statement("completed"), "create"))
+	assert.False(stop.Triggers(order, "create"))
+	order.MedicationCodeableConcept = &models.CodeableConcept{Coding: medications}
+	assert.True(stop.Triggers(order, "create"))
+
+	notTaken := statement("active")
+	notTaken.WasNotTaken = new(bool)
+	*notTaken.WasNotTaken = true
+	assert.False(start.Triggers(notTaken, "create"))
+
+	// Only changes to the definition's medications trigger it, so definitions without medications never trigger
+	other := statement("active")
+	other.MedicationCodeableConcept.Coding[0].Code = "314076"
+	assert.False(start.Triggers(other, "create"))
+	anything := NewMedicationChangeNotificationDefinition("Any Start", start.reason, MedicationStart, nil)
+	assert.False(anything.Triggers(statement("active"), "create"))
+
+	cr := start.GetNotification(statement("active"), "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	n.assertNotification(cr, "MedicationStatement", "medication-start")
+	cr = stop.GetNotification(order, "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	assert.Equal("MedicationOrder", cr.Payload[0].ContentReference.Type)
+}
+
+func (n *ResourceNotificationSuite) TestComputedReadmissionNotifications() {
+	require := n.Require()
+	assert := n.Assert()
+
+	admittedOn := time.Date(2015, time.April, 1, 5, 15, 0, 0, time.UTC)
+	encounter := func(code string, start time.Time) *models.Encounter {
+		return &models.Encounter{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+			Status:         "in-progress",
+			Type:           []models.CodeableConcept{{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: code}}}},
+			Patient:        testPatient,
+			Period:         &models.Period{Start: &models.FHIRDateTime{Time: start, Precision: models.Timestamp}},
+		}
+	}
+	var since, until time.Time
+	discharges := func(encounters []models.Encounter, err error) DischargesFunc {
+		return func(patient *models.Reference, excludeID string, s, u time.Time) ([]models.Encounter, error) {
+			assert.Equal(testPatient, patient)
+			assert.Equal("1", excludeID)
+			since, until = s, u
+			return encounters, err
+		}
+	}
+	discharge := encounter("8715000", admittedOn.AddDate(0, 0, -20))
+	discharge.Id = "0"
+	discharge.Status = "finished"
+
+	def := NewReadmissionWindowNotificationDefinition("Computed Readmission", ReadmissionNotificationDefinition.reason, inpatientAdmissionTypes, 30)
+	def.Discharges = discharges([]models.Encounter{*discharge}, nil)
+	assert.True(def.Triggers(encounter("32485007", admittedOn), "create"))
+	assert.Equal(admittedOn.AddDate(0, 0, -30), since)
+	assert.Equal(admittedOn, until)
+	assert.False(def.Triggers(encounter("32485007", admittedOn), "update"))
+
+	// Only discharges from inpatient encounters count, and only inpatient admissions can be readmissions
+	assert.False(def.Triggers(encounter("4525004", admittedOn), "create"))
+	office := *discharge
+	office.Type = []models.CodeableConcept{{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "185349003"}}}}
+	def.Discharges = discharges([]models.Encounter{office}, nil)
+	assert.False(def.Triggers(encounter("32485007", admittedOn), "create"))
+	cancelled := *discharge
+	cancelled.Status = "cancelled"
+	def.Discharges = discharges([]models.Encounter{cancelled}, nil)
+	assert.False(def.Triggers(encounter("32485007", admittedOn), "create"))
+	def.Discharges = discharges(nil, nil)
+	assert.False(def.Triggers(encounter("32485007", admittedOn), "create"))
+	def.Discharges = discharges(nil, errors.New("Database is down"))
+	assert.False(def.Triggers(encounter("32485007", admittedOn), "create"))
+
+	// Discharges from encounters coded as readmissions count too
+	readmission := *discharge
+	readmission.Type = []models.CodeableConcept{{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "417005"}}}}
+	def.Discharges = discharges([]models.Encounter{readmission}, nil)
+	assert.True(def.Triggers(encounter("32485007", admittedOn), "create"))
+
+	// Encounters already coded as readmissions are left to the coded definition
+	def.Discharges = discharges([]models.Encounter{*discharge}, nil)
+	coded := encounter("32485007", admittedOn)
+	coded.Type = append(coded.Type, models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "417005"}}})
+	assert.False(def.Triggers(coded, "create"))
+
+	// Admissions whose type is corrected are readmissions too
+	assert.True(def.TriggersUpdate(encounter("185349003", admittedOn), encounter("32485007", admittedOn)))
+	assert.False(def.TriggersUpdate(encounter("32485007", admittedOn), encounter("32485007", admittedOn)))
+
+	cr := def.GetNotification(encounter("32485007", admittedOn), "create", "http://intervention-engine.org")
+	require.NotNil(cr)
+	assert.Equal("http://intervention-engine.org/Encounter/1", cr.Payload[0].ContentReference.Reference)
+	assert.Equal("417005", cr.Reason[0].Coding[0].Code)
+	assert.Equal(testPatient, cr.Subject)
+
+	// The default admission definition defers to the default computed readmission definition
+	defer func(d DischargesFunc) { ComputedReadmissionNotificationDefinition.Discharges = d }(ComputedReadmissionNotificationDefinition.Discharges)
+	ComputedReadmissionNotificationDefinition.Discharges = discharges([]models.Encounter{*discharge}, nil)
+	assert.True(ComputedReadmissionNotificationDefinition.Triggers(encounter("32485007", admittedOn), "create"))
+	assert.False(AdmissionNotificationDefinition.Triggers(encounter("32485007", admittedOn), "create"))
+	ComputedReadmissionNotificationDefinition.Discharges = discharges(nil, nil)
+	assert.False(ComputedReadmissionNotificationDefinition.Triggers(encounter("32485007", admittedOn), "create"))
+	assert.True(AdmissionNotificationDefinition.Triggers(encounter("32485007", admittedOn), "create"))
+
+	// While the lookups are memoized, the discharges are only found once per admission
+	lookups := 0
+	ComputedReadmissionNotificationDefinition.Discharges = func(patient *models.Reference, excludeID string, s, u time.Time) ([]models.Encounter, error) {
+		lookups++
+		return []models.Encounter{*discharge}, nil
+	}
+	admission := encounter("32485007", admittedOn)
+	done := MemoizeLookups(admission)
+	assert.False(AdmissionNotificationDefinition.Triggers(admission, "create"))
+	assert.True(ComputedReadmissionNotificationDefinition.Triggers(admission, "create"))
+	assert.NotNil(ComputedReadmissionNotificationDefinition.GetNotification(admission, "create", "http://intervention-engine.org"))
+	assert.Equal(1, lookups)
+	done()
+	assert.True(ComputedReadmissionNotificationDefinition.Triggers(admission, "create"))
+	assert.Equal(2, lookups)
+}
+
+func (n *ResourceNotificationSuite) TestConfiguredResourceDefinitions() {
+	require := n.Require()
+	assert := n.Assert()
+
+	defs, err := ParseNotificationDefinitions([]byte(`[
+		{"type": "critical-observation", "name": "High Glucose", "reason": {"system": "http://interventionengine.org/notification-reasons", "code": "critical-lab"},
+		 "limits": [{"code": {"system": "http://loinc.org", "code": "2345-7"}, "high": 300}]},
+		{"type": "risk-threshold", "name": "High MultiFactor Risk", "threshold": 4,
+		 "method": {"system": "http://interventionengine.org/risk-assessments", "code": "MultiFactor"}},
+		{"type": "condition-watch-list", "name": "Diabetes", "codes": [{"system": "http://snomed.info/sct", "code": "44054006"}]},
+		{"type": "medication-change", "name": "Amlodipine Stopped", "change": "stop",
+		 "medications": [{"system": "http://www.nlm.nih.gov/research/umls/rxnorm", "code": "197361"}]}
+	]`))
+	require.NoError(err)
+	require.Len(defs, 4)
+	assert.IsType(new(CriticalObservationNotificationDefinition), defs[0])
+	assert.IsType(new(RiskThresholdNotificationDefinition), defs[1])
+	assert.IsType(new(ConditionWatchListNotificationDefinition), defs[2])
+	assert.IsType(new(MedicationChangeNotificationDefinition), defs[3])
+
+	for _, config := range []string{
+		`[{"type": "critical-observation", "name": "Nothing"}]`,
+		`[{"type": "critical-observation", "name": "No Limits", "limits": [{"code": {"system": "http://loinc.org", "code": "2345-7"}}]}]`,
+		`[{"type": "risk-threshold", "name": "No Method", "threshold": 4}]`,
+		`[{"type": "condition-watch-list", "name": "No Codes"}]`,
+		`[{"type": "medication-change", "name": "Bad Change", "change": "pause", "medications": [{"code": "197361"}]}]`,
+		`[{"type": "medication-change", "name": "Any Stop", "change": "stop"}]`,
+	} {
+		_, err := ParseNotificationDefinitions([]byte(config))
+		assert.Error(err, config)
+	}
+}
+
+func (n *ResourceNotificationSuite) assertNotification(cr *models.CommunicationRequest, resourceType, reason string) {
+	assert := n.Assert()
+	assert.Equal("http://intervention-engine.org/"+resourceType+"/1", cr.Payload[0].ContentReference.Reference)
+	assert.Equal(resourceType, cr.Payload[0].ContentReference.Type)
+	assert.Equal("requested", cr.Status)
+	assert.Equal(NotificationReasonSystem, cr.Reason[0].Coding[0].System)
+	assert.Equal(reason, cr.Reason[0].Coding[0].Code)
+	assert.Equal(testPatient, cr.Subject)
+}
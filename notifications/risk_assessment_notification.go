@@ -0,0 +1,123 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	RegisterNotificationDefinitionType("risk-threshold", func(config []byte) (NotificationDefinition, error) {
+		c := new(RiskThresholdNotificationConfig)
+		if err := json.Unmarshal(config, c); err != nil {
+			return nil, err
+		}
+		if c.Method.Code == "" {
+			return nil, errors.New("Risk threshold notification definitions require a method")
+		}
+		return NewRiskThresholdNotificationDefinition(c.Name, c.Reason, c.Method, c.Threshold), nil
+	})
+}
+
+// PreviousRiskScoreFunc finds the score of the patient's risk assessment (using the same method) before the passed in
+// assessment.  If there is no previous assessment, found is false.
+type PreviousRiskScoreFunc func(assessment *models.RiskAssessment) (score float64, found bool, err error)
+
+// RiskThresholdNotificationConfig is the JSON configuration of a RiskThresholdNotificationDefinition (with the
+// "risk-threshold" type)
+type RiskThresholdNotificationConfig struct {
+	NotificationDefinitionConfig
+	Reason    models.Coding `json:"reason"`
+	Method    models.Coding `json:"method"`
+	Threshold float64       `json:"threshold"`
+}
+
+// RiskThresholdNotificationDefinition is triggered by new risk assessments (using the method) whose score crosses the
+// threshold: the score is at or above the threshold, and the patient's previous score was below it (or the patient
+// wasn't assessed before).  Patients who stay high risk don't trigger a notification with every new assessment.
+type RiskThresholdNotificationDefinition struct {
+	name          string
+	reason        models.Coding
+	method        models.Coding
+	threshold     float64
+	PreviousScore PreviousRiskScoreFunc
+}
+
+// NewRiskThresholdNotificationDefinition creates a definition triggered by scores crossing the threshold.  Previous
+// scores are found in the riskassessments collection.
+func NewRiskThresholdNotificationDefinition(name string, reason models.Coding, method models.Coding, threshold float64) *RiskThresholdNotificationDefinition {
+	return &RiskThresholdNotificationDefinition{name: name, reason: reason, method: method, threshold: threshold, PreviousScore: mongoPreviousRiskScore}
+}
+
+func (def *RiskThresholdNotificationDefinition) Name() string {
+	return def.name
+}
+
+func (def *RiskThresholdNotificationDefinition) Triggers(resource interface{}, action string) bool {
+	if action != "create" {
+		return false
+	}
+
+	ra, ok := resource.(*models.RiskAssessment)
+	if !ok || ra.Method == nil || !ra.Method.MatchesCode(def.method.System, def.method.Code) {
+		return false
+	}
+	if len(ra.Prediction) == 0 || ra.Prediction[0].ProbabilityDecimal == nil || *ra.Prediction[0].ProbabilityDecimal < def.threshold {
+		return false
+	}
+
+	previous, found, err := def.PreviousScore(ra)
+	if err != nil {
+		// Err on the side of notifying, since a missed high risk patient is worse than a duplicate notification
+		return true
+	}
+	return !found || previous < def.threshold
+}
+
+func (def *RiskThresholdNotificationDefinition) GetNotification(resource interface{}, action string, baseURL string) *models.CommunicationRequest {
+	if def.Triggers(resource, action) {
+		ra := resource.(*models.RiskAssessment)
+		return newNotification("RiskAssessment", ra.Id, ra.Subject, def.reason, baseURL)
+	}
+	return nil
+}
+
+// mongoPreviousRiskScore finds the most recent of the patient's other risk assessments (using the same method) dated
+// before the assessment
+func mongoPreviousRiskScore(ra *models.RiskAssessment) (float64, bool, error) {
+	if ra.Subject == nil || ra.Method == nil || len(ra.Method.Coding) == 0 || server.Database == nil {
+		return 0, false, nil
+	}
+	query := bson.M{
+		"_id":                 bson.M{"$ne": ra.Id},
+		"subject.referenceid": ra.Subject.ReferencedID,
+		"method.coding": bson.M{"$elemMatch": bson.M{
+			"system": ra.Method.Coding[0].System,
+			"code":   ra.Method.Coding[0].Code,
+		}},
+	}
+	if ra.Date != nil {
+		query["date.time"] = bson.M{"$lte": ra.Date.Time}
+	}
+	previous := new(models.RiskAssessment)
+	err := server.Database.C("riskassessments").Find(query).Sort("-date.time").One(previous)
+	if err == mgo.ErrNotFound || (err == nil && (len(previous.Prediction) == 0 || previous.Prediction[0].ProbabilityDecimal == nil)) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return *previous.Prediction[0].ProbabilityDecimal, true, nil
+}
+
+// Definition of the default high risk notification, using the scores that schedule the most frequent huddles in the
+// simple huddle configuration
+
+var HighRiskNotificationDefinition = NewRiskThresholdNotificationDefinition(
+	"High Risk",
+	models.Coding{System: NotificationReasonSystem, Code: "high-risk", Display: "High risk score"},
+	models.Coding{System: "http://interventionengine.org/risk-assessments", Code: "Simple"},
+	6)
@@ -0,0 +1,135 @@
+package notifications
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestUpdateNotificationSuite(t *testing.T) {
+	suite.Run(t, new(UpdateNotificationSuite))
+}
+
+type UpdateNotificationSuite struct {
+	suite.Suite
+}
+
+func (n *UpdateNotificationSuite) TestEncounterStatusTransition() {
+	require := n.Require()
+	assert := n.Assert()
+
+	defs, err := ParseNotificationDefinitions([]byte(`[{"type": "encounter-type", "name": "ER Visit", "statuses": ["in-progress", "finished"],
+		"reason": {"system": "http://snomed.info/sct", "code": "4525004"},
+		"types": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99283"}]}]`))
+	require.NoError(err)
+	def := defs[0].(UpdateNotificationDefinition)
+
+	planned, err := UnmarshallEncounter("../fixtures/encounter-er-visit.json")
+	require.NoError(err)
+	planned.Status = "planned"
+	inProgress := *planned
+	inProgress.Status = "in-progress"
+	finished := *planned
+	finished.Status = "finished"
+
+	// The planned encounter doesn't trigger the notification when it's created, but does once it's in progress
+	assert.False(def.Triggers(planned, "create"))
+	assert.True(def.TriggersUpdate(planned, &inProgress))
+	cr := def.GetUpdateNotification(planned, &inProgress, "http://intervention-engine.org")
+	require.NotNil(cr)
+	assert.Equal("http://intervention-engine.org/Encounter/1", cr.Payload[0].ContentReference.Reference)
+
+	// Later updates don't trigger it again
+	assert.False(def.TriggersUpdate(&inProgress, &finished))
+	assert.Nil(def.GetUpdateNotification(&inProgress, &finished, "http://intervention-engine.org"))
+	assert.False(def.Triggers(&finished, "update"))
+
+	// Updates that create the resource (with no previous version) are treated like creates
+	assert.True(def.TriggersUpdate(nil, &finished))
+}
+
+func (n *UpdateNotificationSuite) TestEncounterTypeCorrection() {
+	require := n.Require()
+	assert := n.Assert()
+
+	office, err := UnmarshallEncounter("../fixtures/encounter-office-visit.json")
+	require.NoError(err)
+	er, err := UnmarshallEncounter("../fixtures/encounter-er-visit.json")
+	require.NoError(err)
+	readmission, err := UnmarshallEncounter("../fixtures/encounter-readmission.json")
+	require.NoError(err)
+
+	assert.True(ERVisitNotificationDefinition.TriggersUpdate(office, er))
+	assert.False(ERVisitNotificationDefinition.TriggersUpdate(er, office))
+	assert.False(ERVisitNotificationDefinition.TriggersUpdate(er, er))
+
+	// Admissions corrected to readmissions are still excluded from the admission notification
+	assert.True(ReadmissionNotificationDefinition.TriggersUpdate(office, readmission))
+	assert.False(AdmissionNotificationDefinition.TriggersUpdate(office, readmission))
+
+	data, err := ioutil.ReadFile("../config/notification_definitions.json")
+	require.NoError(err)
+	defs, err := ParseNotificationDefinitions(data)
+	require.NoError(err)
+	assert.False(defs[0].(UpdateNotificationDefinition).TriggersUpdate(office, readmission))
+	assert.True(defs[1].(UpdateNotificationDefinition).TriggersUpdate(office, readmission))
+}
+
+func (n *UpdateNotificationSuite) TestResourceTransitions() {
+	assert := n.Assert()
+
+	value := 6.5
+	observation := func(status string) *models.Observation {
+		return &models.Observation{
+			Status:        status,
+			Code:          &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "2823-3"}}},
+			ValueQuantity: &models.Quantity{Value: &value, Unit: "mmol/L"},
+		}
+	}
+	assert.True(CriticalLabNotificationDefinition.TriggersUpdate(observation("entered-in-error"), observation("amended")))
+	assert.False(CriticalLabNotificationDefinition.TriggersUpdate(observation("final"), observation("amended")))
+
+	condition := func(verificationStatus string) *models.Condition {
+		return &models.Condition{
+			Code:               &models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "84114007"}}},
+			VerificationStatus: verificationStatus,
+		}
+	}
+	assert.True(WatchedConditionNotificationDefinition.TriggersUpdate(condition("refuted"), condition("confirmed")))
+	assert.False(WatchedConditionNotificationDefinition.TriggersUpdate(condition("provisional"), condition("confirmed")))
+
+	medications := []models.Coding{{System: "http://www.nlm.nih.gov/research/umls/rxnorm", Code: "197361"}}
+	statement := func(status string) *models.MedicationStatement {
+		return &models.MedicationStatement{Status: status, MedicationCodeableConcept: &models.CodeableConcept{Coding: medications}}
+	}
+	start := NewMedicationChangeNotificationDefinition("Amlodipine Started", models.Coding{Code: "medication-start"}, MedicationStart, medications)
+	stop := NewMedicationChangeNotificationDefinition("Amlodipine Stopped", models.Coding{Code: "medication-stop"}, MedicationStop, medications)
+	assert.True(start.TriggersUpdate(statement("intended"), statement("active")))
+	assert.True(stop.TriggersUpdate(statement("active"), statement("completed")))
+	assert.False(stop.TriggersUpdate(statement("completed"), statement("completed")))
+	assert.False(start.TriggersUpdate(statement("active"), statement("completed")))
+}
+
+func (n *UpdateNotificationSuite) TestRegistryTriggeredByUpdates() {
+	require := n.Require()
+	assert := n.Assert()
+
+	r := new(NotificationDefinitionRegistry)
+	r.RegisterAll([]NotificationDefinition{HighRiskNotificationDefinition, WatchedConditionNotificationDefinition})
+	assert.True(r.TriggeredByUpdates("Condition"))
+	assert.False(r.TriggeredByUpdates("RiskAssessment"))
+	assert.False(r.TriggeredByUpdates("Encounter"))
+
+	defs, err := ParseNotificationDefinitions([]byte(`[{"type": "medication-change", "name": "Amlodipine Started", "change": "start",
+		"reason": {"code": "medication-start"},
+		"medications": [{"system": "http://www.nlm.nih.gov/research/umls/rxnorm", "code": "197361"}]}]`))
+	require.NoError(err)
+	r.Replace(defs)
+	assert.True(r.TriggeredByUpdates("MedicationStatement"))
+	assert.True(r.TriggeredByUpdates("MedicationOrder"))
+	assert.False(r.TriggeredByUpdates("Condition"))
+}
@@ -0,0 +1,143 @@
+package reports
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/intervention-engine/ie"
+)
+
+// WriteHuddleSummaryCSV writes one row per huddle member, preceded by a header row
+func WriteHuddleSummaryCSV(w io.Writer, summary *ie.HuddleSummary) error {
+	cw := csv.NewWriter(w)
+	header := []string{"Patient ID", "Name", "Age", "Gender", "Reason", "Risk Scores", "Recent Encounters", "Open Notifications"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for i := range summary.Members {
+		m := &summary.Members[i]
+		row := []string{
+			m.Patient.ID,
+			m.Patient.Name.Full,
+			strconv.Itoa(m.Patient.Age),
+			m.Patient.Gender,
+			m.Reason,
+			riskScoresText(m),
+			encountersText(m),
+			notificationsText(m),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Layout of the printable summary: US Letter in landscape, measured in points
+const (
+	pageWidth    = 792
+	pageHeight   = 612
+	pageMargin   = 36
+	rowFontSize  = 9
+	rowHeight    = 12
+	detailIndent = 12
+)
+
+type pdfColumn struct {
+	title    string
+	x        float64
+	maxChars int
+}
+
+var huddleSummaryColumns = []pdfColumn{
+	{"Name", pageMargin, 34},
+	{"Age", 216, 4},
+	{"Gender", 246, 8},
+	{"Reason", 296, 48},
+	{"Risk Scores", 536, 40},
+}
+
+// WriteHuddleSummaryPDF writes a printable version of the summary.  Each member gets a row with their demographics,
+// reason and risk scores, followed by lines listing their recent encounters and open notifications.
+func WriteHuddleSummaryPDF(w io.Writer, summary *ie.HuddleSummary) error {
+	doc := NewPDFDocument(pageWidth, pageHeight)
+	y := startHuddleSummaryPage(doc, summary)
+	for i := range summary.Members {
+		m := &summary.Members[i]
+		// Keep a member's row and details together on the same page
+		if y+3*rowHeight > pageHeight-pageMargin {
+			y = startHuddleSummaryPage(doc, summary)
+		}
+		values := []string{m.Patient.Name.Full, strconv.Itoa(m.Patient.Age), m.Patient.Gender, m.Reason, riskScoresText(m)}
+		for j, col := range huddleSummaryColumns {
+			doc.Text(col.x, y, rowFontSize, false, truncate(values[j], col.maxChars))
+		}
+		y += rowHeight
+		doc.Text(pageMargin+detailIndent, y, rowFontSize-1, false, truncate("Recent encounters: "+orNone(encountersText(m)), 150))
+		y += rowHeight
+		doc.Text(pageMargin+detailIndent, y, rowFontSize-1, false, truncate("Open notifications: "+orNone(notificationsText(m)), 150))
+		y += rowHeight + 4
+	}
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+func startHuddleSummaryPage(doc *PDFDocument, summary *ie.HuddleSummary) float64 {
+	doc.AddPage()
+	y := float64(pageMargin) + 14
+	title := summary.Name
+	if !summary.Date.IsZero() {
+		title += " - " + summary.Date.Format("Monday, January 2, 2006")
+	}
+	doc.Text(pageMargin, y, 14, true, title)
+	y += 16
+	doc.Text(pageMargin, y, rowFontSize, false, fmt.Sprintf("%d patients (page %d)", len(summary.Members), doc.PageCount()))
+	y += 2 * rowHeight
+	for _, col := range huddleSummaryColumns {
+		doc.Text(col.x, y, rowFontSize, true, col.title)
+	}
+	return y + rowHeight + 4
+}
+
+func riskScoresText(m *ie.HuddleSummaryMember) string {
+	var scores []string
+	for _, ra := range m.LatestRiskAssessments() {
+		scores = append(scores, fmt.Sprintf("%d (%s)", ra.Value, ra.Date.Format("01/02/2006")))
+	}
+	return strings.Join(scores, "; ")
+}
+
+func encountersText(m *ie.HuddleSummaryMember) string {
+	encounters := make([]string, len(m.RecentEncounters))
+	for i, enc := range m.RecentEncounters {
+		encounters[i] = fmt.Sprintf("%s (%s)", enc.Type, enc.Start.Format("01/02/2006"))
+	}
+	return strings.Join(encounters, "; ")
+}
+
+func notificationsText(m *ie.HuddleSummaryMember) string {
+	notifications := make([]string, len(m.OpenNotifications))
+	for i, n := range m.OpenNotifications {
+		notifications[i] = fmt.Sprintf("%s (%s)", n.Reason, n.RequestedOn.Format("01/02/2006"))
+	}
+	return strings.Join(notifications, "; ")
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+func truncate(s string, maxChars int) string {
+	r := []rune(s)
+	if len(r) <= maxChars {
+		return s
+	}
+	return string(r[:maxChars-3]) + "..."
+}
@@ -0,0 +1,94 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/ie"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestHuddleSummarySuite(t *testing.T) {
+	suite.Run(t, new(HuddleSummarySuite))
+}
+
+type HuddleSummarySuite struct {
+	suite.Suite
+}
+
+func (h *HuddleSummarySuite) TestWriteHuddleSummaryCSV() {
+	require := h.Require()
+	assert := h.Assert()
+
+	var buf bytes.Buffer
+	require.NoError(WriteHuddleSummaryCSV(&buf, exampleHuddleSummary(1)))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(err)
+	require.Len(rows, 2)
+	assert.Equal([]string{"Patient ID", "Name", "Age", "Gender", "Reason", "Risk Scores", "Recent Encounters", "Open Notifications"}, rows[0])
+	assert.Equal([]string{
+		"58938873bd90ef501e29c900",
+		"Jacqueline Banks0",
+		"54",
+		"female",
+		"Risk Score Warrants Discussion",
+		"7 (03/14/2016); 2 (03/01/2016)",
+		"Emergency department patient visit (03/11/2016)",
+		"ER Visit (03/11/2016)",
+	}, rows[1])
+}
+
+func (h *HuddleSummarySuite) TestWriteHuddleSummaryPDF() {
+	require := h.Require()
+	assert := h.Assert()
+
+	var buf bytes.Buffer
+	require.NoError(WriteHuddleSummaryPDF(&buf, exampleHuddleSummary(1)))
+	pdf := buf.String()
+	assert.Contains(pdf, "(Test Huddle - Monday, March 21, 2016) Tj")
+	assert.Contains(pdf, "(Jacqueline Banks0) Tj")
+	assert.Contains(pdf, "(Recent encounters: Emergency department patient visit \\(03/11/2016\\)) Tj")
+	assert.Contains(pdf, "/Count 1")
+}
+
+func (h *HuddleSummarySuite) TestWriteHuddleSummaryPDFSpansPages() {
+	var buf bytes.Buffer
+	h.Require().NoError(WriteHuddleSummaryPDF(&buf, exampleHuddleSummary(40)))
+	h.Assert().Contains(buf.String(), "/Count 4")
+}
+
+func exampleHuddleSummary(size int) *ie.HuddleSummary {
+	summary := &ie.HuddleSummary{
+		HuddleID: "58c314acb367c1ff54d19e01",
+		Name:     "Test Huddle",
+		Date:     time.Date(2016, time.March, 21, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < size; i++ {
+		summary.Members = append(summary.Members, ie.HuddleSummaryMember{
+			Patient: ie.Patient{
+				ID:     fmt.Sprintf("58938873bd90ef501e29c9%02d", i),
+				Name:   ie.Name{Full: fmt.Sprintf("Jacqueline Banks%d", i)},
+				Age:    54,
+				Gender: "female",
+				RecentRiskAssessments: []ie.RiskAssessment{
+					{GroupID: "stroke", Value: 5, Date: time.Date(2016, time.March, 7, 0, 0, 0, 0, time.UTC)},
+					{GroupID: "stroke", Value: 7, Date: time.Date(2016, time.March, 14, 0, 0, 0, 0, time.UTC)},
+					{GroupID: "negative-outcomes", Value: 2, Date: time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)},
+				},
+			},
+			Reason: "Risk Score Warrants Discussion",
+			RecentEncounters: []ie.EncounterSummary{
+				{ID: "1", Type: "Emergency department patient visit", Start: time.Date(2016, time.March, 11, 12, 30, 0, 0, time.UTC)},
+			},
+			OpenNotifications: []ie.NotificationSummary{
+				{ID: "2", Reason: "ER Visit", RequestedOn: time.Date(2016, time.March, 11, 13, 0, 0, 0, time.UTC)},
+			},
+		})
+	}
+	return summary
+}
@@ -0,0 +1,101 @@
+package reports
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PDFDocument is a minimal PDF writer that lays out lines of text using the standard Helvetica fonts.  It exists so
+// that printable reports can be generated without depending on external services or libraries, and only supports
+// what those reports need: pages of left-aligned text in regular or bold type.
+type PDFDocument struct {
+	Width, Height float64
+	pages         []*bytes.Buffer
+}
+
+// NewPDFDocument creates an empty document whose pages have the given size in points (1/72 inch)
+func NewPDFDocument(width, height float64) *PDFDocument {
+	return &PDFDocument{Width: width, Height: height}
+}
+
+// AddPage starts a new page.  Subsequent text is drawn on the new page.
+func (d *PDFDocument) AddPage() {
+	d.pages = append(d.pages, new(bytes.Buffer))
+}
+
+// PageCount returns the number of pages in the document
+func (d *PDFDocument) PageCount() int {
+	return len(d.pages)
+}
+
+// Text draws a line of text with its baseline starting at (x, y), where y is measured from the top of the page
+func (d *PDFDocument) Text(x, y, size float64, bold bool, s string) {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.Height-y, pdfEscape(s))
+}
+
+// WriteTo writes the complete PDF file to w
+func (d *PDFDocument) WriteTo(w io.Writer) (int64, error) {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+
+	// Objects 1-4 are the catalog, page tree and fonts.  Each page then gets a page object and a content stream.
+	var objects []string
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", d.Width, d.Height, 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.WriteTo(w)
+}
+
+// pdfEscape escapes the characters that are special inside a PDF string and replaces anything the standard fonts
+// can't draw
+func pdfEscape(s string) string {
+	var b bytes.Buffer
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package reports
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestPDFSuite(t *testing.T) {
+	suite.Run(t, new(PDFSuite))
+}
+
+type PDFSuite struct {
+	suite.Suite
+}
+
+func (p *PDFSuite) TestEmptyDocumentHasOnePage() {
+	assert := p.Assert()
+
+	var buf bytes.Buffer
+	doc := NewPDFDocument(612, 792)
+	_, err := doc.WriteTo(&buf)
+	p.Require().NoError(err)
+	assert.Equal(1, doc.PageCount())
+	assert.Contains(buf.String(), "/Count 1")
+}
+
+func (p *PDFSuite) TestXRefOffsetsPointAtObjects() {
+	require := p.Require()
+	assert := p.Assert()
+
+	doc := NewPDFDocument(612, 792)
+	doc.Text(36, 36, 12, true, "Page one")
+	doc.AddPage()
+	doc.Text(36, 36, 12, false, "Page two")
+	var buf bytes.Buffer
+	_, err := doc.WriteTo(&buf)
+	require.NoError(err)
+	data := buf.Bytes()
+
+	assert.True(bytes.HasPrefix(data, []byte("%PDF-1.4\n")))
+	assert.True(bytes.HasSuffix(data, []byte("%%EOF\n")))
+
+	// 4 shared objects plus a page and a content stream per page
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data, -1)
+	require.Len(entries, 8)
+	for i, entry := range entries {
+		offset, err := strconv.Atoi(string(entry[1]))
+		require.NoError(err)
+		assert.True(bytes.HasPrefix(data[offset:], []byte(strconv.Itoa(i+1)+" 0 obj")), "object %d not at offset %d", i+1, offset)
+	}
+
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	require.NotNil(startxref)
+	offset, _ := strconv.Atoi(string(startxref[1]))
+	assert.True(bytes.HasPrefix(data[offset:], []byte("xref\n")))
+}
+
+func (p *PDFSuite) TestTextIsEscaped() {
+	doc := NewPDFDocument(612, 792)
+	doc.Text(36, 36, 12, false, `Smith (Jr.) \ Zoë`)
+	var buf bytes.Buffer
+	_, err := doc.WriteTo(&buf)
+	p.Require().NoError(err)
+	p.Assert().Contains(buf.String(), `(Smith \(Jr.\) \\ Zo?) Tj`)
+}
@@ -16,4 +16,7 @@ type Services interface {
 	CareTeamService() Adapter
 	PatientService() Adapter
 	MembershipService() Adapter
+	TaskService() Adapter
+	HuddleSummaryService() Adapter
+	NotificationService() Adapter
 }
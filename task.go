@@ -0,0 +1,80 @@
+package ie
+
+import (
+	"errors"
+	"time"
+)
+
+// Task statuses, following the subset of the FHIR Task status value set that care teams need for huddle follow-ups
+const (
+	TaskStatusRequested  = "requested"
+	TaskStatusAccepted   = "accepted"
+	TaskStatusInProgress = "in-progress"
+	TaskStatusCompleted  = "completed"
+	TaskStatusCancelled  = "cancelled"
+)
+
+// taskTransitions lists the statuses a task may move to from each status.  Completed and cancelled tasks are final.
+var taskTransitions = map[string][]string{
+	TaskStatusRequested:  {TaskStatusAccepted, TaskStatusInProgress, TaskStatusCompleted, TaskStatusCancelled},
+	TaskStatusAccepted:   {TaskStatusInProgress, TaskStatusCompleted, TaskStatusCancelled},
+	TaskStatusInProgress: {TaskStatusCompleted, TaskStatusCancelled},
+}
+
+// ErrInvalidTaskTransition is returned when a task is asked to move to a status it cannot reach from its current one
+var ErrInvalidTaskTransition = errors.New("invalid status transition")
+
+// Task a follow-up action item assigned during a huddle discussion of a patient.  A task is assigned to a
+// practitioner, a care team, or both.
+type Task struct {
+	ID             string     `bson:"_id,omitempty" json:"id,omitempty"`
+	Title          string     `bson:"title" json:"title" binding:"required"`
+	Description    string     `bson:"description,omitempty" json:"description,omitempty"`
+	PatientID      string     `bson:"patient_id" json:"patient_id"`
+	HuddleID       string     `bson:"huddle_id,omitempty" json:"huddle_id,omitempty"`
+	PractitionerID string     `bson:"practitioner_id,omitempty" json:"practitioner_id,omitempty"`
+	CareTeamID     string     `bson:"care_team_id,omitempty" json:"care_team_id,omitempty"`
+	Status         string     `bson:"status" json:"status"`
+	DueDate        *time.Time `bson:"due_date,omitempty" json:"due_date,omitempty"`
+	CreatedAt      time.Time  `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	UpdatedAt      time.Time  `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+	CompletedAt    *time.Time `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	Overdue        bool       `bson:"-" json:"overdue"`
+}
+
+// IsOpen indicates if the task still needs to be worked
+func (t *Task) IsOpen() bool {
+	return t.Status != TaskStatusCompleted && t.Status != TaskStatusCancelled
+}
+
+// IsOverdue indicates if the task is open and its due date has passed
+func (t *Task) IsOverdue(now time.Time) bool {
+	return t.IsOpen() && t.DueDate != nil && t.DueDate.Before(now)
+}
+
+// TransitionTo moves the task to the given status, returning ErrInvalidTaskTransition if that move isn't allowed
+func (t *Task) TransitionTo(status string, now time.Time) error {
+	for _, s := range taskTransitions[t.Status] {
+		if s == status {
+			t.Status = status
+			t.UpdatedAt = now
+			if !t.IsOpen() {
+				t.CompletedAt = &now
+			}
+			return nil
+		}
+	}
+	return ErrInvalidTaskTransition
+}
+
+// TaskService describes the interface for storing and finding Tasks
+type TaskService interface {
+	Task(id string) (*Task, error)
+	Tasks() ([]Task, error)
+	CreateTask(t *Task) error
+	UpdateTask(t *Task) error
+	TasksForPatient(id string) ([]Task, error)
+	TasksForCareTeam(id string) ([]Task, error)
+	OverdueTasks(now time.Time) ([]Task, error)
+	OpenTasksForHuddle(id string) ([]Task, error)
+}
@@ -0,0 +1,162 @@
+package testutil
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// FakeSMTPServer is a minimal SMTP server that accepts every message and keeps it for tests to inspect.  It listens on
+// localhost, doesn't support any extensions (e.g., STARTTLS or AUTH), and should be closed when the test is done.
+type FakeSMTPServer struct {
+	Addr     string
+	listener net.Listener
+
+	mutex    sync.Mutex
+	messages []FakeSMTPMessage
+}
+
+// FakeSMTPMessage is a message received by a FakeSMTPServer
+type FakeSMTPMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// NewFakeSMTPServer starts a FakeSMTPServer on a free localhost port
+func NewFakeSMTPServer() (*FakeSMTPServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeSMTPServer{Addr: l.Addr().String(), listener: l}
+	go s.serve()
+	return s, nil
+}
+
+// Messages returns the messages received so far
+func (s *FakeSMTPServer) Messages() []FakeSMTPMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]FakeSMTPMessage(nil), s.messages...)
+}
+
+// Close stops the server
+func (s *FakeSMTPServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *FakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *FakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost fake SMTP")
+	var msg FakeSMTPMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = FakeSMTPMessage{From: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.To = append(msg.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				l = strings.TrimRight(l, "\r\n")
+				if l == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(l, "."))
+			}
+			msg.Data = strings.Join(data, "\r\n")
+			s.mutex.Lock()
+			s.messages = append(s.messages, msg)
+			s.mutex.Unlock()
+			reply("250 OK")
+		case cmd == "RSET", cmd == "NOOP":
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// FakeHTTPSink is an HTTP server that records every request it receives, for testing webhooks and HTTP gateways.  It
+// responds with Status (200 OK by default) and should be closed when the test is done.
+type FakeHTTPSink struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	Status   int
+	requests []FakeHTTPRequest
+}
+
+// FakeHTTPRequest is a request received by a FakeHTTPSink
+type FakeHTTPRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// NewFakeHTTPSink starts a FakeHTTPSink
+func NewFakeHTTPSink() *FakeHTTPSink {
+	s := &FakeHTTPSink{Status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		s.requests = append(s.requests, FakeHTTPRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: string(body)})
+		status := s.Status
+		s.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+// SetStatus changes the status the sink responds with
+func (s *FakeHTTPSink) SetStatus(status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Status = status
+}
+
+// Requests returns the requests received so far
+func (s *FakeHTTPSink) Requests() []FakeHTTPRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]FakeHTTPRequest(nil), s.requests...)
+}
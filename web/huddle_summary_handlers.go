@@ -0,0 +1,56 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/reports"
+)
+
+// ExportHuddleSummary Export the summary of a huddle with given id as a CSV (the default) or PDF file, depending on
+// the format query parameter
+func ExportHuddleSummary(ctx *gin.Context) {
+	s := getHuddleSummaryService(ctx)
+	summary, err := s.HuddleSummary(ctx.Param("huddle_id"))
+	if err != nil {
+		ctx.AbortWithError(ErrCode(err), err)
+		return
+	}
+
+	var contentType string
+	var buf bytes.Buffer
+	format := ctx.DefaultQuery("format", "csv")
+	switch format {
+	case "csv":
+		contentType = "text/csv"
+		err = reports.WriteHuddleSummaryCSV(&buf, summary)
+	case "pdf":
+		contentType = "application/pdf"
+		err = reports.WriteHuddleSummaryPDF(&buf, summary)
+	default:
+		ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("unsupported export format: %s", format))
+		return
+	}
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", huddleSummaryFileName(summary), format))
+	ctx.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+func getHuddleSummaryService(ctx *gin.Context) ie.HuddleSummaryService {
+	svc := ctx.MustGet("huddleSummaryService")
+	return svc.(ie.HuddleSummaryService)
+}
+
+func huddleSummaryFileName(summary *ie.HuddleSummary) string {
+	if summary.Date.IsZero() {
+		return "huddle-" + summary.HuddleID
+	}
+	return "huddle-" + summary.Date.Format("2006-01-02")
+}
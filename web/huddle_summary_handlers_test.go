@@ -0,0 +1,84 @@
+package web_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/intervention-engine/ie/web"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type huddleSummarySuite struct {
+	testutil.WebSuite
+}
+
+func TestHuddleSummaryHandlersSuite(t *testing.T) {
+	suite.Run(t, new(huddleSummarySuite))
+}
+
+func (suite *huddleSummarySuite) SetupSuite() {
+	api := suite.LoadGin()
+	web.RegisterHuddleSummaryRoutes(api, suite.withTestService())
+}
+
+// By default the summary should be exported as a CSV attachment
+func (suite *huddleSummarySuite) TestExportCSV() {
+	w := suite.AssertGetRequest("/api/huddles/58c314acb367c1ff54d19e01/export", http.StatusOK)
+	suite.Assert().Contains(w.Header().Get("Content-Type"), "text/csv")
+	suite.Assert().Equal(`attachment; filename="huddle-2016-03-21.csv"`, w.Header().Get("Content-Disposition"))
+	suite.Assert().Contains(w.Body.String(), "Jacqueline Banks")
+}
+
+// When asked for a PDF, should return a PDF document
+func (suite *huddleSummarySuite) TestExportPDF() {
+	w := suite.AssertGetRequest("/api/huddles/58c314acb367c1ff54d19e01/export?format=pdf", http.StatusOK)
+	suite.Assert().Equal("application/pdf", w.Header().Get("Content-Type"))
+	suite.Assert().True(bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")))
+}
+
+// Unknown formats should return 400 Bad Request
+func (suite *huddleSummarySuite) TestExportUnknownFormat() {
+	suite.AssertGetRequest("/api/huddles/58c314acb367c1ff54d19e01/export?format=docx", http.StatusBadRequest)
+}
+
+// If the huddle does not exist, should return 404 Not Found
+func (suite *huddleSummarySuite) TestExportHuddleNotFound() {
+	suite.AssertGetRequest("/api/huddles/58c314acb367c1ff54d19e02/export", http.StatusNotFound)
+}
+
+// Mock Services
+
+func (suite *huddleSummarySuite) HuddleSummary(id string) (*ie.HuddleSummary, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	if id != "58c314acb367c1ff54d19e01" {
+		return nil, errors.New("not found")
+	}
+	return &ie.HuddleSummary{
+		HuddleID: id,
+		Name:     "Test Huddle",
+		Date:     time.Date(2016, time.March, 21, 0, 0, 0, 0, time.UTC),
+		Members: []ie.HuddleSummaryMember{
+			{Patient: ie.Patient{ID: "58938873bd90ef501e29c919", Name: ie.Name{Full: "Jacqueline Banks"}}, Reason: "Risk Score Warrants Discussion"},
+		},
+	}, nil
+}
+
+// Utility Methods
+
+func (suite *huddleSummarySuite) withTestService() ie.Adapter {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			ctx.Set("huddleSummaryService", suite)
+			h(ctx)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/ie"
+)
+
+// GetNotification Get a notification with given id.
+func GetNotification(ctx *gin.Context) {
+	n, err := getNotificationService(ctx).Notification(ctx.Param("id"))
+	Render(ctx, gin.H{"notification": n}, err)
+}
+
+// UpdateNotificationStatus Acknowledge, complete, dismiss, or snooze a notification, recording the user acting on it.
+// If another request changes the notification's status first, the update is rejected with 409 Conflict.
+func UpdateNotificationStatus(ctx *gin.Context) {
+	s := getNotificationService(ctx)
+	id := ctx.Param("id")
+	n, err := s.Notification(id)
+	if err != nil {
+		ctx.AbortWithError(ErrCode(err), err)
+		return
+	}
+	var form struct {
+		Status       string     `json:"status" binding:"required"`
+		User         string     `json:"user" binding:"required"`
+		SnoozedUntil *time.Time `json:"snoozed_until"`
+	}
+	if ctx.BindJSON(&form) != nil {
+		return
+	}
+	previousStatus := n.Status
+	if err := ie.TransitionNotification(n, form.Status, form.User, form.SnoozedUntil, time.Now()); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	err = s.UpdateNotificationStatus(n, previousStatus)
+	if err == ie.ErrNotificationStatusChanged {
+		ctx.AbortWithError(http.StatusConflict, err)
+		return
+	}
+	Render(ctx, gin.H{"notification": n}, err)
+}
+
+// ListAllCareTeamNotifications List the notifications sent to a given care team, which are about the team's patients,
+// or only the open ones when called with open=true
+func ListAllCareTeamNotifications(ctx *gin.Context) {
+	nn, err := getNotificationService(ctx).NotificationsForCareTeam(ctx.Param("id"))
+	if ctx.Query("open") == "true" {
+		now := time.Now()
+		open := nn[:0]
+		for i := range nn {
+			if ie.IsOpenNotification(&nn[i], now) {
+				open = append(open, nn[i])
+			}
+		}
+		nn = open
+	}
+	Render(ctx, gin.H{"notifications": nn}, err)
+}
+
+func getNotificationService(ctx *gin.Context) ie.NotificationService {
+	svc := ctx.MustGet("notificationService")
+	return svc.(ie.NotificationService)
+}
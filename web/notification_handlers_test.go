@@ -0,0 +1,208 @@
+package web_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/mongo"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/intervention-engine/ie/web"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type notificationSuite struct {
+	testutil.WebSuite
+	DB map[string]models.CommunicationRequest
+	// ConcurrentStatus is stored as if another request changed the status while a notification was being updated
+	ConcurrentStatus string
+}
+
+func TestNotificationHandlersSuite(t *testing.T) {
+	m := make(map[string]models.CommunicationRequest)
+	suite.Run(t, &notificationSuite{DB: m})
+}
+
+func (suite *notificationSuite) SetupSuite() {
+	api := suite.LoadGin()
+	web.RegisterNotificationRoutes(api, suite.withTestService())
+}
+
+func (suite *notificationSuite) SetupTest() {
+	suite.ConcurrentStatus = ""
+	for id := range suite.DB {
+		delete(suite.DB, id)
+	}
+	for _, n := range NotificationsDB() {
+		suite.DB[n.Id] = n
+	}
+}
+
+// A care team should only see the notifications sent to it
+func (suite *notificationSuite) TestCareTeamNotifications() {
+	w := suite.AssertGetRequest("/api/care_teams/58c314acb367c1ff54d19e9e/notifications", http.StatusOK)
+	var body = make(map[string][]models.CommunicationRequest)
+	json.NewDecoder(w.Body).Decode(&body)
+	results := body["notifications"]
+	suite.Require().Len(results, 2)
+	suite.Assert().Equal("58c314acb367c1ff54d1a001", results[0].Id)
+	suite.Assert().Equal("58c314acb367c1ff54d1a003", results[1].Id)
+
+	w = suite.AssertGetRequest("/api/care_teams/58c314acb367c1ff54d19e9f/notifications", http.StatusOK)
+	body = make(map[string][]models.CommunicationRequest)
+	json.NewDecoder(w.Body).Decode(&body)
+	suite.Require().Len(body["notifications"], 1)
+	suite.Assert().Equal("58c314acb367c1ff54d1a002", body["notifications"][0].Id)
+}
+
+// When asked for open notifications, should leave out the closed and snoozed ones
+func (suite *notificationSuite) TestOpenCareTeamNotifications() {
+	n := suite.DB["58c314acb367c1ff54d1a003"]
+	n.Status = "rejected"
+	suite.DB[n.Id] = n
+	w := suite.AssertGetRequest("/api/care_teams/58c314acb367c1ff54d19e9e/notifications?open=true", http.StatusOK)
+	var body = make(map[string][]models.CommunicationRequest)
+	json.NewDecoder(w.Body).Decode(&body)
+	suite.Require().Len(body["notifications"], 1)
+	suite.Assert().Equal("58c314acb367c1ff54d1a001", body["notifications"][0].Id)
+}
+
+// Acknowledging a notification should record who acknowledged it and when
+func (suite *notificationSuite) TestAcknowledgeNotification() {
+	body := `{"status": "acknowledged", "user": "Optometrist Prime"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusOK)
+	n := suite.DB["58c314acb367c1ff54d1a001"]
+	suite.Assert().Equal("accepted", n.Status)
+	suite.Require().Len(n.Extension, 2)
+	suite.Assert().Equal(ie.NotificationStatusChangedByExtensionURL, n.Extension[0].Url)
+	suite.Assert().Equal("Optometrist Prime", n.Extension[0].ValueString)
+	suite.Assert().Equal(ie.NotificationStatusChangedAtExtensionURL, n.Extension[1].Url)
+	suite.Assert().NotNil(n.Extension[1].ValueDateTime)
+	suite.Assert().True(ie.IsOpenNotification(&n, time.Now()))
+}
+
+// Snoozed notifications should be closed until the snooze ends
+func (suite *notificationSuite) TestSnoozeNotification() {
+	until := time.Now().Add(4 * time.Hour)
+	body := `{"status": "snoozed", "user": "Optometrist Prime", "snoozed_until": "` + until.Format(time.RFC3339) + `"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusOK)
+	n := suite.DB["58c314acb367c1ff54d1a001"]
+	suite.Assert().Equal("suspended", n.Status)
+	suite.Require().NotNil(n.ScheduledDateTime)
+	suite.Assert().False(ie.IsOpenNotification(&n, time.Now()))
+	suite.Assert().True(ie.IsOpenNotification(&n, until.Add(time.Minute)))
+}
+
+// Snoozing without a time in the future should be rejected with 400 Bad Request
+func (suite *notificationSuite) TestSnoozeNotificationWithoutTime() {
+	body := `{"status": "snoozed", "user": "Optometrist Prime"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusBadRequest)
+}
+
+// Completed notifications cannot be dismissed
+func (suite *notificationSuite) TestUpdateNotificationStatusInvalidTransition() {
+	body := `{"status": "completed", "user": "Optometrist Prime"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusOK)
+	suite.Assert().Equal("completed", suite.DB["58c314acb367c1ff54d1a001"].Status)
+	body = `{"status": "dismissed", "user": "Optometrist Prime"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusBadRequest)
+}
+
+// Status changes require the acting user
+func (suite *notificationSuite) TestUpdateNotificationStatusWithoutUser() {
+	body := `{"status": "dismissed"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusBadRequest)
+}
+
+// Status changes that race with another request should be rejected with 409 Conflict
+func (suite *notificationSuite) TestUpdateNotificationStatusConflict() {
+	suite.ConcurrentStatus = "completed"
+	body := `{"status": "dismissed", "user": "Optometrist Prime"}`
+	suite.AssertPutRequest("/api/notifications/58c314acb367c1ff54d1a001/status", strings.NewReader(body), http.StatusConflict)
+	suite.Assert().Equal("completed", suite.DB["58c314acb367c1ff54d1a001"].Status)
+}
+
+// The care team routes registered by the different services shouldn't conflict with each other
+func (suite *notificationSuite) TestRegisterAPIRoutes() {
+	suite.Assert().NotPanics(func() {
+		web.RegisterAPIRoutes(gin.New(), &mongo.Services{})
+	})
+}
+
+// Mock Services
+
+func (suite *notificationSuite) Notification(id string) (*models.CommunicationRequest, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	n, ok := suite.DB[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &n, nil
+}
+
+func (suite *notificationSuite) UpdateNotificationStatus(n *models.CommunicationRequest, previousStatus string) error {
+	if suite.ConcurrentStatus != "" {
+		stored := suite.DB[n.Id]
+		stored.Status = suite.ConcurrentStatus
+		suite.DB[n.Id] = stored
+	}
+	if suite.DB[n.Id].Status != previousStatus {
+		return ie.ErrNotificationStatusChanged
+	}
+	suite.DB[n.Id] = *n
+	return nil
+}
+
+func (suite *notificationSuite) NotificationsForCareTeam(id string) ([]models.CommunicationRequest, error) {
+	var nn []models.CommunicationRequest
+	for _, n := range NotificationsDB() {
+		n = suite.DB[n.Id]
+		for _, r := range n.Recipient {
+			if r.Type == ie.CareTeamReferenceType && r.ReferencedID == id {
+				nn = append(nn, n)
+			}
+		}
+	}
+	return nn, nil
+}
+
+// Fixtures
+
+func NotificationsDB() []models.CommunicationRequest {
+	autoDocs := CareTeamsDB[0].Reference()
+	roboDocs := CareTeamsDB[1].Reference()
+	return []models.CommunicationRequest{
+		notificationFixture("58c314acb367c1ff54d1a001", "58938873bd90ef501e29c919", autoDocs, models.Reference{Display: CareTeamsDB[0].Leader}),
+		notificationFixture("58c314acb367c1ff54d1a002", "58c314acb367c1ff54d19e9e", roboDocs),
+		notificationFixture("58c314acb367c1ff54d1a003", "576c9bcc8bd4d4bdc2ac42b5", autoDocs),
+	}
+}
+
+func notificationFixture(id, patientID string, recipients ...models.Reference) models.CommunicationRequest {
+	n := models.CommunicationRequest{}
+	n.Id = id
+	n.Status = "requested"
+	n.Subject = &models.Reference{Reference: "Patient/" + patientID, Type: "Patient", ReferencedID: patientID}
+	n.Recipient = recipients
+	return n
+}
+
+// Utility Methods
+
+func (suite *notificationSuite) withTestService() ie.Adapter {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			ctx.Set("notificationService", suite)
+			h(ctx)
+		}
+	}
+}
@@ -14,15 +14,15 @@ func ListAllPatients(ctx *gin.Context) {
 
 // ListAllCareTeamPatients that belong to a given care team
 func ListAllCareTeamPatients(ctx *gin.Context) {
-	id := ctx.Param("care_team_id")
+	id := ctx.Param("id")
 	pp, err := patientsForCareTeam(ctx, id)
 	Render(ctx, gin.H{"patients": pp}, err)
 }
 
 // AddPatientToCareTeam create a membership for a patient
 func AddPatientToCareTeam(ctx *gin.Context) {
-	ct := ctx.Param("care_team_id")
-	p := ctx.Param("id")
+	ct := ctx.Param("id")
+	p := ctx.Param("patient_id")
 	mem := ie.Membership{CareTeamID: ct, PatientID: p}
 	err := getMembershipService(ctx).CreateMembership(mem)
 	Render(ctx, gin.H{"membership": mem}, err)
@@ -49,7 +49,7 @@ func getMembershipService(ctx *gin.Context) ie.MembershipService {
 // patientsForCareTeam Utility Function to get Patients that belong to a care team
 func patientsForCareTeam(ctx *gin.Context, id string) ([]ie.Patient, error) {
 
-	mems, err := getMembershipService(ctx).PatientMemberships(id)
+	mems, err := getMembershipService(ctx).CareTeamMemberships(id)
 
 	if err != nil {
 		return nil, err
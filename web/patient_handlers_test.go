@@ -143,6 +143,16 @@ func (suite *patientSuite) PatientsByID(ids []string) ([]ie.Patient, error) {
 }
 
 func (suite *patientSuite) PatientMemberships(id string) ([]ie.Membership, error) {
+	var mems []ie.Membership
+	for _, mem := range suite.MembersDB {
+		if mem.PatientID == id {
+			mems = append(mems, mem)
+		}
+	}
+	return mems, nil
+}
+
+func (suite *patientSuite) CareTeamMemberships(id string) ([]ie.Membership, error) {
 	mems := make([]ie.Membership, len(suite.MembersDB))
 	for _, mem := range suite.MembersDB {
 		if mem.CareTeamID == id {
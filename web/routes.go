@@ -37,11 +37,21 @@ func RegisterRoutes(s *server.FHIRServer, selfURL, riskServiceEndpoint string, e
 		returnFunc = func() { stopNotifier(workerChannel, &wg) }
 	}
 
-	// Setup the notification handler to use the default notification definitions (and then register it)
+	// Setup the notification handler to use the default notification definitions (and then register it on each
+	// resource that has notification definitions, and on batches, which can contain any of those resources)
 	notificationHandler := &middleware.NotificationHandler{Registry: notifications.DefaultNotificationDefinitionRegistry}
-	s.AddMiddleware("Encounter", notificationHandler.Handle())
+	for _, resource := range []string{"Encounter", "Observation", "RiskAssessment", "Condition", "MedicationStatement", "MedicationOrder", "Batch"} {
+		s.AddMiddleware(resource, notificationHandler.Handle())
+	}
+
+	// Patient searches by groupId join the patients with the group's members, rather than listing them in the query
+	s.AddMiddleware("Patient", groups.GroupSearchHandler)
 
 	s.Engine.POST("/InstaCountAll", groups.InstaCountAllHandler)
+	s.Engine.GET("/GroupMembershipChanges/:id", groups.MembershipChangesHandler)
+	s.Engine.GET("/GroupOverlap", groups.GroupOverlapHandler)
+	s.Engine.POST("/GroupOverlap", groups.GroupOverlapHandler)
+	s.Engine.GET("/Group/:id/$export", groups.GroupExportHandler)
 	s.Engine.GET("/NotificationCount", controllers.NotificationCountHandler)
 	s.Engine.GET("/Pie/:id", controllers.GeneratePieHandler(riskServiceEndpoint))
 	s.Engine.POST("/CodeLookup", controllers.CodeLookup)
@@ -59,14 +69,17 @@ func RegisterAPIRoutes(e *gin.Engine, s ie.Services) {
 	api := e.Group("/api")
 	RegisterPatientRoutes(api, s.PatientService(), s.MembershipService())
 	RegisterCareTeamRoutes(api, s.CareTeamService())
+	RegisterTaskRoutes(api, s.TaskService())
+	RegisterHuddleSummaryRoutes(api, s.HuddleSummaryService())
+	RegisterNotificationRoutes(api, s.NotificationService())
 }
 
 func RegisterPatientRoutes(api *gin.RouterGroup, adapters ...ie.Adapter) {
 	p := api.Group("/patients")
 	p.GET("", ie.Adapt(ListAllPatients, adapters...))
 	p.GET("/:id", ie.Adapt(GetPatient, adapters...))
-	api.GET("/care_teams/:care_team_id/patients", ie.Adapt(ListAllCareTeamPatients, adapters...))
-	api.PUT("/care_teams/:care_team_id/patients/:id", ie.Adapt(AddPatientToCareTeam, adapters...))
+	api.GET("/care_teams/:id/patients", ie.Adapt(ListAllCareTeamPatients, adapters...))
+	api.PUT("/care_teams/:id/patients/:patient_id", ie.Adapt(AddPatientToCareTeam, adapters...))
 }
 
 // func RegisterPatientRoutes(api *gin.RouterGroup, patients ie.Adapter, memberships ie.Adapter) {
@@ -84,6 +97,30 @@ func RegisterCareTeamRoutes(api *gin.RouterGroup, careTeams ie.Adapter) {
 	ct.DELETE("/:id", ie.Adapt(DeleteCareTeam, careTeams))
 }
 
+func RegisterTaskRoutes(api *gin.RouterGroup, tasks ie.Adapter) {
+	t := api.Group("/tasks")
+	t.GET("", ie.Adapt(ListAllTasks, tasks))
+	t.POST("", ie.Adapt(CreateTask, tasks))
+	t.GET("/:id", ie.Adapt(GetTask, tasks))
+	t.PUT("/:id", ie.Adapt(UpdateTask, tasks))
+	t.PUT("/:id/status", ie.Adapt(UpdateTaskStatus, tasks))
+	api.GET("/patients/:id/tasks", ie.Adapt(ListAllPatientTasks, tasks))
+	api.GET("/care_teams/:id/tasks", ie.Adapt(ListAllCareTeamTasks, tasks))
+	api.GET("/huddles/:huddle_id/tasks", ie.Adapt(ListOpenHuddleTasks, tasks))
+	api.POST("/huddles/:huddle_id/patients/:id/tasks", ie.Adapt(CreateHuddleMemberTask, tasks))
+}
+
+func RegisterHuddleSummaryRoutes(api *gin.RouterGroup, summaries ie.Adapter) {
+	api.GET("/huddles/:huddle_id/export", ie.Adapt(ExportHuddleSummary, summaries))
+}
+
+func RegisterNotificationRoutes(api *gin.RouterGroup, notifications ie.Adapter) {
+	n := api.Group("/notifications")
+	n.GET("/:id", ie.Adapt(GetNotification, notifications))
+	n.PUT("/:id/status", ie.Adapt(UpdateNotificationStatus, notifications))
+	api.GET("/care_teams/:id/notifications", ie.Adapt(ListAllCareTeamNotifications, notifications))
+}
+
 func abortNoService(ctx *gin.Context) {
 	ctx.AbortWithError(http.StatusInternalServerError, errors.New("context did not contain a valid mongo service"))
 }
@@ -0,0 +1,148 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/ie"
+)
+
+// ListAllTasks List all tasks, or only the overdue ones when called with overdue=true
+func ListAllTasks(ctx *gin.Context) {
+	s := getTaskService(ctx)
+	var tt []ie.Task
+	var err error
+	if ctx.Query("overdue") == "true" {
+		tt, err = s.OverdueTasks(time.Now())
+	} else {
+		tt, err = s.Tasks()
+	}
+	Render(ctx, gin.H{"tasks": flagOverdueTasks(tt)}, err)
+}
+
+// GetTask Get a task with given id.
+func GetTask(ctx *gin.Context) {
+	s := getTaskService(ctx)
+	id := ctx.Param("id")
+	t, err := s.Task(id)
+	if t != nil {
+		t.Overdue = t.IsOverdue(time.Now())
+	}
+	Render(ctx, gin.H{"task": t}, err)
+}
+
+// CreateTask Create a task
+func CreateTask(ctx *gin.Context) {
+	t := &ie.Task{}
+	if bindTaskData(ctx, t) {
+		createTask(ctx, t)
+	}
+}
+
+// CreateHuddleMemberTask Create a task for a patient that was discussed in a huddle
+func CreateHuddleMemberTask(ctx *gin.Context) {
+	t := &ie.Task{}
+	if bindTaskData(ctx, t) {
+		t.HuddleID = ctx.Param("huddle_id")
+		t.PatientID = ctx.Param("id")
+		createTask(ctx, t)
+	}
+}
+
+// UpdateTask Update the details of a task with given id.  The status can only be changed through UpdateTaskStatus.
+func UpdateTask(ctx *gin.Context) {
+	s := getTaskService(ctx)
+	id := ctx.Param("id")
+	t, err := s.Task(id)
+	if err != nil {
+		ctx.AbortWithError(ErrCode(err), err)
+		return
+	}
+	if bindTaskData(ctx, t) {
+		t.UpdatedAt = time.Now()
+		err = s.UpdateTask(t)
+		Render(ctx, gin.H{"task": t}, err)
+	}
+}
+
+// UpdateTaskStatus Move a task with given id to the requested status
+func UpdateTaskStatus(ctx *gin.Context) {
+	s := getTaskService(ctx)
+	id := ctx.Param("id")
+	t, err := s.Task(id)
+	if err != nil {
+		ctx.AbortWithError(ErrCode(err), err)
+		return
+	}
+	var form struct {
+		Status string `json:"status" binding:"required"`
+	}
+	if ctx.BindJSON(&form) != nil {
+		return
+	}
+	if err := t.TransitionTo(form.Status, time.Now()); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	err = s.UpdateTask(t)
+	Render(ctx, gin.H{"task": t}, err)
+}
+
+// ListAllPatientTasks List all tasks for a given patient
+func ListAllPatientTasks(ctx *gin.Context) {
+	tt, err := getTaskService(ctx).TasksForPatient(ctx.Param("id"))
+	Render(ctx, gin.H{"tasks": flagOverdueTasks(tt)}, err)
+}
+
+// ListAllCareTeamTasks List all tasks assigned to a given care team
+func ListAllCareTeamTasks(ctx *gin.Context) {
+	tt, err := getTaskService(ctx).TasksForCareTeam(ctx.Param("id"))
+	Render(ctx, gin.H{"tasks": flagOverdueTasks(tt)}, err)
+}
+
+// ListOpenHuddleTasks List the open tasks for the patients in a given huddle, so they can be revisited when the
+// patients are discussed again
+func ListOpenHuddleTasks(ctx *gin.Context) {
+	tt, err := getTaskService(ctx).OpenTasksForHuddle(ctx.Param("huddle_id"))
+	Render(ctx, gin.H{"tasks": flagOverdueTasks(tt)}, err)
+}
+
+func getTaskService(ctx *gin.Context) ie.TaskService {
+	svc := ctx.MustGet("taskService")
+	return svc.(ie.TaskService)
+}
+
+func createTask(ctx *gin.Context, t *ie.Task) {
+	if t.PatientID == "" || (t.PractitionerID == "" && t.CareTeamID == "") {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("task requires a patient and an assignee"))
+		return
+	}
+	err := getTaskService(ctx).CreateTask(t)
+	Render(ctx, gin.H{"task": t}, err)
+}
+
+func bindTaskData(ctx *gin.Context, t *ie.Task) bool {
+	var form ie.Task
+	if ctx.BindJSON(&form) != nil {
+		return false
+	}
+	t.Title = form.Title
+	t.Description = form.Description
+	t.DueDate = form.DueDate
+	t.PractitionerID = form.PractitionerID
+	t.CareTeamID = form.CareTeamID
+	if t.PatientID == "" {
+		t.PatientID = form.PatientID
+	}
+	return true
+}
+
+func flagOverdueTasks(tt []ie.Task) []ie.Task {
+	now := time.Now()
+	for i := range tt {
+		tt[i].Overdue = tt[i].IsOverdue(now)
+	}
+	return tt
+}
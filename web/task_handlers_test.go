@@ -0,0 +1,255 @@
+package web_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/ie"
+	"github.com/intervention-engine/ie/testutil"
+	"github.com/intervention-engine/ie/web"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type taskSuite struct {
+	testutil.WebSuite
+	DB map[string]ie.Task
+}
+
+// huddleMembers are the patients in each of the huddles in the mock task service
+var huddleMembers = map[string][]string{
+	"58c314acb367c1ff54d19e01": {"58938873bd90ef501e29c919", "58c314acb367c1ff54d19e9e"},
+}
+
+func TestTaskHandlersSuite(t *testing.T) {
+	m := make(map[string]ie.Task)
+	suite.Run(t, &taskSuite{DB: m})
+}
+
+func (suite *taskSuite) SetupSuite() {
+	api := suite.LoadGin()
+	web.RegisterTaskRoutes(api, suite.withTestService())
+}
+
+func (suite *taskSuite) SetupTest() {
+	for id := range suite.DB {
+		delete(suite.DB, id)
+	}
+	for _, task := range TasksDB() {
+		suite.DB[task.ID] = task
+	}
+}
+
+// When there are tasks, should return them all with overdue ones flagged
+func (suite *taskSuite) TestAllTasksFound() {
+	w := suite.AssertGetRequest("/api/tasks", http.StatusOK)
+	var body = make(map[string][]ie.Task)
+	json.NewDecoder(w.Body).Decode(&body)
+	results := body["tasks"]
+	suite.Assert().Len(results, len(suite.DB))
+	for _, t := range results {
+		suite.Assert().Equal(t.ID == "58c314acb367c1ff54d19f01", t.Overdue, "task %s overdue flag was wrong", t.ID)
+	}
+}
+
+// When asked for overdue tasks, should only return open tasks past their due date
+func (suite *taskSuite) TestOverdueTasks() {
+	w := suite.AssertGetRequest("/api/tasks?overdue=true", http.StatusOK)
+	var body = make(map[string][]ie.Task)
+	json.NewDecoder(w.Body).Decode(&body)
+	results := body["tasks"]
+	suite.Require().Len(results, 1)
+	suite.Assert().Equal("58c314acb367c1ff54d19f01", results[0].ID)
+	suite.Assert().True(results[0].Overdue)
+}
+
+// When given an incorrectly formatted id, should return 400 Bad Request
+func (suite *taskSuite) TestGetTaskWithBadId() {
+	suite.AssertGetRequest("/api/tasks/sdf", http.StatusBadRequest)
+}
+
+// When creating a task from a huddle member, the huddle and patient should come from the path
+func (suite *taskSuite) TestCreateHuddleMemberTask() {
+	body := `{"title": "Call patient", "practitioner_id": "123"}`
+	w := suite.AssertPostRequest("/api/huddles/58c314acb367c1ff54d19e01/patients/58938873bd90ef501e29c919/tasks", strings.NewReader(body), http.StatusOK)
+	var result = make(map[string]ie.Task)
+	json.NewDecoder(w.Body).Decode(&result)
+	task := result["task"]
+	suite.Assert().Equal("Call patient", task.Title)
+	suite.Assert().Equal("58c314acb367c1ff54d19e01", task.HuddleID)
+	suite.Assert().Equal("58938873bd90ef501e29c919", task.PatientID)
+	suite.Assert().Equal(ie.TaskStatusRequested, task.Status)
+}
+
+// A task without an assignee should be rejected with 400 Bad Request
+func (suite *taskSuite) TestCreateTaskWithoutAssignee() {
+	body := `{"title": "Med reconciliation", "patient_id": "58938873bd90ef501e29c919"}`
+	suite.AssertPostRequest("/api/tasks", strings.NewReader(body), http.StatusBadRequest)
+}
+
+// Allowed status transitions should be saved and closed tasks should record when they were completed
+func (suite *taskSuite) TestUpdateTaskStatus() {
+	body := `{"status": "completed"}`
+	suite.AssertPutRequest("/api/tasks/58c314acb367c1ff54d19f01/status", strings.NewReader(body), http.StatusOK)
+	task := suite.DB["58c314acb367c1ff54d19f01"]
+	suite.Assert().Equal(ie.TaskStatusCompleted, task.Status)
+	suite.Assert().NotNil(task.CompletedAt)
+}
+
+// Closed tasks cannot be reopened
+func (suite *taskSuite) TestUpdateTaskStatusInvalidTransition() {
+	body := `{"status": "in-progress"}`
+	suite.AssertPutRequest("/api/tasks/58c314acb367c1ff54d19f03/status", strings.NewReader(body), http.StatusBadRequest)
+}
+
+// Open tasks for the patients in a huddle should be listed for that huddle
+func (suite *taskSuite) TestOpenHuddleTasks() {
+	w := suite.AssertGetRequest("/api/huddles/58c314acb367c1ff54d19e01/tasks", http.StatusOK)
+	var body = make(map[string][]ie.Task)
+	json.NewDecoder(w.Body).Decode(&body)
+	results := body["tasks"]
+	suite.Require().Len(results, 2)
+	for _, t := range results {
+		// The completed task for a huddle member and the open task for a patient outside the huddle aren't listed
+		suite.Assert().NotEqual("58c314acb367c1ff54d19f03", t.ID)
+		suite.Assert().NotEqual("58c314acb367c1ff54d19f04", t.ID)
+	}
+}
+
+// Mock Services
+
+func (suite *taskSuite) Task(id string) (*ie.Task, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("bad id")
+	}
+	t, ok := suite.DB[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &t, nil
+}
+
+func (suite *taskSuite) Tasks() ([]ie.Task, error) {
+	var tt []ie.Task
+	for _, t := range suite.DB {
+		tt = append(tt, t)
+	}
+	return tt, nil
+}
+
+func (suite *taskSuite) CreateTask(t *ie.Task) error {
+	t.ID = bson.NewObjectId().Hex()
+	t.Status = ie.TaskStatusRequested
+	t.CreatedAt = time.Now()
+	suite.DB[t.ID] = *t
+	return nil
+}
+
+func (suite *taskSuite) UpdateTask(t *ie.Task) error {
+	suite.DB[t.ID] = *t
+	return nil
+}
+
+func (suite *taskSuite) TasksForPatient(id string) ([]ie.Task, error) {
+	var tt []ie.Task
+	for _, t := range suite.DB {
+		if t.PatientID == id {
+			tt = append(tt, t)
+		}
+	}
+	return tt, nil
+}
+
+func (suite *taskSuite) TasksForCareTeam(id string) ([]ie.Task, error) {
+	var tt []ie.Task
+	for _, t := range suite.DB {
+		if t.CareTeamID == id {
+			tt = append(tt, t)
+		}
+	}
+	return tt, nil
+}
+
+func (suite *taskSuite) OverdueTasks(now time.Time) ([]ie.Task, error) {
+	var tt []ie.Task
+	for _, t := range suite.DB {
+		if t.IsOverdue(now) {
+			tt = append(tt, t)
+		}
+	}
+	return tt, nil
+}
+
+func (suite *taskSuite) OpenTasksForHuddle(id string) ([]ie.Task, error) {
+	members, ok := huddleMembers[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	var tt []ie.Task
+	for _, t := range suite.DB {
+		for _, m := range members {
+			if t.PatientID == m && t.IsOpen() {
+				tt = append(tt, t)
+			}
+		}
+	}
+	return tt, nil
+}
+
+// Fixtures
+
+func TasksDB() []ie.Task {
+	yesterday := time.Now().AddDate(0, 0, -1)
+	nextWeek := time.Now().AddDate(0, 0, 7)
+	return []ie.Task{
+		{
+			ID:             "58c314acb367c1ff54d19f01",
+			Title:          "Call patient",
+			PatientID:      "58938873bd90ef501e29c919",
+			HuddleID:       "58c314acb367c1ff54d19e01",
+			PractitionerID: "123",
+			Status:         ie.TaskStatusRequested,
+			DueDate:        &yesterday,
+		},
+		{
+			ID:         "58c314acb367c1ff54d19f02",
+			Title:      "Med reconciliation",
+			PatientID:  "58938873bd90ef501e29c919",
+			CareTeamID: "58c314acb367c1ff54d19e9e",
+			Status:     ie.TaskStatusInProgress,
+			DueDate:    &nextWeek,
+		},
+		{
+			ID:         "58c314acb367c1ff54d19f03",
+			Title:      "Schedule follow-up visit",
+			PatientID:  "58c314acb367c1ff54d19e9e",
+			CareTeamID: "58c314acb367c1ff54d19e9e",
+			Status:     ie.TaskStatusCompleted,
+			DueDate:    &yesterday,
+		},
+		{
+			ID:         "58c314acb367c1ff54d19f04",
+			Title:      "Review medications",
+			PatientID:  "58c314acb367c1ff54d19e9f",
+			CareTeamID: "58c314acb367c1ff54d19e9f",
+			Status:     ie.TaskStatusRequested,
+			DueDate:    &nextWeek,
+		},
+	}
+}
+
+// Utility Methods
+
+func (suite *taskSuite) withTestService() ie.Adapter {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			ctx.Set("taskService", suite)
+			h(ctx)
+		}
+	}
+}